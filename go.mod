@@ -3,6 +3,6 @@ module github.com/mergermarket/cdflow2-config-acuris
 go 1.13
 
 require (
-	github.com/aws/aws-sdk-go v1.38.13
+	github.com/aws/aws-sdk-go v1.42.16
 	github.com/mergermarket/cdflow2-config-common v0.44.1
 )
@@ -0,0 +1,244 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// DefaultAccountCachePath is where resolved account IDs are cached when config.params.account_cache_ttl is set.
+const DefaultAccountCachePath = "/cache/cdflow2-config-acuris/accounts.json"
+
+// DefaultAccountSSMPrefix is the SSM parameter path prefix used by the "ssm" account resolver.
+const DefaultAccountSSMPrefix = "/cdflow2/accounts"
+
+// AccountResolver maps an account name (e.g. "mmgprod") to an account ID.
+type AccountResolver interface {
+	ResolveAccountID(accountName string) (string, error)
+}
+
+// OrganizationsAccountResolver finds the account by listing the accounts in the AWS Organization.
+type OrganizationsAccountResolver struct {
+	Client organizationsiface.OrganizationsAPI
+}
+
+// ResolveAccountID implements AccountResolver.
+func (r *OrganizationsAccountResolver) ResolveAccountID(accountName string) (string, error) {
+	var accountID string
+	if err := r.Client.ListAccountsPages(&organizations.ListAccountsInput{}, func(result *organizations.ListAccountsOutput, lastPage bool) bool {
+		for _, account := range result.Accounts {
+			if *account.Name == accountName {
+				accountID = *account.Id
+				return false
+			}
+		}
+		return true
+	}); err != nil {
+		return "", err
+	}
+	if accountID == "" {
+		return "", fmt.Errorf("account %q not found", accountName)
+	}
+	return accountID, nil
+}
+
+// StaticAccountResolver looks the account up in a fixed map, from config.params.accounts.
+type StaticAccountResolver struct {
+	Accounts map[string]string
+}
+
+// ResolveAccountID implements AccountResolver.
+func (r *StaticAccountResolver) ResolveAccountID(accountName string) (string, error) {
+	accountID, ok := r.Accounts[accountName]
+	if !ok {
+		return "", fmt.Errorf("account %q not found in config.params.accounts", accountName)
+	}
+	return accountID, nil
+}
+
+// SSMAccountResolver reads the account ID from the SSM parameter <Prefix>/<account name>.
+type SSMAccountResolver struct {
+	Client ssmiface.SSMAPI
+	Prefix string
+}
+
+// ResolveAccountID implements AccountResolver.
+func (r *SSMAccountResolver) ResolveAccountID(accountName string) (string, error) {
+	name := strings.TrimSuffix(r.Prefix, "/") + "/" + accountName
+	output, err := r.Client.GetParameter(&ssm.GetParameterInput{
+		Name: aws.String(name),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return "", fmt.Errorf("account %q not found: SSM parameter %q does not exist", accountName, name)
+		}
+		return "", err
+	}
+	return *output.Parameter.Value, nil
+}
+
+type cachedAccount struct {
+	ID       string    `json:"id"`
+	Resolved time.Time `json:"resolved"`
+}
+
+// CachingAccountResolver caches the results of another resolver in a file for TTL.
+// Key identifies the wrapped resolver, so that entries cached by a differently configured resolver are not used.
+type CachingAccountResolver struct {
+	Resolver AccountResolver
+	Key      string
+	Path     string
+	TTL      time.Duration
+	Now      func() time.Time
+}
+
+func (r *CachingAccountResolver) cacheKey(accountName string) string {
+	if r.Key == "" {
+		return accountName
+	}
+	return r.Key + ":" + accountName
+}
+
+func (r *CachingAccountResolver) read() map[string]*cachedAccount {
+	cache := make(map[string]*cachedAccount)
+	contents, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return cache
+	}
+	// a corrupt cache is treated as empty and overwritten
+	json.Unmarshal(contents, &cache)
+	return cache
+}
+
+func (r *CachingAccountResolver) write(cache map[string]*cachedAccount) error {
+	serialised, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(r.Path), filepath.Base(r.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(serialised); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), r.Path)
+}
+
+// ResolveAccountID implements AccountResolver.
+func (r *CachingAccountResolver) ResolveAccountID(accountName string) (string, error) {
+	cache := r.read()
+	now := r.Now()
+	key := r.cacheKey(accountName)
+	if entry, ok := cache[key]; ok && accountIDPattern.MatchString(entry.ID) && now.Sub(entry.Resolved) < r.TTL {
+		return entry.ID, nil
+	}
+	accountID, err := r.Resolver.ResolveAccountID(accountName)
+	if err != nil {
+		return "", err
+	}
+	if !accountIDPattern.MatchString(accountID) {
+		return "", fmt.Errorf("account %q resolved to %q, which is not a 12 digit account ID", accountName, accountID)
+	}
+	cache[key] = &cachedAccount{ID: accountID, Resolved: now}
+	// the cache is only an optimisation, so e.g. a read-only cache volume is not fatal
+	r.write(cache)
+	return accountID, nil
+}
+
+// AccountResolver returns the resolver configured in config.params.account_resolver ("organizations", "static" or "ssm"),
+// wrapped in a file cache if config.params.account_cache_ttl is set.
+func (h *Handler) AccountResolver(config map[string]interface{}, session client.ConfigProvider) (AccountResolver, error) {
+	resolverType := "organizations"
+	if _, ok := config["accounts"]; ok {
+		resolverType = "static"
+	}
+	if value, ok := config["account_resolver"]; ok {
+		resolverTypeString, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.account_resolver must be a string")
+		}
+		resolverType = resolverTypeString
+	}
+
+	var resolver AccountResolver
+	var resolverKey string
+	switch resolverType {
+	case "organizations":
+		resolver = &OrganizationsAccountResolver{Client: h.OrganizationsClientFactory(session)}
+		resolverKey = "organizations/" + h.Profile.OrganizationID
+	case "static":
+		accounts, ok := config["accounts"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.accounts must be a map of account names to IDs for the static account resolver")
+		}
+		staticResolver := &StaticAccountResolver{Accounts: make(map[string]string)}
+		for name, id := range accounts {
+			idString, ok := id.(string)
+			if !ok || !accountIDPattern.MatchString(idString) {
+				return nil, fmt.Errorf("cdflow.yaml error: config.params.accounts.%s must be a 12 digit account ID", name)
+			}
+			staticResolver.Accounts[name] = idString
+		}
+		resolver = staticResolver
+		// json.Marshal sorts map keys, so the same accounts always give the same key
+		serialised, err := json.Marshal(staticResolver.Accounts)
+		if err != nil {
+			return nil, err
+		}
+		resolverKey = fmt.Sprintf("static/%x", sha256.Sum256(serialised))
+	case "ssm":
+		prefix := DefaultAccountSSMPrefix
+		if value, ok := config["account_ssm_prefix"]; ok {
+			prefixString, ok := value.(string)
+			if !ok || !strings.HasPrefix(prefixString, "/") {
+				return nil, fmt.Errorf("cdflow.yaml error: config.params.account_ssm_prefix must be a string starting with \"/\"")
+			}
+			prefix = prefixString
+		}
+		resolver = &SSMAccountResolver{Client: h.SSMClientFactory(session), Prefix: prefix}
+		resolverKey = "ssm/" + h.Profile.AccountID + prefix
+	default:
+		return nil, fmt.Errorf("cdflow.yaml error: unknown config.params.account_resolver %q (expected \"organizations\", \"static\" or \"ssm\")", resolverType)
+	}
+
+	if value, ok := config["account_cache_ttl"]; ok {
+		ttlString, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.account_cache_ttl must be a duration string (e.g. \"24h\")")
+		}
+		ttl, err := time.ParseDuration(ttlString)
+		if err != nil {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.account_cache_ttl: %v", err)
+		}
+		resolver = &CachingAccountResolver{
+			Resolver: resolver,
+			Key:      resolverKey,
+			Path:     h.AccountCachePath,
+			TTL:      ttl,
+			Now:      h.Now,
+		}
+	}
+	return resolver, nil
+}
@@ -0,0 +1,292 @@
+package handler_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type MockSSMClient struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+	requested  []string
+	decrypted  bool
+}
+
+func (m *MockSSMClient) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	m.requested = append(m.requested, *input.Name)
+	m.decrypted = aws.BoolValue(input.WithDecryption)
+	value, ok := m.parameters[*input.Name]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	return &ssm.GetParameterOutput{
+		Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String(value)},
+	}, nil
+}
+
+func TestAccountResolver(t *testing.T) {
+	orgsClient := &MockOrganizationsClient{Accounts: map[string]string{"fooprod": "111111111111"}}
+	ssmClient := &MockSSMClient{parameters: map[string]string{
+		"/cdflow2/accounts/fooprod": "222222222222",
+		"/custom/fooprod":           "333333333333",
+	}}
+	h := handler.New().
+		WithOrganizationsClientFactory(func(client.ConfigProvider) organizationsiface.OrganizationsAPI {
+			return orgsClient
+		}).
+		WithSSMClientFactory(func(client.ConfigProvider) ssmiface.SSMAPI {
+			return ssmClient
+		})
+
+	for _, tc := range []struct {
+		name       string
+		config     map[string]interface{}
+		expectedID string
+	}{
+		{"organizations by default", map[string]interface{}{}, "111111111111"},
+		{"static when accounts given", map[string]interface{}{
+			"accounts": map[string]interface{}{"fooprod": "444444444444"},
+		}, "444444444444"},
+		{"ssm", map[string]interface{}{"account_resolver": "ssm"}, "222222222222"},
+		{"ssm with prefix", map[string]interface{}{
+			"account_resolver":   "ssm",
+			"account_ssm_prefix": "/custom/",
+		}, "333333333333"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			resolver, err := h.AccountResolver(tc.config, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// When
+			accountID, err := resolver.ResolveAccountID("fooprod")
+
+			// Then
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accountID != tc.expectedID {
+				t.Fatalf("expected %q, got %q", tc.expectedID, accountID)
+			}
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		// Given
+		resolver, err := h.AccountResolver(map[string]interface{}{"account_resolver": "ssm"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// When
+		_, err = resolver.ResolveAccountID("bardev")
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), `account "bardev" not found`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("invalid static account ID", func(t *testing.T) {
+		// When
+		_, err := h.AccountResolver(map[string]interface{}{
+			"accounts": map[string]interface{}{"fooprod": "111111111111:role/admin"},
+		}, nil)
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), "cdflow.yaml error: config.params.accounts.fooprod must be a 12 digit account ID") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("unknown resolver", func(t *testing.T) {
+		// When
+		_, err := h.AccountResolver(map[string]interface{}{"account_resolver": "ldap"}, nil)
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), `unknown config.params.account_resolver "ldap"`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestCachingAccountResolver(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	orgsClient := &MockOrganizationsClient{Accounts: map[string]string{"fooprod": "111111111111"}}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	resolver := &handler.CachingAccountResolver{
+		Resolver: &handler.OrganizationsAccountResolver{Client: orgsClient},
+		Path:     filepath.Join(dir, "nested", "accounts.json"),
+		TTL:      time.Hour,
+		Now:      func() time.Time { return now },
+	}
+
+	// When
+	for i := 0; i < 3; i++ {
+		accountID, err := resolver.ResolveAccountID("fooprod")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accountID != "111111111111" {
+			t.Fatalf("expected %q, got %q", "111111111111", accountID)
+		}
+	}
+
+	// Then
+	if orgsClient.calls != 1 {
+		t.Fatalf("expected 1 call to organizations, got %d", orgsClient.calls)
+	}
+
+	// When
+	now = now.Add(2 * time.Hour)
+	if _, err := resolver.ResolveAccountID("fooprod"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if orgsClient.calls != 2 {
+		t.Fatalf("expected expired entry to be refreshed, got %d calls", orgsClient.calls)
+	}
+}
+
+func TestCachingAccountResolverKeys(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "accounts.json")
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	orgsClient := &MockOrganizationsClient{Accounts: map[string]string{"fooprod": "111111111111"}}
+	orgsResolver := &handler.CachingAccountResolver{
+		Resolver: &handler.OrganizationsAccountResolver{Client: orgsClient},
+		Key:      "organizations/o-example",
+		Path:     path,
+		TTL:      time.Hour,
+		Now:      func() time.Time { return now },
+	}
+	staticResolver := &handler.CachingAccountResolver{
+		Resolver: &handler.StaticAccountResolver{Accounts: map[string]string{"fooprod": "222222222222"}},
+		Key:      "static/abc",
+		Path:     path,
+		TTL:      time.Hour,
+		Now:      func() time.Time { return now },
+	}
+
+	t.Run("entries from another resolver are not used", func(t *testing.T) {
+		// When
+		if _, err := orgsResolver.ResolveAccountID("fooprod"); err != nil {
+			t.Fatal(err)
+		}
+		accountID, err := staticResolver.ResolveAccountID("fooprod")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		if accountID != "222222222222" {
+			t.Fatalf("expected %q, got %q", "222222222222", accountID)
+		}
+	})
+
+	t.Run("invalid cached IDs are resolved again", func(t *testing.T) {
+		// Given
+		cache := `{"organizations/o-example:fooprod": {"id": "not-an-id", "resolved": "2021-01-01T00:00:00Z"}}`
+		if err := ioutil.WriteFile(path, []byte(cache), 0644); err != nil {
+			t.Fatal(err)
+		}
+		calls := orgsClient.calls
+
+		// When
+		accountID, err := orgsResolver.ResolveAccountID("fooprod")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		if accountID != "111111111111" {
+			t.Fatalf("expected %q, got %q", "111111111111", accountID)
+		}
+		if orgsClient.calls != calls+1 {
+			t.Fatal("expected the account to be resolved again")
+		}
+	})
+
+	t.Run("invalid resolved IDs are rejected", func(t *testing.T) {
+		// Given
+		resolver := &handler.CachingAccountResolver{
+			Resolver: &handler.StaticAccountResolver{Accounts: map[string]string{"foodev": "1234"}},
+			Key:      "static/def",
+			Path:     path,
+			TTL:      time.Hour,
+			Now:      func() time.Time { return now },
+		}
+
+		// When
+		_, err := resolver.ResolveAccountID("foodev")
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), "not a 12 digit account ID") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestPrepareTerraformStaticAccounts(t *testing.T) {
+	// Given
+	request := createPrepareTerraformRequest()
+	request.Config["accounts"] = map[string]interface{}{
+		"foodev":  "555555555555",
+		"fooprod": "666666666666",
+	}
+	response := common.CreatePrepareTerraformResponse()
+
+	var errorBuffer bytes.Buffer
+	stsClient := &MockSTSClient{}
+	orgsClient := &MockOrganizationsClient{}
+	h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, stsClient, nil).
+		WithOrganizationsClientFactory(func(client.ConfigProvider) organizationsiface.OrganizationsAPI {
+			return orgsClient
+		})
+
+	// When
+	if err := h.PrepareTerraform(request, response, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	if orgsClient.calls != 0 {
+		t.Fatal("unexpected call to organizations")
+	}
+	expectedRole := "arn:aws:iam::666666666666:role/test-team-deploy"
+	if stsClient.assumedRoleArn != expectedRole {
+		t.Fatalf("expected %q, got %q", expectedRole, stsClient.assumedRoleArn)
+	}
+}
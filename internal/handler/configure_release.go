@@ -3,7 +3,6 @@ package handler
 import (
 	"encoding/json"
 	"fmt"
-	"sort"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -14,7 +13,8 @@ import (
 	common "github.com/mergermarket/cdflow2-config-common"
 )
 
-const ECR_REPO_POLICY = `
+// ecrRepoPolicyTemplate grants pull access to every account in the organisation given by the %s placeholder.
+const ecrRepoPolicyTemplate = `
 {
 	"Version": "2008-10-17",
 	"Statement": [
@@ -28,7 +28,7 @@ const ECR_REPO_POLICY = `
 			],
 			"Condition": {
 				"StringEquals": {
-					"aws:PrincipalOrgID": "o-qisv7rs9ed"
+					"aws:PrincipalOrgID": "%s"
 				}
 			}
 		}
@@ -39,6 +39,12 @@ const ECR_REPO_POLICY = `
 // ConfigureRelease runs before release to configure it.
 func (h *Handler) ConfigureRelease(request *common.ConfigureReleaseRequest, response *common.ConfigureReleaseResponse) error {
 
+	if err := h.LoadProfile(request.Config, request.Env); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
 	team, err := h.getTeam(request.Config["team"])
 	if err != nil {
 		response.Success = false
@@ -48,7 +54,13 @@ func (h *Handler) ConfigureRelease(request *common.ConfigureReleaseRequest, resp
 
 	response.AdditionalMetadata["team"] = team
 
-	if err := h.InitReleaseAccountCredentials(request.Env, team); err != nil {
+	if err := h.InitReleaseAccountCredentials(&RoleContext{
+		Config:    request.Config,
+		Env:       request.Env,
+		Team:      team,
+		Component: request.Component,
+		Version:   request.Version,
+	}); err != nil {
 		response.Success = false
 		fmt.Fprintln(h.ErrorStream, err)
 		return nil
@@ -66,69 +78,141 @@ func (h *Handler) ConfigureRelease(request *common.ConfigureReleaseRequest, resp
 		return nil
 	}
 
-	var ecrBuilds []string
+	needBuilds := make(map[string][]string)
 	for buildID, reqs := range request.ReleaseRequirements {
 		response.Env[buildID] = make(map[string]string)
 		response.Env[buildID]["GITHUB_TOKEN"] = request.Env["GITHUB_TOKEN"]
 
 		for _, need := range reqs.Needs {
-			if need == "lambda" {
-				response.Env[buildID]["LAMBDA_BUCKET"] = LambdaBucket
-				response.Env[buildID]["LAMBDA_PATH"] = fmt.Sprintf(
-					"%s/%s/%s/%s", team, request.Component, request.Version, buildID,
-				)
-				setAWSEnvironmentVariables(response.Env[buildID], &releaseAccountCredentialsValue, Region)
-			} else if need == "ecr" {
-				ecrBuilds = append(ecrBuilds, buildID)
-				setAWSEnvironmentVariables(response.Env[buildID], &releaseAccountCredentialsValue, Region)
-				setCdflowDockerAuthVariables(response.Env[buildID], request.Env)
-			} else {
+			if _, ok := h.NeedHandlers[need]; !ok {
 				fmt.Fprintf(h.ErrorStream, "unable to satisfy %q need for %q build", need, buildID)
 				response.Success = false
 				return nil
 			}
+			needBuilds[need] = append(needBuilds[need], buildID)
 		}
 	}
-	if len(ecrBuilds) != 0 {
-		sort.Strings(ecrBuilds)
-		ecrClient := h.ECRClientFactory(session)
-		if err := h.setupECR(request.Component, request.Version, team, response, ecrClient, ecrBuilds); err != nil {
-			fmt.Fprintln(h.ErrorStream, err)
-			response.Success = false
-			return nil
-		}
+	if err := h.provideNeeds(needBuilds, &NeedRequest{
+		Config:      request.Config,
+		Env:         request.Env,
+		Team:        team,
+		Component:   request.Component,
+		Version:     request.Version,
+		Session:     session,
+		Credentials: &releaseAccountCredentialsValue,
+	}, response); err != nil {
+		fmt.Fprintln(h.ErrorStream, err)
+		response.Success = false
+		return nil
 	}
 	return nil
 }
 
-func (h *Handler) setupECR(component, version, team string, response *common.ConfigureReleaseResponse, ecrClient ecriface.ECRAPI, ecrBuilds []string) error {
-
-	repoName := team + "-" + component
+// ecrNeed provides an ECR repository for builds to push docker images to.
+type ecrNeed struct{}
 
-	fmt.Fprintf(h.ErrorStream, "- Checking ECR repository...\n")
+func (n *ecrNeed) Validate(h *Handler, request *NeedRequest) error {
+	_, err := h.planECR(request.Config, request.Team, request.Component, request.BuildIDs)
+	return err
+}
 
-	repoURI, err := h.getECRRepo(repoName, ecrClient)
+func (n *ecrNeed) Prepare(h *Handler, request *NeedRequest) (*NeedResult, error) {
+	plan, err := h.planECR(request.Config, request.Team, request.Component, request.BuildIDs)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	result := NewNeedResult(request)
+	result.Metadata[ECRBuildsMetadataKey] = strings.Join(request.BuildIDs, ",")
+	for _, buildID := range request.BuildIDs {
+		setAWSEnvironmentVariables(result.Env[buildID], request.Credentials, h.Profile.Region)
+		setCdflowDockerAuthVariables(result.Env[buildID], request.Env)
+	}
+	if err := h.checkReplicationDestinationAccounts(plan.replication.Destinations, request.Env); err != nil {
+		return nil, err
+	}
+	ecrClient := h.ECRClientFactory(request.Session)
+	if err := h.setupECR(plan, request.Version, result.Env, ecrClient); err != nil {
+		return nil, err
+	}
+	dockerAuthEnv, err := h.ecrDockerAuthEnv(ecrClient)
+	if err != nil {
+		return nil, err
 	}
+	for _, buildID := range request.BuildIDs {
+		for key, value := range dockerAuthEnv {
+			result.Env[buildID][key] = value
+		}
+	}
+	return result, nil
+}
 
-	fmt.Fprintf(h.ErrorStream, "- Checking ECR repository policy...\n")
+// ecrPlan is the ECR setup for a release, worked out from the config before changing anything.
+type ecrPlan struct {
+	// replicationPrefix is the prefix of the repositories replicated by the team's replication rule.
+	replicationPrefix string
+	repos             []*ecrRepoSetup
+	settings          *ECRRepositorySettings
+	replication       *ECRReplicationConfig
+}
 
-	if err := h.ensureRepoPolicy(repoName, ecrClient); err != nil {
-		return err
+func (h *Handler) planECR(config map[string]interface{}, team, component string, ecrBuilds []string) (*ecrPlan, error) {
+	perBuild, err := ECRRepositoryPerBuild(config)
+	if err != nil {
+		return nil, err
+	}
+	lifecycle, err := ParseECRLifecycleConfig(config, ecrBuilds)
+	if err != nil {
+		return nil, err
+	}
+	plan := &ecrPlan{replicationPrefix: ECRReplicationPrefix(team)}
+	if plan.settings, err = ParseECRRepositorySettings(config, team, component); err != nil {
+		return nil, err
+	}
+	if plan.replication, err = ParseECRReplicationConfig(config, h.Profile); err != nil {
+		return nil, err
 	}
 
-	fmt.Fprintf(h.ErrorStream, "- Checking ECR lifecycle policy...\n")
-
-	if err := h.ensureECRRepoLifecycle(repoName, ecrBuilds, ecrClient); err != nil {
-		return err
+	if perBuild {
+		for _, buildID := range ecrBuilds {
+			policy, err := h.ecrRepoPolicy(config, ecrBuilds, buildID)
+			if err != nil {
+				return nil, err
+			}
+			plan.repos = append(plan.repos, &ecrRepoSetup{
+				name:      ECRRepositoryName(team, component, buildID, true),
+				builds:    []string{buildID},
+				policy:    policy,
+				lifecycle: lifecycle.Policy([]string{buildID}),
+			})
+		}
+	} else {
+		policy, err := h.ecrRepoPolicy(config, ecrBuilds, "")
+		if err != nil {
+			return nil, err
+		}
+		plan.repos = append(plan.repos, &ecrRepoSetup{
+			name:      ECRRepositoryName(team, component, "", false),
+			builds:    ecrBuilds,
+			policy:    policy,
+			lifecycle: lifecycle.Policy(ecrBuilds),
+		})
 	}
-	for _, buildID := range ecrBuilds {
-		response.Env[buildID]["ECR_REPOSITORY"] = repoURI
-		response.Env[buildID]["ECR_TAG"] = buildID + "-" + version
+	return plan, nil
+}
+
+func (h *Handler) setupECR(plan *ecrPlan, version string, env map[string]map[string]string, ecrClient ecriface.ECRAPI) error {
+	for _, repo := range plan.repos {
+		repoURI, err := h.ensureECRRepo(repo, plan.settings, ecrClient)
+		if err != nil {
+			return err
+		}
+		for _, buildID := range repo.builds {
+			env[buildID]["ECR_REPOSITORY"] = repoURI
+			env[buildID]["ECR_TAG"] = buildID + "-" + version
+		}
 	}
 
-	return nil
+	return h.ensureRegistryReplication(plan.replicationPrefix, plan.replication.Destinations, ecrClient)
 }
 
 // ECRLifecyclePolicy represents a lifecycle policy in ECR.
@@ -146,8 +230,9 @@ type ECRLifecyclePolicyRule struct {
 // ECRLifecyclePolicyRuleSelection repesents a selection within an ECR lifecycle policy rule.
 type ECRLifecyclePolicyRuleSelection struct {
 	TagStatus     string   `json:"tagStatus"`
-	TagPrefixList []string `json:"tagPrefixList"`
+	TagPrefixList []string `json:"tagPrefixList,omitempty"`
 	CountType     string   `json:"countType"`
+	CountUnit     string   `json:"countUnit,omitempty"`
 	CountNumber   int      `json:"countNumber"`
 }
 
@@ -156,7 +241,7 @@ type ECRLifecyclePolicyRuleAction struct {
 	Type string `json:"type"`
 }
 
-func (h *Handler) ensureECRRepoLifecycle(repoName string, ecrBuilds []string, ecrClient ecriface.ECRAPI) error {
+func (h *Handler) ensureECRRepoLifecycle(repoName string, policy *ECRLifecyclePolicy, ecrClient ecriface.ECRAPI) error {
 	fmt.Fprintf(h.ErrorStream, "- Fetching lifecycle policy...\n")
 	output, err := ecrClient.GetLifecyclePolicy(&ecr.GetLifecyclePolicyInput{
 		RepositoryName: aws.String(repoName),
@@ -169,32 +254,17 @@ func (h *Handler) ensureECRRepoLifecycle(repoName string, ecrBuilds []string, ec
 	} else {
 		existingPolicyText = *output.LifecyclePolicyText
 	}
-	policy := &ECRLifecyclePolicy{}
-	for i, buildID := range ecrBuilds {
-		policy.Rules = append(policy.Rules, &ECRLifecyclePolicyRule{
-			RulePriority: i + 1,
-			Selection: &ECRLifecyclePolicyRuleSelection{
-				TagStatus:     "tagged",
-				TagPrefixList: []string{buildID + "-"},
-				CountType:     "imageCountMoreThan",
-				CountNumber:   50,
-			},
-			Action: &ECRLifecyclePolicyRuleAction{
-				Type: "expire",
-			},
-		})
-	}
 	serialisedPolicy, err := json.Marshal(policy)
 	if err != nil {
 		return err
 	}
-	if string(serialisedPolicy) == existingPolicyText {
+	if policiesEqual(existingPolicyText, string(serialisedPolicy)) {
 		return nil
 	}
-	fmt.Fprintf(h.ErrorStream, "- Updating lifecycle policy...\n")
+	fmt.Fprintf(h.ErrorStream, "- Updating lifecycle policy:\n%s", policyDiff(existingPolicyText, string(serialisedPolicy), "    "))
 	if _, err := ecrClient.PutLifecyclePolicy(&ecr.PutLifecyclePolicyInput{
 		RepositoryName:      aws.String(repoName),
-		RegistryId:          aws.String(AccountID),
+		RegistryId:          aws.String(h.Profile.AccountID),
 		LifecyclePolicyText: aws.String(string(serialisedPolicy)),
 	}); err != nil {
 		return err
@@ -219,13 +289,13 @@ func setCdflowDockerAuthVariables(respEnv map[string]string, reqEnv map[string]s
 	}
 }
 
-func (h *Handler) getECRRepo(repoName string, ecrClient ecriface.ECRAPI) (string, error) {
+func (h *Handler) getECRRepo(repoName string, settings *ECRRepositorySettings, ecrClient ecriface.ECRAPI) (string, error) {
 	response, err := ecrClient.DescribeRepositories(&ecr.DescribeRepositoriesInput{
 		RepositoryNames: []*string{aws.String(repoName)},
 	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeRepositoryNotFoundException {
-			return h.createECRRepo(repoName, ecrClient)
+			return h.createECRRepo(repoName, settings, ecrClient)
 		}
 		return "", err
 	}
@@ -247,26 +317,31 @@ func (h *Handler) getECRRepo(repoName string, ecrClient ecriface.ECRAPI) (string
 			return "", err
 		}
 	}
+	if err := h.reconcileECRRepoSettings(response.Repositories[0], settings, ecrClient); err != nil {
+		return "", err
+	}
 	return *response.Repositories[0].RepositoryUri, nil
 }
 
-func (h *Handler) ensureRepoPolicy(repoName string, ecrClient ecriface.ECRAPI) error {
+func (h *Handler) ensureRepoPolicy(repoName, policy string, ecrClient ecriface.ECRAPI) error {
 	fmt.Fprintf(h.ErrorStream, "- Fetching repository policy...\n")
 	response, err := ecrClient.GetRepositoryPolicy(
 		&ecr.GetRepositoryPolicyInput{RepositoryName: aws.String(repoName)})
 
+	var existingPolicyText string
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); !ok || ok && aerr.Code() != ecr.ErrCodeRepositoryPolicyNotFoundException {
 			return err
 		}
 	} else {
-		if *response.PolicyText == ECR_REPO_POLICY {
+		existingPolicyText = *response.PolicyText
+		if policiesEqual(existingPolicyText, policy) {
 			return nil
 		}
 	}
-	fmt.Fprintf(h.ErrorStream, "- Updating repository policy...\n")
+	fmt.Fprintf(h.ErrorStream, "- Updating repository policy:\n%s", policyDiff(existingPolicyText, policy, "    "))
 	if _, err := ecrClient.SetRepositoryPolicy(&ecr.SetRepositoryPolicyInput{
-		PolicyText:     aws.String(ECR_REPO_POLICY),
+		PolicyText:     aws.String(policy),
 		RepositoryName: aws.String(repoName),
 	}); err != nil {
 		return err
@@ -275,13 +350,15 @@ func (h *Handler) ensureRepoPolicy(repoName string, ecrClient ecriface.ECRAPI) e
 	return nil
 }
 
-func (h *Handler) createECRRepo(name string, ecrClient ecriface.ECRAPI) (string, error) {
+func (h *Handler) createECRRepo(name string, settings *ECRRepositorySettings, ecrClient ecriface.ECRAPI) (string, error) {
 	response, err := ecrClient.CreateRepository(&ecr.CreateRepositoryInput{
 		RepositoryName: aws.String(name),
 		ImageScanningConfiguration: &ecr.ImageScanningConfiguration{
 			ScanOnPush: aws.Bool(true),
 		},
-		ImageTagMutability: aws.String("IMMUTABLE"),
+		ImageTagMutability:      aws.String("IMMUTABLE"),
+		EncryptionConfiguration: settings.encryptionConfiguration(),
+		Tags:                    settings.ecrTags(),
 	})
 	if err != nil {
 		return "", err
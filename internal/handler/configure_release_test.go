@@ -25,17 +25,25 @@ type MockECRClient struct {
 	SetRepositoryPolicyInput           *ecr.SetRepositoryPolicyInput
 	DefaultMutability                  string
 	DefaultScanOnPush                  bool
+	ExistingRepositoryPolicy           string
+	ExistingLifecyclePolicy            string
+	ExistingEncryption                 *ecr.EncryptionConfiguration
+	ExistingTags                       []*ecr.Tag
+	TagResourceInput                   *ecr.TagResourceInput
 }
 
 func (m *MockECRClient) DescribeRepositories(input *ecr.DescribeRepositoriesInput) (*ecr.DescribeRepositoriesOutput, error) {
 	return &ecr.DescribeRepositoriesOutput{
 		Repositories: []*ecr.Repository{
 			{
-				RepositoryUri: aws.String("repo:" + *input.RepositoryNames[0]),
+				RepositoryName: input.RepositoryNames[0],
+				RepositoryArn:  aws.String("arn:aws:ecr:eu-west-1:" + handler.AccountID + ":repository/" + *input.RepositoryNames[0]),
+				RepositoryUri:  aws.String("repo:" + *input.RepositoryNames[0]),
 				ImageScanningConfiguration: &ecr.ImageScanningConfiguration{
 					ScanOnPush: aws.Bool(m.DefaultScanOnPush),
 				},
-				ImageTagMutability: aws.String(m.DefaultMutability),
+				ImageTagMutability:      aws.String(m.DefaultMutability),
+				EncryptionConfiguration: m.ExistingEncryption,
 			},
 		},
 	}, nil
@@ -64,9 +72,13 @@ const expectedRepoPolicyDocument = `
 }
 `
 
-func (*MockECRClient) GetLifecyclePolicy(input *ecr.GetLifecyclePolicyInput) (*ecr.GetLifecyclePolicyOutput, error) {
+func (m *MockECRClient) GetLifecyclePolicy(input *ecr.GetLifecyclePolicyInput) (*ecr.GetLifecyclePolicyOutput, error) {
+	policy := expectedPolicyDocument
+	if m.ExistingLifecyclePolicy != "" {
+		policy = m.ExistingLifecyclePolicy
+	}
 	return &ecr.GetLifecyclePolicyOutput{
-		LifecyclePolicyText: aws.String(expectedPolicyDocument),
+		LifecyclePolicyText: aws.String(policy),
 	}, nil
 }
 
@@ -96,8 +108,12 @@ func (m *MockECRClient) PutImageScanningConfiguration(input *ecr.PutImageScannin
 
 func (m *MockECRClient) GetRepositoryPolicy(input *ecr.GetRepositoryPolicyInput) (*ecr.GetRepositoryPolicyOutput, error) {
 	m.GetRepositoryPolicyInput = input
+	policy := expectedRepoPolicyDocument
+	if m.ExistingRepositoryPolicy != "" {
+		policy = m.ExistingRepositoryPolicy
+	}
 	return &ecr.GetRepositoryPolicyOutput{
-		PolicyText: aws.String(expectedRepoPolicyDocument),
+		PolicyText: aws.String(policy),
 	}, nil
 }
 
@@ -109,6 +125,22 @@ func (m *MockECRClient) SetRepositoryPolicy(input *ecr.SetRepositoryPolicyInput)
 	return &ecr.SetRepositoryPolicyOutput{}, nil
 }
 
+func (m *MockECRClient) ListTagsForResource(input *ecr.ListTagsForResourceInput) (*ecr.ListTagsForResourceOutput, error) {
+	return &ecr.ListTagsForResourceOutput{Tags: m.ExistingTags}, nil
+}
+
+func (m *MockECRClient) TagResource(input *ecr.TagResourceInput) (*ecr.TagResourceOutput, error) {
+	if m.TagResourceInput != nil {
+		panic("TagResource already called")
+	}
+	m.TagResourceInput = input
+	return &ecr.TagResourceOutput{}, nil
+}
+
+func (m *MockECRClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	return mockECRAuthorizationToken(), nil
+}
+
 type MockECRClientNoRepo struct {
 	ecriface.ECRAPI
 	CreateRepositoryInput    *ecr.CreateRepositoryInput
@@ -164,6 +196,10 @@ func (m *MockECRClientNoRepo) SetRepositoryPolicy(input *ecr.SetRepositoryPolicy
 	}, nil
 }
 
+func (m *MockECRClientNoRepo) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	return mockECRAuthorizationToken(), nil
+}
+
 func createConfigureReleaseRequest() *common.ConfigureReleaseRequest {
 	request := common.CreateConfigureReleaseRequest()
 	request.Env["AWS_ACCESS_KEY_ID"] = "foo"
@@ -178,7 +214,7 @@ func TestConfigureRelease(t *testing.T) {
 	accessKeyID := "test-access-key-id"
 	secretAccessKey := "test-secret-access-key"
 	sessionToken := "test-session-token"
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider(accessKeyID, secretAccessKey, sessionToken)
 	}
 
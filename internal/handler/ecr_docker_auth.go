@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+)
+
+// DockerAuthPrefix is the prefix of environment variables containing docker registry credentials, with the registry
+// (upper case, with other characters replaced by underscores) as the suffix.
+const DockerAuthPrefix = "CDFLOW2_DOCKER_AUTH_"
+
+var dockerAuthSuffixPattern = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// dockerAuthConfig is the docker config.json format, as accepted in DOCKER_AUTH_CONFIG.
+type dockerAuthConfig struct {
+	Auths map[string]dockerAuth `json:"auths"`
+}
+
+type dockerAuth struct {
+	Auth string `json:"auth"`
+}
+
+// ecrDockerAuthEnv gets docker login credentials for the release account's ECR registry, returning them as
+// DOCKER_AUTH_CONFIG and CDFLOW2_DOCKER_AUTH_<registry> environment variables for builds.
+func (h *Handler) ecrDockerAuthEnv(ecrClient ecriface.ECRAPI) (map[string]string, error) {
+	fmt.Fprintf(h.ErrorStream, "- Getting ECR docker login credentials...\n")
+	output, err := ecrClient.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ECR docker login credentials: %v", err)
+	}
+	config := dockerAuthConfig{Auths: make(map[string]dockerAuth)}
+	env := make(map[string]string)
+	for _, data := range output.AuthorizationData {
+		registry := strings.TrimPrefix(aws.StringValue(data.ProxyEndpoint), "https://")
+		token := aws.StringValue(data.AuthorizationToken)
+		config.Auths[registry] = dockerAuth{Auth: token}
+		env[DockerAuthPrefix+strings.Trim(dockerAuthSuffixPattern.ReplaceAllString(strings.ToUpper(registry), "_"), "_")] = token
+		if data.ExpiresAt != nil {
+			fmt.Fprintf(h.ErrorStream, "  %s (expires %s)\n", registry, data.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"))
+		}
+	}
+	if len(config.Auths) == 0 {
+		return nil, fmt.Errorf("no ECR docker login credentials returned")
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	env["DOCKER_AUTH_CONFIG"] = string(configJSON)
+	return env, nil
+}
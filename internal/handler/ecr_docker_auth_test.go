@@ -0,0 +1,97 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+const mockECRRegistry = handler.AccountID + ".dkr.ecr.eu-west-1.amazonaws.com"
+
+func mockECRAuthorizationToken() *ecr.GetAuthorizationTokenOutput {
+	return &ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []*ecr.AuthorizationData{{
+			AuthorizationToken: aws.String("QVdTOnNlY3JldA=="),
+			ExpiresAt:          aws.Time(time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)),
+			ProxyEndpoint:      aws.String("https://" + mockECRRegistry),
+		}},
+	}
+}
+
+func TestConfigureReleaseProvidesECRDockerAuth(t *testing.T) {
+	// Given
+	request := createECRSettingsConfigureReleaseRequest()
+	request.Env["CDFLOW2_DOCKER_AUTH_DOCKERHUB"] = "dockerhub-auth"
+	response := common.CreateConfigureReleaseResponse()
+	var errorBuffer bytes.Buffer
+
+	// When
+	if err := createECRSettingsHandler(&errorBuffer, &MockECRClient{DefaultMutability: "IMMUTABLE", DefaultScanOnPush: true}).
+		ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	env := response.Env["my-ecr"]
+	expectedKey := "CDFLOW2_DOCKER_AUTH_" + handler.AccountID + "_DKR_ECR_EU_WEST_1_AMAZONAWS_COM"
+	if env[expectedKey] != "QVdTOnNlY3JldA==" {
+		t.Fatalf("expected %q, got %q", "QVdTOnNlY3JldA==", env[expectedKey])
+	}
+	if env["CDFLOW2_DOCKER_AUTH_DOCKERHUB"] != "dockerhub-auth" {
+		t.Fatalf("expected %q, got %q", "dockerhub-auth", env["CDFLOW2_DOCKER_AUTH_DOCKERHUB"])
+	}
+	var config struct {
+		Auths map[string]struct{ Auth string }
+	}
+	if err := json.Unmarshal([]byte(env["DOCKER_AUTH_CONFIG"]), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Auths[mockECRRegistry].Auth != "QVdTOnNlY3JldA==" {
+		t.Fatalf("unexpected DOCKER_AUTH_CONFIG: %s", env["DOCKER_AUTH_CONFIG"])
+	}
+	expected := "  " + mockECRRegistry + " (expires 2026-06-01 12:00 UTC)\n"
+	if !strings.Contains(errorBuffer.String(), expected) {
+		t.Fatalf("expected %q in %q", expected, errorBuffer.String())
+	}
+}
+
+type MockECRClientNoAuth struct {
+	MockECRClient
+}
+
+func (m *MockECRClientNoAuth) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	return nil, awserr.New("AccessDeniedException", "not authorized to perform: ecr:GetAuthorizationToken", nil)
+}
+
+func TestConfigureReleaseECRDockerAuthError(t *testing.T) {
+	// Given
+	request := createECRSettingsConfigureReleaseRequest()
+	response := common.CreateConfigureReleaseResponse()
+	var errorBuffer bytes.Buffer
+	ecrClient := &MockECRClientNoAuth{MockECRClient{DefaultMutability: "IMMUTABLE", DefaultScanOnPush: true}}
+
+	// When
+	if err := createECRSettingsHandler(&errorBuffer, ecrClient).ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := "unable to get ECR docker login credentials: AccessDeniedException"
+	if !strings.Contains(errorBuffer.String(), expected) {
+		t.Fatalf("expected %q in %q", expected, errorBuffer.String())
+	}
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultECRLifecycleKeep is the number of images kept per build when config.params.ecr.lifecycle doesn't say otherwise.
+const DefaultECRLifecycleKeep = 50
+
+// protectedImageCount is the count for rules protecting tag prefixes. An image matched by a rule can't be expired by
+// a lower priority rule, so these effectively exclude the images from the other rules.
+const protectedImageCount = 10000
+
+// ECRRetention is how long images for a build are kept - either the newest Keep images, or images pushed in the last
+// MaxAgeDays days.
+type ECRRetention struct {
+	Keep       int
+	MaxAgeDays int
+}
+
+// ECRLifecycleConfig is config.params.ecr.lifecycle.
+type ECRLifecycleConfig struct {
+	Retention          *ECRRetention
+	Builds             map[string]*ECRRetention
+	UntaggedExpiryDays int
+	ProtectPrefixes    []string
+}
+
+// ecrParams returns config.params.ecr, or an empty map if it isn't set.
+func ecrParams(config map[string]interface{}) (map[string]interface{}, error) {
+	value, ok := config["ecr"]
+	if !ok {
+		return map[string]interface{}{}, nil
+	}
+	ecrMap, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: config.params.ecr must be a map")
+	}
+	return ecrMap, nil
+}
+
+func positiveIntParam(value interface{}, param string) (int, error) {
+	result, err := intParam(value, param)
+	if err != nil {
+		return 0, err
+	}
+	if result < 1 {
+		return 0, fmt.Errorf("cdflow.yaml error: %s must be at least 1", param)
+	}
+	return int(result), nil
+}
+
+// parseECRRetention reads keep/max_age_days from a map, along with any of the extra keys allowed at that level.
+func parseECRRetention(values map[string]interface{}, param string, extraKeys ...string) (*ECRRetention, error) {
+	var retention *ECRRetention
+	for key, value := range values {
+		switch key {
+		case "keep", "max_age_days":
+			number, err := positiveIntParam(value, param+"."+key)
+			if err != nil {
+				return nil, err
+			}
+			if retention != nil {
+				return nil, fmt.Errorf("cdflow.yaml error: %s can set keep or max_age_days, but not both", param)
+			}
+			if key == "keep" {
+				retention = &ECRRetention{Keep: number}
+			} else {
+				retention = &ECRRetention{MaxAgeDays: number}
+			}
+		default:
+			if !contains(key, extraKeys) {
+				return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+			}
+		}
+	}
+	return retention, nil
+}
+
+// ParseECRLifecycleConfig reads config.params.ecr.lifecycle, checking that any per-build settings are for ECR builds.
+func ParseECRLifecycleConfig(config map[string]interface{}, ecrBuilds []string) (*ECRLifecycleConfig, error) {
+	result := &ECRLifecycleConfig{
+		Retention: &ECRRetention{Keep: DefaultECRLifecycleKeep},
+		Builds:    make(map[string]*ECRRetention),
+	}
+	ecrMap, err := ecrParams(config)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := ecrMap["lifecycle"]
+	if !ok {
+		return result, nil
+	}
+	const param = "config.params.ecr.lifecycle"
+	lifecycle, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map", param)
+	}
+	retention, err := parseECRRetention(lifecycle, param, "builds", "untagged_expiry_days", "protect_prefixes")
+	if err != nil {
+		return nil, err
+	}
+	if retention != nil {
+		result.Retention = retention
+	}
+	if value, ok := lifecycle["untagged_expiry_days"]; ok {
+		if result.UntaggedExpiryDays, err = positiveIntParam(value, param+".untagged_expiry_days"); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := lifecycle["protect_prefixes"]; ok {
+		prefixes, err := stringSlice(value, param+".protect_prefixes")
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range prefixes {
+			if prefix == "" {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.protect_prefixes cannot contain an empty prefix", param)
+			}
+			if !contains(prefix, result.ProtectPrefixes) {
+				result.ProtectPrefixes = append(result.ProtectPrefixes, prefix)
+			}
+		}
+	}
+	if value, ok := lifecycle["builds"]; ok {
+		builds, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.builds must be a map of build IDs to lifecycle settings", param)
+		}
+		for buildID, value := range builds {
+			buildParam := param + ".builds." + buildID
+			if !contains(buildID, ecrBuilds) {
+				return nil, fmt.Errorf("cdflow.yaml error: %s does not match a build that needs \"ecr\"", buildParam)
+			}
+			buildMap, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cdflow.yaml error: %s must be a map", buildParam)
+			}
+			retention, err := parseECRRetention(buildMap, buildParam)
+			if err != nil {
+				return nil, err
+			}
+			if retention != nil {
+				result.Builds[buildID] = retention
+			}
+		}
+	}
+	return result, nil
+}
+
+func (c *ECRLifecycleConfig) retention(buildID string) *ECRRetention {
+	if retention, ok := c.Builds[buildID]; ok {
+		return retention
+	}
+	return c.Retention
+}
+
+// Policy returns the lifecycle policy for the builds. Protected prefixes come first so that no other rule can expire
+// them, then a rule per build (in the order given, which should be sorted), then the untagged rule. The result only
+// depends on the config and builds, so the serialised policy can be compared with the current one to skip updates.
+func (c *ECRLifecycleConfig) Policy(ecrBuilds []string) *ECRLifecyclePolicy {
+	policy := &ECRLifecyclePolicy{}
+	addRule := func(selection *ECRLifecyclePolicyRuleSelection) {
+		policy.Rules = append(policy.Rules, &ECRLifecyclePolicyRule{
+			RulePriority: len(policy.Rules) + 1,
+			Selection:    selection,
+			Action: &ECRLifecyclePolicyRuleAction{
+				Type: "expire",
+			},
+		})
+	}
+	if len(c.ProtectPrefixes) > 0 {
+		prefixes := append([]string{}, c.ProtectPrefixes...)
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			addRule(&ECRLifecyclePolicyRuleSelection{
+				TagStatus:     "tagged",
+				TagPrefixList: []string{prefix},
+				CountType:     "imageCountMoreThan",
+				CountNumber:   protectedImageCount,
+			})
+		}
+	}
+	for _, buildID := range ecrBuilds {
+		selection := &ECRLifecyclePolicyRuleSelection{
+			TagStatus:     "tagged",
+			TagPrefixList: []string{buildID + "-"},
+		}
+		if retention := c.retention(buildID); retention.MaxAgeDays != 0 {
+			selection.CountType = "sinceImagePushed"
+			selection.CountUnit = "days"
+			selection.CountNumber = retention.MaxAgeDays
+		} else {
+			selection.CountType = "imageCountMoreThan"
+			selection.CountNumber = retention.Keep
+		}
+		addRule(selection)
+	}
+	if c.UntaggedExpiryDays != 0 {
+		addRule(&ECRLifecyclePolicyRuleSelection{
+			TagStatus:   "untagged",
+			CountType:   "sinceImagePushed",
+			CountUnit:   "days",
+			CountNumber: c.UntaggedExpiryDays,
+		})
+	}
+	return policy
+}
@@ -0,0 +1,166 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestECRLifecyclePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   map[string]interface{}
+		builds   []string
+		expected string
+	}{
+		{
+			"default",
+			map[string]interface{}{},
+			[]string{"my-ecr"},
+			expectedPolicyDocument,
+		},
+		{
+			"repo-wide count and untagged expiry",
+			map[string]interface{}{
+				"ecr": map[string]interface{}{
+					"lifecycle": map[string]interface{}{
+						"keep":                 float64(200),
+						"untagged_expiry_days": float64(7),
+					},
+				},
+			},
+			[]string{"api", "worker"},
+			`{"rules":[` +
+				`{"rulePriority":1,"selection":{"tagStatus":"tagged","tagPrefixList":["api-"],"countType":"imageCountMoreThan","countNumber":200},"action":{"type":"expire"}},` +
+				`{"rulePriority":2,"selection":{"tagStatus":"tagged","tagPrefixList":["worker-"],"countType":"imageCountMoreThan","countNumber":200},"action":{"type":"expire"}},` +
+				`{"rulePriority":3,"selection":{"tagStatus":"untagged","countType":"sinceImagePushed","countUnit":"days","countNumber":7},"action":{"type":"expire"}}` +
+				`]}`,
+		},
+		{
+			"per build age and protected prefixes",
+			map[string]interface{}{
+				"ecr": map[string]interface{}{
+					"lifecycle": map[string]interface{}{
+						"protect_prefixes": []interface{}{"release-", "api-release-", "release-"},
+						"builds": map[string]interface{}{
+							"worker": map[string]interface{}{"max_age_days": float64(30)},
+						},
+					},
+				},
+			},
+			[]string{"api", "worker"},
+			`{"rules":[` +
+				`{"rulePriority":1,"selection":{"tagStatus":"tagged","tagPrefixList":["api-release-"],"countType":"imageCountMoreThan","countNumber":10000},"action":{"type":"expire"}},` +
+				`{"rulePriority":2,"selection":{"tagStatus":"tagged","tagPrefixList":["release-"],"countType":"imageCountMoreThan","countNumber":10000},"action":{"type":"expire"}},` +
+				`{"rulePriority":3,"selection":{"tagStatus":"tagged","tagPrefixList":["api-"],"countType":"imageCountMoreThan","countNumber":50},"action":{"type":"expire"}},` +
+				`{"rulePriority":4,"selection":{"tagStatus":"tagged","tagPrefixList":["worker-"],"countType":"sinceImagePushed","countUnit":"days","countNumber":30},"action":{"type":"expire"}}` +
+				`]}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			lifecycle, err := handler.ParseECRLifecycleConfig(tc.config, tc.builds)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// When
+			serialised, err := json.Marshal(lifecycle.Policy(tc.builds))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			if string(serialised) != tc.expected {
+				t.Fatalf("expected %s, got %s", tc.expected, serialised)
+			}
+		})
+	}
+}
+
+func TestECRLifecycleConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		lifecycle     map[string]interface{}
+		expectedError string
+	}{
+		{
+			"count and age",
+			map[string]interface{}{"builds": map[string]interface{}{"api": map[string]interface{}{"keep": float64(10), "max_age_days": float64(10)}}},
+			"config.params.ecr.lifecycle.builds.api can set keep or max_age_days, but not both",
+		},
+		{
+			"not an ECR build",
+			map[string]interface{}{"builds": map[string]interface{}{"lambda": map[string]interface{}{"keep": float64(10)}}},
+			`config.params.ecr.lifecycle.builds.lambda does not match a build that needs "ecr"`,
+		},
+		{
+			"zero",
+			map[string]interface{}{"untagged_expiry_days": float64(0)},
+			"config.params.ecr.lifecycle.untagged_expiry_days must be at least 1",
+		},
+		{
+			"unknown key",
+			map[string]interface{}{"kep": float64(10)},
+			"unknown key config.params.ecr.lifecycle.kep",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			_, err := handler.ParseECRLifecycleConfig(map[string]interface{}{
+				"ecr": map[string]interface{}{"lifecycle": tc.lifecycle},
+			}, []string{"api"})
+
+			// Then
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Fatalf("expected error containing %q, got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestConfigureReleaseECRLifecycle(t *testing.T) {
+	// Given
+	request := createConfigureReleaseRequest()
+	request.Component = "my-component"
+	request.Config["team"] = "my-team"
+	request.Config["ecr"] = map[string]interface{}{
+		"lifecycle": map[string]interface{}{"keep": float64(200)},
+	}
+	request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+		"my-ecr": {Needs: []string{"ecr"}},
+	}
+	response := common.CreateConfigureReleaseResponse()
+
+	ecrClient := &MockECRClient{DefaultMutability: "IMMUTABLE", DefaultScanOnPush: true}
+	h := handler.New().
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		}).
+		WithECRClientFactory(func(session client.ConfigProvider) ecriface.ECRAPI {
+			return ecrClient
+		})
+
+	// When
+	if err := h.ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatal("unexpected failure")
+	}
+	if ecrClient.PutLifecyclePolicyInput == nil {
+		t.Fatal("expected lifecycle policy to be updated")
+	}
+	expected := strings.Replace(expectedPolicyDocument, `"countNumber":50`, `"countNumber":200`, 1)
+	if *ecrClient.PutLifecyclePolicyInput.LifecyclePolicyText != expected {
+		t.Fatalf("expected %s, got %s", expected, *ecrClient.PutLifecyclePolicyInput.LifecyclePolicyText)
+	}
+}
@@ -0,0 +1,735 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// ECRImageMetadataKey is the key in a build's map in the release metadata for the image URI to deploy, which is the
+// copy of the image when it has been replicated or copied to the deploy region or account.
+const ECRImageMetadataKey = "ecr_image"
+
+// Limits for waiting for registry replication when deploying, which is asynchronous.
+const (
+	ecrReplicationTimeout      = 5 * time.Minute
+	ecrReplicationPollInterval = 10 * time.Second
+)
+
+// ecrDefaultLayerPartSize is used to upload copied layers if ECR doesn't give a part size.
+const ecrDefaultLayerPartSize = 10 * 1024 * 1024
+
+// ecrLayerHTTPClient downloads layers when copying images. The overall timeout is generous since layers can be large,
+// but a server that stops responding fails the connection quickly rather than hanging the deploy.
+var ecrLayerHTTPClient = &http.Client{
+	Timeout: 30 * time.Minute,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+// Image manifest media types that can be copied.
+var ecrManifestMediaTypes = []*string{
+	aws.String("application/vnd.docker.distribution.manifest.v2+json"),
+	aws.String("application/vnd.docker.distribution.manifest.list.v2+json"),
+	aws.String("application/vnd.oci.image.manifest.v1+json"),
+	aws.String("application/vnd.oci.image.index.v1+json"),
+}
+
+// ECRReplicationConfig is config.params.ecr.replication.
+type ECRReplicationConfig struct {
+	// Destinations are added to the release registry's replication rules when releasing.
+	Destinations []*ecr.ReplicationDestination
+	// Copy copies the release images to ECR in the deploy account and region when deploying.
+	Copy bool
+}
+
+// ParseECRReplicationConfig reads config.params.ecr.replication. Destinations without a registry_id are in the release
+// account.
+func ParseECRReplicationConfig(config map[string]interface{}, profile *Profile) (*ECRReplicationConfig, error) {
+	result := &ECRReplicationConfig{}
+	ecrMap, err := ecrParams(config)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := ecrMap["replication"]
+	if !ok {
+		return result, nil
+	}
+	const param = "config.params.ecr.replication"
+	replication, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map", param)
+	}
+	for key, value := range replication {
+		switch key {
+		case "copy":
+			if result.Copy, ok = value.(bool); !ok {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.copy must be true or false", param)
+			}
+		case "destinations":
+			entries, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.destinations must be a list", param)
+			}
+			for i, entry := range entries {
+				destination, err := parseECRReplicationDestination(fmt.Sprintf("%s.destinations[%d]", param, i), entry, profile)
+				if err != nil {
+					return nil, err
+				}
+				result.Destinations = append(result.Destinations, destination)
+			}
+		default:
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+		}
+	}
+	return result, nil
+}
+
+func parseECRReplicationDestination(param string, value interface{}, profile *Profile) (*ecr.ReplicationDestination, error) {
+	entry, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map with region and optionally registry_id", param)
+	}
+	destination := &ecr.ReplicationDestination{RegistryId: aws.String(profile.AccountID)}
+	for key, value := range entry {
+		valueString, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.%s must be a string", param, key)
+		}
+		switch key {
+		case "region":
+			if !regionPattern.MatchString(valueString) {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.region %q is not a valid AWS region", param, valueString)
+			}
+			destination.Region = aws.String(valueString)
+		case "registry_id":
+			if !accountIDPattern.MatchString(valueString) {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.registry_id %q is not a valid AWS account ID", param, valueString)
+			}
+			destination.RegistryId = aws.String(valueString)
+		default:
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+		}
+	}
+	if destination.Region == nil {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.region must be set", param)
+	}
+	if *destination.Region == profile.Region && *destination.RegistryId == profile.AccountID {
+		return nil, fmt.Errorf("cdflow.yaml error: %s is the release registry itself", param)
+	}
+	return destination, nil
+}
+
+func replicationDestinationString(destination *ecr.ReplicationDestination) string {
+	return aws.StringValue(destination.RegistryId) + "/" + aws.StringValue(destination.Region)
+}
+
+// checkReplicationDestinationAccounts fails unless the registry of each replication destination outside the release
+// account is an account in the organisation, so that config can't send release images to any account.
+func (h *Handler) checkReplicationDestinationAccounts(destinations []*ecr.ReplicationDestination, env map[string]string) error {
+	var registryIDs []string
+	for _, destination := range destinations {
+		if registryID := aws.StringValue(destination.RegistryId); registryID != h.Profile.AccountID && !contains(registryID, registryIDs) {
+			registryIDs = append(registryIDs, registryID)
+		}
+	}
+	if len(registryIDs) == 0 {
+		return nil
+	}
+	session, err := h.GetRootAccountSession(env)
+	if err != nil {
+		return err
+	}
+	accounts := make(map[string]bool)
+	if err := h.OrganizationsClientFactory(session).ListAccountsPages(&organizations.ListAccountsInput{}, func(result *organizations.ListAccountsOutput, lastPage bool) bool {
+		for _, account := range result.Accounts {
+			if aws.StringValue(account.Status) == organizations.AccountStatusActive {
+				accounts[aws.StringValue(account.Id)] = true
+			}
+		}
+		return true
+	}); err != nil {
+		return fmt.Errorf("unable to list the organisation's accounts to check ECR replication destinations: %v", err)
+	}
+	for _, registryID := range registryIDs {
+		if !accounts[registryID] {
+			return fmt.Errorf(
+				"cdflow.yaml error: config.params.ecr.replication.destinations: registry_id %s is not an account in the organisation",
+				registryID,
+			)
+		}
+	}
+	return nil
+}
+
+// Limits on the release registry's replication configuration. ECR allows at most ten rules and 25 unique destinations
+// across all of them.
+const (
+	maxECRReplicationRules        = 10
+	maxECRReplicationDestinations = 25
+)
+
+// ECR has no conditional update of the replication configuration, so after updating it the config container waits for
+// any concurrent update that read the configuration before the write to land, checks the destinations are still there
+// and adds them again if not.
+const (
+	ecrReplicationSettleDelay = 5 * time.Second
+	maxECRReplicationAttempts = 5
+)
+
+// ECRReplicationPrefix returns the prefix of the repositories replicated by a team's replication rule. Repositories are
+// named <team>-<component>, so the separator keeps the rule to the team's repositories rather than every repository
+// whose name starts with the team name.
+func ECRReplicationPrefix(team string) string {
+	return team + "-"
+}
+
+// replicationRuleCovers returns whether a replication rule applies to the repositories starting with prefix.
+func replicationRuleCovers(rule *ecr.ReplicationRule, prefix string) bool {
+	if len(rule.RepositoryFilters) == 0 {
+		return true
+	}
+	for _, filter := range rule.RepositoryFilters {
+		if aws.StringValue(filter.FilterType) == ecr.RepositoryFilterTypePrefixMatch && strings.HasPrefix(prefix, aws.StringValue(filter.Filter)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTeamReplicationRule returns whether a rule is the one added for the repositories starting with prefix.
+func isTeamReplicationRule(rule *ecr.ReplicationRule, prefix string) bool {
+	return len(rule.RepositoryFilters) == 1 &&
+		aws.StringValue(rule.RepositoryFilters[0].FilterType) == ecr.RepositoryFilterTypePrefixMatch &&
+		aws.StringValue(rule.RepositoryFilters[0].Filter) == prefix
+}
+
+// missingReplicationDestinations returns the destinations that no rule replicates the repositories starting with prefix
+// to.
+func missingReplicationDestinations(rules []*ecr.ReplicationRule, prefix string, destinations []*ecr.ReplicationDestination) []*ecr.ReplicationDestination {
+	existing := make(map[string]bool)
+	for _, rule := range rules {
+		if !replicationRuleCovers(rule, prefix) {
+			continue
+		}
+		for _, destination := range rule.Destinations {
+			existing[replicationDestinationString(destination)] = true
+		}
+	}
+	var missing []*ecr.ReplicationDestination
+	for _, destination := range destinations {
+		if !existing[replicationDestinationString(destination)] {
+			missing = append(missing, destination)
+		}
+	}
+	return missing
+}
+
+// addReplicationDestinations returns the rules with the destinations added to the rule for the repositories starting
+// with prefix, which is created if needed. Other rules are unchanged.
+func addReplicationDestinations(rules []*ecr.ReplicationRule, prefix string, destinations []*ecr.ReplicationDestination) []*ecr.ReplicationRule {
+	updated := make([]*ecr.ReplicationRule, 0, len(rules)+1)
+	added := false
+	for _, rule := range rules {
+		if !added && isTeamReplicationRule(rule, prefix) {
+			rule = &ecr.ReplicationRule{
+				Destinations:      append(append([]*ecr.ReplicationDestination{}, rule.Destinations...), destinations...),
+				RepositoryFilters: rule.RepositoryFilters,
+			}
+			added = true
+		}
+		updated = append(updated, rule)
+	}
+	if !added {
+		updated = append(updated, &ecr.ReplicationRule{
+			Destinations: destinations,
+			RepositoryFilters: []*ecr.RepositoryFilter{{
+				Filter:     aws.String(prefix),
+				FilterType: aws.String(ecr.RepositoryFilterTypePrefixMatch),
+			}},
+		})
+	}
+	return updated
+}
+
+// checkReplicationLimits fails if the rules are more than ECR allows in a registry's replication configuration.
+func checkReplicationLimits(rules []*ecr.ReplicationRule) error {
+	if len(rules) > maxECRReplicationRules {
+		return fmt.Errorf(
+			"unable to add ECR registry replication: the release registry would have %d replication rules, but ECR allows at most %d",
+			len(rules), maxECRReplicationRules,
+		)
+	}
+	destinations := make(map[string]bool)
+	for _, rule := range rules {
+		for _, destination := range rule.Destinations {
+			destinations[replicationDestinationString(destination)] = true
+		}
+	}
+	if len(destinations) > maxECRReplicationDestinations {
+		return fmt.Errorf(
+			"unable to add ECR registry replication: the release registry would replicate to %d destinations, but ECR allows at most %d",
+			len(destinations), maxECRReplicationDestinations,
+		)
+	}
+	return nil
+}
+
+func registryReplicationRules(ecrClient ecriface.ECRAPI) ([]*ecr.ReplicationRule, error) {
+	output, err := ecrClient.DescribeRegistry(&ecr.DescribeRegistryInput{})
+	if err != nil {
+		return nil, err
+	}
+	if output.ReplicationConfiguration == nil {
+		return nil, nil
+	}
+	return output.ReplicationConfiguration.Rules, nil
+}
+
+// ensureRegistryReplication adds any destinations missing for the team's repositories (those starting with prefix) to
+// the release registry's replication configuration. The configuration is shared by every repository in the registry,
+// so the destinations are added to one rule per team, and other rules are never changed or removed.
+func (h *Handler) ensureRegistryReplication(prefix string, destinations []*ecr.ReplicationDestination, ecrClient ecriface.ECRAPI) error {
+	if len(destinations) == 0 {
+		return nil
+	}
+	fmt.Fprintf(h.ErrorStream, "- Checking ECR registry replication...\n")
+	for attempt := 1; ; attempt++ {
+		rules, err := registryReplicationRules(ecrClient)
+		if err != nil {
+			return err
+		}
+		missing := missingReplicationDestinations(rules, prefix, destinations)
+		if len(missing) == 0 {
+			return nil
+		}
+		descriptions := make([]string, len(missing))
+		for i, destination := range missing {
+			descriptions[i] = replicationDestinationString(destination)
+		}
+		if attempt > maxECRReplicationAttempts {
+			return fmt.Errorf(
+				"unable to add ECR registry replication of %s* to %s: it was overwritten by concurrent updates %d times",
+				prefix, strings.Join(descriptions, ", "), maxECRReplicationAttempts,
+			)
+		}
+		if attempt > 1 {
+			fmt.Fprintf(h.ErrorStream, "- ECR registry replication was overwritten by a concurrent update, retrying...\n")
+		}
+		fmt.Fprintf(h.ErrorStream, "- Adding ECR registry replication of %s* to %s...\n", prefix, strings.Join(descriptions, ", "))
+		updated := addReplicationDestinations(rules, prefix, missing)
+		if err := checkReplicationLimits(updated); err != nil {
+			return err
+		}
+		if _, err := ecrClient.PutReplicationConfiguration(&ecr.PutReplicationConfigurationInput{
+			ReplicationConfiguration: &ecr.ReplicationConfiguration{Rules: updated},
+		}); err != nil {
+			return err
+		}
+		h.Sleep(ecrReplicationSettleDelay)
+	}
+}
+
+// waitForReplicatedImage waits for an image to be replicated to a registry in the deploy region. Replication is
+// asynchronous, and only applies to images pushed after the replication rule was added.
+func (h *Handler) waitForReplicatedImage(registryID, repoName, tag, region string, ecrClient ecriface.ECRAPI) error {
+	deadline := h.Now().Add(ecrReplicationTimeout)
+	waiting := false
+	for {
+		_, err := ecrClient.DescribeImages(&ecr.DescribeImagesInput{
+			RegistryId:     aws.String(registryID),
+			RepositoryName: aws.String(repoName),
+			ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(tag)}},
+		})
+		if err == nil {
+			return nil
+		}
+		if aerr, ok := err.(awserr.Error); !ok || (aerr.Code() != ecr.ErrCodeImageNotFoundException && aerr.Code() != ecr.ErrCodeRepositoryNotFoundException) {
+			return err
+		}
+		if !h.Now().Before(deadline) {
+			return fmt.Errorf(
+				"image %s:%s has not been replicated to %s/%s after %v - replication only applies to images pushed after "+
+					"the destination was added, so release a new version or set config.params.ecr.replication.copy",
+				repoName, tag, registryID, region, ecrReplicationTimeout,
+			)
+		}
+		if !waiting {
+			fmt.Fprintf(h.ErrorStream, "- Waiting for image %s:%s to be replicated to %s/%s...\n", repoName, tag, registryID, region)
+			waiting = true
+		}
+		h.Sleep(ecrReplicationPollInterval)
+	}
+}
+
+func ecrImageURI(registryID, region, repoName, tag string) string {
+	return fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s:%s", registryID, region, repoName, tag)
+}
+
+// findECRImage returns the first repository containing the tag, with the image's manifest.
+func (h *Handler) findECRImage(repoNames []string, tag string, ecrClient ecriface.ECRAPI) (string, *ecr.Image, error) {
+	for _, repoName := range repoNames {
+		output, err := ecrClient.BatchGetImage(&ecr.BatchGetImageInput{
+			RegistryId:         aws.String(h.Profile.AccountID),
+			RepositoryName:     aws.String(repoName),
+			ImageIds:           []*ecr.ImageIdentifier{{ImageTag: aws.String(tag)}},
+			AcceptedMediaTypes: ecrManifestMediaTypes,
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeRepositoryNotFoundException {
+				continue
+			}
+			return "", nil, err
+		}
+		if len(output.Images) != 0 {
+			return repoName, output.Images[0], nil
+		}
+	}
+	return "", nil, fmt.Errorf("image with tag %s not found in %s", tag, strings.Join(repoNames, " or "))
+}
+
+// resolveECRImages adds the URI of the image to deploy to the map of each of the release's ECR builds in the release
+// metadata, copying the image to the deploy account and region first if config.params.ecr.replication.copy is set.
+func (h *Handler) resolveECRImages(config map[string]interface{}, team, component, version, releaseDir string, releaseECR ecriface.ECRAPI, responseEnv map[string]string) error {
+	metadata, err := readReleaseMetadata(releaseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	buildsString := metadata["release"][ECRBuildsMetadataKey]
+	if buildsString == "" {
+		return nil
+	}
+	replication, err := ParseECRReplicationConfig(config, h.Profile)
+	if err != nil {
+		return err
+	}
+	perBuild, err := ECRRepositoryPerBuild(config)
+	if err != nil {
+		return err
+	}
+	builds := strings.Split(buildsString, ",")
+	deployRegion := responseEnv["AWS_DEFAULT_REGION"]
+	var deployECR, replicaECR ecriface.ECRAPI
+	var copyRepos map[string]*ecrRepoSetup
+	var copySettings *ECRRepositorySettings
+	var replicaRegistryID string
+	if replication.Copy {
+		session, err := deployAccountSession(responseEnv)
+		if err != nil {
+			return err
+		}
+		deployECR = h.ECRClientFactory(session)
+		if copyRepos, copySettings, err = h.copyRepositorySetups(config, team, component, builds); err != nil {
+			return err
+		}
+	} else if replicaRegistryID, replicaECR, err = h.replicaRegistry(replication.Destinations, deployRegion, responseEnv); err != nil {
+		return err
+	}
+	for _, buildID := range builds {
+		tag := buildID + "-" + version
+		repoNames := ecrImageRepositories(team, component, buildID, perBuild)
+		repoName := repoNames[0]
+		var image *ecr.Image
+		if replication.Copy || len(repoNames) > 1 {
+			if repoName, image, err = h.findECRImage(repoNames, tag, releaseECR); err != nil {
+				return err
+			}
+		}
+		uri := ecrImageURI(h.Profile.AccountID, h.Profile.Region, repoName, tag)
+		if replication.Copy {
+			if uri, err = h.copyECRImage(releaseECR, deployECR, copyRepos[repoName], copySettings, tag, image, deployRegion); err != nil {
+				return fmt.Errorf("unable to copy image %s to the deploy account: %v", uri, err)
+			}
+		} else if replicaRegistryID != "" {
+			if err := h.waitForReplicatedImage(replicaRegistryID, repoName, tag, deployRegion, replicaECR); err != nil {
+				return err
+			}
+			uri = ecrImageURI(replicaRegistryID, deployRegion, repoName, tag)
+		}
+		fmt.Fprintf(h.ErrorStream, "- Using image %s for %s.\n", uri, buildID)
+		if err := updateReleaseMetadata(releaseDir, buildID, map[string]string{ECRImageMetadataKey: uri}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicaRegistry returns the registry in the deploy region that release images are replicated to, with an ECR client
+// for it, or "" if there isn't one. A destination in the release account is used if there is one, otherwise one in the
+// deploy account. Replicas in any other account aren't used, since the deploy credentials can't be assumed to be able to
+// pull from them.
+func (h *Handler) replicaRegistry(destinations []*ecr.ReplicationDestination, deployRegion string, responseEnv map[string]string) (string, ecriface.ECRAPI, error) {
+	var otherAccounts []string
+	for _, destination := range destinations {
+		if aws.StringValue(destination.Region) != deployRegion {
+			continue
+		}
+		registryID := aws.StringValue(destination.RegistryId)
+		if registryID == h.Profile.AccountID {
+			session, err := h.createReleaseAccountSessionInRegion(deployRegion)
+			if err != nil {
+				return "", nil, fmt.Errorf("unable to create AWS session in release account: %v", err)
+			}
+			return registryID, h.ECRClientFactory(session), nil
+		}
+		otherAccounts = append(otherAccounts, registryID)
+	}
+	if len(otherAccounts) == 0 {
+		return "", nil, nil
+	}
+	session, err := deployAccountSession(responseEnv)
+	if err != nil {
+		return "", nil, err
+	}
+	identity, err := h.STSClientFactory(session).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to get the deploy account to find the ECR replica: %v", err)
+	}
+	if deployAccount := aws.StringValue(identity.Account); contains(deployAccount, otherAccounts) {
+		return deployAccount, h.ECRClientFactory(session), nil
+	}
+	fmt.Fprintf(
+		h.ErrorStream,
+		"- Warning: images are replicated to %s in %s, but not to the release or deploy account, so the release registry's image is used.\n",
+		deployRegion, strings.Join(otherAccounts, ", "),
+	)
+	return "", nil, nil
+}
+
+// copyRepositorySetups returns the setup of the copies of the component's repositories in the deploy account, by name,
+// with the settings to create them with. The copies have the same policies, lifecycle, encryption and tags as the
+// release repositories, except that a config.params.ecr.kms_key is in the release account and region, so the copies
+// are encrypted with the AWS managed key instead.
+func (h *Handler) copyRepositorySetups(config map[string]interface{}, team, component string, builds []string) (map[string]*ecrRepoSetup, *ECRRepositorySettings, error) {
+	plan, err := h.planECR(config, team, component, builds)
+	if err != nil {
+		return nil, nil, err
+	}
+	repos := make(map[string]*ecrRepoSetup, len(plan.repos)+1)
+	for _, repo := range plan.repos {
+		repos[repo.name] = repo
+	}
+	// Images pushed before switching to a repository per build are in the shared repository.
+	if shared := ECRRepositoryName(team, component, "", false); repos[shared] == nil {
+		policy, err := h.ecrRepoPolicy(config, nil, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		lifecycle, err := ParseECRLifecycleConfig(config, builds)
+		if err != nil {
+			return nil, nil, err
+		}
+		repos[shared] = &ecrRepoSetup{name: shared, builds: builds, policy: policy, lifecycle: lifecycle.Policy(builds)}
+	}
+	settings := *plan.settings
+	settings.KMSKey = ""
+	return repos, &settings, nil
+}
+
+// copyECRImage copies an image to the repository of the same name in the target registry (creating or updating it
+// like the release repository), returning the URI of the copy. Layers already in the target aren't copied again.
+func (h *Handler) copyECRImage(source, target ecriface.ECRAPI, repo *ecrRepoSetup, settings *ECRRepositorySettings, tag string, image *ecr.Image, region string) (string, error) {
+	repoURI, err := h.ensureECRRepo(repo, settings, target)
+	if err != nil {
+		return "", err
+	}
+	if registryID := strings.SplitN(repoURI, ".", 2)[0]; registryID == h.Profile.AccountID && region == h.Profile.Region {
+		return ecrImageURI(registryID, region, repo.name, tag), nil
+	}
+	uri := repoURI + ":" + tag
+	existing, err := target.BatchGetImage(&ecr.BatchGetImageInput{
+		RepositoryName: aws.String(repo.name),
+		ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(tag)}},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(existing.Images) != 0 {
+		return uri, nil
+	}
+	fmt.Fprintf(h.ErrorStream, "- Copying image %s:%s to %s...\n", repo.name, tag, uri)
+	if err := h.copyECRManifest(source, target, repo.name, image, tag); err != nil {
+		return "", err
+	}
+	return uri, nil
+}
+
+// imageManifest is the part of an image manifest or manifest list/index needed to copy it.
+type imageManifest struct {
+	Config *struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// copyECRManifest copies an image's blobs (or for a manifest list, each image in it) and then its manifest. Images in
+// a manifest list are put by digest, and the top level image by tag.
+func (h *Handler) copyECRManifest(source, target ecriface.ECRAPI, repoName string, image *ecr.Image, tag string) error {
+	var manifest imageManifest
+	if err := json.Unmarshal([]byte(aws.StringValue(image.ImageManifest)), &manifest); err != nil {
+		return fmt.Errorf("unable to parse image manifest: %v", err)
+	}
+	for _, child := range manifest.Manifests {
+		output, err := source.BatchGetImage(&ecr.BatchGetImageInput{
+			RegistryId:         aws.String(h.Profile.AccountID),
+			RepositoryName:     aws.String(repoName),
+			ImageIds:           []*ecr.ImageIdentifier{{ImageDigest: aws.String(child.Digest)}},
+			AcceptedMediaTypes: ecrManifestMediaTypes,
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.Images) == 0 {
+			return fmt.Errorf("image %s@%s in the manifest list not found", repoName, child.Digest)
+		}
+		if err := h.copyECRManifest(source, target, repoName, output.Images[0], ""); err != nil {
+			return err
+		}
+	}
+	var digests []string
+	if manifest.Config != nil {
+		digests = append(digests, manifest.Config.Digest)
+	}
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	if err := h.copyECRLayers(source, target, repoName, digests); err != nil {
+		return err
+	}
+	input := &ecr.PutImageInput{
+		RepositoryName:         aws.String(repoName),
+		ImageManifest:          image.ImageManifest,
+		ImageManifestMediaType: image.ImageManifestMediaType,
+	}
+	if tag != "" {
+		input.ImageTag = aws.String(tag)
+	} else {
+		input.ImageDigest = image.ImageId.ImageDigest
+	}
+	if _, err := target.PutImage(input); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeImageAlreadyExistsException {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) copyECRLayers(source, target ecriface.ECRAPI, repoName string, digests []string) error {
+	if len(digests) == 0 {
+		return nil
+	}
+	layerDigests := make([]*string, len(digests))
+	for i, digest := range digests {
+		layerDigests[i] = aws.String(digest)
+	}
+	availability, err := target.BatchCheckLayerAvailability(&ecr.BatchCheckLayerAvailabilityInput{
+		RepositoryName: aws.String(repoName),
+		LayerDigests:   layerDigests,
+	})
+	if err != nil {
+		return err
+	}
+	available := make(map[string]bool)
+	for _, layer := range availability.Layers {
+		if aws.StringValue(layer.LayerAvailability) == ecr.LayerAvailabilityAvailable {
+			available[aws.StringValue(layer.LayerDigest)] = true
+		}
+	}
+	for _, digest := range digests {
+		if available[digest] {
+			continue
+		}
+		if err := h.copyECRLayer(source, target, repoName, digest); err != nil {
+			return fmt.Errorf("unable to copy layer %s: %v", digest, err)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) copyECRLayer(source, target ecriface.ECRAPI, repoName, digest string) error {
+	download, err := source.GetDownloadUrlForLayer(&ecr.GetDownloadUrlForLayerInput{
+		RegistryId:     aws.String(h.Profile.AccountID),
+		RepositoryName: aws.String(repoName),
+		LayerDigest:    aws.String(digest),
+	})
+	if err != nil {
+		return err
+	}
+	httpResponse, err := ecrLayerHTTPClient.Get(aws.StringValue(download.DownloadUrl))
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", httpResponse.Status)
+	}
+	upload, err := target.InitiateLayerUpload(&ecr.InitiateLayerUploadInput{
+		RepositoryName: aws.String(repoName),
+	})
+	if err != nil {
+		return err
+	}
+	partSize := aws.Int64Value(upload.PartSize)
+	if partSize <= 0 {
+		partSize = ecrDefaultLayerPartSize
+	}
+	part := make([]byte, partSize)
+	var position int64
+	for {
+		n, err := io.ReadFull(httpResponse.Body, part)
+		if n > 0 {
+			if _, err := target.UploadLayerPart(&ecr.UploadLayerPartInput{
+				RepositoryName: aws.String(repoName),
+				UploadId:       upload.UploadId,
+				LayerPartBlob:  part[:n],
+				PartFirstByte:  aws.Int64(position),
+				PartLastByte:   aws.Int64(position + int64(n) - 1),
+			}); err != nil {
+				return err
+			}
+			position += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := target.CompleteLayerUpload(&ecr.CompleteLayerUploadInput{
+		RepositoryName: aws.String(repoName),
+		UploadId:       upload.UploadId,
+		LayerDigests:   []*string{aws.String(digest)},
+	}); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeLayerAlreadyExistsException {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
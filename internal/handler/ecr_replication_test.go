@@ -0,0 +1,582 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type MockECRReplicationClient struct {
+	MockECRMultiRepoClient
+	existingRules []*ecr.ReplicationRule
+	putInput      *ecr.PutReplicationConfigurationInput
+	puts          int
+	// overwrites is the number of updates that are lost to a concurrent update of the replication configuration.
+	overwrites int
+}
+
+func (m *MockECRReplicationClient) DescribeRegistry(input *ecr.DescribeRegistryInput) (*ecr.DescribeRegistryOutput, error) {
+	return &ecr.DescribeRegistryOutput{
+		RegistryId:               aws.String(handler.AccountID),
+		ReplicationConfiguration: &ecr.ReplicationConfiguration{Rules: m.existingRules},
+	}, nil
+}
+
+func (m *MockECRReplicationClient) PutReplicationConfiguration(input *ecr.PutReplicationConfigurationInput) (*ecr.PutReplicationConfigurationOutput, error) {
+	m.putInput = input
+	m.puts++
+	if m.overwrites > 0 {
+		m.overwrites--
+	} else {
+		m.existingRules = input.ReplicationConfiguration.Rules
+	}
+	return &ecr.PutReplicationConfigurationOutput{}, nil
+}
+
+func configureReleaseWithReplication(t *testing.T, destinations []interface{}, ecrClient *MockECRReplicationClient) (*common.ConfigureReleaseResponse, string) {
+	request := createConfigureReleaseRequest()
+	request.Config["team"] = "my-team"
+	request.Component = "my-component"
+	request.Config["ecr"] = map[string]interface{}{
+		"replication": map[string]interface{}{"destinations": destinations},
+	}
+	request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+		"my-ecr": {Needs: []string{"ecr"}},
+	}
+	response := common.CreateConfigureReleaseResponse()
+	var errorBuffer bytes.Buffer
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := createECRSettingsHandler(&errorBuffer, ecrClient).
+		WithClock(func() time.Time { return now }, func(d time.Duration) { now = now.Add(d) }).
+		WithOrganizationsClientFactory(func(client.ConfigProvider) organizationsiface.OrganizationsAPI {
+			return &MockOrganizationsClient{Accounts: map[string]string{"fooprod": "111111111111"}}
+		})
+
+	if err := h.ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String()
+}
+
+func TestConfigureReleaseAddsRegistryReplication(t *testing.T) {
+	// Given
+	existing := &ecr.ReplicationRule{
+		Destinations: []*ecr.ReplicationDestination{
+			{Region: aws.String("us-east-1"), RegistryId: aws.String(handler.AccountID)},
+		},
+	}
+	otherTeam := &ecr.ReplicationRule{
+		Destinations: []*ecr.ReplicationDestination{
+			{Region: aws.String("eu-central-1"), RegistryId: aws.String("111111111111")},
+		},
+		RepositoryFilters: []*ecr.RepositoryFilter{
+			{Filter: aws.String("my-team2-"), FilterType: aws.String(ecr.RepositoryFilterTypePrefixMatch)},
+		},
+	}
+	ecrClient := &MockECRReplicationClient{existingRules: []*ecr.ReplicationRule{existing, otherTeam}}
+
+	// When
+	response, output := configureReleaseWithReplication(t, []interface{}{
+		map[string]interface{}{"region": "us-east-1"},
+		map[string]interface{}{"region": "eu-central-1", "registry_id": "111111111111"},
+	}, ecrClient)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if ecrClient.putInput == nil {
+		t.Fatal("expected the replication configuration to be updated")
+	}
+	rules := ecrClient.putInput.ReplicationConfiguration.Rules
+	if len(rules) != 3 || rules[0] != existing || rules[1] != otherTeam {
+		t.Fatalf("expected the existing rules to be kept and one added, got %v", rules)
+	}
+	if len(rules[2].Destinations) != 1 || *rules[2].Destinations[0].Region != "eu-central-1" || *rules[2].Destinations[0].RegistryId != "111111111111" {
+		t.Fatalf("expected only the missing destination to be added, got %v", rules[2].Destinations)
+	}
+	filters := rules[2].RepositoryFilters
+	if len(filters) != 1 || *filters[0].Filter != "my-team-" || *filters[0].FilterType != ecr.RepositoryFilterTypePrefixMatch {
+		t.Fatalf("expected the rule to be filtered to the team's repositories, got %v", filters)
+	}
+	expected := "- Adding ECR registry replication of my-team-* to 111111111111/eu-central-1...\n"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+}
+
+func TestConfigureReleaseExtendsTeamReplicationRule(t *testing.T) {
+	// Given
+	existing := &ecr.ReplicationRule{
+		Destinations: []*ecr.ReplicationDestination{
+			{Region: aws.String("us-east-1"), RegistryId: aws.String(handler.AccountID)},
+		},
+		RepositoryFilters: []*ecr.RepositoryFilter{
+			{Filter: aws.String("my-team-"), FilterType: aws.String(ecr.RepositoryFilterTypePrefixMatch)},
+		},
+	}
+	ecrClient := &MockECRReplicationClient{existingRules: []*ecr.ReplicationRule{existing}}
+
+	// When
+	response, output := configureReleaseWithReplication(t, []interface{}{
+		map[string]interface{}{"region": "us-east-1"},
+		map[string]interface{}{"region": "us-west-2"},
+	}, ecrClient)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	rules := ecrClient.putInput.ReplicationConfiguration.Rules
+	if len(rules) != 1 || len(rules[0].Destinations) != 2 || *rules[0].Destinations[1].Region != "us-west-2" {
+		t.Fatalf("expected the destination to be added to the team's rule, got %v", rules)
+	}
+	if *rules[0].RepositoryFilters[0].Filter != "my-team-" {
+		t.Fatalf("expected the rule's filter to be kept, got %v", rules[0].RepositoryFilters)
+	}
+}
+
+func TestConfigureReleaseRetriesOverwrittenReplication(t *testing.T) {
+	// Given
+	ecrClient := &MockECRReplicationClient{overwrites: 1}
+
+	// When
+	response, output := configureReleaseWithReplication(t, []interface{}{
+		map[string]interface{}{"region": "us-east-1"},
+	}, ecrClient)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if ecrClient.puts != 2 {
+		t.Fatalf("expected the replication configuration to be updated again, got %d updates", ecrClient.puts)
+	}
+	if len(ecrClient.existingRules) != 1 || *ecrClient.existingRules[0].Destinations[0].Region != "us-east-1" {
+		t.Fatalf("expected the destination to be added, got %v", ecrClient.existingRules)
+	}
+	expected := "- ECR registry replication was overwritten by a concurrent update, retrying...\n"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+}
+
+func TestConfigureReleaseFailsWhenReplicationRulesWouldExceedLimit(t *testing.T) {
+	// Given
+	var rules []*ecr.ReplicationRule
+	for i := 0; i < 10; i++ {
+		rules = append(rules, &ecr.ReplicationRule{
+			Destinations: []*ecr.ReplicationDestination{
+				{Region: aws.String("us-east-1"), RegistryId: aws.String(handler.AccountID)},
+			},
+			RepositoryFilters: []*ecr.RepositoryFilter{
+				{Filter: aws.String(fmt.Sprintf("team%d-", i)), FilterType: aws.String(ecr.RepositoryFilterTypePrefixMatch)},
+			},
+		})
+	}
+	ecrClient := &MockECRReplicationClient{existingRules: rules}
+
+	// When
+	response, output := configureReleaseWithReplication(t, []interface{}{
+		map[string]interface{}{"region": "us-east-1"},
+	}, ecrClient)
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := "the release registry would have 11 replication rules, but ECR allows at most 10"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+	if ecrClient.putInput != nil {
+		t.Fatal("unexpected replication configuration update")
+	}
+}
+
+func TestConfigureReleaseRejectsReplicationOutsideOrganisation(t *testing.T) {
+	// Given
+	ecrClient := &MockECRReplicationClient{}
+
+	// When
+	response, output := configureReleaseWithReplication(t, []interface{}{
+		map[string]interface{}{"region": "eu-central-1", "registry_id": "999999999999"},
+	}, ecrClient)
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := "cdflow.yaml error: config.params.ecr.replication.destinations: registry_id 999999999999 is not an account in the organisation"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+	if ecrClient.putInput != nil {
+		t.Fatal("unexpected replication configuration update")
+	}
+}
+
+func TestParseECRReplicationConfigRejectsReleaseRegistry(t *testing.T) {
+	// Given
+	config := map[string]interface{}{
+		"ecr": map[string]interface{}{
+			"replication": map[string]interface{}{
+				"destinations": []interface{}{map[string]interface{}{"region": handler.Region}},
+			},
+		},
+	}
+
+	// When
+	_, err := handler.ParseECRReplicationConfig(config, handler.New().Profile)
+
+	// Then
+	expected := "cdflow.yaml error: config.params.ecr.replication.destinations[0] is the release registry itself"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected %q, got %v", expected, err)
+	}
+}
+
+// MockECRReplicaClient is the release account ECR in the deploy region, where images are replicated to.
+type MockECRReplicaClient struct {
+	ecriface.ECRAPI
+	// pendingCalls is the number of DescribeImages calls before the image is found, or -1 if it never is.
+	pendingCalls int
+	calls        int
+}
+
+func (m *MockECRReplicaClient) DescribeImages(input *ecr.DescribeImagesInput) (*ecr.DescribeImagesOutput, error) {
+	m.calls++
+	if m.pendingCalls < 0 || m.calls <= m.pendingCalls {
+		return nil, awserr.New(ecr.ErrCodeImageNotFoundException, "image not found", nil)
+	}
+	return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{ImageTags: []*string{input.ImageIds[0].ImageTag}}}}, nil
+}
+
+// MockECRCopyTargetClient is the ECR in the deploy account that images are copied to.
+type MockECRCopyTargetClient struct {
+	ecriface.ECRAPI
+	createdRepository string
+	createInput       *ecr.CreateRepositoryInput
+	policy            string
+	lifecyclePolicy   string
+	availableLayers   map[string]bool
+	uploads           map[string]*bytes.Buffer
+	uploadID          string
+	putImages         []*ecr.PutImageInput
+}
+
+func (m *MockECRCopyTargetClient) DescribeRepositories(input *ecr.DescribeRepositoriesInput) (*ecr.DescribeRepositoriesOutput, error) {
+	return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+}
+
+func (m *MockECRCopyTargetClient) CreateRepository(input *ecr.CreateRepositoryInput) (*ecr.CreateRepositoryOutput, error) {
+	m.createdRepository = *input.RepositoryName
+	m.createInput = input
+	return &ecr.CreateRepositoryOutput{
+		Repository: &ecr.Repository{
+			RegistryId:    aws.String("1234567890"),
+			RepositoryUri: aws.String("1234567890.dkr.ecr.us-east-1.amazonaws.com/" + *input.RepositoryName),
+		},
+	}, nil
+}
+
+func (m *MockECRCopyTargetClient) GetRepositoryPolicy(input *ecr.GetRepositoryPolicyInput) (*ecr.GetRepositoryPolicyOutput, error) {
+	return nil, awserr.New(ecr.ErrCodeRepositoryPolicyNotFoundException, "no policy", nil)
+}
+
+func (m *MockECRCopyTargetClient) SetRepositoryPolicy(input *ecr.SetRepositoryPolicyInput) (*ecr.SetRepositoryPolicyOutput, error) {
+	m.policy = *input.PolicyText
+	return &ecr.SetRepositoryPolicyOutput{}, nil
+}
+
+func (m *MockECRCopyTargetClient) GetLifecyclePolicy(input *ecr.GetLifecyclePolicyInput) (*ecr.GetLifecyclePolicyOutput, error) {
+	return nil, awserr.New(ecr.ErrCodeLifecyclePolicyNotFoundException, "no lifecycle policy", nil)
+}
+
+func (m *MockECRCopyTargetClient) PutLifecyclePolicy(input *ecr.PutLifecyclePolicyInput) (*ecr.PutLifecyclePolicyOutput, error) {
+	m.lifecyclePolicy = *input.LifecyclePolicyText
+	return &ecr.PutLifecyclePolicyOutput{}, nil
+}
+
+func (m *MockECRCopyTargetClient) BatchGetImage(input *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+	return &ecr.BatchGetImageOutput{}, nil
+}
+
+func (m *MockECRCopyTargetClient) BatchCheckLayerAvailability(input *ecr.BatchCheckLayerAvailabilityInput) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+	output := &ecr.BatchCheckLayerAvailabilityOutput{}
+	for _, digest := range input.LayerDigests {
+		availability := ecr.LayerAvailabilityUnavailable
+		if m.availableLayers[*digest] {
+			availability = ecr.LayerAvailabilityAvailable
+		}
+		output.Layers = append(output.Layers, &ecr.Layer{LayerDigest: digest, LayerAvailability: aws.String(availability)})
+	}
+	return output, nil
+}
+
+func (m *MockECRCopyTargetClient) InitiateLayerUpload(input *ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+	m.uploadID += "x"
+	m.uploads[m.uploadID] = &bytes.Buffer{}
+	return &ecr.InitiateLayerUploadOutput{UploadId: aws.String(m.uploadID), PartSize: aws.Int64(4)}, nil
+}
+
+func (m *MockECRCopyTargetClient) UploadLayerPart(input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+	upload := m.uploads[*input.UploadId]
+	if int64(upload.Len()) != *input.PartFirstByte || *input.PartLastByte-*input.PartFirstByte+1 != int64(len(input.LayerPartBlob)) {
+		return nil, awserr.New(ecr.ErrCodeInvalidLayerPartException, "unexpected part", nil)
+	}
+	upload.Write(input.LayerPartBlob)
+	return &ecr.UploadLayerPartOutput{}, nil
+}
+
+func (m *MockECRCopyTargetClient) CompleteLayerUpload(input *ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+	digest := *input.LayerDigests[0]
+	m.uploads[digest] = m.uploads[*input.UploadId]
+	delete(m.uploads, *input.UploadId)
+	return &ecr.CompleteLayerUploadOutput{}, nil
+}
+
+func (m *MockECRCopyTargetClient) PutImage(input *ecr.PutImageInput) (*ecr.PutImageOutput, error) {
+	m.putImages = append(m.putImages, input)
+	return &ecr.PutImageOutput{}, nil
+}
+
+// MockECRCopySourceClient is the release account ECR, serving layers from a test HTTP server.
+type MockECRCopySourceClient struct {
+	MockECRScanClient
+	manifest  string
+	serverURL string
+}
+
+func (m *MockECRCopySourceClient) BatchGetImage(input *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+	return &ecr.BatchGetImageOutput{
+		Images: []*ecr.Image{{
+			RepositoryName:         input.RepositoryName,
+			ImageId:                input.ImageIds[0],
+			ImageManifest:          aws.String(m.manifest),
+			ImageManifestMediaType: aws.String("application/vnd.docker.distribution.manifest.v2+json"),
+		}},
+	}, nil
+}
+
+func (m *MockECRCopySourceClient) GetDownloadUrlForLayer(input *ecr.GetDownloadUrlForLayerInput) (*ecr.GetDownloadUrlForLayerOutput, error) {
+	return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(m.serverURL + "/" + *input.LayerDigest)}, nil
+}
+
+func prepareTerraformWithECRClients(t *testing.T, config map[string]interface{}, ecrClients ...ecriface.ECRAPI) (*common.PrepareTerraformResponse, string, map[string]map[string]string) {
+	request := createPrepareTerraformRequest()
+	request.Version = "1"
+	for key, value := range config {
+		request.Config[key] = value
+	}
+	response := common.CreatePrepareTerraformResponse()
+
+	releaseDir, err := ioutil.TempDir("", "ecr-replication-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+	metadataPath := filepath.Join(releaseDir, handler.ReleaseMetadataFile)
+	if err := ioutil.WriteFile(metadataPath, []byte(`{"release": {"ecr_builds": "my-ecr"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var errorBuffer bytes.Buffer
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{getObjectBody: ioutil.NopCloser(&bytes.Buffer{})}, &MockSTSClient{}, nil).
+		WithClock(func() time.Time { return now }, func(d time.Duration) { now = now.Add(d) }).
+		WithECRClientFactory(func(session client.ConfigProvider) ecriface.ECRAPI {
+			ecrClient := ecrClients[0]
+			ecrClients = ecrClients[1:]
+			return ecrClient
+		})
+
+	if err := h.PrepareTerraform(request, response, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+
+	metadataJSON, err := ioutil.ReadFile(metadataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata map[string]map[string]string
+	if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String(), metadata
+}
+
+func TestPrepareTerraformExposesImageURI(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		replication map[string]interface{}
+		ecrClients  []ecriface.ECRAPI
+		expected    string
+	}{
+		{
+			"not replicated",
+			map[string]interface{}{},
+			[]ecriface.ECRAPI{&MockECRScanClient{}},
+			handler.AccountID + ".dkr.ecr." + handler.Region + ".amazonaws.com/test-team-test-component:my-ecr-1",
+		},
+		{
+			"replicated to the deploy region",
+			map[string]interface{}{
+				"destinations": []interface{}{map[string]interface{}{"region": "us-east-1"}},
+			},
+			[]ecriface.ECRAPI{&MockECRScanClient{}, &MockECRReplicaClient{pendingCalls: 2}},
+			handler.AccountID + ".dkr.ecr.us-east-1.amazonaws.com/test-team-test-component:my-ecr-1",
+		},
+		{
+			"replicated to the deploy account",
+			map[string]interface{}{
+				"destinations": []interface{}{map[string]interface{}{"region": "us-east-1", "registry_id": "123456789012"}},
+			},
+			[]ecriface.ECRAPI{&MockECRScanClient{}, &MockECRReplicaClient{}},
+			"123456789012.dkr.ecr.us-east-1.amazonaws.com/test-team-test-component:my-ecr-1",
+		},
+		{
+			"replicated to another account",
+			map[string]interface{}{
+				"destinations": []interface{}{map[string]interface{}{"region": "us-east-1", "registry_id": "111111111111"}},
+			},
+			[]ecriface.ECRAPI{&MockECRScanClient{}},
+			handler.AccountID + ".dkr.ecr." + handler.Region + ".amazonaws.com/test-team-test-component:my-ecr-1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			config := map[string]interface{}{
+				"region": "us-east-1",
+				"ecr":    map[string]interface{}{"replication": tc.replication},
+			}
+
+			// When
+			response, output, metadata := prepareTerraformWithECRClients(t, config, tc.ecrClients...)
+
+			// Then
+			if !response.Success {
+				t.Fatalf("unexpected failure: %s", output)
+			}
+			if metadata["my-ecr"][handler.ECRImageMetadataKey] != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, metadata["my-ecr"][handler.ECRImageMetadataKey])
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformFailsForImageNotReplicated(t *testing.T) {
+	// Given
+	config := map[string]interface{}{
+		"region": "us-east-1",
+		"ecr": map[string]interface{}{
+			"replication": map[string]interface{}{
+				"destinations": []interface{}{map[string]interface{}{"region": "us-east-1"}},
+			},
+		},
+	}
+	replica := &MockECRReplicaClient{pendingCalls: -1}
+
+	// When
+	response, output, _ := prepareTerraformWithECRClients(t, config, &MockECRScanClient{}, replica)
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := "image test-team-test-component:my-ecr-1 has not been replicated to " + handler.AccountID + "/us-east-1 after 5m0s"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+	if replica.calls < 2 {
+		t.Fatalf("expected DescribeImages to be polled, got %d calls", replica.calls)
+	}
+}
+
+func TestPrepareTerraformCopiesImage(t *testing.T) {
+	// Given
+	blobs := map[string]string{
+		"sha256:config": "config-blob",
+		"sha256:layer1": "first layer",
+		"sha256:layer2": "second layer",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, ok := blobs[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(blob))
+	}))
+	defer server.Close()
+
+	source := &MockECRCopySourceClient{
+		manifest:  `{"config": {"digest": "sha256:config"}, "layers": [{"digest": "sha256:layer1"}, {"digest": "sha256:layer2"}]}`,
+		serverURL: server.URL,
+	}
+	target := &MockECRCopyTargetClient{
+		availableLayers: map[string]bool{"sha256:layer1": true},
+		uploads:         make(map[string]*bytes.Buffer),
+	}
+	config := map[string]interface{}{
+		"region": "us-east-1",
+		"ecr": map[string]interface{}{
+			"replication": map[string]interface{}{"copy": true},
+			"encryption":  "KMS",
+			"kms_key":     "alias/release-images",
+		},
+	}
+
+	// When
+	response, output, metadata := prepareTerraformWithECRClients(t, config, source, target)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if target.createdRepository != "test-team-test-component" {
+		t.Fatalf("expected %q, got %q", "test-team-test-component", target.createdRepository)
+	}
+	encryption := target.createInput.EncryptionConfiguration
+	if *encryption.EncryptionType != ecr.EncryptionTypeKms || encryption.KmsKey != nil {
+		t.Fatalf("expected KMS encryption with the AWS managed key, got %v", encryption)
+	}
+	if len(target.createInput.Tags) == 0 {
+		t.Fatal("expected the repository to be tagged like the release repository")
+	}
+	if !strings.Contains(target.policy, "aws:PrincipalOrgID") || target.lifecyclePolicy == "" {
+		t.Fatalf("expected the release repository's policies, got %q and %q", target.policy, target.lifecyclePolicy)
+	}
+	if len(target.uploads) != 2 {
+		t.Fatalf("expected only the missing blobs to be uploaded, got %v", target.uploads)
+	}
+	for _, digest := range []string{"sha256:config", "sha256:layer2"} {
+		if target.uploads[digest] == nil || target.uploads[digest].String() != blobs[digest] {
+			t.Fatalf("expected %q uploaded for %s, got %v", blobs[digest], digest, target.uploads[digest])
+		}
+	}
+	if len(target.putImages) != 1 || *target.putImages[0].ImageTag != "my-ecr-1" || *target.putImages[0].ImageManifest != source.manifest {
+		t.Fatalf("expected the manifest to be put with the release tag, got %v", target.putImages)
+	}
+	expected := "1234567890.dkr.ecr.us-east-1.amazonaws.com/test-team-test-component:my-ecr-1"
+	if metadata["my-ecr"][handler.ECRImageMetadataKey] != expected {
+		t.Fatalf("expected %q, got %q", expected, metadata["my-ecr"][handler.ECRImageMetadataKey])
+	}
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// ECRRepositoryPerBuild returns config.params.ecr.repository_per_build - whether each build that needs "ecr" gets its
+// own repository, rather than sharing one per component.
+func ECRRepositoryPerBuild(config map[string]interface{}) (bool, error) {
+	ecrMap, err := ecrParams(config)
+	if err != nil {
+		return false, err
+	}
+	value, ok := ecrMap["repository_per_build"]
+	if !ok {
+		return false, nil
+	}
+	perBuild, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("cdflow.yaml error: config.params.ecr.repository_per_build must be true or false")
+	}
+	return perBuild, nil
+}
+
+// ECRRepositoryName returns the repository for a build - <team>-<component>-<buildID> with a repository per build,
+// otherwise the shared <team>-<component> repository.
+func ECRRepositoryName(team, component, buildID string, perBuild bool) string {
+	if perBuild {
+		return team + "-" + component + "-" + buildID
+	}
+	return team + "-" + component
+}
+
+// ecrImageRepositories returns the repositories to look for a build's image in, in order. With a repository per build
+// the shared repository is checked too, so that images pushed before switching can still be found.
+func ecrImageRepositories(team, component, buildID string, perBuild bool) []string {
+	if perBuild {
+		return []string{ECRRepositoryName(team, component, buildID, true), ECRRepositoryName(team, component, "", false)}
+	}
+	return []string{ECRRepositoryName(team, component, "", false)}
+}
+
+// ecrBuildIDs returns the sorted IDs of the builds that need "ecr".
+func ecrBuildIDs(releaseRequirements map[string]*common.ReleaseRequirements) []string {
+	return buildIDsWithNeed(releaseRequirements, "ecr")
+}
+
+// buildIDsWithNeed returns the sorted IDs of the builds that advertise a need.
+func buildIDsWithNeed(releaseRequirements map[string]*common.ReleaseRequirements, need string) []string {
+	var result []string
+	for buildID, reqs := range releaseRequirements {
+		if reqs != nil && contains(need, reqs.Needs) {
+			result = append(result, buildID)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ecrRepoSetup is a repository to set up and the builds that push to it.
+type ecrRepoSetup struct {
+	name      string
+	builds    []string
+	policy    string
+	lifecycle *ECRLifecyclePolicy
+}
+
+// ensureECRRepo creates or updates a repository, returning its URI.
+func (h *Handler) ensureECRRepo(repo *ecrRepoSetup, settings *ECRRepositorySettings, ecrClient ecriface.ECRAPI) (string, error) {
+	fmt.Fprintf(h.ErrorStream, "- Checking ECR repository %q...\n", repo.name)
+
+	repoURI, err := h.getECRRepo(repo.name, settings, ecrClient)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(h.ErrorStream, "- Checking ECR repository policy...\n")
+
+	if err := h.ensureRepoPolicy(repo.name, repo.policy, ecrClient); err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(h.ErrorStream, "- Checking ECR lifecycle policy...\n")
+
+	if err := h.ensureECRRepoLifecycle(repo.name, repo.lifecycle, ecrClient); err != nil {
+		return "", err
+	}
+	return repoURI, nil
+}
@@ -0,0 +1,211 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// MockECRMultiRepoClient records the repositories created and the policies set, by repository name.
+type MockECRMultiRepoClient struct {
+	ecriface.ECRAPI
+	created           []string
+	repositoryPolicy  map[string]string
+	lifecyclePolicies map[string]string
+}
+
+func (m *MockECRMultiRepoClient) DescribeRepositories(input *ecr.DescribeRepositoriesInput) (*ecr.DescribeRepositoriesOutput, error) {
+	return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+}
+
+func (m *MockECRMultiRepoClient) CreateRepository(input *ecr.CreateRepositoryInput) (*ecr.CreateRepositoryOutput, error) {
+	m.created = append(m.created, *input.RepositoryName)
+	return &ecr.CreateRepositoryOutput{
+		Repository: &ecr.Repository{RepositoryUri: aws.String("repo:" + *input.RepositoryName)},
+	}, nil
+}
+
+func (m *MockECRMultiRepoClient) GetRepositoryPolicy(input *ecr.GetRepositoryPolicyInput) (*ecr.GetRepositoryPolicyOutput, error) {
+	return nil, awserr.New(ecr.ErrCodeRepositoryPolicyNotFoundException, "", nil)
+}
+
+func (m *MockECRMultiRepoClient) SetRepositoryPolicy(input *ecr.SetRepositoryPolicyInput) (*ecr.SetRepositoryPolicyOutput, error) {
+	if m.repositoryPolicy == nil {
+		m.repositoryPolicy = make(map[string]string)
+	}
+	m.repositoryPolicy[*input.RepositoryName] = *input.PolicyText
+	return &ecr.SetRepositoryPolicyOutput{}, nil
+}
+
+func (m *MockECRMultiRepoClient) GetLifecyclePolicy(input *ecr.GetLifecyclePolicyInput) (*ecr.GetLifecyclePolicyOutput, error) {
+	return nil, awserr.New(ecr.ErrCodeLifecyclePolicyNotFoundException, "", nil)
+}
+
+func (m *MockECRMultiRepoClient) PutLifecyclePolicy(input *ecr.PutLifecyclePolicyInput) (*ecr.PutLifecyclePolicyOutput, error) {
+	if m.lifecyclePolicies == nil {
+		m.lifecyclePolicies = make(map[string]string)
+	}
+	m.lifecyclePolicies[*input.RepositoryName] = *input.LifecyclePolicyText
+	return &ecr.PutLifecyclePolicyOutput{}, nil
+}
+
+func (m *MockECRMultiRepoClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	return mockECRAuthorizationToken(), nil
+}
+
+func configureReleasePerBuild(t *testing.T, ecrConfig map[string]interface{}) (*MockECRMultiRepoClient, *common.ConfigureReleaseResponse, string) {
+	request := createConfigureReleaseRequest()
+	request.Component = "my-component"
+	request.Config["team"] = "my-team"
+	request.Config["ecr"] = ecrConfig
+	request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+		"api":    {Needs: []string{"ecr"}},
+		"worker": {Needs: []string{"ecr"}},
+	}
+	request.Version = "1"
+	response := common.CreateConfigureReleaseResponse()
+
+	var errorBuffer bytes.Buffer
+	ecrClient := &MockECRMultiRepoClient{}
+	if err := createECRSettingsHandler(&errorBuffer, ecrClient).ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+	return ecrClient, response, errorBuffer.String()
+}
+
+func TestConfigureReleaseRepositoryPerBuild(t *testing.T) {
+	// Given
+	ecrConfig := map[string]interface{}{
+		"repository_per_build": true,
+		"lifecycle": map[string]interface{}{
+			"builds": map[string]interface{}{"worker": map[string]interface{}{"keep": float64(5)}},
+		},
+		"repository_policy": map[string]interface{}{
+			"codebuild_pull": true,
+			"builds": map[string]interface{}{
+				"api": map[string]interface{}{"pull_accounts": []interface{}{"111111111111"}},
+			},
+		},
+	}
+
+	// When
+	ecrClient, response, output := configureReleasePerBuild(t, ecrConfig)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if strings.Join(ecrClient.created, ",") != "my-team-my-component-api,my-team-my-component-worker" {
+		t.Fatalf("unexpected repositories created: %q", ecrClient.created)
+	}
+	for _, buildID := range []string{"api", "worker"} {
+		expected := "repo:my-team-my-component-" + buildID
+		if response.Env[buildID]["ECR_REPOSITORY"] != expected {
+			t.Fatalf("expected %q, got %q", expected, response.Env[buildID]["ECR_REPOSITORY"])
+		}
+		if response.Env[buildID]["ECR_TAG"] != buildID+"-1" {
+			t.Fatalf("expected %q, got %q", buildID+"-1", response.Env[buildID]["ECR_TAG"])
+		}
+	}
+
+	expectedLifecycle := map[string]string{
+		"api":    `"tagPrefixList":["api-"],"countType":"imageCountMoreThan","countNumber":50`,
+		"worker": `"tagPrefixList":["worker-"],"countType":"imageCountMoreThan","countNumber":5`,
+	}
+	for buildID, expected := range expectedLifecycle {
+		policy := ecrClient.lifecyclePolicies["my-team-my-component-"+buildID]
+		if !strings.Contains(policy, expected) || strings.Count(policy, "rulePriority") != 1 {
+			t.Fatalf("expected a single rule containing %s, got %s", expected, policy)
+		}
+	}
+
+	expectedSids := map[string]string{
+		"api":    ",CodeBuildPull,PullAccountsBuild",
+		"worker": ",CodeBuildPull",
+	}
+	for buildID, expected := range expectedSids {
+		var policy struct{ Statement []struct{ Sid string } }
+		if err := json.Unmarshal([]byte(ecrClient.repositoryPolicy["my-team-my-component-"+buildID]), &policy); err != nil {
+			t.Fatal(err)
+		}
+		var sids []string
+		for _, statement := range policy.Statement {
+			sids = append(sids, statement.Sid)
+		}
+		if strings.Join(sids, ",") != expected {
+			t.Fatalf("expected %q, got %q", expected, strings.Join(sids, ","))
+		}
+	}
+}
+
+func TestConfigureReleaseBuildPolicyNeedsRepositoryPerBuild(t *testing.T) {
+	// Given
+	ecrConfig := map[string]interface{}{
+		"repository_policy": map[string]interface{}{
+			"builds": map[string]interface{}{
+				"api": map[string]interface{}{"pull_accounts": []interface{}{"111111111111"}},
+			},
+		},
+	}
+
+	// When
+	ecrClient, response, output := configureReleasePerBuild(t, ecrConfig)
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := "config.params.ecr.repository_policy.builds.api can only be set when config.params.ecr.repository_per_build is true"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+	if len(ecrClient.created) != 0 {
+		t.Fatal("unexpected repository created")
+	}
+}
+
+func TestPrepareTerraformScanGateFindsImageInSharedRepository(t *testing.T) {
+	// Given
+	ecrClient := &MockECRScanClient{
+		missingRepos: map[string]bool{"test-team-test-component-my-ecr": true},
+	}
+	ecrConfig := map[string]interface{}{
+		"repository_per_build": true,
+		"scan_gate":            map[string]interface{}{"tiers": []interface{}{"prod"}},
+	}
+
+	// When
+	response, output, _ := prepareTerraformWithECRConfig(t, "live", ecrConfig, ecrClient)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure:\n%s", output)
+	}
+	if len(ecrClient.inputs) != 1 || *ecrClient.inputs[0].RepositoryName != "test-team-test-component" {
+		t.Fatalf("expected the shared repository to be checked, got %v", ecrClient.inputs)
+	}
+	expected := "- Checking image scan findings for test-team-test-component-my-ecr:my-ecr-1...\n" +
+		"  image not found\n" +
+		"- Checking image scan findings for test-team-test-component:my-ecr-1...\n" +
+		"  no findings\n"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in:\n%s", expected, output)
+	}
+}
+
+func TestECRRepositoryName(t *testing.T) {
+	if name := handler.ECRRepositoryName("team", "component", "api", false); name != "team-component" {
+		t.Fatalf("expected %q, got %q", "team-component", name)
+	}
+	if name := handler.ECRRepositoryName("team", "component", "api", true); name != "team-component-api" {
+		t.Fatalf("expected %q, got %q", "team-component-api", name)
+	}
+}
@@ -0,0 +1,369 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ecrPullActions are the actions needed to pull an image.
+var ecrPullActions = []interface{}{
+	"ecr:BatchCheckLayerAvailability",
+	"ecr:BatchGetImage",
+	"ecr:GetDownloadUrlForLayer",
+}
+
+// lambdaPullActions are the actions Lambda needs to create functions from container images.
+var lambdaPullActions = []interface{}{
+	"ecr:BatchGetImage",
+	"ecr:GetDownloadUrlForLayer",
+}
+
+// principalScopingConditionKeys are the condition keys accepted as limiting who a wildcard or service principal
+// applies to.
+var principalScopingConditionKeys = []string{
+	"aws:principalorgid",
+	"aws:principalorgpaths",
+	"aws:principalaccount",
+	"aws:sourceaccount",
+	"aws:sourcearn",
+	"aws:sourceorgid",
+	"aws:sourceorgpaths",
+}
+
+// principalScopingConditionOperators are the condition operators accepted as limiting who a principal applies to -
+// others (e.g. StringNotEquals, Null or the IfExists variants) can match requests without the key's value.
+var principalScopingConditionOperators = []string{
+	"stringequals",
+	"stringlike",
+	"foranyvalue:stringequals",
+	"foranyvalue:stringlike",
+	"arnequals",
+	"arnlike",
+}
+
+var (
+	accountIDPattern    = regexp.MustCompile(`^\d{12}$`)
+	statementSidPattern = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+)
+
+// accountIDs reads a list of AWS account IDs.
+func accountIDs(value interface{}, param string) ([]string, error) {
+	ids, err := stringSlice(value, param)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if !accountIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("cdflow.yaml error: %s: %q is not a valid AWS account ID", param, id)
+		}
+	}
+	return ids, nil
+}
+
+func accountPrincipals(ids []string) []interface{} {
+	principals := make([]interface{}, len(ids))
+	for i, id := range ids {
+		principals[i] = fmt.Sprintf("arn:aws:iam::%s:root", id)
+	}
+	return principals
+}
+
+// validateECRPolicyStatement checks a statement from config.params.ecr.repository_policy.statements. It doesn't try to
+// be a full IAM policy validator (AWS will reject anything else that's wrong), but catches common mistakes early and
+// stops statements being used for anything other than ECR actions. Allow statements can only grant the pull actions,
+// and a wildcard or service principal must be limited by a condition (e.g. aws:PrincipalOrgID or aws:SourceAccount), so
+// that config can't make a repository writable or readable by everyone (or by the service for any account).
+func validateECRPolicyStatement(value interface{}, param string) (map[string]interface{}, error) {
+	statement, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map", param)
+	}
+	for key := range statement {
+		if !contains(key, []string{"Sid", "Effect", "Principal", "Action", "Condition"}) {
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s (expected Sid, Effect, Principal, Action or Condition)", param, key)
+		}
+	}
+	if sid, ok := statement["Sid"]; ok {
+		sidString, ok := sid.(string)
+		if !ok || !statementSidPattern.MatchString(sidString) {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.Sid must be alphanumeric", param)
+		}
+	}
+	if effect := statement["Effect"]; effect != "Allow" && effect != "Deny" {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.Effect must be \"Allow\" or \"Deny\"", param)
+	}
+	wildcardPrincipal, servicePrincipal := false, false
+	switch principal := statement["Principal"].(type) {
+	case string:
+		if principal != "*" {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.Principal must be \"*\" or a map (e.g. {AWS: [...]})", param)
+		}
+		wildcardPrincipal = true
+	case map[string]interface{}:
+		if len(principal) == 0 {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.Principal cannot be empty", param)
+		}
+		wildcardPrincipal = hasWildcardPrincipal(principal)
+		_, servicePrincipal = principal["Service"]
+	default:
+		return nil, fmt.Errorf("cdflow.yaml error: %s.Principal must be set", param)
+	}
+	actions := statement["Action"]
+	if action, ok := actions.(string); ok {
+		actions = []interface{}{action}
+	}
+	actionList, err := stringSlice(actions, param+".Action")
+	if err != nil || len(actionList) == 0 {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.Action must be an action or a non-empty list of actions", param)
+	}
+	for _, action := range actionList {
+		if !strings.HasPrefix(action, "ecr:") {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.Action: %q is not an ECR action", param, action)
+		}
+		if statement["Effect"] == "Allow" && !containsInterface(action, ecrPullActions) {
+			return nil, fmt.Errorf(
+				"cdflow.yaml error: %s.Action: %q cannot be allowed, only the pull actions (%s) can",
+				param, action, strings.Join(interfaceStrings(ecrPullActions), ", "),
+			)
+		}
+	}
+	var conditions map[string]interface{}
+	if condition, ok := statement["Condition"]; ok {
+		if conditions, ok = condition.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.Condition must be a map", param)
+		}
+	}
+	if statement["Effect"] == "Allow" && !hasPrincipalScopingCondition(conditions) {
+		if wildcardPrincipal {
+			return nil, fmt.Errorf(
+				"cdflow.yaml error: %s allows a wildcard Principal, so must have a Condition limiting it (e.g. StringEquals on aws:PrincipalOrgID)",
+				param,
+			)
+		}
+		if servicePrincipal {
+			return nil, fmt.Errorf(
+				"cdflow.yaml error: %s allows a service Principal, so must have a Condition limiting it (e.g. StringEquals on aws:SourceAccount)",
+				param,
+			)
+		}
+	}
+	return statement, nil
+}
+
+// hasWildcardPrincipal returns whether a principal map allows any AWS principal, i.e. {AWS: "*"} or {AWS: [..., "*"]}.
+func hasWildcardPrincipal(principal map[string]interface{}) bool {
+	switch value := principal["AWS"].(type) {
+	case string:
+		return value == "*"
+	case []interface{}:
+		return containsInterface("*", value)
+	}
+	return false
+}
+
+// hasPrincipalScopingCondition returns whether the conditions of a statement limit who it applies to, with one of
+// principalScopingConditionOperators on one of principalScopingConditionKeys (both are case insensitive).
+func hasPrincipalScopingCondition(conditions map[string]interface{}) bool {
+	for operator, value := range conditions {
+		if !contains(strings.ToLower(operator), principalScopingConditionOperators) {
+			continue
+		}
+		keys, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key := range keys {
+			if contains(strings.ToLower(key), principalScopingConditionKeys) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsInterface(needle string, haystack []interface{}) bool {
+	for _, item := range haystack {
+		if item == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func interfaceStrings(values []interface{}) []string {
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i] = fmt.Sprint(value)
+	}
+	return result
+}
+
+// ecrPolicyStatements returns the statements to add to the base organisation statement from a
+// config.params.ecr.repository_policy map (or a map for a build within it), ignoring the builds key. sidSuffix is
+// added to the Sids of the generated statements, so that they don't clash between levels. organizationID limits
+// codebuild_pull to CodeBuild projects in the organisation.
+func ecrPolicyStatements(repositoryPolicy map[string]interface{}, param, sidSuffix, organizationID string) ([]interface{}, error) {
+	var statements []interface{}
+	for key := range repositoryPolicy {
+		if !contains(key, []string{"pull_accounts", "lambda_pull_accounts", "codebuild_pull", "statements", "builds"}) {
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+		}
+	}
+	if value, ok := repositoryPolicy["pull_accounts"]; ok {
+		ids, err := accountIDs(value, param+".pull_accounts")
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, map[string]interface{}{
+			"Sid":       "PullAccounts" + sidSuffix,
+			"Effect":    "Allow",
+			"Principal": map[string]interface{}{"AWS": accountPrincipals(ids)},
+			"Action":    ecrPullActions,
+		})
+	}
+	if value, ok := repositoryPolicy["lambda_pull_accounts"]; ok {
+		ids, err := accountIDs(value, param+".lambda_pull_accounts")
+		if err != nil {
+			return nil, err
+		}
+		// Lambda needs both the service to be allowed (restricted to functions in the accounts) and, for accounts
+		// outside the organisation, the accounts themselves
+		sourceARNs := make([]interface{}, len(ids))
+		for i, id := range ids {
+			sourceARNs[i] = fmt.Sprintf("arn:aws:lambda:*:%s:function:*", id)
+		}
+		statements = append(statements, map[string]interface{}{
+			"Sid":       "LambdaPull" + sidSuffix,
+			"Effect":    "Allow",
+			"Principal": map[string]interface{}{"Service": "lambda.amazonaws.com"},
+			"Action":    lambdaPullActions,
+			"Condition": map[string]interface{}{
+				"StringLike": map[string]interface{}{"aws:sourceArn": sourceARNs},
+			},
+		}, map[string]interface{}{
+			"Sid":       "LambdaPullAccounts" + sidSuffix,
+			"Effect":    "Allow",
+			"Principal": map[string]interface{}{"AWS": accountPrincipals(ids)},
+			"Action":    lambdaPullActions,
+		})
+	}
+	if value, ok := repositoryPolicy["codebuild_pull"]; ok {
+		// the service principal would otherwise let CodeBuild projects in any account pull (the confused deputy problem)
+		var condition map[string]interface{}
+		if enabled, ok := value.(bool); ok {
+			if enabled {
+				condition = map[string]interface{}{"aws:SourceOrgID": organizationID}
+			}
+		} else {
+			ids, err := accountIDs(value, param+".codebuild_pull")
+			if err != nil {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.codebuild_pull must be true, false or a list of AWS account IDs", param)
+			}
+			condition = map[string]interface{}{"aws:SourceAccount": ids}
+		}
+		if condition != nil {
+			statements = append(statements, map[string]interface{}{
+				"Sid":       "CodeBuildPull" + sidSuffix,
+				"Effect":    "Allow",
+				"Principal": map[string]interface{}{"Service": "codebuild.amazonaws.com"},
+				"Action":    ecrPullActions,
+				"Condition": map[string]interface{}{"StringEquals": condition},
+			})
+		}
+	}
+	if value, ok := repositoryPolicy["statements"]; ok {
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.statements must be a list of policy statements", param)
+		}
+		for i, item := range list {
+			statement, err := validateECRPolicyStatement(item, fmt.Sprintf("%s.statements[%d]", param, i))
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, statement)
+		}
+	}
+	return statements, nil
+}
+
+// ecrRepoPolicy returns the policy for a repository - the organisation pull statement, plus any statements from
+// config.params.ecr.repository_policy. When there is a repository per build, buildID is the repository's build and
+// the statements from config.params.ecr.repository_policy.builds.<buildID> are added too. ecrBuilds is nil for a
+// repository that isn't for builds (i.e. a chart repository), which only gets the statements for every repository.
+func (h *Handler) ecrRepoPolicy(config map[string]interface{}, ecrBuilds []string, buildID string) (string, error) {
+	const param = "config.params.ecr.repository_policy"
+	ecrMap, err := ecrParams(config)
+	if err != nil {
+		return "", err
+	}
+	value, ok := ecrMap["repository_policy"]
+	if !ok {
+		return fmt.Sprintf(ecrRepoPolicyTemplate, h.Profile.OrganizationID), nil
+	}
+	repositoryPolicy, ok := value.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("cdflow.yaml error: %s must be a map", param)
+	}
+	statements, err := ecrPolicyStatements(repositoryPolicy, param, "", h.Profile.OrganizationID)
+	if err != nil {
+		return "", err
+	}
+	if value, ok := repositoryPolicy["builds"]; ok && ecrBuilds != nil {
+		builds, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("cdflow.yaml error: %s.builds must be a map of build IDs to policy settings", param)
+		}
+		for id, value := range builds {
+			buildParam := param + ".builds." + id
+			if !contains(id, ecrBuilds) {
+				return "", fmt.Errorf("cdflow.yaml error: %s does not match a build that needs \"ecr\"", buildParam)
+			}
+			if buildID == "" {
+				return "", fmt.Errorf("cdflow.yaml error: %s can only be set when config.params.ecr.repository_per_build is true", buildParam)
+			}
+			buildPolicy, ok := value.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("cdflow.yaml error: %s must be a map", buildParam)
+			}
+			if _, ok := buildPolicy["builds"]; ok {
+				return "", fmt.Errorf("cdflow.yaml error: unknown key %s.builds", buildParam)
+			}
+			buildStatements, err := ecrPolicyStatements(buildPolicy, buildParam, "Build", h.Profile.OrganizationID)
+			if err != nil {
+				return "", err
+			}
+			if id == buildID {
+				statements = append(statements, buildStatements...)
+			}
+		}
+	}
+	return h.ecrPolicyDocument(statements, param)
+}
+
+// ecrPolicyDocument returns the organisation pull statement with statements added, after checking their Sids are
+// unique.
+func (h *Handler) ecrPolicyDocument(statements []interface{}, param string) (string, error) {
+	basePolicy := fmt.Sprintf(ecrRepoPolicyTemplate, h.Profile.OrganizationID)
+	sids := make(map[string]bool)
+	for _, statement := range statements {
+		if sid, ok := statement.(map[string]interface{})["Sid"].(string); ok {
+			if sids[sid] {
+				return "", fmt.Errorf("cdflow.yaml error: %s has more than one statement with Sid %q", param, sid)
+			}
+			sids[sid] = true
+		}
+	}
+	var policy map[string]interface{}
+	if err := json.Unmarshal([]byte(basePolicy), &policy); err != nil {
+		return "", err
+	}
+	policy["Statement"] = append(policy["Statement"].([]interface{}), statements...)
+	serialised, err := json.MarshalIndent(policy, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(serialised), nil
+}
@@ -0,0 +1,253 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func configureReleaseWithRepositoryPolicy(t *testing.T, repositoryPolicy interface{}) (*MockECRClient, *common.ConfigureReleaseResponse, string) {
+	request := createConfigureReleaseRequest()
+	request.Component = "my-component"
+	request.Config["team"] = "my-team"
+	request.Config["ecr"] = map[string]interface{}{"repository_policy": repositoryPolicy}
+	request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+		"my-ecr": {Needs: []string{"ecr"}},
+	}
+	response := common.CreateConfigureReleaseResponse()
+
+	var errorBuffer bytes.Buffer
+	ecrClient := &MockECRClient{DefaultMutability: "IMMUTABLE", DefaultScanOnPush: true}
+	h := handler.New().
+		WithErrorStream(&errorBuffer).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		}).
+		WithECRClientFactory(func(session client.ConfigProvider) ecriface.ECRAPI {
+			return ecrClient
+		})
+
+	if err := h.ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+	return ecrClient, response, errorBuffer.String()
+}
+
+func TestConfigureReleaseRepositoryPolicy(t *testing.T) {
+	// Given
+	repositoryPolicy := map[string]interface{}{
+		"pull_accounts":        []interface{}{"111111111111"},
+		"lambda_pull_accounts": []interface{}{"222222222222"},
+		"codebuild_pull":       true,
+		"statements": []interface{}{
+			map[string]interface{}{
+				"Sid":       "DenyDelete",
+				"Effect":    "Deny",
+				"Principal": "*",
+				"Action":    "ecr:BatchDeleteImage",
+			},
+			map[string]interface{}{
+				"Sid":       "OrgPathPull",
+				"Effect":    "Allow",
+				"Principal": "*",
+				"Action":    "ecr:BatchGetImage",
+				"Condition": map[string]interface{}{
+					"ForAnyValue:StringLike": map[string]interface{}{"aws:PrincipalOrgPaths": "o-qisv7rs9ed/r-abcd/ou-abcd-*"},
+				},
+			},
+		},
+	}
+
+	// When
+	ecrClient, response, output := configureReleaseWithRepositoryPolicy(t, repositoryPolicy)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if ecrClient.SetRepositoryPolicyInput == nil {
+		t.Fatal("expected repository policy to be set")
+	}
+	var policy struct {
+		Statement []struct {
+			Sid       string
+			Effect    string
+			Principal interface{}
+			Action    interface{}
+			Condition map[string]map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal([]byte(*ecrClient.SetRepositoryPolicyInput.PolicyText), &policy); err != nil {
+		t.Fatal(err)
+	}
+	var sids []string
+	for _, statement := range policy.Statement {
+		sids = append(sids, statement.Sid)
+	}
+	if strings.Join(sids, ",") != ",PullAccounts,LambdaPull,LambdaPullAccounts,CodeBuildPull,DenyDelete,OrgPathPull" {
+		t.Fatalf("unexpected statements: %q", sids)
+	}
+	if !strings.Contains(*ecrClient.SetRepositoryPolicyInput.PolicyText, `"aws:PrincipalOrgID": "o-qisv7rs9ed"`) {
+		t.Fatalf("expected org statement in %s", *ecrClient.SetRepositoryPolicyInput.PolicyText)
+	}
+	sourceARNs, _ := policy.Statement[2].Condition["StringLike"]["aws:sourceArn"].([]interface{})
+	if len(sourceARNs) != 1 || sourceARNs[0] != "arn:aws:lambda:*:222222222222:function:*" {
+		t.Fatalf("unexpected lambda source ARN condition %q", sourceARNs)
+	}
+	if principal, ok := policy.Statement[1].Principal.(map[string]interface{}); !ok || principal["AWS"].([]interface{})[0] != "arn:aws:iam::111111111111:root" {
+		t.Fatalf("unexpected pull accounts principal %v", policy.Statement[1].Principal)
+	}
+	if orgID := policy.Statement[4].Condition["StringEquals"]["aws:SourceOrgID"]; orgID != "o-qisv7rs9ed" {
+		t.Fatalf("expected CodeBuild to be limited to the organisation, got %v", policy.Statement[4].Condition)
+	}
+}
+
+func TestConfigureReleaseRepositoryPolicyCodeBuildAccounts(t *testing.T) {
+	// When
+	ecrClient, response, output := configureReleaseWithRepositoryPolicy(t, map[string]interface{}{
+		"codebuild_pull": []interface{}{"111111111111"},
+	})
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	var policy struct {
+		Statement []struct {
+			Sid       string
+			Condition map[string]map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal([]byte(*ecrClient.SetRepositoryPolicyInput.PolicyText), &policy); err != nil {
+		t.Fatal(err)
+	}
+	accounts, _ := policy.Statement[1].Condition["StringEquals"]["aws:SourceAccount"].([]interface{})
+	if policy.Statement[1].Sid != "CodeBuildPull" || len(accounts) != 1 || accounts[0] != "111111111111" {
+		t.Fatalf("expected CodeBuild to be limited to the account, got %+v", policy.Statement[1])
+	}
+}
+
+func TestConfigureReleaseRepositoryPolicyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		repositoryPolicy interface{}
+		expectedError    string
+	}{
+		{
+			"bad account",
+			map[string]interface{}{"pull_accounts": []interface{}{"1234"}},
+			`config.params.ecr.repository_policy.pull_accounts: "1234" is not a valid AWS account ID`,
+		},
+		{
+			"unknown key",
+			map[string]interface{}{"pull_acounts": []interface{}{"111111111111"}},
+			"unknown key config.params.ecr.repository_policy.pull_acounts",
+		},
+		{
+			"non-ECR action",
+			map[string]interface{}{"statements": []interface{}{map[string]interface{}{
+				"Effect": "Allow", "Principal": "*", "Action": []interface{}{"s3:GetObject"},
+			}}},
+			`config.params.ecr.repository_policy.statements[0].Action: "s3:GetObject" is not an ECR action`,
+		},
+		{
+			"missing principal",
+			map[string]interface{}{"statements": []interface{}{map[string]interface{}{
+				"Effect": "Allow", "Action": "ecr:BatchGetImage",
+			}}},
+			"config.params.ecr.repository_policy.statements[0].Principal must be set",
+		},
+		{
+			"bad effect",
+			map[string]interface{}{"statements": []interface{}{map[string]interface{}{
+				"Effect": "allow", "Principal": "*", "Action": "ecr:BatchGetImage",
+			}}},
+			`config.params.ecr.repository_policy.statements[0].Effect must be "Allow" or "Deny"`,
+		},
+		{
+			"write action allowed",
+			map[string]interface{}{"statements": []interface{}{map[string]interface{}{
+				"Effect": "Allow", "Action": []interface{}{"ecr:BatchGetImage", "ecr:PutImage"},
+				"Principal": map[string]interface{}{"AWS": "arn:aws:iam::111111111111:root"},
+			}}},
+			`config.params.ecr.repository_policy.statements[0].Action: "ecr:PutImage" cannot be allowed`,
+		},
+		{
+			"unconditional wildcard principal",
+			map[string]interface{}{"statements": []interface{}{map[string]interface{}{
+				"Effect": "Allow", "Principal": map[string]interface{}{"AWS": []interface{}{"*"}}, "Action": "ecr:BatchGetImage",
+			}}},
+			"config.params.ecr.repository_policy.statements[0] allows a wildcard Principal, so must have a Condition",
+		},
+		{
+			"wildcard principal with an unrelated condition",
+			map[string]interface{}{"statements": []interface{}{map[string]interface{}{
+				"Effect": "Allow", "Principal": "*", "Action": "ecr:BatchGetImage",
+				"Condition": map[string]interface{}{"Bool": map[string]interface{}{"aws:SecureTransport": "true"}},
+			}}},
+			"config.params.ecr.repository_policy.statements[0] allows a wildcard Principal, so must have a Condition",
+		},
+		{
+			"wildcard principal with a negated condition",
+			map[string]interface{}{"statements": []interface{}{map[string]interface{}{
+				"Effect": "Allow", "Principal": "*", "Action": "ecr:BatchGetImage",
+				"Condition": map[string]interface{}{"StringNotEquals": map[string]interface{}{"aws:PrincipalOrgID": "o-other"}},
+			}}},
+			"config.params.ecr.repository_policy.statements[0] allows a wildcard Principal, so must have a Condition",
+		},
+		{
+			"wildcard principal with a null condition",
+			map[string]interface{}{"statements": []interface{}{map[string]interface{}{
+				"Effect": "Allow", "Principal": "*", "Action": "ecr:BatchGetImage",
+				"Condition": map[string]interface{}{"Null": map[string]interface{}{"aws:PrincipalOrgID": "false"}},
+			}}},
+			"config.params.ecr.repository_policy.statements[0] allows a wildcard Principal, so must have a Condition",
+		},
+		{
+			"unconditional service principal",
+			map[string]interface{}{"statements": []interface{}{map[string]interface{}{
+				"Effect": "Allow", "Principal": map[string]interface{}{"Service": "codebuild.amazonaws.com"}, "Action": "ecr:BatchGetImage",
+			}}},
+			"config.params.ecr.repository_policy.statements[0] allows a service Principal, so must have a Condition",
+		},
+		{
+			"bad codebuild account",
+			map[string]interface{}{"codebuild_pull": []interface{}{"1234"}},
+			"config.params.ecr.repository_policy.codebuild_pull must be true, false or a list of AWS account IDs",
+		},
+		{
+			"duplicate sid",
+			map[string]interface{}{
+				"codebuild_pull": true,
+				"statements": []interface{}{map[string]interface{}{
+					"Sid": "CodeBuildPull", "Effect": "Allow", "Action": "ecr:BatchGetImage",
+					"Principal": map[string]interface{}{"AWS": "arn:aws:iam::111111111111:root"},
+				}},
+			},
+			`config.params.ecr.repository_policy has more than one statement with Sid "CodeBuildPull"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			ecrClient, response, output := configureReleaseWithRepositoryPolicy(t, tc.repositoryPolicy)
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			if !strings.Contains(output, tc.expectedError) {
+				t.Fatalf("expected error containing %q, got %q", tc.expectedError, output)
+			}
+			if ecrClient.SetRepositoryPolicyInput != nil {
+				t.Fatal("unexpected repository policy update")
+			}
+		})
+	}
+}
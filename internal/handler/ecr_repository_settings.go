@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+)
+
+// Tag keys for resources created by the config container.
+const (
+	ResourceTagTeam       = "team"
+	ResourceTagComponent  = "component"
+	ResourceTagCostCentre = "cost-centre"
+	ResourceTagCreatedBy  = "created-by"
+)
+
+// ResourceCreatedBy is the value of the created-by tag.
+const ResourceCreatedBy = "cdflow2-config-acuris"
+
+// AWS limits for resource tags.
+const (
+	maxResourceTagKeyLength   = 128
+	maxResourceTagValueLength = 256
+)
+
+// ECRRepositorySettings are the settings for an ECR repository from config.params.ecr.encryption, kms_key and tags.
+type ECRRepositorySettings struct {
+	// EncryptionType is ecr.EncryptionTypeAes256 or ecr.EncryptionTypeKms.
+	EncryptionType string
+	// KMSKey is the key for KMS encryption, or empty for the AWS managed key.
+	KMSKey string
+	Tags   map[string]string
+}
+
+// ParseECRRepositorySettings reads the repository settings from config.
+func ParseECRRepositorySettings(config map[string]interface{}, team, component string) (*ECRRepositorySettings, error) {
+	settings := &ECRRepositorySettings{
+		EncryptionType: ecr.EncryptionTypeAes256,
+		Tags: map[string]string{
+			ResourceTagTeam:      team,
+			ResourceTagComponent: component,
+			ResourceTagCreatedBy: ResourceCreatedBy,
+		},
+	}
+	if value, ok := config["cost_centre"]; ok {
+		costCentre, ok := value.(string)
+		if !ok || costCentre == "" {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.cost_centre must be a non-empty string")
+		}
+		settings.Tags[ResourceTagCostCentre] = costCentre
+	}
+	ecrMap, err := ecrParams(config)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := ecrMap["encryption"]; ok {
+		encryptionType, ok := value.(string)
+		if !ok || (encryptionType != ecr.EncryptionTypeAes256 && encryptionType != ecr.EncryptionTypeKms) {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.ecr.encryption must be %q or %q", ecr.EncryptionTypeAes256, ecr.EncryptionTypeKms)
+		}
+		settings.EncryptionType = encryptionType
+	}
+	if value, ok := ecrMap["kms_key"]; ok {
+		kmsKey, ok := value.(string)
+		if !ok || kmsKey == "" {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.ecr.kms_key must be a non-empty string")
+		}
+		if settings.EncryptionType != ecr.EncryptionTypeKms {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.ecr.kms_key can only be set when config.params.ecr.encryption is %q", ecr.EncryptionTypeKms)
+		}
+		settings.KMSKey = kmsKey
+	}
+	if value, ok := ecrMap["tags"]; ok {
+		tags, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.ecr.tags must be a map of tag names to values")
+		}
+		for key, value := range tags {
+			param := "config.params.ecr.tags." + key
+			if _, ok := settings.Tags[key]; ok || key == ResourceTagCostCentre {
+				return nil, fmt.Errorf("cdflow.yaml error: %s is set by the config container and cannot be overridden", param)
+			}
+			if len(key) > maxResourceTagKeyLength || strings.HasPrefix(key, "aws:") {
+				return nil, fmt.Errorf("cdflow.yaml error: %s is not a valid tag name", param)
+			}
+			tagValue, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("cdflow.yaml error: %s must be a string", param)
+			}
+			if len(tagValue) > maxResourceTagValueLength {
+				return nil, fmt.Errorf("cdflow.yaml error: %s must be at most %d characters", param, maxResourceTagValueLength)
+			}
+			settings.Tags[key] = tagValue
+		}
+	}
+	return settings, nil
+}
+
+// encryptionConfiguration returns the encryption configuration for creating a repository.
+func (s *ECRRepositorySettings) encryptionConfiguration() *ecr.EncryptionConfiguration {
+	result := &ecr.EncryptionConfiguration{EncryptionType: aws.String(s.EncryptionType)}
+	if s.KMSKey != "" {
+		result.KmsKey = aws.String(s.KMSKey)
+	}
+	return result
+}
+
+// ecrTags returns the tags in the form the ECR API takes, sorted by key.
+func (s *ECRRepositorySettings) ecrTags() []*ecr.Tag {
+	keys := make([]string, 0, len(s.Tags))
+	for key := range s.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tags := make([]*ecr.Tag, len(keys))
+	for i, key := range keys {
+		tags[i] = &ecr.Tag{Key: aws.String(key), Value: aws.String(s.Tags[key])}
+	}
+	return tags
+}
+
+// encryptionDrift describes how an existing repository's encryption differs from the settings, or returns "" if it
+// doesn't. Keys given as an alias or ID can't be compared with the key ARN ECR reports, so only the type is checked.
+func (s *ECRRepositorySettings) encryptionDrift(existing *ecr.EncryptionConfiguration) string {
+	existingType, existingKey := ecr.EncryptionTypeAes256, ""
+	if existing != nil {
+		existingType, existingKey = aws.StringValue(existing.EncryptionType), aws.StringValue(existing.KmsKey)
+	}
+	if existingType != s.EncryptionType {
+		return fmt.Sprintf("encryption is %s, but config.params.ecr.encryption is %s", existingType, s.EncryptionType)
+	}
+	if strings.HasPrefix(s.KMSKey, "arn:") && !strings.Contains(s.KMSKey, ":alias/") && existingKey != s.KMSKey {
+		return fmt.Sprintf("KMS key is %s, but config.params.ecr.kms_key is %s", existingKey, s.KMSKey)
+	}
+	return ""
+}
+
+// reconcileECRRepoSettings brings an existing repository's tags into line with the settings and reports any drift in
+// settings that can't be changed in place. Tags not managed by the config container are left alone.
+func (h *Handler) reconcileECRRepoSettings(repository *ecr.Repository, settings *ECRRepositorySettings, ecrClient ecriface.ECRAPI) error {
+	repoName := aws.StringValue(repository.RepositoryName)
+	if drift := settings.encryptionDrift(repository.EncryptionConfiguration); drift != "" {
+		fmt.Fprintf(
+			h.ErrorStream,
+			"- Warning: ECR repository %q %s. Encryption can't be changed for an existing repository - "+
+				"it must be deleted and recreated to change it.\n",
+			repoName, drift,
+		)
+	}
+	output, err := ecrClient.ListTagsForResource(&ecr.ListTagsForResourceInput{
+		ResourceArn: repository.RepositoryArn,
+	})
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]string, len(output.Tags))
+	for _, tag := range output.Tags {
+		existing[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	var changed []*ecr.Tag
+	var descriptions []string
+	for _, tag := range settings.ecrTags() {
+		if value, ok := existing[*tag.Key]; ok && value == *tag.Value {
+			continue
+		}
+		changed = append(changed, tag)
+		descriptions = append(descriptions, fmt.Sprintf("%s=%s", *tag.Key, *tag.Value))
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	fmt.Fprintf(h.ErrorStream, "- Updating repository tags: %s\n", strings.Join(descriptions, ", "))
+	_, err = ecrClient.TagResource(&ecr.TagResourceInput{
+		ResourceArn: repository.RepositoryArn,
+		Tags:        changed,
+	})
+	return err
+}
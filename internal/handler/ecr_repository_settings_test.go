@@ -0,0 +1,231 @@
+package handler_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func createECRSettingsConfigureReleaseRequest() *common.ConfigureReleaseRequest {
+	request := createConfigureReleaseRequest()
+	request.Component = "my-component"
+	request.Config["team"] = "my-team"
+	request.Config["cost_centre"] = "cc-123"
+	request.Config["ecr"] = map[string]interface{}{
+		"encryption": "KMS",
+		"kms_key":    "arn:aws:kms:eu-west-1:724178030834:key/new-key",
+		"tags":       map[string]interface{}{"owner": "someone"},
+	}
+	request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+		"my-ecr": {Needs: []string{"ecr"}},
+	}
+	return request
+}
+
+func createECRSettingsHandler(errorBuffer *bytes.Buffer, ecrClient ecriface.ECRAPI) *handler.Handler {
+	return handler.New().
+		WithErrorStream(errorBuffer).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		}).
+		WithECRClientFactory(func(session client.ConfigProvider) ecriface.ECRAPI {
+			return ecrClient
+		})
+}
+
+func TestParseECRRepositorySettings(t *testing.T) {
+	// When
+	settings, err := handler.ParseECRRepositorySettings(map[string]interface{}{}, "my-team", "my-component")
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.EncryptionType != ecr.EncryptionTypeAes256 {
+		t.Fatalf("expected %q, got %q", ecr.EncryptionTypeAes256, settings.EncryptionType)
+	}
+	expectedTags := map[string]string{
+		"team":       "my-team",
+		"component":  "my-component",
+		"created-by": "cdflow2-config-acuris",
+	}
+	if !reflect.DeepEqual(settings.Tags, expectedTags) {
+		t.Fatalf("expected %v, got %v", expectedTags, settings.Tags)
+	}
+}
+
+func TestParseECRRepositorySettingsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		config        map[string]interface{}
+		expectedError string
+	}{
+		{
+			"bad encryption",
+			map[string]interface{}{"ecr": map[string]interface{}{"encryption": "aes"}},
+			`config.params.ecr.encryption must be "AES256" or "KMS"`,
+		},
+		{
+			"key without KMS",
+			map[string]interface{}{"ecr": map[string]interface{}{"kms_key": "alias/my-key"}},
+			`config.params.ecr.kms_key can only be set when config.params.ecr.encryption is "KMS"`,
+		},
+		{
+			"reserved tag",
+			map[string]interface{}{"ecr": map[string]interface{}{"tags": map[string]interface{}{"team": "other"}}},
+			"config.params.ecr.tags.team is set by the config container and cannot be overridden",
+		},
+		{
+			"non-string tag",
+			map[string]interface{}{"ecr": map[string]interface{}{"tags": map[string]interface{}{"owner": float64(1)}}},
+			"config.params.ecr.tags.owner must be a string",
+		},
+		{
+			"empty cost centre",
+			map[string]interface{}{"cost_centre": ""},
+			"config.params.cost_centre must be a non-empty string",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			_, err := handler.ParseECRRepositorySettings(tc.config, "my-team", "my-component")
+
+			// Then
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Fatalf("expected error containing %q, got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestConfigureReleaseCreatesECRRepositoryWithSettings(t *testing.T) {
+	// Given
+	request := createECRSettingsConfigureReleaseRequest()
+	response := common.CreateConfigureReleaseResponse()
+	var errorBuffer bytes.Buffer
+	ecrClient := &MockECRClientNoRepo{}
+
+	// When
+	if err := createECRSettingsHandler(&errorBuffer, ecrClient).ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	encryption := ecrClient.CreateRepositoryInput.EncryptionConfiguration
+	if *encryption.EncryptionType != "KMS" || *encryption.KmsKey != "arn:aws:kms:eu-west-1:724178030834:key/new-key" {
+		t.Fatalf("unexpected encryption configuration %v", encryption)
+	}
+	var tags []string
+	for _, tag := range ecrClient.CreateRepositoryInput.Tags {
+		tags = append(tags, *tag.Key+"="+*tag.Value)
+	}
+	expected := "component=my-component,cost-centre=cc-123,created-by=cdflow2-config-acuris,owner=someone,team=my-team"
+	if strings.Join(tags, ",") != expected {
+		t.Fatalf("expected %q, got %q", expected, strings.Join(tags, ","))
+	}
+}
+
+func TestConfigureReleaseReconcilesECRRepositorySettings(t *testing.T) {
+	// Given
+	request := createECRSettingsConfigureReleaseRequest()
+	response := common.CreateConfigureReleaseResponse()
+	var errorBuffer bytes.Buffer
+	ecrClient := &MockECRClient{
+		DefaultMutability: "IMMUTABLE",
+		DefaultScanOnPush: true,
+		ExistingEncryption: &ecr.EncryptionConfiguration{
+			EncryptionType: aws.String("KMS"),
+			KmsKey:         aws.String("arn:aws:kms:eu-west-1:724178030834:key/old-key"),
+		},
+		ExistingTags: []*ecr.Tag{
+			{Key: aws.String("team"), Value: aws.String("my-team")},
+			{Key: aws.String("component"), Value: aws.String("my-component")},
+			{Key: aws.String("created-by"), Value: aws.String("cdflow2-config-acuris")},
+			{Key: aws.String("cost-centre"), Value: aws.String("cc-old")},
+			{Key: aws.String("unmanaged"), Value: aws.String("left-alone")},
+		},
+	}
+
+	// When
+	if err := createECRSettingsHandler(&errorBuffer, ecrClient).ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	if ecrClient.TagResourceInput == nil {
+		t.Fatal("expected tags to be updated")
+	}
+	expectedARN := "arn:aws:ecr:eu-west-1:" + handler.AccountID + ":repository/my-team-my-component"
+	if *ecrClient.TagResourceInput.ResourceArn != expectedARN {
+		t.Fatalf("expected %q, got %q", expectedARN, *ecrClient.TagResourceInput.ResourceArn)
+	}
+	var tags []string
+	for _, tag := range ecrClient.TagResourceInput.Tags {
+		tags = append(tags, *tag.Key+"="+*tag.Value)
+	}
+	if strings.Join(tags, ",") != "cost-centre=cc-123,owner=someone" {
+		t.Fatalf("expected %q, got %q", "cost-centre=cc-123,owner=someone", strings.Join(tags, ","))
+	}
+	output := errorBuffer.String()
+	for _, expected := range []string{
+		"- Updating repository tags: cost-centre=cc-123, owner=someone\n",
+		`- Warning: ECR repository "my-team-my-component" KMS key is arn:aws:kms:eu-west-1:724178030834:key/old-key, ` +
+			"but config.params.ecr.kms_key is arn:aws:kms:eu-west-1:724178030834:key/new-key.",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, output)
+		}
+	}
+}
+
+func TestConfigureReleaseECRRepositorySettingsUnchanged(t *testing.T) {
+	// Given
+	request := createConfigureReleaseRequest()
+	request.Component = "my-component"
+	request.Config["team"] = "my-team"
+	request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+		"my-ecr": {Needs: []string{"ecr"}},
+	}
+	response := common.CreateConfigureReleaseResponse()
+	var errorBuffer bytes.Buffer
+	ecrClient := &MockECRClient{
+		DefaultMutability: "IMMUTABLE",
+		DefaultScanOnPush: true,
+		ExistingTags: []*ecr.Tag{
+			{Key: aws.String("team"), Value: aws.String("my-team")},
+			{Key: aws.String("component"), Value: aws.String("my-component")},
+			{Key: aws.String("created-by"), Value: aws.String("cdflow2-config-acuris")},
+		},
+	}
+
+	// When
+	if err := createECRSettingsHandler(&errorBuffer, ecrClient).ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	if ecrClient.TagResourceInput != nil {
+		t.Fatal("unexpected tag update")
+	}
+	if strings.Contains(errorBuffer.String(), "Warning") {
+		t.Fatalf("unexpected warning in:\n%s", errorBuffer.String())
+	}
+}
@@ -0,0 +1,381 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+)
+
+// ECRBuildsMetadataKey is the key in the release map of the release metadata listing the builds that needed "ecr",
+// comma separated.
+const ECRBuildsMetadataKey = "ecr_builds"
+
+// Defaults for config.params.ecr.scan_gate.
+const (
+	DefaultECRScanSeverity = ecr.FindingSeverityHigh
+	DefaultECRScanTimeout  = 5 * time.Minute
+)
+
+const ecrScanPollInterval = 10 * time.Second
+
+// ecrSeverityUntriaged is the severity enhanced scanning gives findings that haven't been assessed yet. They could be of
+// any severity, so they block at any threshold unless config.params.ecr.scan_gate.block_untriaged is false.
+const ecrSeverityUntriaged = "UNTRIAGED"
+
+// ecrSeverities are the finding severities from least to most severe (UNTRIAGED only for display, see blocks).
+var ecrSeverities = []string{
+	ecr.FindingSeverityUndefined,
+	ecrSeverityUntriaged,
+	ecr.FindingSeverityInformational,
+	ecr.FindingSeverityLow,
+	ecr.FindingSeverityMedium,
+	ecr.FindingSeverityHigh,
+	ecr.FindingSeverityCritical,
+}
+
+func severityRank(severity string) int {
+	for i, candidate := range ecrSeverities {
+		if candidate == severity {
+			return i
+		}
+	}
+	return 0
+}
+
+// ECRScanSuppression allows deploying with a finding until the end of the day (UTC) it expires.
+type ECRScanSuppression struct {
+	ID      string
+	Expires time.Time
+	Reason  string
+}
+
+// ECRScanGateConfig is config.params.ecr.scan_gate.
+type ECRScanGateConfig struct {
+	Tiers        []string
+	Severity     string
+	Timeout      time.Duration
+	Suppressions map[string]*ECRScanSuppression
+	// BlockUntriaged is whether findings that haven't been assessed yet block, whatever Severity is.
+	BlockUntriaged bool
+}
+
+// blocks returns whether findings of a severity block deploying.
+func (g *ECRScanGateConfig) blocks(severity string) bool {
+	if severity == ecrSeverityUntriaged {
+		return g.BlockUntriaged
+	}
+	return severityRank(severity) >= severityRank(g.Severity)
+}
+
+func parseECRScanSuppression(index int, value interface{}) (*ECRScanSuppression, error) {
+	param := fmt.Sprintf("config.params.ecr.scan_gate.suppressions[%d]", index)
+	entry, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map with id and expires", param)
+	}
+	suppression := &ECRScanSuppression{}
+	for key, value := range entry {
+		valueString, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.%s must be a string", param, key)
+		}
+		switch key {
+		case "id":
+			suppression.ID = valueString
+		case "expires":
+			expires, err := time.Parse("2006-01-02", valueString)
+			if err != nil {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.expires must be a date (YYYY-MM-DD)", param)
+			}
+			suppression.Expires = expires
+		case "reason":
+			suppression.Reason = valueString
+		default:
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+		}
+	}
+	if suppression.ID == "" {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.id must be set", param)
+	}
+	if suppression.Expires.IsZero() {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.expires must be set - suppressions cannot be permanent", param)
+	}
+	return suppression, nil
+}
+
+// ParseECRScanGateConfig reads config.params.ecr.scan_gate, returning nil if it isn't set.
+func ParseECRScanGateConfig(config map[string]interface{}) (*ECRScanGateConfig, error) {
+	ecrMap, err := ecrParams(config)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := ecrMap["scan_gate"]
+	if !ok {
+		return nil, nil
+	}
+	const param = "config.params.ecr.scan_gate"
+	gateMap, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map", param)
+	}
+	gate := &ECRScanGateConfig{
+		Severity:       DefaultECRScanSeverity,
+		Timeout:        DefaultECRScanTimeout,
+		Suppressions:   make(map[string]*ECRScanSuppression),
+		BlockUntriaged: true,
+	}
+	for key, value := range gateMap {
+		switch key {
+		case "tiers":
+			if gate.Tiers, err = stringSlice(value, param+".tiers"); err != nil {
+				return nil, err
+			}
+		case "severity":
+			severity, ok := value.(string)
+			if !ok || severityRank(severity) < severityRank(ecr.FindingSeverityLow) {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.severity must be one of LOW, MEDIUM, HIGH or CRITICAL", param)
+			}
+			gate.Severity = severity
+		case "block_untriaged":
+			blockUntriaged, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.block_untriaged must be true or false", param)
+			}
+			gate.BlockUntriaged = blockUntriaged
+		case "timeout_seconds":
+			seconds, err := positiveIntParam(value, param+".timeout_seconds")
+			if err != nil {
+				return nil, err
+			}
+			gate.Timeout = time.Duration(seconds) * time.Second
+		case "suppressions":
+			entries, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.suppressions must be a list", param)
+			}
+			for i, entry := range entries {
+				suppression, err := parseECRScanSuppression(i, entry)
+				if err != nil {
+					return nil, err
+				}
+				gate.Suppressions[suppression.ID] = suppression
+			}
+		default:
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+		}
+	}
+	if len(gate.Tiers) == 0 {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.tiers must list the tiers to check image scans for", param)
+	}
+	return gate, nil
+}
+
+type ecrImageNotFoundError struct {
+	repoName string
+	tag      string
+}
+
+func (e *ecrImageNotFoundError) Error() string {
+	return fmt.Sprintf("image %s:%s not found", e.repoName, e.tag)
+}
+
+// ecrScanFinding is a finding from either basic or enhanced scanning.
+type ecrScanFinding struct {
+	Name     string
+	Severity string
+}
+
+// ecrScanFindings returns the findings from a page of scan results. Basic scanning returns Findings, named by CVE,
+// while enhanced scanning (Amazon Inspector) returns EnhancedFindings, which are named by their vulnerability ID where
+// there is one so that suppressions work the same way for both. Enhanced findings that Inspector has closed or
+// suppressed are left out.
+func ecrScanFindings(findings *ecr.ImageScanFindings) []*ecrScanFinding {
+	if findings == nil {
+		return nil
+	}
+	var result []*ecrScanFinding
+	for _, finding := range findings.Findings {
+		result = append(result, &ecrScanFinding{
+			Name:     aws.StringValue(finding.Name),
+			Severity: aws.StringValue(finding.Severity),
+		})
+	}
+	for _, finding := range findings.EnhancedFindings {
+		if status := aws.StringValue(finding.Status); status != "" && status != "ACTIVE" {
+			continue
+		}
+		name := aws.StringValue(finding.Title)
+		if details := finding.PackageVulnerabilityDetails; details != nil && aws.StringValue(details.VulnerabilityId) != "" {
+			name = aws.StringValue(details.VulnerabilityId)
+		}
+		result = append(result, &ecrScanFinding{
+			Name:     name,
+			Severity: aws.StringValue(finding.Severity),
+		})
+	}
+	return result
+}
+
+// waitForImageScan waits up to timeout for the scan of an image to complete (or, with enhanced scanning, to become
+// active), then returns all its findings.
+func (h *Handler) waitForImageScan(repoName, tag string, timeout time.Duration, ecrClient ecriface.ECRAPI) ([]*ecrScanFinding, error) {
+	input := &ecr.DescribeImageScanFindingsInput{
+		RegistryId:     aws.String(h.Profile.AccountID),
+		RepositoryName: aws.String(repoName),
+		ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String(tag)},
+	}
+	deadline := h.Now().Add(timeout)
+	waiting := false
+	for {
+		output, err := ecrClient.DescribeImageScanFindings(input)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case ecr.ErrCodeImageNotFoundException, ecr.ErrCodeRepositoryNotFoundException:
+					return nil, &ecrImageNotFoundError{repoName, tag}
+				case ecr.ErrCodeScanNotFoundException:
+					return nil, fmt.Errorf("image %s:%s has not been scanned", repoName, tag)
+				}
+			}
+			return nil, err
+		}
+		switch status := aws.StringValue(output.ImageScanStatus.Status); status {
+		case ecr.ScanStatusComplete, ecr.ScanStatusActive:
+			var findings []*ecrScanFinding
+			for {
+				findings = append(findings, ecrScanFindings(output.ImageScanFindings)...)
+				if output.NextToken == nil {
+					return findings, nil
+				}
+				input.NextToken = output.NextToken
+				if output, err = ecrClient.DescribeImageScanFindings(input); err != nil {
+					return nil, err
+				}
+			}
+		case ecr.ScanStatusFailed, ecr.ScanStatusUnsupportedImage, ecr.ScanStatusFindingsUnavailable, ecr.ScanStatusScanEligibilityExpired:
+			return nil, fmt.Errorf(
+				"image scan of %s:%s did not produce findings (%s): %s",
+				repoName, tag, status, aws.StringValue(output.ImageScanStatus.Description),
+			)
+		}
+		if !h.Now().Before(deadline) {
+			return nil, fmt.Errorf("timed out after %v waiting for the image scan of %s:%s", timeout, repoName, tag)
+		}
+		if !waiting {
+			fmt.Fprintf(h.ErrorStream, "- Waiting for the image scan of %s:%s to complete...\n", repoName, tag)
+			waiting = true
+		}
+		h.Sleep(ecrScanPollInterval)
+	}
+}
+
+// waitForBuildImageScan waits for the scan of a build's image, trying each repository it could be in.
+func (h *Handler) waitForBuildImageScan(repoNames []string, tag string, timeout time.Duration, ecrClient ecriface.ECRAPI) ([]*ecrScanFinding, error) {
+	var err error
+	for _, repoName := range repoNames {
+		fmt.Fprintf(h.ErrorStream, "- Checking image scan findings for %s:%s...\n", repoName, tag)
+		var findings []*ecrScanFinding
+		findings, err = h.waitForImageScan(repoName, tag, timeout, ecrClient)
+		if _, ok := err.(*ecrImageNotFoundError); ok {
+			fmt.Fprintf(h.ErrorStream, "  image not found\n")
+			continue
+		}
+		return findings, err
+	}
+	return nil, err
+}
+
+// checkImageScans fails if the images for the release's ECR builds have scan findings at or above the configured
+// severity, when deploying to a tier listed in config.params.ecr.scan_gate.tiers. Findings are summarised to the
+// error stream. A release that doesn't record its ECR builds (e.g. one made before the gate existed) fails the check,
+// since its images can't be found to check.
+func (h *Handler) checkImageScans(config map[string]interface{}, tier, team, component, version, releaseDir string, ecrClient ecriface.ECRAPI) error {
+	gate, err := ParseECRScanGateConfig(config)
+	if err != nil || gate == nil || !contains(tier, gate.Tiers) {
+		return err
+	}
+	metadata, err := readReleaseMetadata(releaseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var builds []string
+	if buildsString := metadata["release"][ECRBuildsMetadataKey]; buildsString != "" {
+		builds = strings.Split(buildsString, ",")
+	}
+	if len(builds) == 0 {
+		return fmt.Errorf(
+			"release %s does not record its ECR builds (%s in %s), so its image scans can't be checked before deploying "+
+				"to the %q tier - release a new version, or remove the tier from config.params.ecr.scan_gate.tiers",
+			version, ECRBuildsMetadataKey, ReleaseMetadataFile, tier,
+		)
+	}
+	perBuild, err := ECRRepositoryPerBuild(config)
+	if err != nil {
+		return err
+	}
+	now := h.Now()
+	var blocking []string
+	for _, buildID := range builds {
+		findings, err := h.waitForBuildImageScan(
+			ecrImageRepositories(team, component, buildID, perBuild), buildID+"-"+version, gate.Timeout, ecrClient,
+		)
+		if err != nil {
+			return err
+		}
+		counts := make(map[string]int)
+		for _, finding := range findings {
+			counts[finding.Severity]++
+		}
+		var summary []string
+		for i := len(ecrSeverities) - 1; i >= 0; i-- {
+			if count := counts[ecrSeverities[i]]; count > 0 {
+				summary = append(summary, fmt.Sprintf("%s %d", ecrSeverities[i], count))
+			}
+		}
+		if len(summary) == 0 {
+			fmt.Fprintf(h.ErrorStream, "  no findings\n")
+			continue
+		}
+		fmt.Fprintf(h.ErrorStream, "  %s\n", strings.Join(summary, ", "))
+		sort.SliceStable(findings, func(i, j int) bool {
+			return severityRank(findings[i].Severity) > severityRank(findings[j].Severity)
+		})
+		for _, finding := range findings {
+			name, severity := finding.Name, finding.Severity
+			if !gate.blocks(severity) {
+				continue
+			}
+			status := "blocking"
+			if suppression, ok := gate.Suppressions[name]; ok {
+				expires := suppression.Expires.Format("2006-01-02")
+				if now.Before(suppression.Expires.AddDate(0, 0, 1)) {
+					status = "suppressed until " + expires
+					if suppression.Reason != "" {
+						status += " (" + suppression.Reason + ")"
+					}
+				} else {
+					status = "blocking, suppression expired " + expires
+				}
+			}
+			fmt.Fprintf(h.ErrorStream, "  %s %s: %s\n", severity, name, status)
+			if strings.HasPrefix(status, "blocking") && !contains(name, blocking) {
+				blocking = append(blocking, name)
+			}
+		}
+	}
+	if len(blocking) > 0 {
+		return fmt.Errorf(
+			"image scan findings at or above %s severity block deploying to the %q tier: %s\n\n"+
+				"Fix the findings and release a new version, or suppress them until a date with config.params.ecr.scan_gate.suppressions.",
+			gate.Severity, tier, strings.Join(blocking, ", "),
+		)
+	}
+	return nil
+}
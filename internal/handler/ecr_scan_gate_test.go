@@ -0,0 +1,371 @@
+package handler_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type MockECRScanClient struct {
+	ecriface.ECRAPI
+	inProgressCalls int
+	findings        []*ecr.ImageScanFinding
+	inputs          []*ecr.DescribeImageScanFindingsInput
+	missingRepos    map[string]bool
+	// enhancedFindings are returned on the first page, with an ACTIVE (enhanced scanning) status
+	enhancedFindings []*ecr.EnhancedImageScanFinding
+}
+
+func (m *MockECRScanClient) DescribeImageScanFindings(input *ecr.DescribeImageScanFindingsInput) (*ecr.DescribeImageScanFindingsOutput, error) {
+	if m.missingRepos[*input.RepositoryName] {
+		return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+	}
+	m.inputs = append(m.inputs, input)
+	if len(m.inputs) <= m.inProgressCalls {
+		return &ecr.DescribeImageScanFindingsOutput{
+			ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusInProgress)},
+		}, nil
+	}
+	// one finding per page, to check pagination
+	page := 0
+	if input.NextToken != nil {
+		page = len(*input.NextToken)
+	}
+	output := &ecr.DescribeImageScanFindingsOutput{
+		ImageScanStatus:   &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusComplete)},
+		ImageScanFindings: &ecr.ImageScanFindings{},
+	}
+	if page < len(m.findings) {
+		output.ImageScanFindings.Findings = m.findings[page : page+1]
+	}
+	if page+1 < len(m.findings) {
+		output.NextToken = aws.String(strings.Repeat("x", page+1))
+	}
+	if m.enhancedFindings != nil {
+		output.ImageScanStatus.Status = aws.String(ecr.ScanStatusActive)
+		if page == 0 {
+			output.ImageScanFindings.EnhancedFindings = m.enhancedFindings
+		}
+	}
+	return output, nil
+}
+
+func (m *MockECRScanClient) BatchGetImage(input *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+	if m.missingRepos[*input.RepositoryName] {
+		return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+	}
+	return &ecr.BatchGetImageOutput{
+		Images: []*ecr.Image{{RepositoryName: input.RepositoryName, ImageId: input.ImageIds[0]}},
+	}, nil
+}
+
+func scanFinding(name, severity string) *ecr.ImageScanFinding {
+	return &ecr.ImageScanFinding{Name: aws.String(name), Severity: aws.String(severity)}
+}
+
+func prepareTerraformWithScanGate(t *testing.T, envName string, scanGate map[string]interface{}, ecrClient *MockECRScanClient) (*common.PrepareTerraformResponse, string, int) {
+	return prepareTerraformWithECRConfig(t, envName, map[string]interface{}{"scan_gate": scanGate}, ecrClient)
+}
+
+func prepareTerraformWithECRConfig(t *testing.T, envName string, ecrConfig map[string]interface{}, ecrClient *MockECRScanClient) (*common.PrepareTerraformResponse, string, int) {
+	return prepareTerraformWithECRMetadata(t, envName, ecrConfig, `{"release": {"ecr_builds": "my-ecr"}}`, ecrClient)
+}
+
+func prepareTerraformWithECRMetadata(t *testing.T, envName string, ecrConfig map[string]interface{}, metadata string, ecrClient *MockECRScanClient) (*common.PrepareTerraformResponse, string, int) {
+	request := createPrepareTerraformRequest()
+	request.EnvName = envName
+	request.Version = "1"
+	request.Config["ecr"] = ecrConfig
+	response := common.CreatePrepareTerraformResponse()
+
+	releaseDir, err := ioutil.TempDir("", "scan-gate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+	if err := ioutil.WriteFile(filepath.Join(releaseDir, handler.ReleaseMetadataFile), []byte(metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	sleeps := 0
+	var errorBuffer bytes.Buffer
+	h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{getObjectBody: ioutil.NopCloser(&bytes.Buffer{})}, &MockSTSClient{}, nil).
+		WithECRClientFactory(func(session client.ConfigProvider) ecriface.ECRAPI {
+			return ecrClient
+		}).
+		WithClock(func() time.Time { return now }, func(duration time.Duration) {
+			sleeps++
+			now = now.Add(duration)
+		})
+
+	if err := h.PrepareTerraform(request, response, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String(), sleeps
+}
+
+func TestPrepareTerraformScanGateBlocks(t *testing.T) {
+	// Given
+	ecrClient := &MockECRScanClient{
+		findings: []*ecr.ImageScanFinding{
+			scanFinding("CVE-2026-0001", ecr.FindingSeverityMedium),
+			scanFinding("CVE-2026-0002", ecr.FindingSeverityHigh),
+			scanFinding("CVE-2026-0003", ecr.FindingSeverityCritical),
+			scanFinding("CVE-2026-0004", ecr.FindingSeverityHigh),
+		},
+	}
+	scanGate := map[string]interface{}{
+		"tiers": []interface{}{"prod"},
+		"suppressions": []interface{}{
+			map[string]interface{}{"id": "CVE-2026-0002", "expires": "2026-06-01", "reason": "not exploitable"},
+			map[string]interface{}{"id": "CVE-2026-0004", "expires": "2026-05-31"},
+		},
+	}
+
+	// When
+	response, output, _ := prepareTerraformWithScanGate(t, "live", scanGate, ecrClient)
+
+	// Then
+	if response.Success {
+		t.Fatalf("expected failure, got:\n%s", output)
+	}
+	input := ecrClient.inputs[0]
+	if *input.RepositoryName != "test-team-test-component" || *input.ImageId.ImageTag != "my-ecr-1" || *input.RegistryId != handler.AccountID {
+		t.Fatalf("unexpected input %v", input)
+	}
+	for _, expected := range []string{
+		"- Checking image scan findings for test-team-test-component:my-ecr-1...\n",
+		"  CRITICAL 1, HIGH 2, MEDIUM 1\n",
+		"  CRITICAL CVE-2026-0003: blocking\n",
+		"  HIGH CVE-2026-0002: suppressed until 2026-06-01 (not exploitable)\n",
+		"  HIGH CVE-2026-0004: blocking, suppression expired 2026-05-31\n",
+		`image scan findings at or above HIGH severity block deploying to the "prod" tier: CVE-2026-0003, CVE-2026-0004`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, "MEDIUM CVE-2026-0001") {
+		t.Fatalf("unexpected finding below the threshold in:\n%s", output)
+	}
+}
+
+func TestPrepareTerraformScanGateEnhancedFindings(t *testing.T) {
+	// Given
+	ecrClient := &MockECRScanClient{
+		findings: []*ecr.ImageScanFinding{scanFinding("CVE-2026-0001", ecr.FindingSeverityLow)},
+		enhancedFindings: []*ecr.EnhancedImageScanFinding{
+			{
+				Title:                       aws.String("CVE-2026-0005 - openssl"),
+				Severity:                    aws.String(ecr.FindingSeverityCritical),
+				Status:                      aws.String("ACTIVE"),
+				PackageVulnerabilityDetails: &ecr.PackageVulnerabilityDetails{VulnerabilityId: aws.String("CVE-2026-0005")},
+			},
+			{
+				Title:    aws.String("CVE-2026-0006 - zlib"),
+				Severity: aws.String(ecr.FindingSeverityCritical),
+				Status:   aws.String("CLOSED"),
+			},
+		},
+	}
+	scanGate := map[string]interface{}{"tiers": []interface{}{"prod"}}
+
+	// When
+	response, output, sleeps := prepareTerraformWithScanGate(t, "live", scanGate, ecrClient)
+
+	// Then
+	if response.Success {
+		t.Fatalf("expected failure, got:\n%s", output)
+	}
+	if sleeps != 0 {
+		t.Fatalf("expected an active enhanced scan not to be waited for, got %d waits", sleeps)
+	}
+	if !strings.Contains(output, "  CRITICAL 1, LOW 1\n") || !strings.Contains(output, "block deploying to the \"prod\" tier: CVE-2026-0005\n") {
+		t.Fatalf("expected the enhanced finding to block in:\n%s", output)
+	}
+}
+
+func TestPrepareTerraformScanGateUntriagedFindings(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		scanGate    map[string]interface{}
+		expectBlock bool
+	}{
+		{"block by default", map[string]interface{}{"tiers": []interface{}{"prod"}, "severity": "LOW"}, true},
+		{"block at the highest threshold", map[string]interface{}{"tiers": []interface{}{"prod"}, "severity": "CRITICAL"}, true},
+		{"not blocking", map[string]interface{}{"tiers": []interface{}{"prod"}, "block_untriaged": false}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			ecrClient := &MockECRScanClient{
+				enhancedFindings: []*ecr.EnhancedImageScanFinding{{
+					Title:                       aws.String("CVE-2026-0007 - libxml2"),
+					Severity:                    aws.String("UNTRIAGED"),
+					Status:                      aws.String("ACTIVE"),
+					PackageVulnerabilityDetails: &ecr.PackageVulnerabilityDetails{VulnerabilityId: aws.String("CVE-2026-0007")},
+				}},
+			}
+
+			// When
+			response, output, _ := prepareTerraformWithScanGate(t, "live", tc.scanGate, ecrClient)
+
+			// Then
+			if response.Success == tc.expectBlock {
+				t.Fatalf("expected blocking to be %t, got:\n%s", tc.expectBlock, output)
+			}
+			if tc.expectBlock && !strings.Contains(output, "  UNTRIAGED CVE-2026-0007: blocking\n") {
+				t.Fatalf("expected the untriaged finding to block in:\n%s", output)
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformScanGateNoRecordedBuilds(t *testing.T) {
+	// Given
+	ecrClient := &MockECRScanClient{}
+	ecrConfig := map[string]interface{}{"scan_gate": map[string]interface{}{"tiers": []interface{}{"prod"}}}
+
+	// When
+	response, output, _ := prepareTerraformWithECRMetadata(t, "live", ecrConfig, `{"release": {}}`, ecrClient)
+
+	// Then
+	if response.Success {
+		t.Fatalf("expected failure, got:\n%s", output)
+	}
+	if !strings.Contains(output, `release 1 does not record its ECR builds (ecr_builds in release-metadata.json), so its image scans can't be checked before deploying to the "prod" tier`) {
+		t.Fatalf("expected missing builds error in:\n%s", output)
+	}
+}
+
+func TestPrepareTerraformScanGateWaitsForScan(t *testing.T) {
+	// Given
+	ecrClient := &MockECRScanClient{
+		inProgressCalls: 2,
+		findings:        []*ecr.ImageScanFinding{scanFinding("CVE-2026-0001", ecr.FindingSeverityHigh)},
+	}
+	scanGate := map[string]interface{}{"tiers": []interface{}{"prod"}, "severity": "CRITICAL"}
+
+	// When
+	response, output, sleeps := prepareTerraformWithScanGate(t, "live", scanGate, ecrClient)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure:\n%s", output)
+	}
+	if sleeps != 2 {
+		t.Fatalf("expected 2 waits, got %d", sleeps)
+	}
+	if !strings.Contains(output, "- Waiting for the image scan of test-team-test-component:my-ecr-1 to complete...\n") {
+		t.Fatalf("expected waiting message in:\n%s", output)
+	}
+}
+
+func TestPrepareTerraformScanGateTimeout(t *testing.T) {
+	// Given
+	ecrClient := &MockECRScanClient{inProgressCalls: 1000}
+	scanGate := map[string]interface{}{"tiers": []interface{}{"prod"}, "timeout_seconds": float64(60)}
+
+	// When
+	response, output, sleeps := prepareTerraformWithScanGate(t, "live", scanGate, ecrClient)
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	if sleeps != 6 {
+		t.Fatalf("expected 6 waits, got %d", sleeps)
+	}
+	if !strings.Contains(output, "timed out after 1m0s waiting for the image scan of test-team-test-component:my-ecr-1") {
+		t.Fatalf("expected timeout error in:\n%s", output)
+	}
+}
+
+func TestPrepareTerraformScanGateOtherTier(t *testing.T) {
+	// Given
+	ecrClient := &MockECRScanClient{
+		findings: []*ecr.ImageScanFinding{scanFinding("CVE-2026-0001", ecr.FindingSeverityCritical)},
+	}
+	scanGate := map[string]interface{}{"tiers": []interface{}{"prod"}}
+
+	// When
+	response, output, _ := prepareTerraformWithScanGate(t, "ci", scanGate, ecrClient)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure:\n%s", output)
+	}
+	if len(ecrClient.inputs) != 0 {
+		t.Fatal("unexpected image scan check")
+	}
+}
+
+func TestECRScanGateConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		scanGate      map[string]interface{}
+		expectedError string
+	}{
+		{
+			"no tiers",
+			map[string]interface{}{"severity": "HIGH"},
+			"config.params.ecr.scan_gate.tiers must list the tiers to check image scans for",
+		},
+		{
+			"bad severity",
+			map[string]interface{}{"tiers": []interface{}{"prod"}, "severity": "SEVERE"},
+			"config.params.ecr.scan_gate.severity must be one of LOW, MEDIUM, HIGH or CRITICAL",
+		},
+		{
+			"permanent suppression",
+			map[string]interface{}{"tiers": []interface{}{"prod"}, "suppressions": []interface{}{
+				map[string]interface{}{"id": "CVE-2026-0001"},
+			}},
+			"config.params.ecr.scan_gate.suppressions[0].expires must be set - suppressions cannot be permanent",
+		},
+		{
+			"bad expiry",
+			map[string]interface{}{"tiers": []interface{}{"prod"}, "suppressions": []interface{}{
+				map[string]interface{}{"id": "CVE-2026-0001", "expires": "next week"},
+			}},
+			"config.params.ecr.scan_gate.suppressions[0].expires must be a date (YYYY-MM-DD)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			_, err := handler.ParseECRScanGateConfig(map[string]interface{}{
+				"ecr": map[string]interface{}{"scan_gate": tc.scanGate},
+			})
+
+			// Then
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Fatalf("expected error containing %q, got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestConfigureReleaseRecordsECRBuilds(t *testing.T) {
+	// When
+	_, response, output := configureReleaseWithRepositoryPolicy(t, map[string]interface{}{})
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure:\n%s", output)
+	}
+	if response.AdditionalMetadata[handler.ECRBuildsMetadataKey] != "my-ecr" {
+		t.Fatalf("expected %q, got %q", "my-ecr", response.AdditionalMetadata[handler.ECRBuildsMetadataKey])
+	}
+}
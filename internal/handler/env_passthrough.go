@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// EnvPassthrough copies variables from the environment cdflow2 is run in to terraform's environment.
+type EnvPassthrough struct {
+	// Source is a variable name, or a glob pattern (e.g. "TF_VAR_*").
+	Source string
+	// Target is the name to give the variable, defaulting to the source name. For a glob source, a "*" in the target is
+	// replaced with the part of the name the source's "*" matched.
+	Target string
+	// Envs are the environments (names or glob patterns) the variable is passed to, or all environments if empty.
+	Envs []string
+	// Required variables that are missing from the environment are an error rather than left out.
+	Required bool
+}
+
+// DefaultEnvPassthrough is passed through unless config.params.env_passthrough_defaults is false.
+var DefaultEnvPassthrough = []*EnvPassthrough{
+	{Source: "DATADOG_APP_KEY", Target: "DD_APP_KEY"},
+	{Source: "DATADOG_API_KEY", Target: "DD_API_KEY"},
+	{Source: "FASTLY_API_KEY"},
+	{Source: "GITHUB_TOKEN"},
+	{Source: "MONGODB_ATLAS_PUBLIC_KEY"},
+	{Source: "MONGODB_ATLAS_PRIVATE_KEY"},
+	{Source: "JUNOS_PASSWORD"},
+}
+
+func (p *EnvPassthrough) isGlob() bool {
+	return strings.ContainsAny(p.Source, "*?[")
+}
+
+func (p *EnvPassthrough) appliesTo(envName string) bool {
+	if len(p.Envs) == 0 {
+		return true
+	}
+	for _, pattern := range p.Envs {
+		if matched, _ := path.Match(pattern, envName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns the name for a source variable that matched.
+func (p *EnvPassthrough) target(name string) string {
+	if p.Target == "" {
+		return name
+	}
+	if !p.isGlob() || !strings.Contains(p.Target, "*") {
+		return p.Target
+	}
+	// parseEnvPassthrough checks the source has exactly one "*" in this case
+	prefix := p.Source[:strings.Index(p.Source, "*")]
+	suffix := p.Source[strings.Index(p.Source, "*")+1:]
+	return strings.Replace(p.Target, "*", strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 1)
+}
+
+func parseEnvPassthrough(index int, value interface{}) (*EnvPassthrough, error) {
+	param := fmt.Sprintf("config.params.env_passthrough[%d]", index)
+	if source, ok := value.(string); ok {
+		value = map[string]interface{}{"source": source}
+	}
+	entry, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a variable name or a map", param)
+	}
+	passthrough := &EnvPassthrough{}
+	for key, value := range entry {
+		switch key {
+		case "source", "target":
+			valueString, ok := value.(string)
+			if !ok || valueString == "" {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.%s must be a non-empty string", param, key)
+			}
+			if key == "source" {
+				passthrough.Source = valueString
+			} else {
+				passthrough.Target = valueString
+			}
+		case "envs":
+			envs, err := stringSlice(value, param+".envs")
+			if err != nil {
+				return nil, err
+			}
+			passthrough.Envs = envs
+		case "required":
+			required, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.required must be true or false", param)
+			}
+			passthrough.Required = required
+		default:
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+		}
+	}
+	if passthrough.Source == "" {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.source must be set", param)
+	}
+	if _, err := path.Match(passthrough.Source, ""); err != nil {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.source: %v", param, err)
+	}
+	if passthrough.isGlob() && strings.Contains(passthrough.Target, "*") && strings.Count(passthrough.Source, "*") != 1 {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.target can only contain \"*\" when the source contains exactly one \"*\"", param)
+	}
+	return passthrough, nil
+}
+
+// EnvPassthroughs returns the defaults (unless config.params.env_passthrough_defaults is false) followed by the entries
+// in config.params.env_passthrough.
+func EnvPassthroughs(config map[string]interface{}) ([]*EnvPassthrough, error) {
+	var result []*EnvPassthrough
+	includeDefaults := true
+	if value, ok := config["env_passthrough_defaults"]; ok {
+		if includeDefaults, ok = value.(bool); !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.env_passthrough_defaults must be true or false")
+		}
+	}
+	if includeDefaults {
+		result = append(result, DefaultEnvPassthrough...)
+	}
+	value, ok := config["env_passthrough"]
+	if !ok {
+		return result, nil
+	}
+	entries, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: config.params.env_passthrough must be a list")
+	}
+	for i, entry := range entries {
+		passthrough, err := parseEnvPassthrough(i, entry)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, passthrough)
+	}
+	return result, nil
+}
+
+// AddAdditionalEnvironment passes variables from the request env through to terraform, as configured by
+// config.params.env_passthrough. Variables already set in responseEnv (e.g. the deploy credentials) are never replaced.
+func AddAdditionalEnvironment(config map[string]interface{}, envName string, requestEnv map[string]string, responseEnv map[string]string) error {
+	passthroughs, err := EnvPassthroughs(config)
+	if err != nil {
+		return err
+	}
+	reserved := make(map[string]bool, len(responseEnv))
+	for name := range responseEnv {
+		reserved[name] = true
+	}
+	names := make([]string, 0, len(requestEnv))
+	for name := range requestEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var missing []string
+	for _, passthrough := range passthroughs {
+		if !passthrough.appliesTo(envName) {
+			continue
+		}
+		if !passthrough.isGlob() {
+			target := passthrough.target(passthrough.Source)
+			if reserved[target] {
+				return fmt.Errorf("cdflow.yaml error: config.params.env_passthrough cannot set %s, which is set by the config container", target)
+			}
+			value, ok := requestEnv[passthrough.Source]
+			if !ok || (value == "" && passthrough.Required) {
+				if passthrough.Required {
+					missing = append(missing, passthrough.Source)
+				}
+				continue
+			}
+			responseEnv[target] = value
+			continue
+		}
+		found := false
+		for _, name := range names {
+			if matched, _ := path.Match(passthrough.Source, name); !matched {
+				continue
+			}
+			target := passthrough.target(name)
+			if reserved[target] {
+				continue
+			}
+			responseEnv[target] = requestEnv[name]
+			found = true
+		}
+		if !found && passthrough.Required {
+			missing = append(missing, passthrough.Source)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf(
+			"required environment variables are not set for environment %q: %s\n\n"+
+				"Set them in the environment cdflow2 is run from, or remove required from config.params.env_passthrough.",
+			envName, strings.Join(missing, ", "),
+		)
+	}
+	return nil
+}
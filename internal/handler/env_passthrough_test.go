@@ -0,0 +1,180 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestAddAdditionalEnvironment(t *testing.T) {
+	requestEnv := map[string]string{
+		"DATADOG_APP_KEY":     "dd-app",
+		"GITHUB_TOKEN":        "gh-token",
+		"ACME_TOKEN":          "acme",
+		"TF_VAR_foo":          "foo",
+		"TF_VAR_bar":          "bar",
+		"NEW_RELIC_KEY_LIVE":  "nr-live",
+		"AWS_ACCESS_KEY_ID":   "root",
+		"UNRELATED_VARIABLE":  "unrelated",
+		"MONGODB_ATLAS_EMPTY": "",
+	}
+
+	for _, tc := range []struct {
+		name          string
+		config        map[string]interface{}
+		envName       string
+		expected      map[string]string
+		expectedError string
+	}{
+		{
+			"defaults",
+			map[string]interface{}{},
+			"live",
+			map[string]string{"DD_APP_KEY": "dd-app", "GITHUB_TOKEN": "gh-token"},
+			"",
+		},
+		{
+			"additional mappings",
+			map[string]interface{}{
+				"env_passthrough": []interface{}{
+					"ACME_TOKEN",
+					map[string]interface{}{"source": "TF_VAR_*"},
+					map[string]interface{}{"source": "NEW_RELIC_KEY_*", "target": "NEW_RELIC_*_KEY", "envs": []interface{}{"live"}},
+				},
+			},
+			"live",
+			map[string]string{
+				"DD_APP_KEY":         "dd-app",
+				"GITHUB_TOKEN":       "gh-token",
+				"ACME_TOKEN":         "acme",
+				"TF_VAR_foo":         "foo",
+				"TF_VAR_bar":         "bar",
+				"NEW_RELIC_LIVE_KEY": "nr-live",
+			},
+			"",
+		},
+		{
+			"scoped to other envs",
+			map[string]interface{}{
+				"env_passthrough_defaults": false,
+				"env_passthrough": []interface{}{
+					map[string]interface{}{"source": "ACME_TOKEN", "envs": []interface{}{"live", "ci-*"}},
+				},
+			},
+			"dev",
+			map[string]string{},
+			"",
+		},
+		{
+			"scoped by pattern",
+			map[string]interface{}{
+				"env_passthrough_defaults": false,
+				"env_passthrough": []interface{}{
+					map[string]interface{}{"source": "ACME_TOKEN", "target": "ACME_API_TOKEN", "envs": []interface{}{"live", "ci-*"}},
+				},
+			},
+			"ci-123",
+			map[string]string{"ACME_API_TOKEN": "acme"},
+			"",
+		},
+		{
+			"glob never replaces config container values",
+			map[string]interface{}{
+				"env_passthrough_defaults": false,
+				"env_passthrough":          []interface{}{"AWS_*"},
+			},
+			"live",
+			map[string]string{},
+			"",
+		},
+		{
+			"explicit mapping cannot replace config container values",
+			map[string]interface{}{
+				"env_passthrough": []interface{}{"AWS_ACCESS_KEY_ID"},
+			},
+			"live",
+			nil,
+			"cannot set AWS_ACCESS_KEY_ID, which is set by the config container",
+		},
+		{
+			"required missing",
+			map[string]interface{}{
+				"env_passthrough": []interface{}{
+					map[string]interface{}{"source": "FASTLY_API_KEY", "required": true},
+					map[string]interface{}{"source": "MONGODB_ATLAS_EMPTY", "required": true},
+					map[string]interface{}{"source": "PAGERDUTY_*", "required": true},
+				},
+			},
+			"live",
+			nil,
+			`required environment variables are not set for environment "live": FASTLY_API_KEY, MONGODB_ATLAS_EMPTY, PAGERDUTY_*`,
+		},
+		{
+			"unknown key",
+			map[string]interface{}{
+				"env_passthrough": []interface{}{map[string]interface{}{"source": "A", "requred": true}},
+			},
+			"live",
+			nil,
+			"unknown key config.params.env_passthrough[0].requred",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			responseEnv := map[string]string{"AWS_ACCESS_KEY_ID": "deploy"}
+
+			// When
+			err := handler.AddAdditionalEnvironment(tc.config, tc.envName, requestEnv, responseEnv)
+
+			// Then
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing %q, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if responseEnv["AWS_ACCESS_KEY_ID"] != "deploy" {
+				t.Fatalf("expected %q, got %q", "deploy", responseEnv["AWS_ACCESS_KEY_ID"])
+			}
+			delete(responseEnv, "AWS_ACCESS_KEY_ID")
+			if len(responseEnv) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, responseEnv)
+			}
+			for key, value := range tc.expected {
+				if responseEnv[key] != value {
+					t.Fatalf("expected %q, got %q for %s", value, responseEnv[key], key)
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformRequiredEnvPassthrough(t *testing.T) {
+	// Given
+	request := createPrepareTerraformRequest()
+	request.Config["env_passthrough"] = []interface{}{
+		map[string]interface{}{"source": "FASTLY_API_KEY", "required": true},
+	}
+	response := common.CreatePrepareTerraformResponse()
+	var errorBuffer bytes.Buffer
+	h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, &MockSTSClient{}, nil)
+
+	// When
+	if err := h.PrepareTerraform(request, response, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	if !strings.Contains(errorBuffer.String(), "FASTLY_API_KEY") {
+		t.Fatalf("expected missing variable in %q", errorBuffer.String())
+	}
+}
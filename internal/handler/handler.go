@@ -13,43 +13,55 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/codeartifact"
+	"github.com/aws/aws-sdk-go/service/codeartifact/codeartifactiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/aws/aws-sdk-go/service/organizations"
 	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	common "github.com/mergermarket/cdflow2-config-common"
 )
 
+// Defaults for the platform profile, see Profile.
 const (
-	AccountID     = "724178030834"
-	LambdaBucket  = "acuris-lambdas"
-	ReleaseBucket = "acuris-releases"
-	TFStateBucket = "acuris-tfstate"
-	ReleaseFolder = "/release"
-	Region        = "eu-west-1"
+	AccountID      = "724178030834"
+	LambdaBucket   = "acuris-lambdas"
+	ReleaseBucket  = "acuris-releases"
+	TFStateBucket  = "acuris-tfstate"
+	ReleaseFolder  = "/release"
+	Region         = "eu-west-1"
+	OrganizationID = "o-qisv7rs9ed"
 )
 
-// GetRootAccountSession gets an AWS session in the root account.
+// GetRootAccountSession gets an AWS session in the root account, using the first credential source found in env.
 func (h *Handler) GetRootAccountSession(env map[string]string) (*session.Session, error) {
 	if h.RootAccountSession != nil {
 		return h.RootAccountSession, nil
 	}
-	if env["AWS_ACCESS_KEY_ID"] == "" || env["AWS_SECRET_ACCESS_KEY"] == "" {
-		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not found in env")
+	sourceName, provider, err := h.rootCredentialsProvider(env)
+	if err != nil {
+		return nil, err
 	}
+	fmt.Fprintf(h.ErrorStream, "- Using AWS credentials from %s\n", sourceName)
 	config := aws.NewConfig().
-		WithCredentials(credentials.NewStaticCredentials(
-			env["AWS_ACCESS_KEY_ID"],
-			env["AWS_SECRET_ACCESS_KEY"],
-			env["AWS_SESSION_TOKEN"],
-		)).
-		WithRegion(Region)
+		WithCredentials(credentials.NewCredentials(provider)).
+		WithRegion(h.Profile.Region)
 
 	session, err := session.NewSession(config)
 	if err != nil {
@@ -60,21 +72,36 @@ func (h *Handler) GetRootAccountSession(env map[string]string) (*session.Session
 }
 
 // InitReleaseAccountCredentials initialises the release account credentials.
-func (h *Handler) InitReleaseAccountCredentials(env map[string]string, team string) error {
-	fmt.Fprintf(h.ErrorStream, "- Assuming \"%s-deploy\" role in \"acurisrelease\" account...\n", team)
+func (h *Handler) InitReleaseAccountCredentials(ctx *RoleContext) error {
+	role, err := releaseRoleName(ctx.Config, ctx.Team)
+	if err != nil {
+		return err
+	}
+	options, err := assumeRoleOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(h.ErrorStream, "- Assuming %q role in \"acurisrelease\" account...\n", role)
 
-	session, err := h.GetRootAccountSession(env)
+	session, err := h.GetRootAccountSession(ctx.Env)
 	if err != nil {
 		return err
 	}
-	roleSessionName, err := GetRoleSessionName(env)
+	roleSessionName, err := ctx.RoleSessionName()
 	if err != nil {
 		return err
 	}
 
-	h.ReleaseAccountCredentials = credentials.NewCredentials(
-		h.AssumeRoleProviderFactory(session, fmt.Sprintf("arn:aws:iam::%s:role/%s-deploy", AccountID, team), roleSessionName),
-	)
+	roleARN := fmt.Sprintf("arn:aws:iam::%s:role/%s", h.Profile.AccountID, role)
+	if err := h.checkSessionDuration(session, roleARN, options.Duration); err != nil {
+		return err
+	}
+	h.ReleaseAccountCredentials = credentials.NewCredentials(&sessionDurationErrorProvider{
+		Provider: h.AssumeRoleProviderFactory(session, roleARN, roleSessionName, options),
+		roleARN:  roleARN,
+		duration: options.Duration,
+	})
 	return nil
 }
 
@@ -83,10 +110,14 @@ func (h *Handler) releaseAccountCredentials() *credentials.Credentials {
 }
 
 func (h *Handler) createReleaseAccountSession() (client.ConfigProvider, error) {
+	return h.createReleaseAccountSessionInRegion(h.Profile.Region)
+}
+
+func (h *Handler) createReleaseAccountSessionInRegion(region string) (client.ConfigProvider, error) {
 	return session.NewSession(
 		aws.NewConfig().
 			WithCredentials(h.ReleaseAccountCredentials).
-			WithRegion(Region),
+			WithRegion(region),
 	)
 }
 
@@ -100,7 +131,7 @@ type S3ClientFactory func(client.ConfigProvider) s3iface.S3API
 type S3UploaderFactory func(client.ConfigProvider) s3manageriface.UploaderAPI
 
 // AssumeRoleProviderFactory is a function that returns an assume role provider.
-type AssumeRoleProviderFactory func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider
+type AssumeRoleProviderFactory func(session client.ConfigProvider, roleARN, roleSessionName string, options *AssumeRoleOptions) credentials.Provider
 
 // STSClientFactory is a function that returns an STS client.
 type STSClientFactory func(client.ConfigProvider) stsiface.STSAPI
@@ -108,27 +139,64 @@ type STSClientFactory func(client.ConfigProvider) stsiface.STSAPI
 // OrganizationsClientFactory is a function that returns an organizations client.
 type OrganizationsClientFactory func(client.ConfigProvider) organizationsiface.OrganizationsAPI
 
+// DynamoDBClientFactory is a function that returns a DynamoDB client.
+type DynamoDBClientFactory func(client.ConfigProvider) dynamodbiface.DynamoDBAPI
+
+// SSMClientFactory is a function that returns an SSM client.
+type SSMClientFactory func(client.ConfigProvider) ssmiface.SSMAPI
+
+// SecretsManagerClientFactory is a function that returns a Secrets Manager client.
+type SecretsManagerClientFactory func(client.ConfigProvider) secretsmanageriface.SecretsManagerAPI
+
+// CodeArtifactClientFactory is a function that returns a CodeArtifact client.
+type CodeArtifactClientFactory func(client.ConfigProvider) codeartifactiface.CodeArtifactAPI
+
+// KMSClientFactory is a function that returns a KMS client.
+type KMSClientFactory func(client.ConfigProvider) kmsiface.KMSAPI
+
+// IAMClientFactory is a function that returns an IAM client.
+type IAMClientFactory func(client.ConfigProvider) iamiface.IAMAPI
+
 // Handler handles config requests.
 type Handler struct {
-	RootAccountSession         *session.Session
-	AssumeRoleProviderFactory  AssumeRoleProviderFactory
-	ReleaseAccountCredentials  *credentials.Credentials
-	ErrorStream                io.Writer
-	ReleaseFolder              string
-	ECRClientFactory           ECRClientFactory
-	S3ClientFactory            S3ClientFactory
-	S3UploaderFactory          S3UploaderFactory
-	STSClientFactory           STSClientFactory
-	OrganizationsClientFactory OrganizationsClientFactory
-	ReleaseLoader              common.ReleaseLoader
-	ReleaseSaver               common.ReleaseSaver
+	Profile                     *Profile
+	ProfilePath                 string
+	RootAccountSession          *session.Session
+	AssumeRoleProviderFactory   AssumeRoleProviderFactory
+	ReleaseAccountCredentials   *credentials.Credentials
+	ErrorStream                 io.Writer
+	ReleaseFolder               string
+	ECRClientFactory            ECRClientFactory
+	S3ClientFactory             S3ClientFactory
+	S3UploaderFactory           S3UploaderFactory
+	STSClientFactory            STSClientFactory
+	OrganizationsClientFactory  OrganizationsClientFactory
+	DynamoDBClientFactory       DynamoDBClientFactory
+	SSMClientFactory            SSMClientFactory
+	SecretsManagerClientFactory SecretsManagerClientFactory
+	CodeArtifactClientFactory   CodeArtifactClientFactory
+	KMSClientFactory            KMSClientFactory
+	IAMClientFactory            IAMClientFactory
+	AccountCachePath            string
+	ReleaseLoader               common.ReleaseLoader
+	ReleaseSaver                common.ReleaseSaver
+	Now                         func() time.Time
+	Sleep                       func(time.Duration)
+	NeedHandlers                map[string]NeedHandler
 }
 
 // New returns a new handler.
 func New() *Handler {
+	profilePath := os.Getenv(ProfilePathEnvVar)
+	if profilePath == "" {
+		profilePath = DefaultProfilePath
+	}
 	return &Handler{
-		ErrorStream:   os.Stderr,
-		ReleaseFolder: ReleaseFolder,
+		Profile:          DefaultProfile(),
+		ProfilePath:      profilePath,
+		ErrorStream:      os.Stderr,
+		ReleaseFolder:    ReleaseFolder,
+		AccountCachePath: DefaultAccountCachePath,
 		OrganizationsClientFactory: func(session client.ConfigProvider) organizationsiface.OrganizationsAPI {
 			return organizations.New(session)
 		},
@@ -144,16 +212,43 @@ func New() *Handler {
 		STSClientFactory: func(session client.ConfigProvider) stsiface.STSAPI {
 			return sts.New(session)
 		},
-		AssumeRoleProviderFactory: func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
-			return &stscreds.AssumeRoleProvider{
+		DynamoDBClientFactory: func(session client.ConfigProvider) dynamodbiface.DynamoDBAPI {
+			return dynamodb.New(session)
+		},
+		SSMClientFactory: func(session client.ConfigProvider) ssmiface.SSMAPI {
+			return ssm.New(session)
+		},
+		SecretsManagerClientFactory: func(session client.ConfigProvider) secretsmanageriface.SecretsManagerAPI {
+			return secretsmanager.New(session)
+		},
+		CodeArtifactClientFactory: func(session client.ConfigProvider) codeartifactiface.CodeArtifactAPI {
+			return codeartifact.New(session)
+		},
+		KMSClientFactory: func(session client.ConfigProvider) kmsiface.KMSAPI {
+			return kms.New(session)
+		},
+		IAMClientFactory: func(session client.ConfigProvider) iamiface.IAMAPI {
+			return iam.New(session)
+		},
+		AssumeRoleProviderFactory: func(session client.ConfigProvider, roleARN, roleSessionName string, options *AssumeRoleOptions) credentials.Provider {
+			provider := &stscreds.AssumeRoleProvider{
 				Client:          sts.New(session),
 				RoleARN:         roleARN,
 				RoleSessionName: roleSessionName,
-				Duration:        time.Duration(60) * time.Minute,
+				Duration:        options.Duration,
 			}
+			if options.ExternalID != "" {
+				provider.ExternalID = aws.String(options.ExternalID)
+			}
+			provider.Tags = options.Tags
+			provider.TransitiveTagKeys = options.TransitiveTagKeys
+			return provider
 		},
 		ReleaseLoader: common.CreateReleaseLoader(),
 		ReleaseSaver:  common.CreateReleaseSaver(),
+		Now:           time.Now,
+		Sleep:         time.Sleep,
+		NeedHandlers:  DefaultNeedHandlers(),
 	}
 }
 
@@ -199,6 +294,36 @@ func (h *Handler) WithOrganizationsClientFactory(factory OrganizationsClientFact
 	return h
 }
 
+// WithDynamoDBClientFactory overrides the function used to create a DynamoDB client.
+func (h *Handler) WithDynamoDBClientFactory(factory DynamoDBClientFactory) *Handler {
+	h.DynamoDBClientFactory = factory
+	return h
+}
+
+// WithSSMClientFactory overrides the function used to create an SSM client.
+func (h *Handler) WithSSMClientFactory(factory SSMClientFactory) *Handler {
+	h.SSMClientFactory = factory
+	return h
+}
+
+// WithSecretsManagerClientFactory overrides the function used to create a Secrets Manager client.
+func (h *Handler) WithSecretsManagerClientFactory(factory SecretsManagerClientFactory) *Handler {
+	h.SecretsManagerClientFactory = factory
+	return h
+}
+
+// WithAccountCachePath overrides the path of the account ID cache file.
+func (h *Handler) WithAccountCachePath(path string) *Handler {
+	h.AccountCachePath = path
+	return h
+}
+
+// WithProfilePath overrides the path of the platform profile file.
+func (h *Handler) WithProfilePath(path string) *Handler {
+	h.ProfilePath = path
+	return h
+}
+
 // WithReleaseFolder overrides the release folder.
 func (h *Handler) WithReleaseFolder(folder string) *Handler {
 	h.ReleaseFolder = folder
@@ -217,6 +342,37 @@ func (h *Handler) WithReleaseSaver(saver common.ReleaseSaver) *Handler {
 	return h
 }
 
+// WithClock overrides the functions used to get the current time and to wait.
+func (h *Handler) WithClock(now func() time.Time, sleep func(time.Duration)) *Handler {
+	h.Now = now
+	h.Sleep = sleep
+	return h
+}
+
+// WithNeedHandler adds or replaces the handler for a need.
+func (h *Handler) WithNeedHandler(need string, handler NeedHandler) *Handler {
+	h.NeedHandlers[need] = handler
+	return h
+}
+
+// WithCodeArtifactClientFactory overrides the function used to create a CodeArtifact client.
+func (h *Handler) WithCodeArtifactClientFactory(factory CodeArtifactClientFactory) *Handler {
+	h.CodeArtifactClientFactory = factory
+	return h
+}
+
+// WithKMSClientFactory overrides the function used to create a KMS client.
+func (h *Handler) WithKMSClientFactory(factory KMSClientFactory) *Handler {
+	h.KMSClientFactory = factory
+	return h
+}
+
+// WithIAMClientFactory overrides the function used to create an IAM client.
+func (h *Handler) WithIAMClientFactory(factory IAMClientFactory) *Handler {
+	h.IAMClientFactory = factory
+	return h
+}
+
 func releaseS3Key(team, component, version string) string {
 	return fmt.Sprintf("%s/%s/%s-%s.zip", team, component, component, version)
 }
@@ -4,10 +4,12 @@ import (
 	"errors"
 	"io"
 	"path"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
@@ -43,17 +45,53 @@ type MockS3Client struct {
 	getObjectBody          io.ReadCloser
 	getObjectContentLength int64
 	headObjectMetadata     map[string]*string
+	deleteObjectCalls      []*s3.DeleteObjectInput
+	accessDeniedBuckets    map[string]bool
+	headObjectVersionID    string
+	copyObjectCalls        []*s3.CopyObjectInput
+	getObjectMetadata      map[string]*string
+	getObjectLastModified  *time.Time
+	getObjectErr           error
+	createUploadCalls      []*s3.CreateMultipartUploadInput
+	abortUploadCalls       []*s3.AbortMultipartUploadInput
+}
+
+func (m *MockS3Client) accessDenied(bucket *string) error {
+	if m.accessDeniedBuckets[*bucket] {
+		return awserr.New("AccessDenied", "Access Denied", nil)
+	}
+	return nil
 }
 
 func (m *MockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if err := m.accessDenied(input.Bucket); err != nil {
+		return nil, err
+	}
 	m.putObjectCalls = append(m.putObjectCalls, input)
 	return &s3.PutObjectOutput{}, nil
 }
 
+func (m *MockS3Client) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	return m.PutObject(input)
+}
+
 func (m *MockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if m.getObjectErr != nil {
+		return nil, m.getObjectErr
+	}
+	if m.getObjectBody == nil {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	lastModified := m.getObjectLastModified
+	if lastModified == nil {
+		// before hashes were recorded, so releases without one are used
+		lastModified = aws.Time(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	}
 	return &s3.GetObjectOutput{
 		Body:          m.getObjectBody,
 		ContentLength: aws.Int64(m.getObjectContentLength),
+		Metadata:      m.getObjectMetadata,
+		LastModified:  lastModified,
 	}, nil
 }
 
@@ -64,6 +102,50 @@ func (m *MockS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutp
 	}
 
 	return &s3.HeadObjectOutput{
-		Metadata: m.headObjectMetadata,
+		Metadata:  m.headObjectMetadata,
+		VersionId: aws.String(m.headObjectVersionID),
 	}, nil
 }
+
+func (m *MockS3Client) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	if err := m.accessDenied(input.Bucket); err != nil {
+		return nil, err
+	}
+	m.copyObjectCalls = append(m.copyObjectCalls, input)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *MockS3Client) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	if err := m.accessDenied(input.Bucket); err != nil {
+		return nil, err
+	}
+	return &s3.ListObjectsV2Output{}, nil
+}
+
+func (m *MockS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	if err := m.accessDenied(input.Bucket); err != nil {
+		return nil, err
+	}
+	m.deleteObjectCalls = append(m.deleteObjectCalls, input)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *MockS3Client) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	if err := m.accessDenied(input.Bucket); err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m *MockS3Client) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	if err := m.accessDenied(input.Bucket); err != nil {
+		return nil, err
+	}
+	m.createUploadCalls = append(m.createUploadCalls, input)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("test-upload-id")}, nil
+}
+
+func (m *MockS3Client) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	m.abortUploadCalls = append(m.abortUploadCalls, input)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
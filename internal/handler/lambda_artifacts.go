@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// LambdaObjectsMetadataKey is the key in a lambda build's map in the release metadata for the objects it uploaded
+// under LAMBDA_PATH, as JSON.
+const LambdaObjectsMetadataKey = "lambda_objects"
+
+// lambdaSHA256MetadataKey is the S3 object metadata key for the hash of lambda artifacts copied to a regional bucket.
+const lambdaSHA256MetadataKey = "sha256"
+
+// LambdaObject is an object uploaded by a lambda build, by its path under LAMBDA_PATH.
+type LambdaObject struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	VersionID string `json:"version_id,omitempty"`
+	// SHA256 is base64 encoded, as for the source_code_hash of an aws_lambda_function.
+	SHA256 string `json:"sha256"`
+	// ETag is the ETag of the object that was hashed, used to check it hasn't been overwritten when deploying (the
+	// version ID is empty in unversioned buckets). It isn't recorded by older releases.
+	ETag string `json:"etag,omitempty"`
+}
+
+func lambdaPath(team, component, version, buildID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", team, component, version, buildID)
+}
+
+// LambdaBuckets returns the lambda bucket for each region - the platform's lambda bucket in its region, plus the
+// buckets from config.params.lambda_buckets, since Lambda requires function code to be in the same region.
+func LambdaBuckets(config map[string]interface{}, profile *Profile) (map[string]string, error) {
+	const param = "config.params.lambda_buckets"
+	result := map[string]string{profile.Region: profile.LambdaBucket}
+	value, ok := config["lambda_buckets"]
+	if !ok {
+		return result, nil
+	}
+	buckets, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map of region to bucket", param)
+	}
+	for region, value := range buckets {
+		bucket, ok := value.(string)
+		if !ok || !bucketPattern.MatchString(bucket) {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.%s must be a valid bucket name", param, region)
+		}
+		result[region] = bucket
+	}
+	return result, nil
+}
+
+// LambdaBucketForRegion returns the lambda bucket for a region from LambdaBuckets.
+func LambdaBucketForRegion(config map[string]interface{}, profile *Profile, region string) (string, error) {
+	buckets, err := LambdaBuckets(config, profile)
+	if err != nil {
+		return "", err
+	}
+	bucket, ok := buckets[region]
+	if !ok {
+		return "", fmt.Errorf("cdflow.yaml error: no lambda bucket for region %s - add one to config.params.lambda_buckets", region)
+	}
+	return bucket, nil
+}
+
+// recordLambdaObjects hashes the objects each lambda build uploaded and records them in the build's map in the
+// release metadata, so they can be checked when deploying.
+func (h *Handler) recordLambdaObjects(team, component, version string, buildIDs []string, releaseDir string, s3Client s3iface.S3API) error {
+	for _, buildID := range buildIDs {
+		prefix := lambdaPath(team, component, version, buildID) + "/"
+		objects := make(map[string]*LambdaObject)
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(h.Profile.LambdaBucket),
+			Prefix: aws.String(prefix),
+		}
+		for {
+			output, err := s3Client.ListObjectsV2(input)
+			if err != nil {
+				return err
+			}
+			for _, object := range output.Contents {
+				key := aws.StringValue(object.Key)
+				lambdaObject, err := h.hashLambdaObject(key, s3Client)
+				if err != nil {
+					return err
+				}
+				objects[strings.TrimPrefix(key, prefix)] = lambdaObject
+			}
+			if !aws.BoolValue(output.IsTruncated) {
+				break
+			}
+			input.ContinuationToken = output.NextContinuationToken
+		}
+		if len(objects) == 0 {
+			return fmt.Errorf("lambda build %q didn't upload anything to s3://%s/%s", buildID, h.Profile.LambdaBucket, prefix)
+		}
+		serialised, err := json.Marshal(objects)
+		if err != nil {
+			return err
+		}
+		if err := updateReleaseMetadata(releaseDir, buildID, map[string]string{
+			LambdaObjectsMetadataKey: string(serialised),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) hashLambdaObject(key string, s3Client s3iface.S3API) (*LambdaObject, error) {
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(h.Profile.LambdaBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, output.Body); err != nil {
+		return nil, err
+	}
+	object := &LambdaObject{
+		Bucket: h.Profile.LambdaBucket,
+		Key:    key,
+		SHA256: base64.StdEncoding.EncodeToString(hash.Sum(nil)),
+		ETag:   aws.StringValue(output.ETag),
+	}
+	// unversioned buckets return "null"
+	if versionID := aws.StringValue(output.VersionId); versionID != "null" {
+		object.VersionID = versionID
+	}
+	fmt.Fprintf(h.ErrorStream, "- Recorded lambda artifact s3://%s/%s (sha256 %s)\n", object.Bucket, key, object.SHA256)
+	return object, nil
+}
+
+// resolveLambdaObjects checks the objects recorded for each lambda build still exist, copying them to the lambda
+// bucket for the deploy region if it's different, and adds their location and hash to the build's map in the release
+// metadata. Builds with a single object also get lambda_bucket, lambda_key, lambda_version_id and
+// lambda_source_code_hash.
+func (h *Handler) resolveLambdaObjects(config map[string]interface{}, releaseDir, region string, releaseS3, regionS3 s3iface.S3API) error {
+	metadata, err := readReleaseMetadata(releaseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var buildIDs []string
+	for name, values := range metadata {
+		if name != "release" && values[LambdaObjectsMetadataKey] != "" {
+			buildIDs = append(buildIDs, name)
+		}
+	}
+	if len(buildIDs) == 0 {
+		return nil
+	}
+	sort.Strings(buildIDs)
+	bucket, err := LambdaBucketForRegion(config, h.Profile, region)
+	if err != nil {
+		return err
+	}
+	for _, buildID := range buildIDs {
+		var objects map[string]*LambdaObject
+		if err := json.Unmarshal([]byte(metadata[buildID][LambdaObjectsMetadataKey]), &objects); err != nil {
+			return fmt.Errorf("unable to read %s for the %q build: %v", LambdaObjectsMetadataKey, buildID, err)
+		}
+		for _, object := range objects {
+			if err := h.checkLambdaObject(buildID, object, releaseS3); err != nil {
+				return err
+			}
+			if bucket != object.Bucket {
+				if err := h.copyLambdaObject(object, bucket, regionS3); err != nil {
+					if isPreconditionFailed(err) {
+						return lambdaObjectChangedError(buildID, object)
+					}
+					return fmt.Errorf("unable to copy lambda artifact s3://%s/%s to %s: %v", object.Bucket, object.Key, bucket, err)
+				}
+			}
+		}
+		serialised, err := json.Marshal(objects)
+		if err != nil {
+			return err
+		}
+		values := map[string]string{LambdaObjectsMetadataKey: string(serialised)}
+		if len(objects) == 1 {
+			for _, object := range objects {
+				values["lambda_bucket"] = object.Bucket
+				values["lambda_key"] = object.Key
+				values["lambda_version_id"] = object.VersionID
+				values["lambda_source_code_hash"] = object.SHA256
+			}
+		}
+		if err := updateReleaseMetadata(releaseDir, buildID, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) checkLambdaObject(buildID string, object *LambdaObject, s3Client s3iface.S3API) error {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(object.Bucket),
+		Key:    aws.String(object.Key),
+	}
+	if object.VersionID != "" {
+		input.VersionId = aws.String(object.VersionID)
+	}
+	if object.ETag != "" {
+		input.IfMatch = aws.String(object.ETag)
+	}
+	if _, err := s3Client.HeadObject(input); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+			return fmt.Errorf(
+				"lambda artifact s3://%s/%s (version %q) for the %q build no longer exists - release a new version",
+				object.Bucket, object.Key, object.VersionID, buildID,
+			)
+		}
+		if isPreconditionFailed(err) {
+			return lambdaObjectChangedError(buildID, object)
+		}
+		return err
+	}
+	return nil
+}
+
+func lambdaObjectChangedError(buildID string, object *LambdaObject) error {
+	return fmt.Errorf(
+		"lambda artifact s3://%s/%s (version %q) for the %q build has been overwritten since it was released (ETag is no longer %s) - release a new version",
+		object.Bucket, object.Key, object.VersionID, buildID, object.ETag,
+	)
+}
+
+// objectMetadata returns an S3 object metadata value - the keys returned by the SDK are canonicalised like HTTP headers.
+func objectMetadata(metadata map[string]*string, key string) string {
+	for candidate, value := range metadata {
+		if strings.EqualFold(candidate, key) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
+
+// copyLambdaObject copies an object to the bucket, unless it has already been copied, updating it to the copy.
+func (h *Handler) copyLambdaObject(object *LambdaObject, bucket string, s3Client s3iface.S3API) error {
+	existing, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(object.Key),
+	})
+	if err == nil && objectMetadata(existing.Metadata, lambdaSHA256MetadataKey) == object.SHA256 {
+		object.Bucket = bucket
+		object.VersionID = strings.TrimPrefix(aws.StringValue(existing.VersionId), "null")
+		object.ETag = aws.StringValue(existing.ETag)
+		return nil
+	}
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || (aerr.Code() != "NotFound" && aerr.Code() != s3.ErrCodeNoSuchKey) {
+			return err
+		}
+	}
+	source := url.PathEscape(object.Bucket + "/" + object.Key)
+	if object.VersionID != "" {
+		source += "?versionId=" + url.QueryEscape(object.VersionID)
+	}
+	fmt.Fprintf(h.ErrorStream, "- Copying lambda artifact s3://%s/%s to %s...\n", object.Bucket, object.Key, bucket)
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(object.Key),
+		CopySource:        aws.String(source),
+		Metadata:          map[string]*string{lambdaSHA256MetadataKey: aws.String(object.SHA256)},
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	}
+	// the source could be overwritten between checking it and copying it, and the copy would then get its hash
+	if object.ETag != "" {
+		input.CopySourceIfMatch = aws.String(object.ETag)
+	}
+	output, err := s3Client.CopyObject(input)
+	if err != nil {
+		return err
+	}
+	object.Bucket = bucket
+	object.VersionID = strings.TrimPrefix(aws.StringValue(output.VersionId), "null")
+	if output.CopyObjectResult != nil {
+		object.ETag = aws.StringValue(output.CopyObjectResult.ETag)
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// MockLambdaS3Client stores objects by "<bucket>/<key>", returning one object per page when listing.
+type MockLambdaS3Client struct {
+	s3iface.S3API
+	objects    map[string]string
+	versions   map[string]string
+	etags      map[string]string
+	metadata   map[string]map[string]*string
+	headInputs []*s3.HeadObjectInput
+	copyInputs []*s3.CopyObjectInput
+}
+
+func (m *MockLambdaS3Client) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for path := range m.objects {
+		if strings.HasPrefix(path, *input.Bucket+"/"+*input.Prefix) {
+			keys = append(keys, strings.TrimPrefix(path, *input.Bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	page := 0
+	if input.ContinuationToken != nil {
+		page, _ = strconv.Atoi(*input.ContinuationToken)
+	}
+	output := &s3.ListObjectsV2Output{}
+	if page < len(keys) {
+		output.Contents = []*s3.Object{{Key: aws.String(keys[page])}}
+	}
+	if page+1 < len(keys) {
+		output.IsTruncated = aws.Bool(true)
+		output.NextContinuationToken = aws.String(strconv.Itoa(page + 1))
+	}
+	return output, nil
+}
+
+func (m *MockLambdaS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	path := *input.Bucket + "/" + *input.Key
+	if _, ok := m.objects[path]; !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body:      ioutil.NopCloser(strings.NewReader(m.objects[path])),
+		VersionId: aws.String(m.versions[path]),
+		ETag:      aws.String(m.etags[path]),
+		Metadata:  m.metadata[path],
+	}, nil
+}
+
+func (m *MockLambdaS3Client) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	contents, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.objects[*input.Bucket+"/"+*input.Key] = string(contents)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *MockLambdaS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	m.headInputs = append(m.headInputs, input)
+	path := *input.Bucket + "/" + *input.Key
+	if _, ok := m.objects[path]; !ok || (input.VersionId != nil && *input.VersionId != m.versions[path]) {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	if input.IfMatch != nil && *input.IfMatch != m.etags[path] {
+		return nil, awserr.New("PreconditionFailed", "Precondition Failed", nil)
+	}
+	return &s3.HeadObjectOutput{VersionId: aws.String(m.versions[path]), ETag: aws.String(m.etags[path]), Metadata: m.metadata[path]}, nil
+}
+
+func (m *MockLambdaS3Client) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	m.copyInputs = append(m.copyInputs, input)
+	sourcePath, _ := url.PathUnescape(strings.SplitN(*input.CopySource, "?", 2)[0])
+	if input.CopySourceIfMatch != nil && *input.CopySourceIfMatch != m.etags[sourcePath] {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	path := *input.Bucket + "/" + *input.Key
+	m.objects[path] = "copy"
+	m.versions[path] = "copied-version"
+	return &s3.CopyObjectOutput{
+		VersionId:        aws.String("copied-version"),
+		CopyObjectResult: &s3.CopyObjectResult{ETag: aws.String(`"copied-etag"`)},
+	}, nil
+}
+
+func writeReleaseMetadata(t *testing.T, metadata string) string {
+	releaseDir, err := ioutil.TempDir("", "lambda-artifacts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(releaseDir, handler.ReleaseMetadataFile), []byte(metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return releaseDir
+}
+
+func readTestReleaseMetadata(t *testing.T, releaseDir string) map[string]map[string]string {
+	contents, err := ioutil.ReadFile(filepath.Join(releaseDir, handler.ReleaseMetadataFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata map[string]map[string]string
+	if err := json.Unmarshal(contents, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+func TestUploadReleaseRecordsLambdaObjects(t *testing.T) {
+	// Given
+	s3Client := &MockLambdaS3Client{
+		objects: map[string]string{
+			"acuris-lambdas/my-team/my-component/1/my-lambda/function.zip": "function code",
+			"acuris-lambdas/my-team/my-component/1/my-lambda/layer.zip":    "layer code",
+			"acuris-lambdas/my-team/my-component/1/other/ignored.zip":      "other",
+		},
+		versions: map[string]string{
+			"acuris-lambdas/my-team/my-component/1/my-lambda/function.zip": "v1",
+			"acuris-lambdas/my-team/my-component/1/my-lambda/layer.zip":    "null",
+		},
+		etags: map[string]string{
+			"acuris-lambdas/my-team/my-component/1/my-lambda/function.zip": `"function-etag"`,
+			"acuris-lambdas/my-team/my-component/1/my-lambda/layer.zip":    `"layer-etag"`,
+		},
+	}
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Config["team"] = "my-team"
+	configureReleaseRequest.Component = "my-component"
+	configureReleaseRequest.Version = "1"
+	configureReleaseRequest.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+		"my-lambda": {Needs: []string{"lambda"}},
+	}
+	releaseDir := writeReleaseMetadata(t, `{"release": {}, "my-lambda": {}}`)
+	defer os.RemoveAll(releaseDir)
+
+	var errorBuffer bytes.Buffer
+	h := handler.New().
+		WithErrorStream(&errorBuffer).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client }).
+		WithS3UploaderFactory(func(client.ConfigProvider) s3manageriface.UploaderAPI { return &MockS3Uploader{} }).
+		WithReleaseSaver(&MockReleaseSaver{reader: ioutil.NopCloser(&bytes.Buffer{})})
+	response := common.CreateUploadReleaseResponse()
+
+	// When
+	if err := h.UploadRelease(common.CreateUploadReleaseRequest(), response, configureReleaseRequest, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	var objects map[string]*handler.LambdaObject
+	if err := json.Unmarshal([]byte(readTestReleaseMetadata(t, releaseDir)["my-lambda"][handler.LambdaObjectsMetadataKey]), &objects); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]*handler.LambdaObject{
+		"function.zip": {
+			Bucket:    "acuris-lambdas",
+			Key:       "my-team/my-component/1/my-lambda/function.zip",
+			VersionID: "v1",
+			// echo -n "function code" | openssl dgst -sha256 -binary | base64
+			SHA256: "zhgtcVtCsn8bq/i0GWzU+MkAymWTpCk9RV0eXiKW6+4=",
+			ETag:   `"function-etag"`,
+		},
+		"layer.zip": {
+			Bucket: "acuris-lambdas",
+			Key:    "my-team/my-component/1/my-lambda/layer.zip",
+			SHA256: "pBTzXoQYAb8Mzjir/p3gDTXDZ+Z17B57oGae1/5+UcM=",
+			ETag:   `"layer-etag"`,
+		},
+	}
+	if len(objects) != len(expected) {
+		t.Fatalf("expected %d objects, got %d", len(expected), len(objects))
+	}
+	for name, object := range expected {
+		if *objects[name] != *object {
+			t.Fatalf("expected %+v for %s, got %+v", object, name, objects[name])
+		}
+	}
+}
+
+func prepareTerraformWithLambdaObjects(t *testing.T, config map[string]interface{}, s3Client *MockLambdaS3Client) (*common.PrepareTerraformResponse, string, map[string]map[string]string) {
+	request := createPrepareTerraformRequest()
+	request.Version = "1"
+	for key, value := range config {
+		request.Config[key] = value
+	}
+	response := common.CreatePrepareTerraformResponse()
+	objects := `{"function.zip": {"bucket": "acuris-lambdas", "key": "t/c/1/my-lambda/function.zip", "version_id": "v1", "sha256": "abc=", "etag": "\"e1\""}}`
+	metadata, err := json.Marshal(map[string]map[string]string{
+		"release":   {},
+		"my-lambda": {handler.LambdaObjectsMetadataKey: objects},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseDir := writeReleaseMetadata(t, string(metadata))
+	defer os.RemoveAll(releaseDir)
+
+	releasePath := handler.ReleaseBucket + "/test-team/test-component/test-component-1.zip"
+	s3Client.objects[releasePath] = "release contents"
+	s3Client.metadata = map[string]map[string]*string{
+		releasePath: {handler.ReleaseSHA256MetadataKey: aws.String(releaseContentsSHA256)},
+	}
+
+	var errorBuffer bytes.Buffer
+	h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, &MockSTSClient{}, nil).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client })
+	if err := h.PrepareTerraform(request, response, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String(), readTestReleaseMetadata(t, releaseDir)
+}
+
+func TestPrepareTerraformLambdaObjects(t *testing.T) {
+	// Given
+	s3Client := &MockLambdaS3Client{
+		objects:  map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": "function code"},
+		versions: map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": "v1"},
+		etags:    map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": `"e1"`},
+	}
+
+	// When
+	response, output, metadata := prepareTerraformWithLambdaObjects(t, nil, s3Client)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	expected := map[string]string{
+		"lambda_bucket":           "acuris-lambdas",
+		"lambda_key":              "t/c/1/my-lambda/function.zip",
+		"lambda_version_id":       "v1",
+		"lambda_source_code_hash": "abc=",
+	}
+	for key, value := range expected {
+		if metadata["my-lambda"][key] != value {
+			t.Fatalf("expected %q for %s, got %q", value, key, metadata["my-lambda"][key])
+		}
+	}
+	if len(s3Client.copyInputs) != 0 {
+		t.Fatal("unexpected copy")
+	}
+	if len(s3Client.headInputs) != 1 || aws.StringValue(s3Client.headInputs[0].IfMatch) != `"e1"` {
+		t.Fatalf("expected the object to be checked against the recorded ETag, got %v", s3Client.headInputs)
+	}
+}
+
+func TestPrepareTerraformCopiesLambdaObjectsToRegionalBucket(t *testing.T) {
+	// Given
+	s3Client := &MockLambdaS3Client{
+		objects:  map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": "function code"},
+		versions: map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": "v1"},
+		etags:    map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": `"e1"`},
+	}
+	config := map[string]interface{}{
+		"region":         "us-east-1",
+		"lambda_buckets": map[string]interface{}{"us-east-1": "acuris-lambdas-us-east-1"},
+	}
+
+	// When
+	response, output, metadata := prepareTerraformWithLambdaObjects(t, config, s3Client)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if len(s3Client.copyInputs) != 1 {
+		t.Fatalf("expected one copy, got %d", len(s3Client.copyInputs))
+	}
+	copyInput := s3Client.copyInputs[0]
+	if *copyInput.CopySource != "acuris-lambdas%2Ft%2Fc%2F1%2Fmy-lambda%2Ffunction.zip?versionId=v1" {
+		t.Fatalf("unexpected copy source %q", *copyInput.CopySource)
+	}
+	if aws.StringValue(copyInput.CopySourceIfMatch) != `"e1"` {
+		t.Fatalf("expected the copy to be conditional on the recorded ETag, got %v", copyInput.CopySourceIfMatch)
+	}
+	if *copyInput.Metadata["sha256"] != "abc=" {
+		t.Fatalf("expected %q, got %q", "abc=", *copyInput.Metadata["sha256"])
+	}
+	if metadata["my-lambda"]["lambda_bucket"] != "acuris-lambdas-us-east-1" || metadata["my-lambda"]["lambda_version_id"] != "copied-version" {
+		t.Fatalf("expected the regional copy, got %v", metadata["my-lambda"])
+	}
+}
+
+func TestPrepareTerraformLambdaObjectErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   map[string]interface{}
+		versions map[string]string
+		etag     string
+		expected string
+	}{
+		{
+			"object version deleted",
+			nil,
+			map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": "v2"},
+			`"e1"`,
+			`lambda artifact s3://acuris-lambdas/t/c/1/my-lambda/function.zip (version "v1") for the "my-lambda" build no longer exists`,
+		},
+		{
+			"object overwritten",
+			nil,
+			map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": "v1"},
+			`"e2"`,
+			`lambda artifact s3://acuris-lambdas/t/c/1/my-lambda/function.zip (version "v1") for the "my-lambda" build has been overwritten since it was released`,
+		},
+		{
+			"no bucket for region",
+			map[string]interface{}{"region": "us-east-1"},
+			map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": "v1"},
+			`"e1"`,
+			"no lambda bucket for region us-east-1 - add one to config.params.lambda_buckets",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			s3Client := &MockLambdaS3Client{
+				objects:  map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": "function code"},
+				versions: tc.versions,
+				etags:    map[string]string{"acuris-lambdas/t/c/1/my-lambda/function.zip": tc.etag},
+			}
+
+			// When
+			response, output, _ := prepareTerraformWithLambdaObjects(t, tc.config, s3Client)
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			if !strings.Contains(output, tc.expected) {
+				t.Fatalf("expected %q in %q", tc.expected, output)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codeartifact"
+)
+
+// DefaultCodeArtifactFormats are the package formats endpoints are provided for when
+// config.params.codeartifact.formats isn't set.
+var DefaultCodeArtifactFormats = []string{codeartifact.PackageFormatNpm, codeartifact.PackageFormatMaven}
+
+var codeArtifactFormats = []string{
+	codeartifact.PackageFormatNpm,
+	codeartifact.PackageFormatPypi,
+	codeartifact.PackageFormatMaven,
+	codeartifact.PackageFormatNuget,
+}
+
+// CodeArtifactConfig is config.params.codeartifact.
+type CodeArtifactConfig struct {
+	Domain      string
+	DomainOwner string
+	Repository  string
+	Formats     []string
+}
+
+// ParseCodeArtifactConfig reads config.params.codeartifact. The domain owner defaults to the release account.
+func ParseCodeArtifactConfig(config map[string]interface{}, profile *Profile) (*CodeArtifactConfig, error) {
+	const param = "config.params.codeartifact"
+	result := &CodeArtifactConfig{DomainOwner: profile.AccountID, Formats: DefaultCodeArtifactFormats}
+	value, ok := config["codeartifact"]
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.domain and %s.repository must be set for builds that need \"codeartifact\"", param, param)
+	}
+	codeArtifactMap, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map", param)
+	}
+	for key, value := range codeArtifactMap {
+		if key == "formats" {
+			formats, err := stringSlice(value, param+".formats")
+			if err != nil {
+				return nil, err
+			}
+			for _, format := range formats {
+				if !contains(format, codeArtifactFormats) {
+					return nil, fmt.Errorf(
+						"cdflow.yaml error: %s.formats %q is not one of %s", param, format, strings.Join(codeArtifactFormats, ", "),
+					)
+				}
+			}
+			result.Formats = formats
+			continue
+		}
+		valueString, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.%s must be a string", param, key)
+		}
+		switch key {
+		case "domain":
+			result.Domain = valueString
+		case "domain_owner":
+			if !accountIDPattern.MatchString(valueString) {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.domain_owner %q is not a valid AWS account ID", param, valueString)
+			}
+			result.DomainOwner = valueString
+		case "repository":
+			result.Repository = valueString
+		default:
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+		}
+	}
+	if result.Domain == "" || result.Repository == "" {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.domain and %s.repository must be set for builds that need \"codeartifact\"", param, param)
+	}
+	return result, nil
+}
+
+// codeArtifactNeed provides a CodeArtifact repository and auth token for builds to publish packages (e.g. npm or
+// Maven) to.
+type codeArtifactNeed struct{}
+
+func (n *codeArtifactNeed) Validate(h *Handler, request *NeedRequest) error {
+	_, err := ParseCodeArtifactConfig(request.Config, h.Profile)
+	return err
+}
+
+func (n *codeArtifactNeed) Prepare(h *Handler, request *NeedRequest) (*NeedResult, error) {
+	config, err := ParseCodeArtifactConfig(request.Config, h.Profile)
+	if err != nil {
+		return nil, err
+	}
+	client := h.CodeArtifactClientFactory(request.Session)
+
+	fmt.Fprintf(h.ErrorStream, "- Getting CodeArtifact auth token for domain %q...\n", config.Domain)
+	token, err := client.GetAuthorizationToken(&codeartifact.GetAuthorizationTokenInput{
+		Domain:      aws.String(config.Domain),
+		DomainOwner: aws.String(config.DomainOwner),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get CodeArtifact auth token: %v", err)
+	}
+
+	env := map[string]string{
+		"CODEARTIFACT_DOMAIN":       config.Domain,
+		"CODEARTIFACT_DOMAIN_OWNER": config.DomainOwner,
+		"CODEARTIFACT_REPOSITORY":   config.Repository,
+		"CODEARTIFACT_AUTH_TOKEN":   aws.StringValue(token.AuthorizationToken),
+	}
+	for _, format := range config.Formats {
+		endpoint, err := client.GetRepositoryEndpoint(&codeartifact.GetRepositoryEndpointInput{
+			Domain:      aws.String(config.Domain),
+			DomainOwner: aws.String(config.DomainOwner),
+			Repository:  aws.String(config.Repository),
+			Format:      aws.String(format),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get CodeArtifact %s endpoint for repository %q: %v", format, config.Repository, err)
+		}
+		env["CODEARTIFACT_"+strings.ToUpper(format)+"_URL"] = aws.StringValue(endpoint.RepositoryEndpoint)
+	}
+
+	result := NewNeedResult(request)
+	for _, buildID := range request.BuildIDs {
+		for key, value := range env {
+			result.Env[buildID][key] = value
+		}
+		setAWSEnvironmentVariables(result.Env[buildID], request.Credentials, h.Profile.Region)
+	}
+	return result, nil
+}
@@ -0,0 +1,108 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/codeartifact"
+	"github.com/aws/aws-sdk-go/service/codeartifact/codeartifactiface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type MockCodeArtifactClient struct {
+	codeartifactiface.CodeArtifactAPI
+	tokenInput     *codeartifact.GetAuthorizationTokenInput
+	endpointInputs []*codeartifact.GetRepositoryEndpointInput
+}
+
+func (m *MockCodeArtifactClient) GetAuthorizationToken(input *codeartifact.GetAuthorizationTokenInput) (*codeartifact.GetAuthorizationTokenOutput, error) {
+	m.tokenInput = input
+	return &codeartifact.GetAuthorizationTokenOutput{AuthorizationToken: aws.String("test-token")}, nil
+}
+
+func (m *MockCodeArtifactClient) GetRepositoryEndpoint(input *codeartifact.GetRepositoryEndpointInput) (*codeartifact.GetRepositoryEndpointOutput, error) {
+	m.endpointInputs = append(m.endpointInputs, input)
+	return &codeartifact.GetRepositoryEndpointOutput{
+		RepositoryEndpoint: aws.String("https://my-domain/" + *input.Format + "/" + *input.Repository + "/"),
+	}, nil
+}
+
+var codeArtifactRequirements = map[string]*common.ReleaseRequirements{
+	"package": {Needs: []string{"codeartifact"}},
+}
+
+func TestConfigureReleaseCodeArtifact(t *testing.T) {
+	// Given
+	codeArtifactClient := &MockCodeArtifactClient{}
+	h := createECRSettingsHandler(&bytes.Buffer{}, nil).
+		WithCodeArtifactClientFactory(func(client.ConfigProvider) codeartifactiface.CodeArtifactAPI {
+			return codeArtifactClient
+		})
+	config := map[string]interface{}{
+		"codeartifact": map[string]interface{}{"domain": "my-domain", "repository": "my-repo"},
+	}
+
+	// When
+	response, output := configureReleaseWithNeeds(t, h, config, codeArtifactRequirements)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if *codeArtifactClient.tokenInput.Domain != "my-domain" || *codeArtifactClient.tokenInput.DomainOwner != handler.AccountID {
+		t.Fatalf("unexpected token request: %v", codeArtifactClient.tokenInput)
+	}
+	expectedEnv := map[string]string{
+		"CODEARTIFACT_DOMAIN":       "my-domain",
+		"CODEARTIFACT_DOMAIN_OWNER": handler.AccountID,
+		"CODEARTIFACT_REPOSITORY":   "my-repo",
+		"CODEARTIFACT_AUTH_TOKEN":   "test-token",
+		"CODEARTIFACT_NPM_URL":      "https://my-domain/npm/my-repo/",
+		"CODEARTIFACT_MAVEN_URL":    "https://my-domain/maven/my-repo/",
+		"AWS_ACCESS_KEY_ID":         "foo",
+	}
+	for key, expected := range expectedEnv {
+		if response.Env["package"][key] != expected {
+			t.Fatalf("expected %q for %s, got %q", expected, key, response.Env["package"][key])
+		}
+	}
+}
+
+func TestConfigureReleaseCodeArtifactErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   interface{}
+		expected string
+	}{
+		{"missing", nil, "config.params.codeartifact.domain and config.params.codeartifact.repository must be set"},
+		{"no repository", map[string]interface{}{"domain": "my-domain"}, "config.params.codeartifact.domain and config.params.codeartifact.repository must be set"},
+		{
+			"bad format",
+			map[string]interface{}{"domain": "d", "repository": "r", "formats": []interface{}{"cargo"}},
+			`config.params.codeartifact.formats "cargo" is not one of npm, pypi, maven, nuget`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			config := map[string]interface{}{}
+			if tc.config != nil {
+				config["codeartifact"] = tc.config
+			}
+
+			// When
+			response, output := configureReleaseWithNeeds(t, createECRSettingsHandler(&bytes.Buffer{}, nil), config, codeArtifactRequirements)
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			if !strings.Contains(output, tc.expected) {
+				t.Fatalf("expected %q in %q", tc.expected, output)
+			}
+		})
+	}
+}
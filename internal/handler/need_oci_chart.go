@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"fmt"
+)
+
+// OCIChartNamespace returns the namespace in the release account's ECR registry that a component's charts are pushed
+// to. Each chart is stored in the <namespace>/<chart> repository.
+func OCIChartNamespace(team, component string) string {
+	return team + "-" + component + "-charts"
+}
+
+// ociChartNeed provides an ECR repository for builds to push Helm charts to as OCI artifacts. The chart must be named
+// after the build.
+type ociChartNeed struct{}
+
+func (n *ociChartNeed) Validate(h *Handler, request *NeedRequest) error {
+	if _, err := ParseECRRepositorySettings(request.Config, request.Team, request.Component); err != nil {
+		return err
+	}
+	_, err := h.ecrRepoPolicy(request.Config, nil, "")
+	return err
+}
+
+func (n *ociChartNeed) Prepare(h *Handler, request *NeedRequest) (*NeedResult, error) {
+	settings, err := ParseECRRepositorySettings(request.Config, request.Team, request.Component)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := h.ecrRepoPolicy(request.Config, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	// charts are versioned by the chart version rather than a build prefixed tag, so keep the newest of any tag
+	lifecycle := &ECRLifecyclePolicy{
+		Rules: []*ECRLifecyclePolicyRule{
+			{
+				RulePriority: 1,
+				Selection: &ECRLifecyclePolicyRuleSelection{
+					TagStatus:   "any",
+					CountType:   "imageCountMoreThan",
+					CountNumber: DefaultECRLifecycleKeep,
+				},
+				Action: &ECRLifecyclePolicyRuleAction{Type: "expire"},
+			},
+		},
+	}
+	namespace := OCIChartNamespace(request.Team, request.Component)
+	registry := fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", h.Profile.AccountID, h.Profile.Region)
+	ecrClient := h.ECRClientFactory(request.Session)
+
+	result := NewNeedResult(request)
+	result.Metadata["oci_chart_repository"] = "oci://" + registry + "/" + namespace
+	for _, buildID := range request.BuildIDs {
+		if _, err := h.ensureECRRepo(&ecrRepoSetup{
+			name:      namespace + "/" + buildID,
+			builds:    []string{buildID},
+			policy:    policy,
+			lifecycle: lifecycle,
+		}, settings, ecrClient); err != nil {
+			return nil, err
+		}
+		env := result.Env[buildID]
+		env["OCI_CHART_REGISTRY"] = registry
+		env["OCI_CHART_REPOSITORY"] = "oci://" + registry + "/" + namespace
+		env["OCI_CHART_NAME"] = buildID
+		setAWSEnvironmentVariables(env, request.Credentials, h.Profile.Region)
+	}
+
+	dockerAuthEnv, err := h.ecrDockerAuthEnv(ecrClient)
+	if err != nil {
+		return nil, err
+	}
+	for _, buildID := range request.BuildIDs {
+		for key, value := range dockerAuthEnv {
+			result.Env[buildID][key] = value
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestConfigureReleaseOCIChart(t *testing.T) {
+	// Given
+	ecrClient := &MockECRMultiRepoClient{}
+	h := createECRSettingsHandler(&bytes.Buffer{}, ecrClient)
+
+	// When
+	response, output := configureReleaseWithNeeds(t, h, nil, map[string]*common.ReleaseRequirements{
+		"my-chart": {Needs: []string{"oci-chart"}},
+	})
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if len(ecrClient.created) != 1 || ecrClient.created[0] != "my-team-my-component-charts/my-chart" {
+		t.Fatalf("unexpected repositories created: %q", ecrClient.created)
+	}
+	registry := handler.AccountID + ".dkr.ecr.eu-west-1.amazonaws.com"
+	expectedEnv := map[string]string{
+		"OCI_CHART_REGISTRY":   registry,
+		"OCI_CHART_REPOSITORY": "oci://" + registry + "/my-team-my-component-charts",
+		"OCI_CHART_NAME":       "my-chart",
+		"DOCKER_AUTH_CONFIG":   `{"auths":{"` + registry + `":{"auth":"QVdTOnNlY3JldA=="}}}`,
+	}
+	for key, expected := range expectedEnv {
+		if response.Env["my-chart"][key] != expected {
+			t.Fatalf("expected %q for %s, got %q", expected, key, response.Env["my-chart"][key])
+		}
+	}
+	expectedLifecycle := `{"rules":[{"rulePriority":1,"selection":{"tagStatus":"any","countType":"imageCountMoreThan","countNumber":50},"action":{"type":"expire"}}]}`
+	if policy := ecrClient.lifecyclePolicies["my-team-my-component-charts/my-chart"]; policy != expectedLifecycle {
+		t.Fatalf("expected %s, got %s", expectedLifecycle, policy)
+	}
+	if response.AdditionalMetadata["oci_chart_repository"] != expectedEnv["OCI_CHART_REPOSITORY"] {
+		t.Fatalf("expected %q, got %q", expectedEnv["OCI_CHART_REPOSITORY"], response.AdditionalMetadata["oci_chart_repository"])
+	}
+}
+
+func TestConfigureReleaseOCIChartRepositoryPolicy(t *testing.T) {
+	// Given
+	ecrClient := &MockECRMultiRepoClient{}
+	h := createECRSettingsHandler(&bytes.Buffer{}, ecrClient)
+	config := map[string]interface{}{
+		"ecr": map[string]interface{}{
+			"repository_policy": map[string]interface{}{"pull_accounts": []interface{}{"111111111111"}},
+		},
+	}
+
+	// When
+	response, output := configureReleaseWithNeeds(t, h, config, map[string]*common.ReleaseRequirements{
+		"my-chart": {Needs: []string{"oci-chart"}},
+	})
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	policy := ecrClient.repositoryPolicy["my-team-my-component-charts/my-chart"]
+	if !strings.Contains(policy, `"Sid": "PullAccounts"`) || !strings.Contains(policy, "arn:aws:iam::111111111111:root") {
+		t.Fatalf("expected the pull accounts statement in %s", policy)
+	}
+}
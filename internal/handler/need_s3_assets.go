@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3AssetsConfig is config.params.s3_assets.
+type S3AssetsConfig struct {
+	Bucket string
+	// Prefix is where releases are stored in the bucket, in <version>/<build> folders.
+	Prefix string
+}
+
+// ParseS3AssetsConfig reads config.params.s3_assets. The prefix defaults to <team>/<component>.
+func ParseS3AssetsConfig(config map[string]interface{}, team, component string) (*S3AssetsConfig, error) {
+	const param = "config.params.s3_assets"
+	result := &S3AssetsConfig{Prefix: team + "/" + component}
+	value, ok := config["s3_assets"]
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.bucket must be set for builds that need \"s3-assets\"", param)
+	}
+	assets, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map", param)
+	}
+	for key, value := range assets {
+		valueString, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: %s.%s must be a string", param, key)
+		}
+		switch key {
+		case "bucket":
+			if !bucketPattern.MatchString(valueString) {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.bucket %q is not a valid bucket name", param, valueString)
+			}
+			result.Bucket = valueString
+		case "prefix":
+			if valueString == "" || strings.HasPrefix(valueString, "/") || strings.HasSuffix(valueString, "/") {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.prefix must be non-empty and not start or end with /", param)
+			}
+			result.Prefix = valueString
+		default:
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+		}
+	}
+	if result.Bucket == "" {
+		return nil, fmt.Errorf("cdflow.yaml error: %s.bucket must be set for builds that need \"s3-assets\"", param)
+	}
+	return result, nil
+}
+
+// s3AssetsNeed provides a bucket and prefix for builds to publish static assets (e.g. a frontend) to.
+type s3AssetsNeed struct{}
+
+func (n *s3AssetsNeed) Validate(h *Handler, request *NeedRequest) error {
+	_, err := ParseS3AssetsConfig(request.Config, request.Team, request.Component)
+	return err
+}
+
+func (n *s3AssetsNeed) Prepare(h *Handler, request *NeedRequest) (*NeedResult, error) {
+	assets, err := ParseS3AssetsConfig(request.Config, request.Team, request.Component)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(h.ErrorStream, "- Checking assets bucket %q...\n", assets.Bucket)
+	if _, err := h.S3ClientFactory(request.Session).HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(assets.Bucket),
+	}); err != nil {
+		return nil, fmt.Errorf("unable to access assets bucket %q: %v", assets.Bucket, err)
+	}
+	versionPrefix := assets.Prefix + "/" + request.Version
+	result := NewNeedResult(request)
+	result.Metadata["s3_assets_bucket"] = assets.Bucket
+	result.Metadata["s3_assets_prefix"] = versionPrefix
+	for _, buildID := range request.BuildIDs {
+		env := result.Env[buildID]
+		env["S3_ASSETS_BUCKET"] = assets.Bucket
+		env["S3_ASSETS_PREFIX"] = versionPrefix + "/" + buildID
+		setAWSEnvironmentVariables(env, request.Credentials, h.Profile.Region)
+	}
+	return result, nil
+}
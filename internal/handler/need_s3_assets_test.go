@@ -0,0 +1,84 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+var s3AssetsRequirements = map[string]*common.ReleaseRequirements{
+	"web": {Needs: []string{"s3-assets"}},
+}
+
+func TestConfigureReleaseS3Assets(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		config         map[string]interface{}
+		expectedPrefix string
+	}{
+		{"default prefix", map[string]interface{}{"bucket": "my-assets"}, "my-team/my-component/1"},
+		{"prefix", map[string]interface{}{"bucket": "my-assets", "prefix": "frontend/site"}, "frontend/site/1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := createECRSettingsHandler(&bytes.Buffer{}, nil).
+				WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return &MockS3Client{} })
+
+			// When
+			response, output := configureReleaseWithNeeds(t, h, map[string]interface{}{"s3_assets": tc.config}, s3AssetsRequirements)
+
+			// Then
+			if !response.Success {
+				t.Fatalf("unexpected failure: %s", output)
+			}
+			env := response.Env["web"]
+			if env["S3_ASSETS_BUCKET"] != "my-assets" {
+				t.Fatalf("expected %q, got %q", "my-assets", env["S3_ASSETS_BUCKET"])
+			}
+			if env["S3_ASSETS_PREFIX"] != tc.expectedPrefix+"/web" {
+				t.Fatalf("expected %q, got %q", tc.expectedPrefix+"/web", env["S3_ASSETS_PREFIX"])
+			}
+			if env["AWS_ACCESS_KEY_ID"] != "foo" {
+				t.Fatalf("expected %q, got %q", "foo", env["AWS_ACCESS_KEY_ID"])
+			}
+			if response.AdditionalMetadata["s3_assets_prefix"] != tc.expectedPrefix {
+				t.Fatalf("expected %q, got %q", tc.expectedPrefix, response.AdditionalMetadata["s3_assets_prefix"])
+			}
+		})
+	}
+}
+
+func TestConfigureReleaseS3AssetsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   map[string]interface{}
+		expected string
+	}{
+		{"missing bucket", map[string]interface{}{}, `config.params.s3_assets.bucket must be set for builds that need "s3-assets"`},
+		{"bad prefix", map[string]interface{}{"bucket": "my-assets", "prefix": "/x/"}, "config.params.s3_assets.prefix must be non-empty"},
+		{"no access", map[string]interface{}{"bucket": "denied"}, `unable to access assets bucket "denied": AccessDenied`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := createECRSettingsHandler(&bytes.Buffer{}, nil).
+				WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API {
+					return &MockS3Client{accessDeniedBuckets: map[string]bool{"denied": true}}
+				})
+
+			// When
+			response, output := configureReleaseWithNeeds(t, h, map[string]interface{}{"s3_assets": tc.config}, s3AssetsRequirements)
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			if !strings.Contains(output, tc.expected) {
+				t.Fatalf("expected %q in %q", tc.expected, output)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// NeedRequest is the release that builds advertising a need are part of.
+type NeedRequest struct {
+	Need      string
+	Config    map[string]interface{}
+	Env       map[string]string
+	Team      string
+	Component string
+	Version   string
+	// BuildIDs are the sorted IDs of the builds that advertise the need.
+	BuildIDs []string
+	// Session and Credentials are for the release account.
+	Session     client.ConfigProvider
+	Credentials *credentials.Value
+}
+
+// NeedResult is what a need handler provides to the release.
+type NeedResult struct {
+	// Env has environment variables for each build, by build ID.
+	Env map[string]map[string]string
+	// Metadata is added to the release map in the release metadata.
+	Metadata map[string]string
+}
+
+// NewNeedResult returns an empty result for the builds in the request.
+func NewNeedResult(request *NeedRequest) *NeedResult {
+	result := &NeedResult{
+		Env:      make(map[string]map[string]string),
+		Metadata: make(map[string]string),
+	}
+	for _, buildID := range request.BuildIDs {
+		result.Env[buildID] = make(map[string]string)
+	}
+	return result
+}
+
+// NeedHandler provides a need that builds can advertise.
+type NeedHandler interface {
+	// Validate checks the config for the need. All needs are validated before any are prepared, so that config
+	// errors don't leave resources partially set up.
+	Validate(h *Handler, request *NeedRequest) error
+	// Prepare creates or updates any resources the builds need, returning their environment and release metadata.
+	Prepare(h *Handler, request *NeedRequest) (*NeedResult, error)
+}
+
+// DefaultNeedHandlers returns the need handlers built into the config container, by need.
+func DefaultNeedHandlers() map[string]NeedHandler {
+	return map[string]NeedHandler{
+		"ecr":          &ecrNeed{},
+		"lambda":       &lambdaNeed{},
+		"s3-assets":    &s3AssetsNeed{},
+		"codeartifact": &codeArtifactNeed{},
+		"oci-chart":    &ociChartNeed{},
+	}
+}
+
+// provideNeeds validates and then prepares each need in turn (in name order), adding the results to the response.
+func (h *Handler) provideNeeds(needBuilds map[string][]string, base *NeedRequest, response *common.ConfigureReleaseResponse) error {
+	var needs []string
+	for need := range needBuilds {
+		needs = append(needs, need)
+	}
+	sort.Strings(needs)
+
+	requests := make(map[string]*NeedRequest)
+	for _, need := range needs {
+		request := *base
+		request.Need = need
+		request.BuildIDs = append([]string{}, needBuilds[need]...)
+		sort.Strings(request.BuildIDs)
+		if err := h.NeedHandlers[need].Validate(h, &request); err != nil {
+			return err
+		}
+		requests[need] = &request
+	}
+
+	for _, need := range needs {
+		result, err := h.NeedHandlers[need].Prepare(h, requests[need])
+		if err != nil {
+			return fmt.Errorf("unable to satisfy %q need: %v", need, err)
+		}
+		for buildID, env := range result.Env {
+			for key, value := range env {
+				response.Env[buildID][key] = value
+			}
+		}
+		for key, value := range result.Metadata {
+			response.AdditionalMetadata[key] = value
+		}
+	}
+	return nil
+}
+
+// lambdaNeed provides the bucket and path that builds upload lambda function code to.
+type lambdaNeed struct{}
+
+func (n *lambdaNeed) Validate(h *Handler, request *NeedRequest) error {
+	return nil
+}
+
+func (n *lambdaNeed) Prepare(h *Handler, request *NeedRequest) (*NeedResult, error) {
+	result := NewNeedResult(request)
+	for _, buildID := range request.BuildIDs {
+		env := result.Env[buildID]
+		env["LAMBDA_BUCKET"] = h.Profile.LambdaBucket
+		env["LAMBDA_PATH"] = lambdaPath(request.Team, request.Component, request.Version, buildID)
+		setAWSEnvironmentVariables(env, request.Credentials, h.Profile.Region)
+	}
+	return result, nil
+}
@@ -0,0 +1,122 @@
+package handler_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type MockNeedHandler struct {
+	validateErr error
+	requests    []*handler.NeedRequest
+}
+
+func (m *MockNeedHandler) Validate(h *handler.Handler, request *handler.NeedRequest) error {
+	return m.validateErr
+}
+
+func (m *MockNeedHandler) Prepare(h *handler.Handler, request *handler.NeedRequest) (*handler.NeedResult, error) {
+	m.requests = append(m.requests, request)
+	result := handler.NewNeedResult(request)
+	for _, buildID := range request.BuildIDs {
+		result.Env[buildID]["MOCK_BUILD"] = buildID
+	}
+	result.Metadata["mock_builds"] = strings.Join(request.BuildIDs, ",")
+	return result, nil
+}
+
+func configureReleaseWithNeeds(t *testing.T, h *handler.Handler, config map[string]interface{}, requirements map[string]*common.ReleaseRequirements) (*common.ConfigureReleaseResponse, string) {
+	request := createConfigureReleaseRequest()
+	request.Component = "my-component"
+	request.Config["team"] = "my-team"
+	for key, value := range config {
+		request.Config[key] = value
+	}
+	request.Version = "1"
+	request.ReleaseRequirements = requirements
+	response := common.CreateConfigureReleaseResponse()
+
+	var errorBuffer bytes.Buffer
+	if err := h.WithErrorStream(&errorBuffer).ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String()
+}
+
+func TestConfigureReleaseCustomNeedHandler(t *testing.T) {
+	// Given
+	need := &MockNeedHandler{}
+	h := createECRSettingsHandler(&bytes.Buffer{}, nil).WithNeedHandler("mock", need)
+
+	// When
+	response, output := configureReleaseWithNeeds(t, h, nil, map[string]*common.ReleaseRequirements{
+		"b": {Needs: []string{"mock"}},
+		"a": {Needs: []string{"mock", "lambda"}},
+		"c": {},
+	})
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if len(need.requests) != 1 || strings.Join(need.requests[0].BuildIDs, ",") != "a,b" {
+		t.Fatalf("expected one request for builds a and b, got %v", need.requests)
+	}
+	if need.requests[0].Team != "my-team" || need.requests[0].Credentials.AccessKeyID != "foo" {
+		t.Fatalf("unexpected request: %+v", need.requests[0])
+	}
+	if response.Env["a"]["MOCK_BUILD"] != "a" || response.Env["b"]["MOCK_BUILD"] != "b" {
+		t.Fatalf("unexpected env: %v", response.Env)
+	}
+	if response.Env["a"]["LAMBDA_PATH"] != "my-team/my-component/1/a" {
+		t.Fatalf("expected %q, got %q", "my-team/my-component/1/a", response.Env["a"]["LAMBDA_PATH"])
+	}
+	if response.AdditionalMetadata["mock_builds"] != "a,b" {
+		t.Fatalf("expected %q, got %q", "a,b", response.AdditionalMetadata["mock_builds"])
+	}
+}
+
+func TestConfigureReleaseValidatesAllNeedsFirst(t *testing.T) {
+	// Given
+	valid := &MockNeedHandler{}
+	invalid := &MockNeedHandler{validateErr: errors.New("cdflow.yaml error: bad config")}
+	h := createECRSettingsHandler(&bytes.Buffer{}, nil).
+		WithNeedHandler("a-valid", valid).
+		WithNeedHandler("b-invalid", invalid)
+
+	// When
+	response, output := configureReleaseWithNeeds(t, h, nil, map[string]*common.ReleaseRequirements{
+		"build": {Needs: []string{"a-valid", "b-invalid"}},
+	})
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	if !strings.Contains(output, "cdflow.yaml error: bad config") {
+		t.Fatalf("expected validation error in %q", output)
+	}
+	if len(valid.requests) != 0 {
+		t.Fatal("expected no need to be prepared")
+	}
+}
+
+func TestConfigureReleaseUnknownNeed(t *testing.T) {
+	// When
+	response, output := configureReleaseWithNeeds(t, createECRSettingsHandler(&bytes.Buffer{}, nil), nil, map[string]*common.ReleaseRequirements{
+		"build": {Needs: []string{"unknown"}},
+	})
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := `unable to satisfy "unknown" need for "build" build`
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+}
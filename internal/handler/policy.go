@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// canonicalisePolicy normalises a parsed JSON policy (repository or lifecycle) so that documents AWS treats as the same
+// compare as equal: a single string value is the same as a list containing just that string, and lists (statements,
+// actions, rules, tag prefixes, etc.) are unordered. Whitespace and key order are already gone once the JSON is parsed.
+func canonicalisePolicy(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			if itemString, ok := item.(string); ok {
+				result[key] = []interface{}{itemString}
+			} else {
+				result[key] = canonicalisePolicy(item)
+			}
+		}
+		return result
+	case []interface{}:
+		items := make([]interface{}, 0, len(typed))
+		seen := make(map[string]bool, len(typed))
+		for _, item := range typed {
+			canonical := canonicalisePolicy(item)
+			key := canonicalKey(canonical)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			items = append(items, canonical)
+		}
+		sort.Slice(items, func(i, j int) bool {
+			return canonicalKey(items[i]) < canonicalKey(items[j])
+		})
+		return items
+	}
+	return value
+}
+
+// canonicalKey serialises a canonical value for sorting and de-duplication (encoding/json sorts map keys).
+func canonicalKey(value interface{}) string {
+	serialised, _ := json.Marshal(value)
+	return string(serialised)
+}
+
+// policiesEqual reports whether two JSON policy documents are equivalent. Invalid JSON is never equal to anything,
+// so that a corrupt policy gets replaced.
+func policiesEqual(a, b string) bool {
+	var parsedA, parsedB interface{}
+	if err := json.Unmarshal([]byte(a), &parsedA); err != nil {
+		return false
+	}
+	if err := json.Unmarshal([]byte(b), &parsedB); err != nil {
+		return false
+	}
+	return canonicalKey(canonicalisePolicy(parsedA)) == canonicalKey(canonicalisePolicy(parsedB))
+}
+
+// sortPolicyLists orders the lists in a parsed policy by their canonical form, so that both sides of a diff list
+// things in the same order.
+func sortPolicyLists(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			result[key] = sortPolicyLists(item)
+		}
+		return result
+	case []interface{}:
+		items := make([]interface{}, len(typed))
+		for i, item := range typed {
+			items[i] = sortPolicyLists(item)
+		}
+		sort.SliceStable(items, func(i, j int) bool {
+			return canonicalKey(canonicalisePolicy(items[i])) < canonicalKey(canonicalisePolicy(items[j]))
+		})
+		return items
+	}
+	return value
+}
+
+// matchPolicyShape rewrites single string values in existing as lists, or single string lists as strings, where
+// desired uses the other form - so that a diff doesn't show differences AWS ignores.
+func matchPolicyShape(existing, desired interface{}) interface{} {
+	switch typed := existing.(type) {
+	case map[string]interface{}:
+		desiredMap, ok := desired.(map[string]interface{})
+		if !ok {
+			return existing
+		}
+		result := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			result[key] = matchPolicyShape(item, desiredMap[key])
+		}
+		return result
+	case []interface{}:
+		if desiredString, ok := desired.(string); ok && len(typed) == 1 && typed[0] == desiredString {
+			return desiredString
+		}
+		desiredList, ok := desired.([]interface{})
+		if !ok || len(desiredList) != len(typed) {
+			return existing
+		}
+		result := make([]interface{}, len(typed))
+		for i, item := range typed {
+			result[i] = matchPolicyShape(item, desiredList[i])
+		}
+		return result
+	case string:
+		if desiredList, ok := desired.([]interface{}); ok && len(desiredList) == 1 && desiredList[0] == typed {
+			return desiredList
+		}
+	}
+	return existing
+}
+
+// prettyPolicies formats the existing and desired JSON policies for diffing. Invalid JSON is returned unchanged.
+func prettyPolicies(existing, desired string) (string, string) {
+	var parsedExisting, parsedDesired interface{}
+	if err := json.Unmarshal([]byte(desired), &parsedDesired); err != nil {
+		return existing, desired
+	}
+	parsedDesired = sortPolicyLists(parsedDesired)
+	prettyDesired, _ := json.MarshalIndent(parsedDesired, "", "  ")
+	if err := json.Unmarshal([]byte(existing), &parsedExisting); err != nil {
+		return existing, string(prettyDesired)
+	}
+	parsedExisting = matchPolicyShape(sortPolicyLists(parsedExisting), parsedDesired)
+	prettyExisting, _ := json.MarshalIndent(parsedExisting, "", "  ")
+	return string(prettyExisting), string(prettyDesired)
+}
+
+// policyDiff returns a line diff between two JSON policies, with lines prefixed "- " for removed, "+ " for added and
+// "  " for unchanged, each indented by indent.
+func policyDiff(existing, desired, indent string) string {
+	prettyExisting, prettyDesired := prettyPolicies(existing, desired)
+	var a []string
+	if existing != "" {
+		a = strings.Split(prettyExisting, "\n")
+	}
+	b := strings.Split(prettyDesired, "\n")
+
+	// longest common subsequence, which is fine for policies of a few hundred lines at most
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	var builder strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			builder.WriteString(indent + "  " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lengths[i+1][j] >= lengths[i][j+1]):
+			builder.WriteString(indent + "- " + a[i] + "\n")
+			i++
+		default:
+			builder.WriteString(indent + "+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,106 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// normalisedRepoPolicyDocument is expectedRepoPolicyDocument as AWS returns it - compact, with keys reordered and
+// single item lists collapsed.
+const normalisedRepoPolicyDocument = `{"Statement":[{"Action":["ecr:GetDownloadUrlForLayer","ecr:BatchGetImage","ecr:BatchCheckLayerAvailability"],` +
+	`"Condition":{"StringEquals":{"aws:PrincipalOrgID":["o-qisv7rs9ed"]}},"Principal":"*","Effect":"Allow"}],"Version":"2008-10-17"}`
+
+const reorderedPolicyDocument = `{"rules": [{"action": {"type": "expire"}, "selection": {"countNumber": 50, "countType": "imageCountMoreThan", ` +
+	`"tagPrefixList": ["my-ecr-"], "tagStatus": "tagged"}, "rulePriority": 1}]}`
+
+func configureReleaseWithPolicies(t *testing.T, ecrClient *MockECRClient) string {
+	request := createConfigureReleaseRequest()
+	request.Component = "my-component"
+	request.Config["team"] = "my-team"
+	request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+		"my-ecr": {Needs: []string{"ecr"}},
+	}
+	response := common.CreateConfigureReleaseResponse()
+
+	var errorBuffer bytes.Buffer
+	h := handler.New().
+		WithErrorStream(&errorBuffer).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		}).
+		WithECRClientFactory(func(session client.ConfigProvider) ecriface.ECRAPI {
+			return ecrClient
+		})
+
+	if err := h.ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	return errorBuffer.String()
+}
+
+func TestConfigureReleaseEquivalentPolicies(t *testing.T) {
+	// Given
+	ecrClient := &MockECRClient{
+		DefaultMutability:        "IMMUTABLE",
+		DefaultScanOnPush:        true,
+		ExistingRepositoryPolicy: normalisedRepoPolicyDocument,
+		ExistingLifecyclePolicy:  reorderedPolicyDocument,
+	}
+
+	// When
+	configureReleaseWithPolicies(t, ecrClient)
+
+	// Then
+	if ecrClient.SetRepositoryPolicyInput != nil {
+		t.Fatal("unexpected repository policy update")
+	}
+	if ecrClient.PutLifecyclePolicyInput != nil {
+		t.Fatal("unexpected lifecycle policy update")
+	}
+}
+
+func TestConfigureReleaseChangedPolicies(t *testing.T) {
+	// Given
+	ecrClient := &MockECRClient{
+		DefaultMutability:        "IMMUTABLE",
+		DefaultScanOnPush:        true,
+		ExistingRepositoryPolicy: strings.Replace(normalisedRepoPolicyDocument, `"ecr:BatchGetImage",`, "", 1),
+		ExistingLifecyclePolicy:  strings.Replace(reorderedPolicyDocument, `"countNumber": 50`, `"countNumber": 20`, 1),
+	}
+
+	// When
+	output := configureReleaseWithPolicies(t, ecrClient)
+
+	// Then
+	if ecrClient.SetRepositoryPolicyInput == nil {
+		t.Fatal("expected repository policy update")
+	}
+	if strings.Contains(output, `"aws:PrincipalOrgID": [`) {
+		t.Fatalf("unexpected diff for equivalent values:\n%s", output)
+	}
+	if ecrClient.PutLifecyclePolicyInput == nil {
+		t.Fatal("expected lifecycle policy update")
+	}
+	for _, expected := range []string{
+		"- Updating repository policy:\n",
+		`    +         "ecr:BatchGetImage",` + "\n",
+		"- Updating lifecycle policy:\n",
+		`    -         "countNumber": 20,` + "\n",
+		`    +         "countNumber": 50,` + "\n",
+		`              "countType": "imageCountMoreThan",` + "\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, output)
+		}
+	}
+}
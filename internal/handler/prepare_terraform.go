@@ -8,7 +8,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -17,6 +17,12 @@ import (
 
 // PrepareTerraform runs before terraform to configure.
 func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, response *common.PrepareTerraformResponse, releaseDir string) error {
+	if err := h.LoadProfile(request.Config, request.Env); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
 	team, err := h.getTeam(request.Config["team"])
 	if err != nil {
 		response.Success = false
@@ -24,7 +30,26 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 		return nil
 	}
 
-	if err := h.InitReleaseAccountCredentials(request.Env, team); err != nil {
+	encryption, err := ParseS3Encryption(request.Config, h.Profile, team)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+	releaseRole, err := releaseRoleName(request.Config, team)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+	allowUnverified, err := AllowUnverifiedRelease(request.Config)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	if err := h.InitReleaseAccountCredentials(prepareTerraformRoleContext(request, team)); err != nil {
 		response.Success = false
 		fmt.Fprintln(h.ErrorStream, err)
 		return nil
@@ -41,12 +66,13 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 	response.TerraformBackendConfig["access_key"] = releaseAccountCredentialsValue.AccessKeyID
 	response.TerraformBackendConfig["secret_key"] = releaseAccountCredentialsValue.SecretAccessKey
 	response.TerraformBackendConfig["token"] = releaseAccountCredentialsValue.SessionToken
-	response.TerraformBackendConfig["region"] = Region
-	response.TerraformBackendConfig["bucket"] = TFStateBucket
+	response.TerraformBackendConfig["region"] = h.Profile.Region
+	response.TerraformBackendConfig["bucket"] = h.Profile.TFStateBucket
 	// When using a non-default workspace, the state path will be bucket/workspace_key_prefix/workspace_name/key
 	response.TerraformBackendConfig["workspace_key_prefix"] = fmt.Sprintf("%s/%s", team, request.Component)
 	response.TerraformBackendConfig["key"] = "terraform.tfstate"
 	response.TerraformBackendConfig["dynamodb_table"] = fmt.Sprintf("%s-tflocks", team)
+	encryption.applyToBackend(response.TerraformBackendConfig)
 
 	session, err := h.createReleaseAccountSession()
 	if err != nil {
@@ -59,7 +85,23 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 		return nil
 	}
 
-	AddAdditionalEnvironment(request.Env, response.Env)
+	secrets, err := h.ResolveSecrets(request, response.Env)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	if err := AddAdditionalEnvironment(request.Config, request.EnvName, request.Env, response.Env); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	// secrets take priority over variables passed through from the environment
+	for name, value := range secrets {
+		response.Env[name] = value
+	}
 
 	s3Client := h.S3ClientFactory(session)
 
@@ -82,24 +124,48 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 	}
 
 	if request.Version == "" {
-		return nil
+		return recordEnvTier(releaseDir, response.Env)
 	}
 
 	key := releaseS3Key(team, request.Component, request.Version)
-	fmt.Fprintf(h.ErrorStream, "- Downloading release from s3://%s/%s...\n", ReleaseBucket, key)
+	fmt.Fprintf(h.ErrorStream, "- Downloading release from s3://%s/%s...\n", h.Profile.ReleaseBucket, key)
 
 	getObjectOutput, err := s3Client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(ReleaseBucket),
+		Bucket: aws.String(h.Profile.ReleaseBucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			err = h.missingReleaseError(team, request.Component, request.Version, s3Client)
+		} else if isKMSAccessDenied(err) {
+			err = encryption.kmsAccessDenied(err, fmt.Sprintf("s3://%s/%s", h.Profile.ReleaseBucket, key), releaseRole)
+		} else if ok && aerr.Code() == "AccessDenied" {
+			err = h.releaseAccessDeniedError(err, team, request.Component, request.Version, s3Client)
+		}
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	release, checksum, err := h.verifiedRelease(key, getObjectOutput, allowUnverified)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+	defer os.Remove(release.Name())
+	defer release.Close()
+
+	if err := h.verifyReleaseSignature(
+		request.Env, request.EnvName, response.Env, key, checksum, s3Client, h.KMSClientFactory(session),
+	); err != nil {
 		response.Success = false
 		fmt.Fprintln(h.ErrorStream, err)
 		return nil
 	}
 
 	terraformImage, err := h.ReleaseLoader.Load(
-		getObjectOutput.Body, request.Component, request.Version, releaseDir,
+		release, request.Component, request.Version, releaseDir,
 		func(path, checksum string) (io.ReadCloser, error) {
 			expectedPrefix := ".terraform/plugins/"
 			if !strings.HasPrefix(path, expectedPrefix) {
@@ -113,12 +179,15 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 				return nil, err
 			}
 			fmt.Fprintf(h.ErrorStream, "- Downloading provider plugin %s...\n", name)
+			pluginKey := savedPluginKey(team, path, checksum)
 			getObjectOutput, err := s3Client.GetObject(&s3.GetObjectInput{
-				Bucket: aws.String(ReleaseBucket),
-				Key:    aws.String(savedPluginKey(team, path, checksum)),
+				Bucket: aws.String(h.Profile.ReleaseBucket),
+				Key:    aws.String(pluginKey),
 			})
 			if err != nil {
-				return nil, err
+				return nil, encryption.kmsAccessDenied(
+					err, fmt.Sprintf("s3://%s/%s", h.Profile.ReleaseBucket, pluginKey), releaseRole,
+				)
 			}
 			return getObjectOutput.Body, nil
 		},
@@ -128,7 +197,43 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 	}
 	response.TerraformImage = terraformImage
 
-	return nil
+	ecrClient := h.ECRClientFactory(session)
+	if err := h.checkImageScans(
+		request.Config, response.Env["ACURIS_ENV_TIER"], team, request.Component, request.Version, releaseDir, ecrClient,
+	); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	if err := h.resolveECRImages(
+		request.Config, team, request.Component, request.Version, releaseDir, ecrClient, response.Env,
+	); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	deployRegionSession, err := h.createReleaseAccountSessionInRegion(response.Env["AWS_DEFAULT_REGION"])
+	if err != nil {
+		return fmt.Errorf("unable to create AWS session in release account: %v", err)
+	}
+	if err := h.resolveLambdaObjects(
+		request.Config, releaseDir, response.Env["AWS_DEFAULT_REGION"], s3Client, h.S3ClientFactory(deployRegionSession),
+	); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	return recordEnvTier(releaseDir, response.Env)
+}
+
+// recordEnvTier adds the tier of the environment to the release metadata.
+func recordEnvTier(releaseDir string, responseEnv map[string]string) error {
+	return updateReleaseMetadata(releaseDir, "release", map[string]string{
+		"env_tier": responseEnv["ACURIS_ENV_TIER"],
+	})
 }
 
 func (h *Handler) validateStateExists(request *common.PrepareTerraformRequest, team string, statePath string, response *common.PrepareTerraformResponse, s3Client s3iface.S3API) error {
@@ -177,17 +282,54 @@ func (h *Handler) validateStateDoesNotExist(request *common.PrepareTerraformRequ
 	)
 }
 
-func (h *Handler) addRootAccountCredentials(requestEnv map[string]string, responseEnv map[string]string) error {
-	if requestEnv["AWS_ACCESS_KEY_ID"] == "" || requestEnv["AWS_SECRET_ACCESS_KEY"] == "" {
-		return fmt.Errorf("AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not found in env")
+func (h *Handler) addRootAccountCredentials(requestEnv map[string]string, responseEnv map[string]string, region string) error {
+	session, err := h.GetRootAccountSession(requestEnv)
+	if err != nil {
+		return err
+	}
+	value, err := session.Config.Credentials.Get()
+	if err != nil {
+		return err
 	}
-	responseEnv["AWS_ACCESS_KEY_ID"] = requestEnv["AWS_ACCESS_KEY_ID"]
-	responseEnv["AWS_SECRET_ACCESS_KEY"] = requestEnv["AWS_SECRET_ACCESS_KEY"]
-	responseEnv["AWS_SESSION_TOKEN"] = requestEnv["AWS_SESSION_TOKEN"]
-	responseEnv["AWS_DEFAULT_REGION"] = Region
+	responseEnv["AWS_ACCESS_KEY_ID"] = value.AccessKeyID
+	responseEnv["AWS_SECRET_ACCESS_KEY"] = value.SecretAccessKey
+	responseEnv["AWS_SESSION_TOKEN"] = value.SessionToken
+	responseEnv["AWS_DEFAULT_REGION"] = region
 	return nil
 }
 
+// deployRegion returns the region to deploy envName to - from config.params.regions if the environment is listed,
+// otherwise config.params.region, otherwise the platform region. The state backend always uses the platform region.
+func (h *Handler) deployRegion(config map[string]interface{}, envName string) (string, error) {
+	region := h.Profile.Region
+	param := "config.params.region"
+	if value, ok := config["region"]; ok {
+		regionString, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("cdflow.yaml error: config.params.region must be a string")
+		}
+		region = regionString
+	}
+	if value, ok := config["regions"]; ok {
+		regions, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("cdflow.yaml error: config.params.regions must be a map of environment names to regions")
+		}
+		if envRegion, ok := regions[envName]; ok {
+			regionString, ok := envRegion.(string)
+			if !ok {
+				return "", fmt.Errorf("cdflow.yaml error: config.params.regions.%s must be a string", envName)
+			}
+			region = regionString
+			param = "config.params.regions." + envName
+		}
+	}
+	if !regionPattern.MatchString(region) {
+		return "", fmt.Errorf("cdflow.yaml error: %s %q is not a valid AWS region", param, region)
+	}
+	return region, nil
+}
+
 // Contains takes a slice and looks for val as an element in it. If found it will
 // return true, otherwise it will return a false.
 func contains(val string, slice []string) bool {
@@ -199,95 +341,108 @@ func contains(val string, slice []string) bool {
 	return false
 }
 
+func prepareTerraformRoleContext(request *common.PrepareTerraformRequest, team string) *RoleContext {
+	return &RoleContext{
+		Config:    request.Config,
+		Env:       request.Env,
+		Team:      team,
+		Component: request.Component,
+		EnvName:   request.EnvName,
+		Version:   request.Version,
+	}
+}
+
 // AddDeployAccountCredentialsValue assumes a role in the right account and returns credentials.
 func (h *Handler) AddDeployAccountCredentialsValue(request *common.PrepareTerraformRequest, team string, responseEnv map[string]string) error {
-	assumeRoleToDeploy, ok := request.Config["assume_role_to_deploy"].(bool)
-	if ok && !assumeRoleToDeploy {
-		return h.addRootAccountCredentials(request.Env, responseEnv)
+	region, err := h.deployRegion(request.Config, request.EnvName)
+	if err != nil {
+		return err
 	}
 
-	accountPrefix, ok := request.Config["account_prefix"].(string)
-	if !ok || accountPrefix == "" {
-		return fmt.Errorf("cdflow.yaml:  error - config.params.account_prefix must be set and be a string value")
+	tier, err := h.ResolveTier(request.Config, request.EnvName)
+	if err != nil {
+		return err
 	}
+	responseEnv["ACURIS_ENV_TIER"] = tier.Name
 
-	prodEnvs := []string{"live"}
-	additionalProdEnvsInterface, ok := request.Config["additional_prod_envs"].([]interface{})
-	if ok {
-		prodEnvs = make([]string, len(additionalProdEnvsInterface)+1)
-		prodEnvs[0] = "live"
-		for i, v := range additionalProdEnvsInterface {
-			prodEnvs[i+1] = v.(string)
-		}
-
-		fmt.Fprintf(h.ErrorStream, "Found additional_prod_envs, appending them to the default resulting in: %v\n", prodEnvs)
+	assumeRoleToDeploy, ok := request.Config["assume_role_to_deploy"].(bool)
+	if ok && !assumeRoleToDeploy {
+		return h.addRootAccountCredentials(request.Env, responseEnv, region)
 	}
 
-	var accountName string
-	if contains(request.EnvName, prodEnvs) {
-		accountName = accountPrefix + "prod"
-	} else {
-		accountName = accountPrefix + "dev"
+	accountName := tier.AccountID
+	if tier.AccountID == "" {
+		accountPrefix, ok := request.Config["account_prefix"].(string)
+		if !ok || accountPrefix == "" {
+			return fmt.Errorf("cdflow.yaml:  error - config.params.account_prefix must be set and be a string value")
+		}
+		accountName = tier.AccountName(accountPrefix)
 	}
 
-	role := team + "-deploy"
-
-	fmt.Fprintf(h.ErrorStream, "- Assuming %q role in %q account...\n", role, accountName)
-
-	session, err := h.GetRootAccountSession(request.Env)
+	role, err := deployRoleName(request.Config, tier, team)
+	if err != nil {
+		return err
+	}
+	roleContext := prepareTerraformRoleContext(request, team)
+	options, err := assumeRoleOptions(roleContext)
 	if err != nil {
 		return err
 	}
 
-	orgsClient := h.OrganizationsClientFactory(session)
+	fmt.Fprintf(h.ErrorStream, "- Assuming %q role in %q account (%s tier) for %s...\n", role, accountName, tier.Name, region)
 
-	input := &organizations.ListAccountsInput{}
-	var accountID string
-	if err := orgsClient.ListAccountsPages(input, func(result *organizations.ListAccountsOutput, lastPage bool) bool {
-		for _, account := range result.Accounts {
-			if *account.Name == accountName {
-				accountID = *account.Id
-				return false
-			}
-		}
-		return true
-	}); err != nil {
+	session, err := h.GetRootAccountSession(request.Env)
+	if err != nil {
 		return err
 	}
 
+	accountID := tier.AccountID
 	if accountID == "" {
-		return fmt.Errorf("account %q not found", accountName)
+		resolver, err := h.AccountResolver(request.Config, session)
+		if err != nil {
+			return err
+		}
+		if accountID, err = resolver.ResolveAccountID(accountName); err != nil {
+			return err
+		}
 	}
 
-	roleSessionName, err := GetRoleSessionName(request.Env)
+	roleSessionName, err := roleContext.RoleSessionName()
 	if err != nil {
 		return err
 	}
 
-	stsClient := h.STSClientFactory(session)
-	result, err := stsClient.AssumeRole(&sts.AssumeRoleInput{
-		RoleArn:         aws.String(fmt.Sprintf("arn:aws:iam::%s:role/%s", accountID, role)),
+	// use the regional endpoint so the session token is valid in opt-in regions
+	stsClient := h.STSClientFactory(session.Copy(
+		aws.NewConfig().
+			WithRegion(region).
+			WithSTSRegionalEndpoint(endpoints.RegionalSTSEndpoint),
+	))
+	roleARN := fmt.Sprintf("arn:aws:iam::%s:role/%s", accountID, role)
+	if err := h.checkSessionDuration(session, roleARN, options.Duration); err != nil {
+		return err
+	}
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(roleARN),
 		RoleSessionName: aws.String(roleSessionName),
-	})
+		DurationSeconds: aws.Int64(int64(options.Duration.Seconds())),
+	}
+	if options.ExternalID != "" {
+		input.ExternalId = aws.String(options.ExternalID)
+	}
+	if len(options.Tags) > 0 {
+		input.Tags = options.Tags
+		input.TransitiveTagKeys = options.TransitiveTagKeys
+	}
+	result, err := stsClient.AssumeRole(input)
 	if err != nil {
-		return err
+		return translateSessionDurationError(err, roleARN, options.Duration)
 	}
 
 	responseEnv["AWS_ACCESS_KEY_ID"] = *result.Credentials.AccessKeyId
 	responseEnv["AWS_SECRET_ACCESS_KEY"] = *result.Credentials.SecretAccessKey
 	responseEnv["AWS_SESSION_TOKEN"] = *result.Credentials.SessionToken
-	responseEnv["AWS_DEFAULT_REGION"] = Region
+	responseEnv["AWS_DEFAULT_REGION"] = region
 
 	return nil
 }
-
-// AddAdditionalEnvironment variables sends in env variables
-func AddAdditionalEnvironment(requestEnv map[string]string, responseEnv map[string]string) {
-	responseEnv["DD_APP_KEY"] = requestEnv["DATADOG_APP_KEY"]
-	responseEnv["DD_API_KEY"] = requestEnv["DATADOG_API_KEY"]
-	responseEnv["FASTLY_API_KEY"] = requestEnv["FASTLY_API_KEY"]
-	responseEnv["GITHUB_TOKEN"] = requestEnv["GITHUB_TOKEN"]
-	responseEnv["MONGODB_ATLAS_PUBLIC_KEY"] = requestEnv["MONGODB_ATLAS_PUBLIC_KEY"]
-	responseEnv["MONGODB_ATLAS_PRIVATE_KEY"] = requestEnv["MONGODB_ATLAS_PRIVATE_KEY"]
-	responseEnv["JUNOS_PASSWORD"] = requestEnv["JUNOS_PASSWORD"]
-}
@@ -29,6 +29,18 @@ type MockSTSClient struct {
 	sessionToken           string
 	assumedRoleArn         string
 	assumedRoleSessionName string
+	assumeRoleInput        *sts.AssumeRoleInput
+	assumeRoleErr          error
+	callerARN              string
+}
+
+func (m *MockSTSClient) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	callerARN := m.callerARN
+	if callerARN == "" {
+		callerARN = "arn:aws:iam::123456789012:user/ci"
+	}
+	callerAccount := strings.Split(callerARN, ":")[4]
+	return &sts.GetCallerIdentityOutput{Arn: aws.String(callerARN), Account: aws.String(callerAccount)}, nil
 }
 
 func (m *MockSTSClient) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
@@ -37,6 +49,10 @@ func (m *MockSTSClient) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleO
 	}
 	m.assumedRoleArn = *input.RoleArn
 	m.assumedRoleSessionName = *input.RoleSessionName
+	m.assumeRoleInput = input
+	if m.assumeRoleErr != nil {
+		return nil, m.assumeRoleErr
+	}
 	return &sts.AssumeRoleOutput{
 		Credentials: &sts.Credentials{
 			AccessKeyId:     aws.String(m.accessKeyID),
@@ -49,9 +65,11 @@ func (m *MockSTSClient) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleO
 type MockOrganizationsClient struct {
 	organizationsiface.OrganizationsAPI
 	Accounts map[string]string
+	calls    int
 }
 
 func (m *MockOrganizationsClient) ListAccountsPages(input *organizations.ListAccountsInput, callback func(*organizations.ListAccountsOutput, bool) bool) error {
+	m.calls++
 	output := organizations.ListAccountsOutput{}
 	for name, id := range m.Accounts {
 		output.Accounts = append(output.Accounts, &organizations.Account{
@@ -67,7 +85,7 @@ func (m *MockOrganizationsClient) ListAccountsPages(input *organizations.ListAcc
 type MockReleaseLoader struct {
 	called         bool
 	terraformImage string
-	reader         io.Reader
+	contents       string
 	component      string
 	version        string
 	releaseDir     string
@@ -81,7 +99,11 @@ func (m *MockReleaseLoader) Load(
 		log.Fatal("Load called twice")
 	}
 	m.called = true
-	m.reader = reader
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	m.contents = string(contents)
 	m.component = component
 	m.version = version
 	m.releaseDir = releaseDir
@@ -115,11 +137,17 @@ func TestPrepareTerraform(t *testing.T) {
 		log.Fatal(err)
 	}
 	defer os.Remove(file.Name())
+	if _, err := file.WriteString("release contents"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Fatal(err)
+	}
 
 	mockS3Client := &MockS3Client{
 		getObjectBody: file,
 	}
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider(accessKeyID, secretAccessKey, sessionToken)
 	}
 
@@ -227,8 +255,8 @@ func TestPrepareTerraform(t *testing.T) {
 	if loader.releaseDir != releaseDir {
 		t.Fatalf("Want %q, got %q", releaseDir, loader.releaseDir)
 	}
-	if loader.reader != file {
-		t.Fatalf("Want %v, got %v", file, loader.reader)
+	if loader.contents != "release contents" {
+		t.Fatalf("Want %q, got %q", "release contents", loader.contents)
 	}
 }
 
@@ -259,7 +287,7 @@ func TestPrepareTerraformNoAccountPrefix(t *testing.T) {
 	mockS3Client := &MockS3Client{
 		getObjectBody: file,
 	}
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider(accessKeyID, secretAccessKey, sessionToken)
 	}
 
@@ -328,7 +356,7 @@ func TestPrepareTerraformWithoutAdditionalProdEnvs(t *testing.T) {
 	mockS3Client := &MockS3Client{
 		getObjectBody: file,
 	}
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider(accessKeyID, secretAccessKey, sessionToken)
 	}
 
@@ -398,7 +426,7 @@ func TestPrepareTerraformWithAdditionalProdEnvs(t *testing.T) {
 	mockS3Client := &MockS3Client{
 		getObjectBody: file,
 	}
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider(accessKeyID, secretAccessKey, sessionToken)
 	}
 
@@ -476,7 +504,7 @@ func TestPrepareTerraformStateShouldExistButDoesNot(t *testing.T) {
 		},
 	}
 
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider(accessKeyID, secretAccessKey, sessionToken)
 	}
 
@@ -575,7 +603,7 @@ func TestPrepareTerraformStateShouldExist(t *testing.T) {
 		},
 	}
 
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider(accessKeyID, secretAccessKey, sessionToken)
 	}
 
@@ -670,7 +698,7 @@ func TestPrepareTerraformStateShouldNotExistButDoes(t *testing.T) {
 		},
 	}
 
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider(accessKeyID, secretAccessKey, sessionToken)
 	}
 
@@ -769,7 +797,7 @@ func TestPrepareTerraformStateShouldNotExist(t *testing.T) {
 		},
 	}
 
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider(accessKeyID, secretAccessKey, sessionToken)
 	}
 
@@ -828,3 +856,127 @@ func TestPrepareTerraformStateShouldNotExist(t *testing.T) {
 		t.Fatal("unexpected failure: Should succeed when tfstate file does not exist")
 	}
 }
+
+func createPrepareTerraformRequest() *common.PrepareTerraformRequest {
+	request := common.CreatePrepareTerraformRequest()
+	request.Env["AWS_ACCESS_KEY_ID"] = "root foo"
+	request.Env["AWS_SECRET_ACCESS_KEY"] = "root bar"
+	request.Env["ROLE_SESSION_NAME"] = "baz"
+	request.Config["team"] = "test-team"
+	request.Config["account_prefix"] = "foo"
+	request.Component = "test-component"
+	request.EnvName = "live"
+	return request
+}
+
+func createPrepareTerraformHandler(errorBuffer *bytes.Buffer, s3Client *MockS3Client, stsClient *MockSTSClient, stsRegion *string) *handler.Handler {
+	return handler.New().
+		WithErrorStream(errorBuffer).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		}).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API {
+			return s3Client
+		}).
+		WithSTSClientFactory(func(session client.ConfigProvider) stsiface.STSAPI {
+			if stsRegion != nil {
+				*stsRegion = *session.ClientConfig(sts.EndpointsID).Config.Region
+			}
+			return stsClient
+		}).
+		WithOrganizationsClientFactory(func(client.ConfigProvider) organizationsiface.OrganizationsAPI {
+			return &MockOrganizationsClient{
+				Accounts: map[string]string{
+					"foodev":  "0987654321",
+					"fooprod": "1234567890",
+				},
+			}
+		}).
+		WithReleaseLoader(&MockReleaseLoader{})
+}
+
+func TestPrepareTerraformRegions(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		config         map[string]interface{}
+		envName        string
+		expectedRegion string
+	}{
+		{"default", map[string]interface{}{}, "live", handler.Region},
+		{"region param", map[string]interface{}{"region": "us-east-1"}, "live", "us-east-1"},
+		{
+			"per-environment region",
+			map[string]interface{}{
+				"region":  "eu-west-1",
+				"regions": map[string]interface{}{"live-us": "us-east-1"},
+			},
+			"live-us",
+			"us-east-1",
+		},
+		{
+			"environment not in regions map",
+			map[string]interface{}{
+				"region":  "ap-southeast-1",
+				"regions": map[string]interface{}{"live-us": "us-east-1"},
+			},
+			"ci",
+			"ap-southeast-1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			request := createPrepareTerraformRequest()
+			request.EnvName = tc.envName
+			for key, value := range tc.config {
+				request.Config[key] = value
+			}
+			response := common.CreatePrepareTerraformResponse()
+
+			var errorBuffer bytes.Buffer
+			var stsRegion string
+			h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, &MockSTSClient{}, &stsRegion)
+
+			// When
+			if err := h.PrepareTerraform(request, response, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			if !response.Success {
+				t.Fatalf("unexpected failure: %s", errorBuffer.String())
+			}
+			if response.Env["AWS_DEFAULT_REGION"] != tc.expectedRegion {
+				t.Fatalf("expected %q, got %q", tc.expectedRegion, response.Env["AWS_DEFAULT_REGION"])
+			}
+			if stsRegion != tc.expectedRegion {
+				t.Fatalf("expected deploy credentials from %q, got %q", tc.expectedRegion, stsRegion)
+			}
+			if response.TerraformBackendConfig["region"] != handler.Region {
+				t.Fatalf("expected backend in %q, got %q", handler.Region, response.TerraformBackendConfig["region"])
+			}
+		})
+	}
+
+	t.Run("invalid region", func(t *testing.T) {
+		// Given
+		request := createPrepareTerraformRequest()
+		request.Config["regions"] = map[string]interface{}{"live": "moon-base-1"}
+		response := common.CreatePrepareTerraformResponse()
+
+		var errorBuffer bytes.Buffer
+		h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, &MockSTSClient{}, nil)
+
+		// When
+		if err := h.PrepareTerraform(request, response, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		if response.Success {
+			t.Fatal("unexpected success")
+		}
+		if !strings.Contains(errorBuffer.String(), `config.params.regions.live "moon-base-1" is not a valid AWS region`) {
+			t.Fatalf("wrong error?: %q", errorBuffer.String())
+		}
+	})
+}
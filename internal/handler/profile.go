@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultProfilePath is where a derived image can bake in a platform profile.
+const DefaultProfilePath = "/etc/cdflow2-config-acuris/profile.json"
+
+// ProfilePathEnvVar names the environment variable that overrides the profile file path.
+const ProfilePathEnvVar = "CDFLOW2_PLATFORM_PROFILE"
+
+// Profile describes the platform installation that releases are stored in and deployed from.
+type Profile struct {
+	AccountID      string `json:"account_id"`
+	LambdaBucket   string `json:"lambda_bucket"`
+	ReleaseBucket  string `json:"release_bucket"`
+	TFStateBucket  string `json:"tfstate_bucket"`
+	Region         string `json:"region"`
+	OrganizationID string `json:"organization_id"`
+	// ReleaseSigning is nil unless releases are signed.
+	ReleaseSigning *ReleaseSigningConfig `json:"-"`
+	// ReleaseSHA256RequiredSince is nil unless releases uploaded since then must have a hash to be deployed.
+	ReleaseSHA256RequiredSince *time.Time `json:"-"`
+}
+
+// DefaultProfile returns the profile for the Acuris platform.
+func DefaultProfile() *Profile {
+	return &Profile{
+		AccountID:      AccountID,
+		LambdaBucket:   LambdaBucket,
+		ReleaseBucket:  ReleaseBucket,
+		TFStateBucket:  TFStateBucket,
+		Region:         Region,
+		OrganizationID: OrganizationID,
+	}
+}
+
+type profileField struct {
+	key     string
+	pattern *regexp.Regexp
+	value   func(*Profile) *string
+}
+
+var bucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-gov)?-[a-z]+-\d$`)
+
+var profileFields = []profileField{
+	{"account_id", regexp.MustCompile(`^\d{12}$`), func(p *Profile) *string { return &p.AccountID }},
+	{"lambda_bucket", bucketPattern, func(p *Profile) *string { return &p.LambdaBucket }},
+	{"release_bucket", bucketPattern, func(p *Profile) *string { return &p.ReleaseBucket }},
+	{"tfstate_bucket", bucketPattern, func(p *Profile) *string { return &p.TFStateBucket }},
+	{"region", regionPattern, func(p *Profile) *string { return &p.Region }},
+	{"organization_id", regexp.MustCompile(`^o-[a-z0-9]{10,32}$`), func(p *Profile) *string { return &p.OrganizationID }},
+}
+
+func isProfileField(key string) bool {
+	for _, field := range profileFields {
+		if field.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func profileEnvVar(key string) string {
+	return "ACURIS_PLATFORM_" + strings.ToUpper(key)
+}
+
+func (p *Profile) apply(values map[string]string) {
+	for _, field := range profileFields {
+		if value, ok := values[field.key]; ok && value != "" {
+			*field.value(p) = value
+		}
+	}
+}
+
+func (p *Profile) applyEnv(env map[string]string) {
+	values := make(map[string]string)
+	for _, field := range profileFields {
+		values[field.key] = env[profileEnvVar(field.key)]
+	}
+	p.apply(values)
+}
+
+func (p *Profile) validate() error {
+	var problems []string
+	for _, field := range profileFields {
+		if value := *field.value(p); !field.pattern.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("%s %q is not valid", field.key, value))
+		}
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid platform profile: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func processEnv() map[string]string {
+	env := make(map[string]string)
+	for _, item := range os.Environ() {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return env
+}
+
+// readProfileFile applies the profile file to the profile, returning its values.
+func (h *Handler) readProfileFile(profile *Profile) (map[string]string, error) {
+	path := h.ProfilePath
+	explicit := path != DefaultProfilePath
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read platform profile %s: %v", path, err)
+	}
+	var values map[string]string
+	if err := json.Unmarshal(contents, &values); err != nil {
+		return nil, fmt.Errorf("unable to parse platform profile %s: %v", path, err)
+	}
+	profile.apply(values)
+	return values, nil
+}
+
+// trustedProfileValues returns the values of keys from the profile file, overridden by the config container's
+// environment.
+func trustedProfileValues(keys []string, fileValues, containerEnv map[string]string) map[string]string {
+	values := make(map[string]string)
+	for _, key := range keys {
+		if value := fileValues[key]; value != "" {
+			values[key] = value
+		}
+		if value := containerEnv[profileEnvVar(key)]; value != "" {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// LoadProfile builds the platform profile from the defaults, overridden in turn by the profile file,
+// the config container's environment, the forwarded environment and config.params.platform. Release signing and
+// release_sha256_required_since are only read from the profile file and the config container's environment.
+func (h *Handler) LoadProfile(config map[string]interface{}, env map[string]string) error {
+	profile := DefaultProfile()
+
+	fileValues, err := h.readProfileFile(profile)
+	if err != nil {
+		return err
+	}
+
+	containerEnv := processEnv()
+	profile.applyEnv(containerEnv)
+	profile.applyEnv(env)
+
+	if platform, ok := config["platform"]; ok {
+		platformMap, ok := platform.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("cdflow.yaml error: config.params.platform must be a map")
+		}
+		values := make(map[string]string)
+		for key, value := range platformMap {
+			if !isProfileField(key) {
+				return fmt.Errorf("cdflow.yaml error: unknown key config.params.platform.%s", key)
+			}
+			stringValue, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("cdflow.yaml error: config.params.platform.%s must be a string", key)
+			}
+			values[key] = stringValue
+		}
+		profile.apply(values)
+	}
+
+	if err := profile.validate(); err != nil {
+		return err
+	}
+	if profile.ReleaseSigning, err = ParseReleaseSigningProfile(trustedProfileValues(releaseSigningProfileKeys, fileValues, containerEnv)); err != nil {
+		return err
+	}
+	requiredSince := trustedProfileValues([]string{releaseSHA256RequiredSinceKey}, fileValues, containerEnv)
+	if profile.ReleaseSHA256RequiredSince, err = ParseReleaseSHA256RequiredSince(requiredSince[releaseSHA256RequiredSinceKey]); err != nil {
+		return err
+	}
+	h.Profile = profile
+	return nil
+}
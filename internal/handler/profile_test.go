@@ -0,0 +1,217 @@
+package handler_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestLoadProfile(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		// Given
+		h := handler.New().WithProfilePath(handler.DefaultProfilePath)
+
+		// When
+		if err := h.LoadProfile(map[string]interface{}{}, map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		if *h.Profile != *handler.DefaultProfile() {
+			t.Fatalf("expected %+v, got %+v", *handler.DefaultProfile(), *h.Profile)
+		}
+	})
+
+	t.Run("file, env and config overrides", func(t *testing.T) {
+		// Given
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "profile.json")
+		if err := ioutil.WriteFile(path, []byte(`{
+			"account_id": "111111111111",
+			"release_bucket": "file-releases",
+			"region": "us-east-1"
+		}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		h := handler.New().WithProfilePath(path)
+		config := map[string]interface{}{
+			"platform": map[string]interface{}{
+				"region": "ap-southeast-1",
+			},
+		}
+		env := map[string]string{
+			"ACURIS_PLATFORM_RELEASE_BUCKET":  "env-releases",
+			"ACURIS_PLATFORM_ORGANIZATION_ID": "o-abcdefghij",
+		}
+
+		// When
+		if err := h.LoadProfile(config, env); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		expected := handler.Profile{
+			AccountID:      "111111111111",
+			LambdaBucket:   handler.LambdaBucket,
+			ReleaseBucket:  "env-releases",
+			TFStateBucket:  handler.TFStateBucket,
+			Region:         "ap-southeast-1",
+			OrganizationID: "o-abcdefghij",
+		}
+		if *h.Profile != expected {
+			t.Fatalf("expected %+v, got %+v", expected, *h.Profile)
+		}
+	})
+
+	t.Run("missing explicit file", func(t *testing.T) {
+		// Given
+		h := handler.New().WithProfilePath("/does/not/exist.json")
+
+		// When
+		err := h.LoadProfile(map[string]interface{}{}, map[string]string{})
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), "unable to read platform profile") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		// Given
+		h := handler.New().WithProfilePath(handler.DefaultProfilePath)
+		config := map[string]interface{}{
+			"platform": map[string]interface{}{
+				"account_id": "not-an-account",
+				"region":     "Europe",
+			},
+		}
+
+		// When
+		err := h.LoadProfile(config, map[string]string{})
+
+		// Then
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		for _, expected := range []string{`account_id "not-an-account" is not valid`, `region "Europe" is not valid`} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Fatalf("expected %q in %q", expected, err.Error())
+			}
+		}
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		// Given
+		h := handler.New().WithProfilePath(handler.DefaultProfilePath)
+		config := map[string]interface{}{
+			"platform": map[string]interface{}{"acount_id": "111111111111"},
+		}
+
+		// When
+		err := h.LoadProfile(config, map[string]string{})
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), "unknown key config.params.platform.acount_id") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("release signing", func(t *testing.T) {
+		// Given
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "profile.json")
+		if err := ioutil.WriteFile(path, []byte(`{
+			"release_signing_kms_key": "alias/releases",
+			"release_signing_environments": "live"
+		}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		h := handler.New().WithProfilePath(path)
+		env := map[string]string{"ACURIS_PLATFORM_RELEASE_SIGNING_ENVIRONMENTS": "staging"}
+
+		// When
+		if err := h.LoadProfile(map[string]interface{}{}, env); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		signing := h.Profile.ReleaseSigning
+		if signing == nil || signing.KMSKey != "alias/releases" || strings.Join(signing.Environments, ",") != "live" {
+			t.Fatalf("expected release signing from the profile file only, got %+v", signing)
+		}
+	})
+
+	t.Run("release signing in config", func(t *testing.T) {
+		// Given
+		h := handler.New().WithProfilePath(handler.DefaultProfilePath)
+		config := map[string]interface{}{
+			"platform": map[string]interface{}{"release_signing_environments": "staging"},
+		}
+
+		// When
+		err := h.LoadProfile(config, map[string]string{})
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), "unknown key config.params.platform.release_signing_environments") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestConfigureReleaseUsesProfile(t *testing.T) {
+	// Given
+	request := createConfigureReleaseRequest()
+	request.Component = "my-component"
+	request.Config["team"] = "my-team"
+	request.Config["platform"] = map[string]interface{}{
+		"lambda_bucket":   "sandbox-lambdas",
+		"organization_id": "o-sandbox123",
+	}
+	request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+		"my-lambda": {Needs: []string{"lambda"}},
+		"my-ecr":    {Needs: []string{"ecr"}},
+	}
+	response := common.CreateConfigureReleaseResponse()
+
+	var ecrClient MockECRClientNoRepo
+	h := handler.New().
+		WithProfilePath(handler.DefaultProfilePath).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		}).
+		WithECRClientFactory(func(session client.ConfigProvider) ecriface.ECRAPI {
+			return &ecrClient
+		})
+
+	// When
+	if err := h.ConfigureRelease(request, response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatal("unexpected failure")
+	}
+	if response.Env["my-lambda"]["LAMBDA_BUCKET"] != "sandbox-lambdas" {
+		t.Fatalf("expected %q, got %q", "sandbox-lambdas", response.Env["my-lambda"]["LAMBDA_BUCKET"])
+	}
+	if !strings.Contains(*ecrClient.SetRepositoryPolicyInput.PolicyText, `"aws:PrincipalOrgID": "o-sandbox123"`) {
+		t.Fatalf("expected organization ID in policy, got %q", *ecrClient.SetRepositoryPolicyInput.PolicyText)
+	}
+}
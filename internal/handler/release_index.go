@@ -0,0 +1,303 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// maxReleaseIndexAttempts is how many times updating the release index is tried when other uploads update it at the
+// same time.
+const maxReleaseIndexAttempts = 5
+
+// nearestReleaseVersions is how many versions either side of a missing version are suggested.
+const nearestReleaseVersions = 3
+
+// ReleaseIndexEntry is a release in the release index.
+type ReleaseIndexEntry struct {
+	Version    string `json:"version"`
+	UploadedAt string `json:"uploaded_at,omitempty"`
+	UploadedBy string `json:"uploaded_by,omitempty"`
+	GitCommit  string `json:"git_commit,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+}
+
+// ReleaseIndex lists the releases of a component, in the order they were uploaded.
+type ReleaseIndex struct {
+	Releases []*ReleaseIndexEntry `json:"releases"`
+}
+
+func releaseIndexKey(team, component string) string {
+	return fmt.Sprintf("%s/%s/releases.json", team, component)
+}
+
+// readReleaseIndex returns the release index for a component and its ETag, or an empty index and ETag if there isn't
+// one yet.
+func (h *Handler) readReleaseIndex(team, component string, s3Client s3iface.S3API) (*ReleaseIndex, string, error) {
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(h.Profile.ReleaseBucket),
+		Key:    aws.String(releaseIndexKey(team, component)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return &ReleaseIndex{}, "", nil
+		}
+		return nil, "", err
+	}
+	defer output.Body.Close()
+	contents, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var index ReleaseIndex
+	if err := json.Unmarshal(contents, &index); err != nil {
+		return nil, "", fmt.Errorf("unable to read release index s3://%s/%s: %v", h.Profile.ReleaseBucket, releaseIndexKey(team, component), err)
+	}
+	return &index, aws.StringValue(output.ETag), nil
+}
+
+// conditionalOnETag makes a put conditional on the object being unchanged since it was read, or on it not existing if
+// it wasn't there.
+func conditionalOnETag(etag string) request.Option {
+	return func(r *request.Request) {
+		if etag == "" {
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		} else {
+			r.HTTPRequest.Header.Set("If-Match", etag)
+		}
+	}
+}
+
+func isConditionalWriteConflict(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == "PreconditionFailed" || aerr.Code() == "ConditionalRequestConflict")
+}
+
+// updateReleaseIndex adds a release to the component's release index, replacing any entry for the same version. The
+// index is only written if it hasn't changed since it was read, retrying if another upload changed it first.
+func (h *Handler) updateReleaseIndex(team, component string, entry *ReleaseIndexEntry, encryption *S3Encryption, s3Client s3iface.S3API) error {
+	for attempt := 1; ; attempt++ {
+		index, etag, err := h.readReleaseIndex(team, component, s3Client)
+		if err != nil {
+			return err
+		}
+		releases := []*ReleaseIndexEntry{}
+		for _, existing := range index.Releases {
+			if existing.Version != entry.Version {
+				releases = append(releases, existing)
+			}
+		}
+		index.Releases = append(releases, entry)
+		serialised, err := json.MarshalIndent(index, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = s3Client.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+			Bucket:               aws.String(h.Profile.ReleaseBucket),
+			Key:                  aws.String(releaseIndexKey(team, component)),
+			Body:                 bytes.NewReader(serialised),
+			ContentType:          aws.String("application/json"),
+			ServerSideEncryption: encryption.serverSideEncryption(),
+			SSEKMSKeyId:          encryption.kmsKeyID(),
+		}, conditionalOnETag(etag))
+		if err == nil {
+			return nil
+		}
+		if !isConditionalWriteConflict(err) || attempt == maxReleaseIndexAttempts {
+			return err
+		}
+		h.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+	}
+}
+
+// releaseVersions returns the released versions of a component - those in the release index, and those found by
+// listing the releases bucket, which includes releases from before there was an index. If the bucket can't be listed,
+// the versions in the index are returned with the error, since they may not be all of the releases.
+func (h *Handler) releaseVersions(team, component string, s3Client s3iface.S3API) ([]string, error) {
+	index, _, err := h.readReleaseIndex(team, component, s3Client)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	seen := make(map[string]bool)
+	add := func(version string) {
+		if !seen[version] {
+			seen[version] = true
+			versions = append(versions, version)
+		}
+	}
+	for _, entry := range index.Releases {
+		add(entry.Version)
+	}
+	prefix := fmt.Sprintf("%s/%s/%s-", team, component, component)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(h.Profile.ReleaseBucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		output, err := s3Client.ListObjectsV2(input)
+		if err != nil {
+			return versions, err
+		}
+		for _, object := range output.Contents {
+			key := aws.StringValue(object.Key)
+			if strings.HasSuffix(key, ".zip") {
+				add(strings.TrimSuffix(strings.TrimPrefix(key, prefix), ".zip"))
+			}
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			return versions, nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+// versionChunks splits a version into runs of digits and non-digits, so that versions can be compared naturally
+// (e.g. 1.10 after 1.9).
+func versionChunks(version string) []string {
+	var chunks []string
+	runes := []rune(version)
+	for i, r := range runes {
+		if i > 0 && unicode.IsDigit(r) == unicode.IsDigit(runes[i-1]) {
+			chunks[len(chunks)-1] += string(r)
+		} else {
+			chunks = append(chunks, string(r))
+		}
+	}
+	return chunks
+}
+
+func versionLess(a, b string) bool {
+	aChunks, bChunks := versionChunks(a), versionChunks(b)
+	for i := 0; i < len(aChunks) && i < len(bChunks); i++ {
+		if aChunks[i] == bChunks[i] {
+			continue
+		}
+		aNumber, aErr := strconv.Atoi(aChunks[i])
+		bNumber, bErr := strconv.Atoi(bChunks[i])
+		if aErr == nil && bErr == nil && aNumber != bNumber {
+			return aNumber < bNumber
+		}
+		return aChunks[i] < bChunks[i]
+	}
+	return len(aChunks) < len(bChunks)
+}
+
+// NearestVersions returns up to count versions either side of version, in version order.
+func NearestVersions(versions []string, version string, count int) []string {
+	sorted := append([]string{}, versions...)
+	sort.Slice(sorted, func(i, j int) bool { return versionLess(sorted[i], sorted[j]) })
+	position := sort.Search(len(sorted), func(i int) bool { return !versionLess(sorted[i], version) })
+	start, end := position-count, position+count
+	if start < 0 {
+		start = 0
+	}
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+	return sorted[start:end]
+}
+
+// missingReleaseError explains that a version hasn't been released, suggesting the nearest versions that have.
+func (h *Handler) missingReleaseError(team, component, version string, s3Client s3iface.S3API) error {
+	versions, err := h.releaseVersions(team, component, s3Client)
+	return h.missingReleaseErrorForVersions(team, component, version, versions, err)
+}
+
+// releaseAccessDeniedError returns the error for access denied downloading a release. S3 returns access denied rather
+// than no such key for a missing object if the bucket can't be listed, so it's the missing release error if listing the
+// releases confirms the version hasn't been released.
+func (h *Handler) releaseAccessDeniedError(accessDenied error, team, component, version string, s3Client s3iface.S3API) error {
+	versions, err := h.releaseVersions(team, component, s3Client)
+	if err == nil && !contains(version, versions) {
+		return h.missingReleaseErrorForVersions(team, component, version, versions, nil)
+	}
+	return fmt.Errorf(
+		"access denied downloading s3://%s/%s: %v", h.Profile.ReleaseBucket, releaseS3Key(team, component, version), accessDenied,
+	)
+}
+
+func (h *Handler) missingReleaseErrorForVersions(team, component, version string, versions []string, err error) error {
+	message := fmt.Sprintf("version %s of %s has not been released (no s3://%s/%s)", version, component, h.Profile.ReleaseBucket, releaseS3Key(team, component, version))
+	if err != nil && len(versions) == 0 {
+		return fmt.Errorf("%s - unable to list released versions: %v", message, err)
+	}
+	if err != nil {
+		return fmt.Errorf(
+			"%s - the nearest versions in the release index are: %s (unable to list earlier releases: %v)",
+			message, strings.Join(NearestVersions(versions, version, nearestReleaseVersions), ", "), err,
+		)
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("%s - there are no releases of %s", message, component)
+	}
+	return fmt.Errorf(
+		"%s - the nearest released versions are: %s",
+		message, strings.Join(NearestVersions(versions, version, nearestReleaseVersions), ", "),
+	)
+}
+
+// ListReleases implements the releases command, printing the release index for a component as a table (newest first)
+// or JSON.
+func (h *Handler) ListReleases(args []string, env map[string]string, output io.Writer) error {
+	flags := flag.NewFlagSet("releases", flag.ContinueOnError)
+	flags.SetOutput(h.ErrorStream)
+	team := flags.String("team", "", "the team that owns the component (required)")
+	component := flags.String("component", "", "the component to list releases of (required)")
+	jsonOutput := flags.Bool("json", false, "print the release index as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *team == "" || *component == "" {
+		flags.Usage()
+		return fmt.Errorf("-team and -component are required")
+	}
+
+	config := map[string]interface{}{}
+	if err := h.LoadProfile(config, env); err != nil {
+		return err
+	}
+	if err := h.InitReleaseAccountCredentials(&RoleContext{Config: config, Env: env, Team: *team, Component: *component}); err != nil {
+		return err
+	}
+	session, err := h.createReleaseAccountSession()
+	if err != nil {
+		return fmt.Errorf("unable to create AWS session in release account: %v", err)
+	}
+	index, _, err := h.readReleaseIndex(*team, *component, h.S3ClientFactory(session))
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(index)
+	}
+	if len(index.Releases) == 0 {
+		fmt.Fprintf(h.ErrorStream, "No releases of %s in the release index.\n", *component)
+		return nil
+	}
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "VERSION\tUPLOADED AT\tUPLOADED BY\tGIT COMMIT\tSHA256")
+	for i := len(index.Releases) - 1; i >= 0; i-- {
+		entry := index.Releases[i]
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", entry.Version, entry.UploadedAt, entry.UploadedBy, entry.GitCommit, entry.SHA256)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,433 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+const releaseIndexKey = "test-team/test-component/releases.json"
+
+// MockReleaseIndexS3Client keeps the release index, only allowing writes conditional on its current ETag. If
+// concurrentRelease is set, it is added to the index just before the first write, as if by another upload. Listing the
+// bucket finds legacyVersions, released before the index existed, or fails with listErr.
+type MockReleaseIndexS3Client struct {
+	*MockS3Client
+	index             *handler.ReleaseIndex
+	etag              int
+	concurrentRelease *handler.ReleaseIndexEntry
+	conditions        []string
+	legacyVersions    []string
+	listErr           error
+}
+
+func (m *MockReleaseIndexS3Client) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	if m.listErr != nil {
+		return nil, m.listErr
+	}
+	output := &s3.ListObjectsV2Output{}
+	for _, version := range m.legacyVersions {
+		output.Contents = append(output.Contents, &s3.Object{Key: aws.String(*input.Prefix + version + ".zip")})
+	}
+	return output, nil
+}
+
+func (m *MockReleaseIndexS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if *input.Key != releaseIndexKey {
+		return m.MockS3Client.GetObject(input)
+	}
+	if m.index == nil {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	serialised, err := json.Marshal(m.index)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(serialised)),
+		ETag: aws.String(strconv.Quote(strconv.Itoa(m.etag))),
+	}, nil
+}
+
+func (m *MockReleaseIndexS3Client) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, options ...request.Option) (*s3.PutObjectOutput, error) {
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	r.ApplyOptions(options...)
+	condition := "If-None-Match: " + r.HTTPRequest.Header.Get("If-None-Match")
+	if r.HTTPRequest.Header.Get("If-Match") != "" {
+		condition = "If-Match: " + r.HTTPRequest.Header.Get("If-Match")
+	}
+	m.conditions = append(m.conditions, condition)
+	if m.concurrentRelease != nil {
+		if m.index == nil {
+			m.index = &handler.ReleaseIndex{}
+		}
+		m.index.Releases = append(m.index.Releases, m.concurrentRelease)
+		m.concurrentRelease = nil
+		m.etag++
+	}
+	expected := "If-None-Match: *"
+	if m.index != nil {
+		expected = "If-Match: " + strconv.Quote(strconv.Itoa(m.etag))
+	}
+	if condition != expected {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	var index handler.ReleaseIndex
+	if err := json.NewDecoder(input.Body).Decode(&index); err != nil {
+		return nil, err
+	}
+	m.index = &index
+	m.etag++
+	return &s3.PutObjectOutput{}, nil
+}
+
+func releaseIndexVersions(index *handler.ReleaseIndex) []string {
+	var versions []string
+	for _, entry := range index.Releases {
+		versions = append(versions, entry.Version)
+	}
+	return versions
+}
+
+func uploadReleaseToIndex(t *testing.T, env map[string]string, s3Client *MockReleaseIndexS3Client) (*common.UploadReleaseResponse, string) {
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Config["team"] = "test-team"
+	configureReleaseRequest.Component = "test-component"
+	configureReleaseRequest.Version = "1"
+	configureReleaseRequest.Env = env
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+
+	var errorBuffer bytes.Buffer
+	h := handler.New().
+		WithErrorStream(&errorBuffer).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client }).
+		WithS3UploaderFactory(func(client.ConfigProvider) s3manageriface.UploaderAPI { return &MockS3Uploader{} }).
+		WithReleaseSaver(&MockReleaseSaver{reader: ioutil.NopCloser(strings.NewReader("release contents"))})
+	response := common.CreateUploadReleaseResponse()
+	if err := h.UploadRelease(common.CreateUploadReleaseRequest(), response, configureReleaseRequest, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String()
+}
+
+func TestUploadReleaseCreatesReleaseIndex(t *testing.T) {
+	// Given
+	s3Client := &MockReleaseIndexS3Client{MockS3Client: &MockS3Client{}}
+
+	// When
+	response, output := uploadReleaseToIndex(t, map[string]string{
+		"GIT_COMMIT":        "abc123",
+		"ROLE_SESSION_NAME": "ci-user",
+	}, s3Client)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if !reflect.DeepEqual(s3Client.conditions, []string{"If-None-Match: *"}) {
+		t.Fatalf("unexpected conditions: %q", s3Client.conditions)
+	}
+	entry := s3Client.index.Releases[0]
+	if len(s3Client.index.Releases) != 1 || entry.Version != "1" || entry.GitCommit != "abc123" || entry.UploadedBy != "ci-user" || entry.SHA256 != releaseContentsSHA256 || entry.UploadedAt == "" {
+		t.Fatalf("unexpected index entry: %+v", entry)
+	}
+}
+
+func TestUploadReleaseUpdatesReleaseIndexConcurrently(t *testing.T) {
+	// Given
+	s3Client := &MockReleaseIndexS3Client{
+		MockS3Client: &MockS3Client{},
+		index: &handler.ReleaseIndex{Releases: []*handler.ReleaseIndexEntry{
+			{Version: "0"},
+			{Version: "1", SHA256: "old"},
+		}},
+		concurrentRelease: &handler.ReleaseIndexEntry{Version: "2"},
+	}
+
+	// When
+	response, output := uploadReleaseToIndex(t, nil, s3Client)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if !reflect.DeepEqual(s3Client.conditions, []string{`If-Match: "0"`, `If-Match: "1"`}) {
+		t.Fatalf("unexpected conditions: %q", s3Client.conditions)
+	}
+	if versions := releaseIndexVersions(s3Client.index); !reflect.DeepEqual(versions, []string{"0", "2", "1"}) {
+		t.Fatalf("unexpected versions: %q", versions)
+	}
+	if sha256 := s3Client.index.Releases[2].SHA256; sha256 != releaseContentsSHA256 {
+		t.Fatalf("expected %q, got %q", releaseContentsSHA256, sha256)
+	}
+}
+
+func TestPrepareTerraformMissingReleaseListsNearestVersions(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		getObjectErr error
+	}{
+		{"no such key", nil},
+		// S3 returns access denied for a missing object if the role can't list the bucket
+		{"access denied", awserr.New("AccessDenied", "Access Denied", nil)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			index := &handler.ReleaseIndex{}
+			for _, version := range []string{"10", "1", "2", "3", "5", "6", "7", "20"} {
+				index.Releases = append(index.Releases, &handler.ReleaseIndexEntry{Version: version})
+			}
+			s3Client := &MockReleaseIndexS3Client{MockS3Client: &MockS3Client{getObjectErr: tc.getObjectErr}, index: index}
+			request := createPrepareTerraformRequest()
+			request.Version = "4"
+			releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(releaseDir)
+			var errorBuffer bytes.Buffer
+			h := createPrepareTerraformHandler(&errorBuffer, s3Client.MockS3Client, &MockSTSClient{}, nil).
+				WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client })
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			if err := h.PrepareTerraform(request, response, releaseDir); err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			expected := "version 4 of test-component has not been released (no s3://acuris-releases/test-team/test-component/test-component-4.zip) - the nearest released versions are: 1, 2, 3, 5, 6, 7"
+			if !strings.Contains(errorBuffer.String(), expected) {
+				t.Fatalf("expected %q in %q", expected, errorBuffer.String())
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformMissingReleaseWithoutIndex(t *testing.T) {
+	// Given
+	s3Client := &MockLambdaS3Client{objects: map[string]string{
+		handler.ReleaseBucket + "/test-team/test-component/test-component-1.zip": "",
+		handler.ReleaseBucket + "/test-team/test-component/test-component-3.zip": "",
+	}}
+	request := createPrepareTerraformRequest()
+	request.Version = "2"
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+	var errorBuffer bytes.Buffer
+	h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, &MockSTSClient{}, nil).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client })
+	response := common.CreatePrepareTerraformResponse()
+
+	// When
+	if err := h.PrepareTerraform(request, response, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := "the nearest released versions are: 1, 3"
+	if !strings.Contains(errorBuffer.String(), expected) {
+		t.Fatalf("expected %q in %q", expected, errorBuffer.String())
+	}
+}
+
+func prepareTerraformWithIndexAndLegacyReleases(t *testing.T, version string, s3Client *MockReleaseIndexS3Client) string {
+	s3Client.index = &handler.ReleaseIndex{Releases: []*handler.ReleaseIndexEntry{{Version: "5"}, {Version: "6"}}}
+	s3Client.legacyVersions = []string{"1", "2", "3"}
+	request := createPrepareTerraformRequest()
+	request.Version = version
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+	var errorBuffer bytes.Buffer
+	h := createPrepareTerraformHandler(&errorBuffer, s3Client.MockS3Client, &MockSTSClient{}, nil).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client })
+	response := common.CreatePrepareTerraformResponse()
+	if err := h.PrepareTerraform(request, response, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	return errorBuffer.String()
+}
+
+func TestPrepareTerraformMissingReleaseWithIndexAndLegacyReleases(t *testing.T) {
+	// Given
+	s3Client := &MockReleaseIndexS3Client{MockS3Client: &MockS3Client{}}
+
+	// When
+	output := prepareTerraformWithIndexAndLegacyReleases(t, "4", s3Client)
+
+	// Then
+	expected := "the nearest released versions are: 1, 2, 3, 5, 6"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+}
+
+func TestPrepareTerraformAccessDeniedForLegacyRelease(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		listErr error
+	}{
+		{"released before the index", nil},
+		{"releases can't be listed", awserr.New("AccessDenied", "Access Denied", nil)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			s3Client := &MockReleaseIndexS3Client{
+				MockS3Client: &MockS3Client{getObjectErr: awserr.New("AccessDenied", "Access Denied", nil)},
+				listErr:      tc.listErr,
+			}
+
+			// When
+			output := prepareTerraformWithIndexAndLegacyReleases(t, "2", s3Client)
+
+			// Then
+			expected := "access denied downloading s3://acuris-releases/test-team/test-component/test-component-2.zip"
+			if !strings.Contains(output, expected) {
+				t.Fatalf("expected %q in %q", expected, output)
+			}
+			if strings.Contains(output, "has not been released") {
+				t.Fatalf("expected the access denied error not to be reported as a missing release: %q", output)
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformMissingReleaseWhenReleasesCantBeListed(t *testing.T) {
+	// Given
+	s3Client := &MockReleaseIndexS3Client{
+		MockS3Client: &MockS3Client{},
+		listErr:      awserr.New("AccessDenied", "Access Denied", nil),
+	}
+
+	// When
+	output := prepareTerraformWithIndexAndLegacyReleases(t, "4", s3Client)
+
+	// Then
+	expected := "the nearest versions in the release index are: 5, 6 (unable to list earlier releases: AccessDenied"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+}
+
+func TestNearestVersions(t *testing.T) {
+	for _, tc := range []struct {
+		versions []string
+		version  string
+		expected []string
+	}{
+		{[]string{"1.10", "1.9", "1.8", "1.11", "1.12"}, "1.10.1", []string{"1.9", "1.10", "1.11", "1.12"}},
+		{[]string{"1", "2", "3"}, "100", []string{"2", "3"}},
+		{[]string{"v2", "v10", "v1"}, "v0", []string{"v1", "v2"}},
+	} {
+		t.Run(tc.version, func(t *testing.T) {
+			// When
+			nearest := handler.NearestVersions(tc.versions, tc.version, 2)
+
+			// Then
+			if !reflect.DeepEqual(nearest, tc.expected) {
+				t.Fatalf("expected %q, got %q", tc.expected, nearest)
+			}
+		})
+	}
+}
+
+func listReleases(t *testing.T, args []string, index *handler.ReleaseIndex) (string, string, error) {
+	s3Client := &MockReleaseIndexS3Client{MockS3Client: &MockS3Client{}, index: index}
+	var output, errorBuffer bytes.Buffer
+	h := handler.New().
+		WithErrorStream(&errorBuffer).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		}).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client })
+	err := h.ListReleases(args, map[string]string{
+		"AWS_ACCESS_KEY_ID":     "root foo",
+		"AWS_SECRET_ACCESS_KEY": "root bar",
+		"ROLE_SESSION_NAME":     "baz",
+	}, &output)
+	return output.String(), errorBuffer.String(), err
+}
+
+var testReleaseIndex = &handler.ReleaseIndex{Releases: []*handler.ReleaseIndexEntry{
+	{Version: "1", UploadedAt: "2021-04-01T12:00:00Z", UploadedBy: "ci-user", GitCommit: "abc123", SHA256: "aaaa"},
+	{Version: "2", UploadedAt: "2021-04-02T12:00:00Z", UploadedBy: "ci-user", GitCommit: "def456", SHA256: "bbbb"},
+}}
+
+func TestListReleasesTable(t *testing.T) {
+	// When
+	output, errors, err := listReleases(t, []string{"-team", "test-team", "-component", "test-component"}, testReleaseIndex)
+
+	// Then
+	if err != nil {
+		t.Fatalf("unexpected error: %v (%s)", err, errors)
+	}
+	expected := "VERSION  UPLOADED AT           UPLOADED BY  GIT COMMIT  SHA256\n" +
+		"2        2021-04-02T12:00:00Z  ci-user      def456      bbbb\n" +
+		"1        2021-04-01T12:00:00Z  ci-user      abc123      aaaa\n"
+	if output != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestListReleasesJSON(t *testing.T) {
+	// When
+	output, errors, err := listReleases(t, []string{"-team", "test-team", "-component", "test-component", "-json"}, testReleaseIndex)
+
+	// Then
+	if err != nil {
+		t.Fatalf("unexpected error: %v (%s)", err, errors)
+	}
+	var index handler.ReleaseIndex
+	if err := json.Unmarshal([]byte(output), &index); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&index, testReleaseIndex) {
+		t.Fatalf("expected %+v, got %+v", testReleaseIndex, &index)
+	}
+}
+
+func TestListReleasesRequiresComponent(t *testing.T) {
+	// When
+	_, _, err := listReleases(t, []string{"-team", "test-team"}, nil)
+
+	// Then
+	if err == nil || err.Error() != "-team and -component are required" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ReleaseMetadataFile is the file in the release folder that cdflow2 passes to terraform as variables - a map per build
+// plus the "release" map.
+const ReleaseMetadataFile = "release-metadata.json"
+
+func readReleaseMetadata(releaseDir string) (map[string]map[string]string, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(releaseDir, ReleaseMetadataFile))
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]map[string]string
+	if err := json.Unmarshal(contents, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// updateReleaseMetadata merges values into the named map in the release metadata file, if the release has one.
+func updateReleaseMetadata(releaseDir, name string, values map[string]string) error {
+	metadata, err := readReleaseMetadata(releaseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if metadata[name] == nil {
+		metadata[name] = make(map[string]string)
+	}
+	for key, value := range values {
+		metadata[name][key] = value
+	}
+	serialised, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(releaseDir, ReleaseMetadataFile), serialised, 0644)
+}
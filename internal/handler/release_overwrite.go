@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// AllowReleaseOverwrite returns config.params.allow_release_overwrite - releases can't be overwritten by default, since
+// a re-run build with the same version would otherwise silently replace what is deployed.
+func AllowReleaseOverwrite(config map[string]interface{}) (bool, error) {
+	value, ok := config["allow_release_overwrite"]
+	if !ok {
+		return false, nil
+	}
+	allow, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("cdflow.yaml error: config.params.allow_release_overwrite must be true or false")
+	}
+	return allow, nil
+}
+
+// checkExistingRelease fails if the release already exists, unless overwriting is allowed, logging the version that
+// would be replaced if the bucket is versioned.
+func (h *Handler) checkExistingRelease(key string, allowOverwrite bool, s3Client s3iface.S3API) error {
+	output, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(h.Profile.ReleaseBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+			return nil
+		}
+		return fmt.Errorf("unable to check for an existing release: %v", err)
+	}
+	location := fmt.Sprintf("s3://%s/%s", h.Profile.ReleaseBucket, key)
+	// unversioned buckets return "null" or nothing
+	if versionID := aws.StringValue(output.VersionId); versionID != "" && versionID != "null" {
+		location += fmt.Sprintf(" (version %s)", versionID)
+	}
+	if !allowOverwrite {
+		return fmt.Errorf(
+			"release %s already exists - release a new version, or set config.params.allow_release_overwrite to replace it",
+			location,
+		)
+	}
+	fmt.Fprintf(h.ErrorStream, "- Overwriting existing release %s\n", location)
+	return nil
+}
+
+// ifNoneMatch makes uploads conditional on the key not existing, so that a release created between checking and
+// uploading isn't replaced. The header only applies to the requests that create the object.
+func ifNoneMatch(r *request.Request) {
+	if r.Operation.Name == "PutObject" || r.Operation.Name == "CompleteMultipartUpload" {
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+}
+
+// isPreconditionFailed returns whether an S3 request failed because of a condition - e.g. an upload because the key was
+// created since it was checked.
+func isPreconditionFailed(err error) bool {
+	for err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+		if aerr.Code() == "PreconditionFailed" {
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
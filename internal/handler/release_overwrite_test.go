@@ -0,0 +1,156 @@
+package handler_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+const existingReleaseKey = handler.ReleaseBucket + "/test-team/test-component/test-component-1.zip"
+
+func uploadReleaseWithS3Client(t *testing.T, config map[string]interface{}, s3Client *MockS3Client, s3Uploader *MockS3Uploader) (*common.UploadReleaseResponse, string, *MockReleaseSaver) {
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Config["team"] = "test-team"
+	configureReleaseRequest.Component = "test-component"
+	configureReleaseRequest.Version = "1"
+	for key, value := range config {
+		configureReleaseRequest.Config[key] = value
+	}
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+
+	var errorBuffer bytes.Buffer
+	saver := &MockReleaseSaver{reader: ioutil.NopCloser(&bytes.Buffer{})}
+	h := handler.New().
+		WithErrorStream(&errorBuffer).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client }).
+		WithS3UploaderFactory(func(client.ConfigProvider) s3manageriface.UploaderAPI { return s3Uploader }).
+		WithReleaseSaver(saver)
+	response := common.CreateUploadReleaseResponse()
+	if err := h.UploadRelease(common.CreateUploadReleaseRequest(), response, configureReleaseRequest, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String(), saver
+}
+
+func TestUploadReleaseRefusesToOverwrite(t *testing.T) {
+	// Given
+	s3Client := &MockS3Client{
+		files:               map[string][]byte{existingReleaseKey: {}},
+		headObjectVersionID: "v1",
+	}
+	s3Uploader := &MockS3Uploader{}
+
+	// When
+	response, output, saver := uploadReleaseWithS3Client(t, nil, s3Client, s3Uploader)
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := "release s3://" + existingReleaseKey + " (version v1) already exists"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+	if saver.called || len(s3Uploader.calls) != 0 {
+		t.Fatal("expected nothing to be saved or uploaded")
+	}
+}
+
+func TestUploadReleaseAllowOverwrite(t *testing.T) {
+	// Given
+	s3Client := &MockS3Client{
+		files:               map[string][]byte{existingReleaseKey: {}},
+		headObjectVersionID: "v1",
+	}
+	s3Uploader := &MockS3Uploader{}
+
+	// When
+	response, output, _ := uploadReleaseWithS3Client(t, map[string]interface{}{"allow_release_overwrite": true}, s3Client, s3Uploader)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	expected := "- Overwriting existing release s3://" + existingReleaseKey + " (version v1)"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+	if len(s3Uploader.uploaders[0].RequestOptions) != 0 {
+		t.Fatal("expected an unconditional upload")
+	}
+}
+
+func TestUploadReleaseIsConditional(t *testing.T) {
+	// Given
+	s3Uploader := &MockS3Uploader{}
+
+	// When
+	response, output, _ := uploadReleaseWithS3Client(t, nil, &MockS3Client{}, s3Uploader)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	for operation, expected := range map[string]string{
+		"PutObject":               "*",
+		"CompleteMultipartUpload": "*",
+		"UploadPart":              "",
+	} {
+		r := &request.Request{
+			Operation:   &request.Operation{Name: operation},
+			HTTPRequest: &http.Request{Header: http.Header{}},
+		}
+		r.ApplyOptions(s3Uploader.uploaders[0].RequestOptions...)
+		if header := r.HTTPRequest.Header.Get("If-None-Match"); header != expected {
+			t.Fatalf("expected %q for %s, got %q", expected, operation, header)
+		}
+	}
+}
+
+func TestUploadReleaseCreatedWhileReleasing(t *testing.T) {
+	// Given
+	s3Uploader := &MockS3Uploader{
+		err: awserr.New("MultipartUpload", "upload multipart failed", awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)),
+	}
+
+	// When
+	response, output, _ := uploadReleaseWithS3Client(t, nil, &MockS3Client{}, s3Uploader)
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := "Release s3://" + existingReleaseKey + " was created by something else while releasing"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+}
+
+func TestUploadReleaseAllowOverwriteInvalid(t *testing.T) {
+	// When
+	response, output, _ := uploadReleaseWithS3Client(t, map[string]interface{}{"allow_release_overwrite": "yes"}, &MockS3Client{}, &MockS3Uploader{})
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	expected := "cdflow.yaml error: config.params.allow_release_overwrite must be true or false"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+}
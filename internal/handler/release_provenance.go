@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// ReleaseSHA256MetadataKey is the S3 object metadata and tag key for the hex encoded SHA-256 of an uploaded release.
+const ReleaseSHA256MetadataKey = "sha256"
+
+// releaseSHA256RequiredSinceKey is the platform profile key for when hashes are required for uploaded releases. It's
+// part of the trust root for deploying, so like release signing it is only read from the profile file and the config
+// container's environment.
+const releaseSHA256RequiredSinceKey = "release_sha256_required_since"
+
+// ParseReleaseSHA256RequiredSince parses release_sha256_required_since from the platform profile - an RFC 3339 time
+// after which releases without a hash fail to deploy. Hashes aren't required if it isn't set.
+func ParseReleaseSHA256RequiredSince(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform profile: %s %q is not an RFC 3339 time", releaseSHA256RequiredSinceKey, value)
+	}
+	return &since, nil
+}
+
+// AllowUnverifiedRelease returns config.params.allow_unverified_release - deploying a release uploaded since hashes
+// were required fails if it doesn't have one, unless this is set.
+func AllowUnverifiedRelease(config map[string]interface{}) (bool, error) {
+	value, ok := config["allow_unverified_release"]
+	if !ok {
+		return false, nil
+	}
+	allow, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("cdflow.yaml error: config.params.allow_unverified_release must be true or false")
+	}
+	return allow, nil
+}
+
+// GitCommit returns the commit being released from the CI environment (Jenkins, GitHub Actions or GitLab CI), if any.
+func GitCommit(env map[string]string) string {
+	for _, name := range []string{"GIT_COMMIT", "GITHUB_SHA", "CI_COMMIT_SHA"} {
+		if env[name] != "" {
+			return env[name]
+		}
+	}
+	return ""
+}
+
+// releaseProvenance returns the metadata recorded on uploaded releases and provider plugins - where the release was
+// built from, by whom and when. Values that aren't known are left out.
+func (h *Handler) releaseProvenance(configureReleaseRequest *common.ConfigureReleaseRequest, team, terraformImage string) map[string]string {
+	// the release account credentials were created with the same name, so an error just means there's no name to record
+	uploadedBy, _ := (&RoleContext{
+		Config:    configureReleaseRequest.Config,
+		Env:       configureReleaseRequest.Env,
+		Team:      team,
+		Component: configureReleaseRequest.Component,
+		Version:   configureReleaseRequest.Version,
+	}).RoleSessionName()
+	provenance := map[string]string{
+		"git-commit":      GitCommit(configureReleaseRequest.Env),
+		"build-url":       BuildURL(configureReleaseRequest.Env),
+		"terraform-image": terraformImage,
+		"uploaded-by":     uploadedBy,
+		"uploaded-at":     h.Now().UTC().Format(time.RFC3339),
+	}
+	for key, value := range provenance {
+		if value == "" {
+			delete(provenance, key)
+		}
+	}
+	return provenance
+}
+
+func provenanceMetadata(provenance map[string]string) map[string]*string {
+	metadata := make(map[string]*string)
+	for key, value := range provenance {
+		metadata[key] = aws.String(value)
+	}
+	return metadata
+}
+
+// provenanceTagging returns the provenance as an S3 tagging header, removing characters that aren't allowed in tags.
+func provenanceTagging(provenance map[string]string) string {
+	tags := url.Values{}
+	for key, value := range provenance {
+		tags.Set(key, sanitiseSessionTagValue(value))
+	}
+	return tags.Encode()
+}
+
+// spoolRelease saves the release to a temporary file, returning the file and the hex encoded SHA-256 of the release, so
+// that the hash can be recorded when the release is uploaded. The caller must remove the file.
+func spoolRelease(release io.Reader) (*os.File, string, error) {
+	file, err := ioutil.TempFile("", "cdflow2-config-acuris-release")
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), release); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", fmt.Errorf("unable to save release: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", err
+	}
+	return file, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifiedRelease downloads the release to a temporary file, checking its hash against the hash recorded when it was
+// uploaded, and returns the file and the hash. The caller must remove the file. Releases without a hash are only used
+// if hashes weren't required when they were uploaded (see release_sha256_required_since), or allowUnverified is set.
+func (h *Handler) verifiedRelease(key string, output *s3.GetObjectOutput, allowUnverified bool) (*os.File, string, error) {
+	defer output.Body.Close()
+	file, err := ioutil.TempFile("", "cdflow2-config-acuris-release")
+	if err != nil {
+		return nil, "", err
+	}
+	discard := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), output.Body); err != nil {
+		discard()
+		return nil, "", fmt.Errorf("unable to download release: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		discard()
+		return nil, "", err
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	expected := objectMetadata(output.Metadata, ReleaseSHA256MetadataKey)
+	if expected == "" {
+		if requiredSince := h.Profile.ReleaseSHA256RequiredSince; requiredSince == nil || (output.LastModified != nil && output.LastModified.Before(*requiredSince)) {
+			fmt.Fprintf(h.ErrorStream, "- Release has no %s metadata (it was released before hashes were required), not verifying\n", ReleaseSHA256MetadataKey)
+			return file, actual, nil
+		}
+		if allowUnverified {
+			fmt.Fprintf(h.ErrorStream, "- WARNING: release has no %s metadata, using it without verifying since config.params.allow_unverified_release is set\n", ReleaseSHA256MetadataKey)
+			return file, actual, nil
+		}
+		discard()
+		return nil, "", fmt.Errorf(
+			"release s3://%s/%s has no %s metadata, so can't be verified - release a new version, or set config.params.allow_unverified_release to use it anyway",
+			h.Profile.ReleaseBucket, key, ReleaseSHA256MetadataKey,
+		)
+	}
+	if actual != expected {
+		discard()
+		return nil, "", fmt.Errorf(
+			"release s3://%s/%s has sha256 %s, but %s was recorded when it was uploaded - it has been modified or corrupted",
+			h.Profile.ReleaseBucket, key, actual, expected,
+		)
+	}
+	fmt.Fprintf(h.ErrorStream, "- Verified release sha256 %s\n", expected)
+	return file, actual, nil
+}
@@ -0,0 +1,277 @@
+package handler_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// echo -n "release contents" | sha256sum
+const releaseContentsSHA256 = "2225ba0ddddc17ea832336525669c34be0bc44f34fc5c1faafbc9984f5882b9f"
+
+func TestUploadReleaseRecordsProvenance(t *testing.T) {
+	// Given
+	request := common.CreateUploadReleaseRequest()
+	request.TerraformImage = "hashicorp/terraform:1.0.0"
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Config["team"] = "test-team"
+	configureReleaseRequest.Component = "test-component"
+	configureReleaseRequest.Version = "1"
+	configureReleaseRequest.Env = map[string]string{
+		"GITHUB_SHA":        "abc123",
+		"GITHUB_SERVER_URL": "https://github.com",
+		"GITHUB_REPOSITORY": "my-org/my-repo",
+		"GITHUB_RUN_ID":     "42",
+		"ROLE_SESSION_NAME": "ci-user",
+	}
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+
+	s3Client := &MockS3Client{}
+	s3Uploader := &MockS3Uploader{}
+	var errorBuffer bytes.Buffer
+	h := handler.New().
+		WithErrorStream(&errorBuffer).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client }).
+		WithS3UploaderFactory(func(client.ConfigProvider) s3manageriface.UploaderAPI { return s3Uploader }).
+		WithReleaseSaver(&MockReleaseSaver{reader: ioutil.NopCloser(strings.NewReader("release contents"))}).
+		WithClock(func() time.Time { return time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC) }, nil)
+	response := common.CreateUploadReleaseResponse()
+
+	// When
+	if err := h.UploadRelease(request, response, configureReleaseRequest, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	expected := map[string]string{
+		"git-commit":      "abc123",
+		"build-url":       "https://github.com/my-org/my-repo/actions/runs/42",
+		"terraform-image": "hashicorp/terraform:1.0.0",
+		"uploaded-by":     "ci-user",
+		"uploaded-at":     "2021-04-01T12:00:00Z",
+	}
+	upload := s3Uploader.calls[0]
+	for key, value := range expected {
+		if aws.StringValue(upload.Metadata[key]) != value {
+			t.Fatalf("expected %q for %s, got %q", value, key, aws.StringValue(upload.Metadata[key]))
+		}
+	}
+	if aws.StringValue(upload.Metadata[handler.ReleaseSHA256MetadataKey]) != releaseContentsSHA256 {
+		t.Fatalf("expected the release's sha256 in %v", upload.Metadata)
+	}
+	expectedTagging := "build-url=https%3A%2F%2Fgithub.com%2Fmy-org%2Fmy-repo%2Factions%2Fruns%2F42&git-commit=abc123&sha256=" + releaseContentsSHA256 + "&terraform-image=hashicorp%2Fterraform%3A1.0.0&uploaded-at=2021-04-01T12%3A00%3A00Z&uploaded-by=ci-user"
+	if *upload.Tagging != expectedTagging {
+		t.Fatalf("expected %q, got %q", expectedTagging, *upload.Tagging)
+	}
+	if s3Uploader.contents[0] != "release contents" {
+		t.Fatalf("expected the release to be uploaded, got %q", s3Uploader.contents[0])
+	}
+	if len(s3Client.copyObjectCalls) != 0 {
+		t.Fatalf("expected the release not to be copied, got %v", s3Client.copyObjectCalls)
+	}
+}
+
+func TestUploadReleaseRecordsPluginChecksum(t *testing.T) {
+	// Given
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Config["team"] = "test-team"
+	configureReleaseRequest.Component = "test-component"
+	configureReleaseRequest.Version = "1"
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+
+	s3Uploader := &MockS3Uploader{}
+	var errorBuffer bytes.Buffer
+	h := handler.New().
+		WithErrorStream(&errorBuffer).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return &MockS3Client{} }).
+		WithS3UploaderFactory(func(client.ConfigProvider) s3manageriface.UploaderAPI { return s3Uploader }).
+		WithReleaseSaver(&MockReleaseSaver{
+			reader:  ioutil.NopCloser(strings.NewReader("release contents")),
+			plugins: map[string]string{"plugins/provider": "abc123"},
+		})
+	response := common.CreateUploadReleaseResponse()
+
+	// When
+	if err := h.UploadRelease(common.CreateUploadReleaseRequest(), response, configureReleaseRequest, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	upload := s3Uploader.calls[0]
+	if *upload.Key != "test-team/cdflow2-saved-plugins/plugins/provider/abc123" {
+		t.Fatalf("expected the plugin to be uploaded first, got %q", *upload.Key)
+	}
+	if aws.StringValue(upload.Metadata[handler.ReleaseSHA256MetadataKey]) != "abc123" {
+		t.Fatalf("expected the plugin's sha256 in %v", upload.Metadata)
+	}
+	if !strings.Contains(*upload.Tagging, "sha256=abc123") {
+		t.Fatalf("expected sha256 in tagging, got %q", *upload.Tagging)
+	}
+}
+
+func prepareTerraformWithReleaseMetadata(t *testing.T, metadata map[string]*string, lastModified time.Time, config map[string]interface{}) (*common.PrepareTerraformResponse, string, *MockReleaseLoader) {
+	return prepareTerraformWithReleaseMetadataAndProfile(t, metadata, lastModified, config, "{}")
+}
+
+func prepareTerraformWithReleaseMetadataAndProfile(t *testing.T, metadata map[string]*string, lastModified time.Time, config map[string]interface{}, profile string) (*common.PrepareTerraformResponse, string, *MockReleaseLoader) {
+	request := createPrepareTerraformRequest()
+	request.Version = "1"
+	for key, value := range config {
+		request.Config[key] = value
+	}
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+	profilePath := filepath.Join(releaseDir, "profile.json")
+	if err := ioutil.WriteFile(profilePath, []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var errorBuffer bytes.Buffer
+	loader := &MockReleaseLoader{}
+	h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{
+		getObjectBody:         ioutil.NopCloser(strings.NewReader("release contents")),
+		getObjectMetadata:     metadata,
+		getObjectLastModified: aws.Time(lastModified),
+	}, &MockSTSClient{}, nil).WithReleaseLoader(loader).WithProfilePath(profilePath)
+	response := common.CreatePrepareTerraformResponse()
+	if err := h.PrepareTerraform(request, response, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String(), loader
+}
+
+func TestPrepareTerraformVerifiesRelease(t *testing.T) {
+	// When
+	response, output, loader := prepareTerraformWithReleaseMetadata(t, map[string]*string{
+		// canonicalised by the SDK
+		"Sha256": aws.String(releaseContentsSHA256),
+	}, time.Now(), nil)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if loader.contents != "release contents" {
+		t.Fatalf("expected %q, got %q", "release contents", loader.contents)
+	}
+	if !strings.Contains(output, "- Verified release sha256 "+releaseContentsSHA256) {
+		t.Fatalf("expected verification in %q", output)
+	}
+}
+
+func TestPrepareTerraformReleaseHashMismatch(t *testing.T) {
+	// When
+	response, output, loader := prepareTerraformWithReleaseMetadata(t, map[string]*string{
+		"Sha256": aws.String("0000"),
+	}, time.Now(), nil)
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	if loader.called {
+		t.Fatal("expected the release not to be loaded")
+	}
+	expected := "release s3://acuris-releases/test-team/test-component/test-component-1.zip has sha256 " + releaseContentsSHA256 + ", but 0000 was recorded"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+}
+
+func TestPrepareTerraformReleaseWithoutHash(t *testing.T) {
+	requiredSince := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	requiredProfile := `{"release_sha256_required_since": "2021-06-01T00:00:00Z"}`
+	for _, tc := range []struct {
+		name         string
+		lastModified time.Time
+		config       map[string]interface{}
+		profile      string
+		loaded       bool
+		expected     string
+	}{
+		{
+			"hashes not required",
+			requiredSince.Add(time.Hour),
+			nil,
+			"{}",
+			true,
+			"- Release has no sha256 metadata (it was released before hashes were required), not verifying",
+		},
+		{
+			"released before hashes were required",
+			requiredSince.Add(-time.Hour),
+			nil,
+			requiredProfile,
+			true,
+			"- Release has no sha256 metadata (it was released before hashes were required), not verifying",
+		},
+		{
+			"released since hashes were required",
+			requiredSince.Add(time.Hour),
+			nil,
+			requiredProfile,
+			false,
+			"release s3://acuris-releases/test-team/test-component/test-component-1.zip has no sha256 metadata, so can't be verified",
+		},
+		{
+			"allowed",
+			requiredSince.Add(time.Hour),
+			map[string]interface{}{"allow_unverified_release": true},
+			requiredProfile,
+			true,
+			"- WARNING: release has no sha256 metadata, using it without verifying",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			response, output, loader := prepareTerraformWithReleaseMetadataAndProfile(t, nil, tc.lastModified, tc.config, tc.profile)
+
+			// Then
+			if response.Success != tc.loaded || loader.called != tc.loaded {
+				t.Fatalf("expected success and loading to be %v, got %v and %v: %s", tc.loaded, response.Success, loader.called, output)
+			}
+			if !strings.Contains(output, tc.expected) {
+				t.Fatalf("expected %q in %q", tc.expected, output)
+			}
+		})
+	}
+}
+
+func TestParseReleaseSHA256RequiredSince(t *testing.T) {
+	// When
+	_, err := handler.ParseReleaseSHA256RequiredSince("2021-06-01")
+
+	// Then
+	expected := `invalid platform profile: release_sha256_required_since "2021-06-01" is not an RFC 3339 time`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected %q, got %v", expected, err)
+	}
+}
@@ -0,0 +1,336 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// ReleaseSigningKeyEnvVar is the environment variable with the base64 encoded ed25519 private key (or seed) used to sign
+// releases when the platform profile has release_signing_ed25519_public_key.
+const ReleaseSigningKeyEnvVar = "CDFLOW2_RELEASE_SIGNING_KEY"
+
+// SkipReleaseSignatureEnvVar is the break-glass environment variable to deploy without verifying the release signature.
+// It should be set to the reason, which is logged.
+const SkipReleaseSignatureEnvVar = "CDFLOW2_SKIP_RELEASE_SIGNATURE"
+
+// DefaultReleaseSigningAlgorithm is the default KMS signing algorithm for release signing.
+const DefaultReleaseSigningAlgorithm = kms.SigningAlgorithmSpecEcdsaSha256
+
+const ed25519SigningAlgorithm = "ED25519"
+
+// ReleaseSigningConfig is the release signing trust root from the platform profile.
+type ReleaseSigningConfig struct {
+	// KMSKey is the ID, ARN or alias of an asymmetric KMS key in the release account.
+	KMSKey    string
+	Algorithm string
+	// Ed25519PublicKey verifies releases signed with the key in ReleaseSigningKeyEnvVar, instead of KMS.
+	Ed25519PublicKey ed25519.PublicKey
+	// Environments are the environments that signatures are verified for when deploying. Tiers are defined by each
+	// project, so aren't used - a project could move an environment into a tier that isn't verified.
+	Environments []string
+	// Accounts are the IDs of the accounts that signatures are verified for deploying to, whatever the environment.
+	Accounts []string
+
+	privateKey ed25519.PrivateKey
+}
+
+// ReleaseSignature is the detached signature uploaded next to the release, with a .sig suffix.
+type ReleaseSignature struct {
+	SHA256    string `json:"sha256"`
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"key"`
+	Signature string `json:"signature"`
+}
+
+func releaseSignatureKey(releaseKey string) string {
+	return releaseKey + ".sig"
+}
+
+// releaseSigningProfileKeys are the platform profile keys for release signing. They are the trust root for release
+// signatures, so are only read from the profile file and the config container's environment - a project can't change
+// the key its releases are verified with, or the environments and accounts they are verified for.
+var releaseSigningProfileKeys = []string{
+	"release_signing_kms_key",
+	"release_signing_algorithm",
+	"release_signing_ed25519_public_key",
+	"release_signing_environments",
+	"release_signing_accounts",
+	// rejected, so that a profile still using it doesn't silently stop verifying signatures
+	"release_signing_tiers",
+}
+
+// ReleaseSigningAlgorithms returns the KMS signing algorithms that can be used. The release's SHA-256 is signed as a
+// digest, which KMS only accepts for algorithms that hash with SHA-256.
+func ReleaseSigningAlgorithms() []string {
+	var algorithms []string
+	for _, algorithm := range kms.SigningAlgorithmSpec_Values() {
+		if strings.HasSuffix(algorithm, "_SHA_256") {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return algorithms
+}
+
+// ParseReleaseSigningProfile reads the release signing keys of the platform profile, returning nil if none are set.
+// release_signing_environments and release_signing_accounts are comma separated.
+func ParseReleaseSigningProfile(values map[string]string) (*ReleaseSigningConfig, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if _, ok := values["release_signing_tiers"]; ok {
+		return nil, fmt.Errorf(
+			"invalid platform profile: release_signing_tiers is not supported, since tiers are defined by each project - " +
+				"use release_signing_environments or release_signing_accounts",
+		)
+	}
+	result := &ReleaseSigningConfig{
+		KMSKey:    values["release_signing_kms_key"],
+		Algorithm: values["release_signing_algorithm"],
+	}
+	if result.Algorithm != "" && !contains(result.Algorithm, ReleaseSigningAlgorithms()) {
+		return nil, fmt.Errorf(
+			"invalid platform profile: release_signing_algorithm %q is not one of %s",
+			result.Algorithm, strings.Join(ReleaseSigningAlgorithms(), ", "),
+		)
+	}
+	if value := values["release_signing_ed25519_public_key"]; value != "" {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid platform profile: release_signing_ed25519_public_key must be a base64 encoded ed25519 public key")
+		}
+		result.Ed25519PublicKey = ed25519.PublicKey(decoded)
+	}
+	result.Environments = profileList(values["release_signing_environments"])
+	result.Accounts = profileList(values["release_signing_accounts"])
+	for _, account := range result.Accounts {
+		if !accountIDPattern.MatchString(account) {
+			return nil, fmt.Errorf("invalid platform profile: release_signing_accounts %q is not a valid AWS account ID", account)
+		}
+	}
+	if (result.KMSKey == "") == (result.Ed25519PublicKey == nil) {
+		return nil, fmt.Errorf("invalid platform profile: release signing must have one of release_signing_kms_key or release_signing_ed25519_public_key")
+	}
+	if result.KMSKey != "" && result.Algorithm == "" {
+		result.Algorithm = DefaultReleaseSigningAlgorithm
+	} else if result.KMSKey == "" && result.Algorithm != "" {
+		return nil, fmt.Errorf("invalid platform profile: release_signing_algorithm only applies to release_signing_kms_key")
+	}
+	return result, nil
+}
+
+// profileList splits a comma separated platform profile value.
+func profileList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// signingKeyName returns how the key is identified in signatures and log messages.
+func (c *ReleaseSigningConfig) signingKeyName() string {
+	if c.KMSKey != "" {
+		return c.KMSKey
+	}
+	return base64.StdEncoding.EncodeToString(c.Ed25519PublicKey)
+}
+
+// loadSigningKey reads the ed25519 private key from ReleaseSigningKeyEnvVar when signing with ed25519, so that a missing
+// or mismatched key is reported before anything is uploaded.
+func (c *ReleaseSigningConfig) loadSigningKey(env map[string]string) error {
+	if c.KMSKey != "" {
+		return nil
+	}
+	value := env[ReleaseSigningKeyEnvVar]
+	if value == "" {
+		return fmt.Errorf("%s must be set to sign releases with the platform profile's release_signing_ed25519_public_key", ReleaseSigningKeyEnvVar)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("%s must be base64 encoded", ReleaseSigningKeyEnvVar)
+	}
+	switch len(decoded) {
+	case ed25519.SeedSize:
+		c.privateKey = ed25519.NewKeyFromSeed(decoded)
+	case ed25519.PrivateKeySize:
+		c.privateKey = ed25519.PrivateKey(decoded)
+	default:
+		return fmt.Errorf("%s must be an ed25519 private key or seed", ReleaseSigningKeyEnvVar)
+	}
+	if !bytes.Equal(c.privateKey.Public().(ed25519.PublicKey), c.Ed25519PublicKey) {
+		return fmt.Errorf("%s is not the private key for the platform profile's release_signing_ed25519_public_key", ReleaseSigningKeyEnvVar)
+	}
+	return nil
+}
+
+// signRelease signs the digest of the uploaded release and uploads the signature next to it.
+func (h *Handler) signRelease(signing *ReleaseSigningConfig, key, checksum string, encryption *S3Encryption, kmsClient kmsiface.KMSAPI, s3Uploader s3manageriface.UploaderAPI, uploadOptions ...func(*s3manager.Uploader)) error {
+	digest, err := hex.DecodeString(checksum)
+	if err != nil {
+		return err
+	}
+	signature := &ReleaseSignature{SHA256: checksum, Key: signing.signingKeyName()}
+	if signing.KMSKey != "" {
+		output, err := kmsClient.Sign(&kms.SignInput{
+			KeyId:            aws.String(signing.KMSKey),
+			Message:          digest,
+			MessageType:      aws.String(kms.MessageTypeDigest),
+			SigningAlgorithm: aws.String(signing.Algorithm),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to sign release with KMS key %s: %v", signing.KMSKey, err)
+		}
+		signature.Algorithm = signing.Algorithm
+		signature.Signature = base64.StdEncoding.EncodeToString(output.Signature)
+	} else {
+		signature.Algorithm = ed25519SigningAlgorithm
+		signature.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signing.privateKey, digest))
+	}
+	serialised, err := json.Marshal(signature)
+	if err != nil {
+		return err
+	}
+	if _, err := s3Uploader.Upload(encryption.applyToUpload(&s3manager.UploadInput{
+		Bucket:      aws.String(h.Profile.ReleaseBucket),
+		Key:         aws.String(releaseSignatureKey(key)),
+		Body:        bytes.NewReader(serialised),
+		ContentType: aws.String("application/json"),
+	}), uploadOptions...); err != nil {
+		return fmt.Errorf("unable to upload release signature: %v", err)
+	}
+	fmt.Fprintf(h.ErrorStream, "- Release signed with %s (%s)\n", signature.Key, signature.Algorithm)
+	return nil
+}
+
+// signedDeployTarget returns what is being deployed to that needs a signed release - an environment listed in the
+// platform profile's release_signing_environments, or a deploy account listed in release_signing_accounts - or "" if
+// nothing does. The deploy account is checked with the deploy credentials, so it's the account actually deployed to
+// however the project's tiers and accounts are configured.
+func (h *Handler) signedDeployTarget(signing *ReleaseSigningConfig, envName string, responseEnv map[string]string) (string, error) {
+	if contains(envName, signing.Environments) {
+		return fmt.Sprintf("the %s environment", envName), nil
+	}
+	if len(signing.Accounts) == 0 {
+		return "", nil
+	}
+	session, err := deployAccountSession(responseEnv)
+	if err != nil {
+		return "", err
+	}
+	identity, err := h.STSClientFactory(session).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("unable to get the deploy account to check whether the release must be signed: %v", err)
+	}
+	if account := aws.StringValue(identity.Account); contains(account, signing.Accounts) {
+		return "account " + account, nil
+	}
+	return "", nil
+}
+
+// verifyReleaseSignature checks the signature of the release when deploying to an environment or account listed in the
+// platform profile, unless the break-glass environment variable is set, which is logged.
+func (h *Handler) verifyReleaseSignature(env map[string]string, envName string, responseEnv map[string]string, key, checksum string, s3Client s3iface.S3API, kmsClient kmsiface.KMSAPI) error {
+	signing := h.Profile.ReleaseSigning
+	if signing == nil {
+		return nil
+	}
+	target, err := h.signedDeployTarget(signing, envName, responseEnv)
+	if err != nil || target == "" {
+		return err
+	}
+	if reason := env[SkipReleaseSignatureEnvVar]; reason != "" {
+		deployer, _ := GetRoleSessionName(env)
+		fmt.Fprintf(
+			h.ErrorStream,
+			"WARNING: NOT verifying the release signature for %s - %s is set by %q, with reason: %s\n",
+			target, SkipReleaseSignatureEnvVar, deployer, reason,
+		)
+		return nil
+	}
+	location := fmt.Sprintf("s3://%s/%s", h.Profile.ReleaseBucket, releaseSignatureKey(key))
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(h.Profile.ReleaseBucket),
+		Key:    aws.String(releaseSignatureKey(key)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return fmt.Errorf(
+				"release is not signed (no %s) - only signed releases can be deployed to %s (set %s to the reason to override)",
+				location, target, SkipReleaseSignatureEnvVar,
+			)
+		}
+		return fmt.Errorf("unable to get release signature: %v", err)
+	}
+	defer output.Body.Close()
+	contents, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return fmt.Errorf("unable to get release signature: %v", err)
+	}
+	var signature ReleaseSignature
+	if err := json.Unmarshal(contents, &signature); err != nil {
+		return fmt.Errorf("unable to read release signature %s: %v", location, err)
+	}
+	if err := h.checkReleaseSignature(signing, &signature, checksum, kmsClient); err != nil {
+		return fmt.Errorf(
+			"release signature verification failed for %s: %v (set %s to the reason to override)",
+			target, err, SkipReleaseSignatureEnvVar,
+		)
+	}
+	fmt.Fprintf(h.ErrorStream, "- Verified release signature from %s\n", signing.signingKeyName())
+	return nil
+}
+
+func (h *Handler) checkReleaseSignature(signing *ReleaseSigningConfig, signature *ReleaseSignature, checksum string, kmsClient kmsiface.KMSAPI) error {
+	if signature.SHA256 != checksum {
+		return fmt.Errorf("the signature is for sha256 %s, but the release has sha256 %s", signature.SHA256, checksum)
+	}
+	digest, err := hex.DecodeString(checksum)
+	if err != nil {
+		return err
+	}
+	signed, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil {
+		return fmt.Errorf("the signature is not base64 encoded")
+	}
+	if signing.KMSKey == "" {
+		if !ed25519.Verify(signing.Ed25519PublicKey, digest, signed) {
+			return fmt.Errorf("the signature is not valid for ed25519 public key %s", signing.signingKeyName())
+		}
+		return nil
+	}
+	output, err := kmsClient.Verify(&kms.VerifyInput{
+		KeyId:            aws.String(signing.KMSKey),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		Signature:        signed,
+		SigningAlgorithm: aws.String(signing.Algorithm),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kms.ErrCodeKMSInvalidSignatureException {
+			return fmt.Errorf("the signature is not valid for KMS key %s", signing.KMSKey)
+		}
+		return err
+	}
+	if !aws.BoolValue(output.SignatureValid) {
+		return fmt.Errorf("the signature is not valid for KMS key %s", signing.KMSKey)
+	}
+	return nil
+}
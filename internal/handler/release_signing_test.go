@@ -0,0 +1,500 @@
+package handler_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+var testSigningSeed = bytes.Repeat([]byte{1}, ed25519.SeedSize)
+
+func testSigningPublicKey() string {
+	return base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(testSigningSeed).Public().(ed25519.PublicKey))
+}
+
+type MockKMSClient struct {
+	kmsiface.KMSAPI
+	signInputs   []*kms.SignInput
+	verifyInputs []*kms.VerifyInput
+}
+
+func (m *MockKMSClient) Sign(input *kms.SignInput) (*kms.SignOutput, error) {
+	m.signInputs = append(m.signInputs, input)
+	return &kms.SignOutput{Signature: []byte("kms-signature")}, nil
+}
+
+func (m *MockKMSClient) Verify(input *kms.VerifyInput) (*kms.VerifyOutput, error) {
+	m.verifyInputs = append(m.verifyInputs, input)
+	if string(input.Signature) != "kms-signature" {
+		return nil, awserr.New(kms.ErrCodeKMSInvalidSignatureException, "invalid signature", nil)
+	}
+	return &kms.VerifyOutput{SignatureValid: aws.Bool(true)}, nil
+}
+
+// MockSignedReleaseS3Client returns the signature for .sig keys, and the release otherwise.
+type MockSignedReleaseS3Client struct {
+	*MockS3Client
+	signature *handler.ReleaseSignature
+}
+
+func (m *MockSignedReleaseS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if !strings.HasSuffix(*input.Key, ".sig") {
+		return m.MockS3Client.GetObject(input)
+	}
+	if m.signature == nil {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	serialised, err := json.Marshal(m.signature)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(serialised))}, nil
+}
+
+// writeSigningProfile writes a platform profile file with the release signing values, returning its path. The caller
+// must remove its directory.
+func writeSigningProfile(t *testing.T, signing map[string]string) string {
+	dir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := json.Marshal(signing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "profile.json")
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func uploadSignedRelease(t *testing.T, signing map[string]string, env map[string]string, kmsClient *MockKMSClient) (*common.UploadReleaseResponse, string, *MockS3Uploader) {
+	profilePath := writeSigningProfile(t, signing)
+	defer os.RemoveAll(filepath.Dir(profilePath))
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Config["team"] = "test-team"
+	configureReleaseRequest.Component = "test-component"
+	configureReleaseRequest.Version = "1"
+	configureReleaseRequest.Env = env
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+
+	var errorBuffer bytes.Buffer
+	s3Uploader := &MockS3Uploader{}
+	h := handler.New().
+		WithErrorStream(&errorBuffer).
+		WithProfilePath(profilePath).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return &MockS3Client{} }).
+		WithS3UploaderFactory(func(client.ConfigProvider) s3manageriface.UploaderAPI { return s3Uploader }).
+		WithKMSClientFactory(func(client.ConfigProvider) kmsiface.KMSAPI { return kmsClient }).
+		WithReleaseSaver(&MockReleaseSaver{reader: ioutil.NopCloser(strings.NewReader("release contents"))})
+	response := common.CreateUploadReleaseResponse()
+	if err := h.UploadRelease(common.CreateUploadReleaseRequest(), response, configureReleaseRequest, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String(), s3Uploader
+}
+
+func uploadedSignature(t *testing.T, s3Uploader *MockS3Uploader) *handler.ReleaseSignature {
+	if len(s3Uploader.calls) != 2 {
+		t.Fatalf("expected the release and signature to be uploaded, got %d uploads", len(s3Uploader.calls))
+	}
+	expectedKey := "test-team/test-component/test-component-1.zip.sig"
+	if *s3Uploader.calls[1].Key != expectedKey {
+		t.Fatalf("expected %q, got %q", expectedKey, *s3Uploader.calls[1].Key)
+	}
+	var signature handler.ReleaseSignature
+	if err := json.Unmarshal([]byte(s3Uploader.contents[1]), &signature); err != nil {
+		t.Fatal(err)
+	}
+	return &signature
+}
+
+func TestUploadReleaseSignsWithEd25519(t *testing.T) {
+	// When
+	response, output, s3Uploader := uploadSignedRelease(
+		t,
+		map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey()},
+		map[string]string{handler.ReleaseSigningKeyEnvVar: base64.StdEncoding.EncodeToString(testSigningSeed)},
+		nil,
+	)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	signature := uploadedSignature(t, s3Uploader)
+	if signature.SHA256 != releaseContentsSHA256 || signature.Algorithm != "ED25519" || signature.Key != testSigningPublicKey() {
+		t.Fatalf("unexpected signature: %+v", signature)
+	}
+	signed, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := hex.DecodeString(releaseContentsSHA256)
+	publicKey, _ := base64.StdEncoding.DecodeString(testSigningPublicKey())
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), digest, signed) {
+		t.Fatal("expected a valid signature")
+	}
+}
+
+func TestUploadReleaseSignsWithKMS(t *testing.T) {
+	// Given
+	kmsClient := &MockKMSClient{}
+
+	// When
+	response, output, s3Uploader := uploadSignedRelease(t, map[string]string{"release_signing_kms_key": "alias/releases"}, nil, kmsClient)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	input := kmsClient.signInputs[0]
+	if *input.KeyId != "alias/releases" || *input.MessageType != kms.MessageTypeDigest || *input.SigningAlgorithm != handler.DefaultReleaseSigningAlgorithm {
+		t.Fatalf("unexpected sign request: %v", input)
+	}
+	if hex.EncodeToString(input.Message) != releaseContentsSHA256 {
+		t.Fatalf("expected %q, got %q", releaseContentsSHA256, hex.EncodeToString(input.Message))
+	}
+	signature := uploadedSignature(t, s3Uploader)
+	if signature.Signature != base64.StdEncoding.EncodeToString([]byte("kms-signature")) {
+		t.Fatalf("unexpected signature: %+v", signature)
+	}
+}
+
+func TestUploadReleaseSigningKeyErrors(t *testing.T) {
+	otherSeed := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+	for _, tc := range []struct {
+		name     string
+		env      map[string]string
+		expected string
+	}{
+		{"missing", nil, handler.ReleaseSigningKeyEnvVar + " must be set"},
+		{"mismatched", map[string]string{handler.ReleaseSigningKeyEnvVar: otherSeed}, "is not the private key for the platform profile's release_signing_ed25519_public_key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			response, output, s3Uploader := uploadSignedRelease(
+				t, map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey()}, tc.env, nil,
+			)
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			if !strings.Contains(output, tc.expected) {
+				t.Fatalf("expected %q in %q", tc.expected, output)
+			}
+			if len(s3Uploader.calls) != 0 {
+				t.Fatal("expected nothing to be uploaded")
+			}
+		})
+	}
+}
+
+func ed25519ReleaseSignature(sha256 string) *handler.ReleaseSignature {
+	digest, _ := hex.DecodeString(sha256)
+	return &handler.ReleaseSignature{
+		SHA256:    sha256,
+		Algorithm: "ED25519",
+		Key:       testSigningPublicKey(),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.NewKeyFromSeed(testSigningSeed), digest)),
+	}
+}
+
+func prepareTerraformWithSignature(t *testing.T, signing map[string]string, config map[string]interface{}, env map[string]string, signature *handler.ReleaseSignature) (*common.PrepareTerraformResponse, string, *MockReleaseLoader) {
+	profilePath := writeSigningProfile(t, signing)
+	defer os.RemoveAll(filepath.Dir(profilePath))
+	request := createPrepareTerraformRequest()
+	request.Version = "1"
+	for key, value := range config {
+		request.Config[key] = value
+	}
+	for key, value := range env {
+		request.Env[key] = value
+	}
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+
+	var errorBuffer bytes.Buffer
+	loader := &MockReleaseLoader{}
+	s3Client := &MockSignedReleaseS3Client{
+		MockS3Client: &MockS3Client{getObjectBody: ioutil.NopCloser(strings.NewReader("release contents"))},
+		signature:    signature,
+	}
+	h := createPrepareTerraformHandler(&errorBuffer, s3Client.MockS3Client, &MockSTSClient{}, nil).
+		WithProfilePath(profilePath).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API { return s3Client }).
+		WithKMSClientFactory(func(client.ConfigProvider) kmsiface.KMSAPI { return &MockKMSClient{} }).
+		WithReleaseLoader(loader)
+	response := common.CreatePrepareTerraformResponse()
+	if err := h.PrepareTerraform(request, response, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String(), loader
+}
+
+func TestPrepareTerraformVerifiesReleaseSignature(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		signing   map[string]string
+		signature *handler.ReleaseSignature
+	}{
+		{
+			"ed25519",
+			map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_environments": "live"},
+			ed25519ReleaseSignature(releaseContentsSHA256),
+		},
+		{
+			"kms",
+			map[string]string{"release_signing_kms_key": "alias/releases", "release_signing_environments": "live"},
+			&handler.ReleaseSignature{SHA256: releaseContentsSHA256, Signature: base64.StdEncoding.EncodeToString([]byte("kms-signature"))},
+		},
+		{
+			"environment not checked",
+			map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_environments": "staging"},
+			nil,
+		},
+		{
+			"account not checked",
+			map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_accounts": "111111111111"},
+			nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			response, output, loader := prepareTerraformWithSignature(t, tc.signing, nil, nil, tc.signature)
+
+			// Then
+			if !response.Success {
+				t.Fatalf("unexpected failure: %s", output)
+			}
+			if !loader.called {
+				t.Fatal("expected the release to be loaded")
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformReleaseSignatureErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		signing   map[string]string
+		signature *handler.ReleaseSignature
+		expected  string
+	}{
+		{
+			"unsigned",
+			map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_environments": "live"},
+			nil,
+			"release is not signed (no s3://acuris-releases/test-team/test-component/test-component-1.zip.sig) - only signed releases can be deployed to the live environment",
+		},
+		{
+			"different release",
+			map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_environments": "live"},
+			ed25519ReleaseSignature(strings.Repeat("00", 32)),
+			"release signature verification failed for the live environment: the signature is for sha256 " + strings.Repeat("00", 32),
+		},
+		{
+			"tampered ed25519",
+			map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_environments": "live"},
+			&handler.ReleaseSignature{SHA256: releaseContentsSHA256, Signature: ed25519ReleaseSignature(strings.Repeat("00", 32)).Signature},
+			"the signature is not valid for ed25519 public key",
+		},
+		{
+			"invalid kms",
+			map[string]string{"release_signing_kms_key": "alias/releases", "release_signing_environments": "live"},
+			&handler.ReleaseSignature{SHA256: releaseContentsSHA256, Signature: base64.StdEncoding.EncodeToString([]byte("forged"))},
+			"the signature is not valid for KMS key alias/releases (set CDFLOW2_SKIP_RELEASE_SIGNATURE to the reason to override)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			response, output, loader := prepareTerraformWithSignature(t, tc.signing, nil, nil, tc.signature)
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			if loader.called {
+				t.Fatal("expected the release not to be loaded")
+			}
+			if !strings.Contains(output, tc.expected) {
+				t.Fatalf("expected %q in %q", tc.expected, output)
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformReleaseSignatureBreakGlass(t *testing.T) {
+	// When
+	response, output, loader := prepareTerraformWithSignature(
+		t,
+		map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_environments": "live"},
+		nil,
+		map[string]string{handler.SkipReleaseSignatureEnvVar: "INC-123 hotfix"},
+		nil,
+	)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if !loader.called {
+		t.Fatal("expected the release to be loaded")
+	}
+	expected := `WARNING: NOT verifying the release signature for the live environment - CDFLOW2_SKIP_RELEASE_SIGNATURE is set by "baz", with reason: INC-123 hotfix`
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in %q", expected, output)
+	}
+}
+
+func TestPrepareTerraformReleaseSigningIgnoresProjectConfig(t *testing.T) {
+	// Given
+	otherKey := base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize)).Public().(ed25519.PublicKey))
+	config := map[string]interface{}{
+		"release_signing": map[string]interface{}{"ed25519_public_key": otherKey, "tiers": []interface{}{"staging"}},
+	}
+
+	// When
+	response, output, loader := prepareTerraformWithSignature(
+		t,
+		map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_environments": "live"},
+		config,
+		nil,
+		nil,
+	)
+
+	// Then
+	if response.Success || loader.called {
+		t.Fatalf("expected the release to be rejected, got: %s", output)
+	}
+	if !strings.Contains(output, "only signed releases can be deployed to the live environment") {
+		t.Fatalf("expected the profile's environments to be enforced in %q", output)
+	}
+}
+
+func TestPrepareTerraformReleaseSignatureIgnoresProjectTiers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		signing  map[string]string
+		expected string
+	}{
+		{
+			"environment",
+			map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_environments": "live"},
+			"only signed releases can be deployed to the live environment",
+		},
+		{
+			"deploy account",
+			map[string]string{"release_signing_ed25519_public_key": testSigningPublicKey(), "release_signing_accounts": "123456789012"},
+			"only signed releases can be deployed to account 123456789012",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			config := map[string]interface{}{
+				"tiers": map[string]interface{}{
+					"unsigned": map[string]interface{}{"environments": []interface{}{"live"}, "account_id": "123456789012"},
+					"dev":      map[string]interface{}{},
+				},
+			}
+
+			// When
+			response, output, loader := prepareTerraformWithSignature(t, tc.signing, config, nil, nil)
+
+			// Then
+			if response.Success || loader.called {
+				t.Fatalf("expected the release to be rejected, got: %s", output)
+			}
+			if !strings.Contains(output, tc.expected) {
+				t.Fatalf("expected %q in %q", tc.expected, output)
+			}
+		})
+	}
+}
+
+func TestParseReleaseSigningProfile(t *testing.T) {
+	// When
+	signing, err := handler.ParseReleaseSigningProfile(map[string]string{
+		"release_signing_kms_key":      "alias/releases",
+		"release_signing_environments": "live, prod-eu",
+		"release_signing_accounts":     "123456789012",
+	})
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signing.Algorithm != handler.DefaultReleaseSigningAlgorithm || strings.Join(signing.Environments, ",") != "live,prod-eu" ||
+		strings.Join(signing.Accounts, ",") != "123456789012" {
+		t.Fatalf("unexpected signing config: %+v", signing)
+	}
+}
+
+func TestParseReleaseSigningProfileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		values   map[string]string
+		expected string
+	}{
+		{"no key", map[string]string{"release_signing_environments": "live"}, "must have one of release_signing_kms_key or release_signing_ed25519_public_key"},
+		{
+			"tiers",
+			map[string]string{"release_signing_kms_key": "alias/releases", "release_signing_tiers": "prod"},
+			"release_signing_tiers is not supported, since tiers are defined by each project",
+		},
+		{
+			"bad account",
+			map[string]string{"release_signing_kms_key": "alias/releases", "release_signing_accounts": "12345"},
+			`release_signing_accounts "12345" is not a valid AWS account ID`,
+		},
+		{
+			"both keys",
+			map[string]string{"release_signing_kms_key": "alias/releases", "release_signing_ed25519_public_key": testSigningPublicKey()},
+			"must have one of release_signing_kms_key or release_signing_ed25519_public_key",
+		},
+		{"bad public key", map[string]string{"release_signing_ed25519_public_key": "abc"}, "must be a base64 encoded ed25519 public key"},
+		{"bad algorithm", map[string]string{"release_signing_kms_key": "k", "release_signing_algorithm": "MD5"}, `release_signing_algorithm "MD5" is not one of`},
+		{
+			"algorithm without SHA-256",
+			map[string]string{"release_signing_kms_key": "k", "release_signing_algorithm": kms.SigningAlgorithmSpecEcdsaSha384},
+			`release_signing_algorithm "ECDSA_SHA_384" is not one of`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			_, err := handler.ParseReleaseSigningProfile(tc.values)
+
+			// Then
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("expected %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Limits on config.params.role_duration_seconds, see the DurationSeconds parameter of sts:AssumeRole.
+const (
+	DefaultRoleDuration = time.Hour
+	minRoleDuration     = 15 * time.Minute
+	maxRoleDuration     = 12 * time.Hour
+	// AWS limits sessions to an hour when role credentials are used to assume another role.
+	roleChainingMaxDuration = time.Hour
+)
+
+var roleNamePattern = regexp.MustCompile(`^[\w+=,.@-]{1,64}$`)
+
+// AssumeRoleOptions are the settings used when assuming the release and deploy roles.
+type AssumeRoleOptions struct {
+	Duration          time.Duration
+	ExternalID        string
+	Tags              []*sts.Tag
+	TransitiveTagKeys []*string
+}
+
+func roleName(config map[string]interface{}, param, team string) (string, error) {
+	value, ok := config[param]
+	if !ok {
+		return team + "-deploy", nil
+	}
+	name, ok := value.(string)
+	if !ok || !roleNamePattern.MatchString(name) {
+		return "", fmt.Errorf("cdflow.yaml error: config.params.%s must be a valid IAM role name", param)
+	}
+	return name, nil
+}
+
+// releaseRoleName returns the role to assume in the release account - config.params.release_role, or <team>-deploy.
+func releaseRoleName(config map[string]interface{}, team string) (string, error) {
+	return roleName(config, "release_role", team)
+}
+
+// deployRoleName returns the role to assume in the deploy account - the tier's deploy_role, then
+// config.params.deploy_role, then <team>-deploy.
+func deployRoleName(config map[string]interface{}, tier *Tier, team string) (string, error) {
+	if tier.DeployRole != "" {
+		return tier.DeployRole, nil
+	}
+	return roleName(config, "deploy_role", team)
+}
+
+func intParam(value interface{}, param string) (int64, error) {
+	switch typed := value.(type) {
+	case int:
+		return int64(typed), nil
+	case int64:
+		return typed, nil
+	case float64:
+		if typed == float64(int64(typed)) {
+			return int64(typed), nil
+		}
+	}
+	return 0, fmt.Errorf("cdflow.yaml error: %s must be a whole number", param)
+}
+
+// assumeRoleOptions returns the options from config.params.role_duration_seconds, config.params.role_external_id and
+// the session tags, checking the duration against the limits AWS will enforce so that it fails before anything is assumed.
+func assumeRoleOptions(ctx *RoleContext) (*AssumeRoleOptions, error) {
+	config, env := ctx.Config, ctx.Env
+	options := &AssumeRoleOptions{Duration: DefaultRoleDuration}
+	if value, ok := config["role_duration_seconds"]; ok {
+		seconds, err := intParam(value, "config.params.role_duration_seconds")
+		if err != nil {
+			return nil, err
+		}
+		options.Duration = time.Duration(seconds) * time.Second
+		if options.Duration < minRoleDuration || options.Duration > maxRoleDuration {
+			return nil, fmt.Errorf(
+				"cdflow.yaml error: config.params.role_duration_seconds must be between %d and %d, got %d",
+				int(minRoleDuration.Seconds()), int(maxRoleDuration.Seconds()), seconds,
+			)
+		}
+		if source := detectRootCredentialSource(env); source != nil && source.roleSession && options.Duration > roleChainingMaxDuration {
+			return nil, fmt.Errorf(
+				"cdflow.yaml error: config.params.role_duration_seconds is %d, but the AWS credentials from %s are role "+
+					"credentials and AWS limits sessions assumed from them (role chaining) to %d seconds",
+				seconds, source.name, int(roleChainingMaxDuration.Seconds()),
+			)
+		}
+	}
+	if value, ok := config["role_external_id"]; ok {
+		externalID, ok := value.(string)
+		if !ok || len(externalID) < 2 || len(externalID) > 1224 {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.role_external_id must be a string of 2 to 1224 characters")
+		}
+		options.ExternalID = externalID
+	}
+	tags, transitiveTagKeys, err := ctx.sessionTags()
+	if err != nil {
+		return nil, err
+	}
+	options.Tags = tags
+	options.TransitiveTagKeys = transitiveTagKeys
+	return options, nil
+}
+
+// checkSessionDuration fails before a role is assumed for longer than AWS allows - an hour if the root credentials are
+// themselves an assumed role (role chaining), otherwise the role's MaxSessionDuration. The role can only be read when
+// it's in the same account as the root credentials, so for other roles the error from STS is translated instead, see
+// translateSessionDurationError.
+func (h *Handler) checkSessionDuration(session client.ConfigProvider, roleARN string, duration time.Duration) error {
+	// every role allows at least an hour, and chained sessions are allowed an hour
+	if duration <= roleChainingMaxDuration {
+		return nil
+	}
+	identity, err := h.STSClientFactory(session).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("unable to get the identity of the AWS credentials: %v", err)
+	}
+	if caller, err := arn.Parse(aws.StringValue(identity.Arn)); err == nil && strings.HasPrefix(caller.Resource, "assumed-role/") {
+		return fmt.Errorf(
+			"cdflow.yaml error: config.params.role_duration_seconds is %d, but the AWS credentials are for the assumed "+
+				"role %s, and AWS limits sessions assumed from them (role chaining) to %d seconds",
+			int(duration.Seconds()), aws.StringValue(identity.Arn), int(roleChainingMaxDuration.Seconds()),
+		)
+	}
+	role, err := arn.Parse(roleARN)
+	if err != nil || role.AccountID != aws.StringValue(identity.Account) {
+		return nil
+	}
+	output, err := h.IAMClientFactory(session).GetRole(&iam.GetRoleInput{
+		RoleName: aws.String(strings.TrimPrefix(role.Resource, "role/")),
+	})
+	// not being able to read the role isn't fatal, since assuming it will still fail with an explanation
+	if err != nil || output.Role.MaxSessionDuration == nil {
+		return nil
+	}
+	if maxDuration := time.Duration(*output.Role.MaxSessionDuration) * time.Second; duration > maxDuration {
+		return fmt.Errorf(
+			"cdflow.yaml error: config.params.role_duration_seconds is %d, but the maximum session duration of %s is %d "+
+				"seconds - reduce config.params.role_duration_seconds, or ask for the role's MaxSessionDuration to be increased",
+			int(duration.Seconds()), roleARN, int(maxDuration.Seconds()),
+		)
+	}
+	return nil
+}
+
+// translateSessionDurationError explains the error AWS returns when the requested duration is longer than the role allows.
+func translateSessionDurationError(err error, roleARN string, duration time.Duration) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "MaxSessionDuration") {
+		return fmt.Errorf(
+			"unable to assume %s for %d seconds as it is longer than the role's maximum session duration - "+
+				"reduce config.params.role_duration_seconds, or ask for the role's MaxSessionDuration to be increased",
+			roleARN, int(duration.Seconds()),
+		)
+	}
+	return err
+}
+
+// sessionDurationErrorProvider wraps an assume role provider to translate session duration errors, see
+// translateSessionDurationError.
+type sessionDurationErrorProvider struct {
+	credentials.Provider
+	roleARN  string
+	duration time.Duration
+}
+
+func (p *sessionDurationErrorProvider) Retrieve() (credentials.Value, error) {
+	value, err := p.Provider.Retrieve()
+	if err != nil {
+		return value, translateSessionDurationError(err, p.roleARN, p.duration)
+	}
+	return value, nil
+}
+
+// ExpiresAt implements credentials.Expirer for the wrapped provider, so that the expiry of the role's credentials is
+// still available.
+func (p *sessionDurationErrorProvider) ExpiresAt() time.Time {
+	if expirer, ok := p.Provider.(credentials.Expirer); ok {
+		return expirer.ExpiresAt()
+	}
+	return time.Time{}
+}
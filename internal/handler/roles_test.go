@@ -0,0 +1,241 @@
+package handler_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestPrepareTerraformRoles(t *testing.T) {
+	// Given
+	request := createPrepareTerraformRequest()
+	request.EnvName = "staging"
+	request.Config["release_role"] = "platform-release"
+	request.Config["deploy_role"] = "platform-deploy"
+	request.Config["role_duration_seconds"] = float64(14400)
+	request.Config["role_external_id"] = "test-external-id"
+	request.Config["tiers"] = map[string]interface{}{
+		"prod":    map[string]interface{}{"environments": []interface{}{"live"}, "deploy_role": "prod-deploy"},
+		"staging": map[string]interface{}{"environments": []interface{}{"staging"}},
+		"dev":     map[string]interface{}{},
+	}
+	response := common.CreatePrepareTerraformResponse()
+
+	var releaseRoleARN string
+	var releaseOptions *handler.AssumeRoleOptions
+	var errorBuffer bytes.Buffer
+	stsClient := &MockSTSClient{}
+	h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, stsClient, nil).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			releaseRoleARN = roleARN
+			releaseOptions = options
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		}).
+		WithOrganizationsClientFactory(func(client.ConfigProvider) organizationsiface.OrganizationsAPI {
+			return &MockOrganizationsClient{Accounts: map[string]string{"foostaging": "2222222222"}}
+		})
+
+	// When
+	if err := h.PrepareTerraform(request, response, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	expectedReleaseRole := "arn:aws:iam::" + handler.AccountID + ":role/platform-release"
+	if releaseRoleARN != expectedReleaseRole {
+		t.Fatalf("expected %q, got %q", expectedReleaseRole, releaseRoleARN)
+	}
+	if releaseOptions.Duration != 4*time.Hour || releaseOptions.ExternalID != "test-external-id" {
+		t.Fatalf("unexpected release role options: %+v", *releaseOptions)
+	}
+	expectedDeployRole := "arn:aws:iam::2222222222:role/platform-deploy"
+	if stsClient.assumedRoleArn != expectedDeployRole {
+		t.Fatalf("expected %q, got %q", expectedDeployRole, stsClient.assumedRoleArn)
+	}
+	if *stsClient.assumeRoleInput.DurationSeconds != 14400 {
+		t.Fatalf("expected %d, got %d", 14400, *stsClient.assumeRoleInput.DurationSeconds)
+	}
+	if *stsClient.assumeRoleInput.ExternalId != "test-external-id" {
+		t.Fatalf("expected %q, got %q", "test-external-id", *stsClient.assumeRoleInput.ExternalId)
+	}
+
+	t.Run("tier deploy role", func(t *testing.T) {
+		// Given
+		request.EnvName = "live"
+		request.Config["tiers"].(map[string]interface{})["prod"].(map[string]interface{})["account_id"] = "333333333333"
+		stsClient := &MockSTSClient{}
+		h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, stsClient, nil)
+
+		// When
+		if err := h.PrepareTerraform(request, common.CreatePrepareTerraformResponse(), ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		expected := "arn:aws:iam::333333333333:role/prod-deploy"
+		if stsClient.assumedRoleArn != expected {
+			t.Fatalf("expected %q, got %q", expected, stsClient.assumedRoleArn)
+		}
+	})
+}
+
+type MockIAMClient struct {
+	iamiface.IAMAPI
+	maxSessionDuration int64
+	requestedRoles     []string
+}
+
+func (m *MockIAMClient) GetRole(input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+	m.requestedRoles = append(m.requestedRoles, *input.RoleName)
+	return &iam.GetRoleOutput{Role: &iam.Role{
+		RoleName:           input.RoleName,
+		MaxSessionDuration: aws.Int64(m.maxSessionDuration),
+	}}, nil
+}
+
+func TestPrepareTerraformRoleDurationErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		duration      interface{}
+		env           map[string]string
+		callerARN     string
+		assumeRoleErr error
+		expectedError string
+	}{
+		{
+			"too short",
+			float64(600),
+			nil,
+			"",
+			nil,
+			"config.params.role_duration_seconds must be between 900 and 43200, got 600",
+		},
+		{
+			"not a number",
+			"4h",
+			nil,
+			"",
+			nil,
+			"config.params.role_duration_seconds must be a whole number",
+		},
+		{
+			"role chaining",
+			float64(7200),
+			map[string]string{
+				"AWS_ACCESS_KEY_ID":           "",
+				"AWS_WEB_IDENTITY_TOKEN_FILE": "/token",
+				"AWS_ROLE_ARN":                "arn:aws:iam::123456789012:role/ci",
+			},
+			"",
+			nil,
+			"AWS limits sessions assumed from them (role chaining) to 3600 seconds",
+		},
+		{
+			"role chaining from static keys",
+			float64(7200),
+			nil,
+			"arn:aws:sts::123456789012:assumed-role/ci/session",
+			nil,
+			"the AWS credentials are for the assumed role arn:aws:sts::123456789012:assumed-role/ci/session, and AWS limits sessions assumed from them (role chaining) to 3600 seconds",
+		},
+		{
+			"exceeds max session duration of a role in the same account",
+			float64(7200),
+			nil,
+			"arn:aws:iam::" + handler.AccountID + ":user/ci",
+			nil,
+			"the maximum session duration of arn:aws:iam::" + handler.AccountID + ":role/test-team-deploy is 3600 seconds",
+		},
+		{
+			"exceeds max session duration",
+			float64(7200),
+			nil,
+			"",
+			awserr.New("ValidationError", "The requested DurationSeconds exceeds the MaxSessionDuration set for this role.", nil),
+			"unable to assume arn:aws:iam::1234567890:role/test-team-deploy for 7200 seconds as it is longer than the role's maximum session duration",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			request := createPrepareTerraformRequest()
+			request.Config["role_duration_seconds"] = tc.duration
+			for key, value := range tc.env {
+				request.Env[key] = value
+			}
+			response := common.CreatePrepareTerraformResponse()
+			var errorBuffer bytes.Buffer
+			stsClient := &MockSTSClient{assumeRoleErr: tc.assumeRoleErr, callerARN: tc.callerARN}
+			h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{getObjectBody: ioutil.NopCloser(&bytes.Buffer{})}, stsClient, nil).
+				WithIAMClientFactory(func(client.ConfigProvider) iamiface.IAMAPI {
+					return &MockIAMClient{maxSessionDuration: 3600}
+				})
+
+			// When
+			if err := h.PrepareTerraform(request, response, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			if !strings.Contains(errorBuffer.String(), tc.expectedError) {
+				t.Fatalf("expected %q in %q", tc.expectedError, errorBuffer.String())
+			}
+		})
+	}
+}
+
+type MockExpiringProvider struct {
+	*MockAssumeRoleProvider
+	expiresAt time.Time
+}
+
+func (m *MockExpiringProvider) ExpiresAt() time.Time {
+	return m.expiresAt
+}
+
+func TestReleaseAccountCredentialsExpiry(t *testing.T) {
+	// Given
+	expiresAt := time.Date(2026, 6, 1, 13, 0, 0, 0, time.UTC)
+	h := handler.New().
+		WithErrorStream(&bytes.Buffer{}).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			return &MockExpiringProvider{createMockAssumeRoleProvider("foo", "bar", "baz"), expiresAt}
+		})
+	request := createPrepareTerraformRequest()
+
+	// When
+	if err := h.InitReleaseAccountCredentials(&handler.RoleContext{
+		Config: request.Config, Env: request.Env, Team: "test-team", Component: "test-component",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ReleaseAccountCredentials.Get(); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := h.ReleaseAccountCredentials.ExpiresAt()
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !actual.Equal(expiresAt) {
+		t.Fatalf("expected %v, got %v", expiresAt, actual)
+	}
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// containerCredentialsHost is the host that AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is relative to (ECS task roles).
+const containerCredentialsHost = "http://169.254.170.2"
+
+// rootCredentialSource is one way of getting root account credentials from the forwarded environment. The SDK's
+// default chain isn't used since it would read the config container's own environment rather than the request's.
+type rootCredentialSource struct {
+	name     string
+	detect   func(env map[string]string) bool
+	provider func(h *Handler, env map[string]string) (credentials.Provider, error)
+	// roleSession is set for sources that always return role credentials, so roles assumed with them are chained.
+	roleSession bool
+}
+
+// rootCredentialSources are tried in order, and the first one whose variables are present is used.
+var rootCredentialSources = []rootCredentialSource{
+	{
+		name: "static keys (AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY)",
+		detect: func(env map[string]string) bool {
+			return env["AWS_ACCESS_KEY_ID"] != "" && env["AWS_SECRET_ACCESS_KEY"] != ""
+		},
+		provider: func(h *Handler, env map[string]string) (credentials.Provider, error) {
+			return &credentials.StaticProvider{Value: credentials.Value{
+				AccessKeyID:     env["AWS_ACCESS_KEY_ID"],
+				SecretAccessKey: env["AWS_SECRET_ACCESS_KEY"],
+				SessionToken:    env["AWS_SESSION_TOKEN"],
+			}}, nil
+		},
+	},
+	{
+		name: "web identity (AWS_WEB_IDENTITY_TOKEN_FILE/AWS_ROLE_ARN)",
+		detect: func(env map[string]string) bool {
+			return env["AWS_WEB_IDENTITY_TOKEN_FILE"] != "" && env["AWS_ROLE_ARN"] != ""
+		},
+		provider:    (*Handler).webIdentityProvider,
+		roleSession: true,
+	},
+	{
+		name: "container credentials endpoint (AWS_CONTAINER_CREDENTIALS_FULL_URI/AWS_CONTAINER_CREDENTIALS_RELATIVE_URI)",
+		detect: func(env map[string]string) bool {
+			return env["AWS_CONTAINER_CREDENTIALS_FULL_URI"] != "" || env["AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"] != ""
+		},
+		provider:    (*Handler).containerCredentialsProvider,
+		roleSession: true,
+	},
+	{
+		name: "shared credentials profile (AWS_PROFILE)",
+		detect: func(env map[string]string) bool {
+			return env["AWS_PROFILE"] != ""
+		},
+		provider: (*Handler).sharedProfileProvider,
+	},
+}
+
+// sharedProfileProvider loads AWS_PROFILE from both the shared config and credentials files, so that profiles using
+// role_arn/source_profile, credential_process or SSO in AWS_CONFIG_FILE work as they do for the AWS CLI.
+func (h *Handler) sharedProfileProvider(env map[string]string) (credentials.Provider, error) {
+	profile := env["AWS_PROFILE"]
+	configFile := env["AWS_CONFIG_FILE"]
+	credentialsFile := env["AWS_SHARED_CREDENTIALS_FILE"]
+	if env["HOME"] != "" {
+		if configFile == "" {
+			configFile = filepath.Join(env["HOME"], ".aws", "config")
+		}
+		if credentialsFile == "" {
+			credentialsFile = filepath.Join(env["HOME"], ".aws", "credentials")
+		}
+	}
+	var files []string
+	for _, file := range []string{configFile, credentialsFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("AWS_PROFILE is set, but neither AWS_CONFIG_FILE/AWS_SHARED_CREDENTIALS_FILE nor HOME are set to locate the shared config files")
+	}
+	// the SDK silently falls back to other credentials for a missing profile, so check it exists first
+	if !sharedProfileExists(files, profile) {
+		return nil, fmt.Errorf("profile %q not found in %s", profile, strings.Join(files, " or "))
+	}
+	profileSession, err := session.NewSessionWithOptions(session.Options{
+		Config:            *aws.NewConfig().WithRegion(h.Profile.Region),
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+		// as with the SDK defaults, the credentials file takes precedence over the config file
+		SharedConfigFiles: files,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to load profile %q from %s: %v", profile, strings.Join(files, " or "), err)
+	}
+	return &sessionCredentialsProvider{profileSession.Config.Credentials}, nil
+}
+
+// sharedProfileExists returns whether any of the shared config files has a section for the profile, which is
+// "[name]" in the credentials file and "[profile name]" in the config file.
+func sharedProfileExists(files []string, profile string) bool {
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+				continue
+			}
+			section := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if section == profile || section == "profile "+profile {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sessionCredentialsProvider adapts the credentials resolved by a session to a credentials.Provider.
+type sessionCredentialsProvider struct {
+	credentials *credentials.Credentials
+}
+
+// Retrieve implements credentials.Provider.
+func (p *sessionCredentialsProvider) Retrieve() (credentials.Value, error) {
+	return p.credentials.Get()
+}
+
+// IsExpired implements credentials.Provider.
+func (p *sessionCredentialsProvider) IsExpired() bool {
+	return p.credentials.IsExpired()
+}
+
+func (h *Handler) webIdentityProvider(env map[string]string) (credentials.Provider, error) {
+	roleSessionName := env["AWS_ROLE_SESSION_NAME"]
+	if roleSessionName == "" {
+		var err error
+		if roleSessionName, err = GetRoleSessionName(env); err != nil {
+			return nil, err
+		}
+	}
+	// AssumeRoleWithWebIdentity is authorised by the token, so the STS client itself needs no credentials
+	stsSession, err := session.NewSession(
+		aws.NewConfig().
+			WithCredentials(credentials.AnonymousCredentials).
+			WithRegion(h.Profile.Region).
+			WithSTSRegionalEndpoint(endpoints.RegionalSTSEndpoint),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return stscreds.NewWebIdentityRoleProvider(
+		h.STSClientFactory(stsSession),
+		env["AWS_ROLE_ARN"],
+		roleSessionName,
+		env["AWS_WEB_IDENTITY_TOKEN_FILE"],
+	), nil
+}
+
+func (h *Handler) containerCredentialsProvider(env map[string]string) (credentials.Provider, error) {
+	endpoint := env["AWS_CONTAINER_CREDENTIALS_FULL_URI"]
+	if endpoint == "" {
+		endpoint = containerCredentialsHost + env["AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"]
+	}
+	authorizationToken := env["AWS_CONTAINER_AUTHORIZATION_TOKEN"]
+	if tokenFile := env["AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"]; authorizationToken == "" && tokenFile != "" {
+		contents, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE: %v", err)
+		}
+		authorizationToken = strings.TrimSpace(string(contents))
+	}
+	return endpointcreds.NewProviderClient(
+		*defaults.Config().WithRegion(h.Profile.Region),
+		defaults.Handlers(),
+		endpoint,
+		func(p *endpointcreds.Provider) {
+			p.AuthorizationToken = authorizationToken
+		},
+	), nil
+}
+
+// detectRootCredentialSource returns the first credential source found in the forwarded environment, or nil.
+func detectRootCredentialSource(env map[string]string) *rootCredentialSource {
+	for i := range rootCredentialSources {
+		if rootCredentialSources[i].detect(env) {
+			return &rootCredentialSources[i]
+		}
+	}
+	return nil
+}
+
+// rootCredentialsProvider returns the provider for the first credential source found in the forwarded environment.
+func (h *Handler) rootCredentialsProvider(env map[string]string) (string, credentials.Provider, error) {
+	if source := detectRootCredentialSource(env); source != nil {
+		provider, err := source.provider(h, env)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to use AWS credentials from %s: %v", source.name, err)
+		}
+		return source.name, provider, nil
+	}
+	names := make([]string, len(rootCredentialSources))
+	for i, source := range rootCredentialSources {
+		names[i] = source.name
+	}
+	return "", nil, fmt.Errorf("no AWS credentials found in env, expected one of (in order of precedence):\n  %s", strings.Join(names, "\n  "))
+}
@@ -0,0 +1,184 @@
+package handler_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+)
+
+const assumeRoleWithWebIdentityResponse = `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>web-key</AccessKeyId>
+      <SecretAccessKey>web-secret</SecretAccessKey>
+      <SessionToken>web-token</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`
+
+func TestGetRootAccountSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-jwt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	credentialsFile := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(credentialsFile, []byte("[ci]\naws_access_key_id = profile-key\naws_secret_access_key = profile-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configFile := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(configFile, []byte("[profile config-only]\naws_access_key_id = config-key\naws_secret_access_key = config-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stsRequestBody string
+	stsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		stsRequestBody = string(body)
+		fmt.Fprint(w, assumeRoleWithWebIdentityResponse)
+	}))
+	defer stsServer.Close()
+
+	var containerAuthorization string
+	containerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		containerAuthorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, `{"AccessKeyId": "container-key", "SecretAccessKey": "container-secret", "Token": "container-token", "Expiration": "2100-01-01T00:00:00Z"}`)
+	}))
+	defer containerServer.Close()
+
+	for _, tc := range []struct {
+		name           string
+		env            map[string]string
+		expectedKey    string
+		expectedSource string
+	}{
+		{
+			"static keys take precedence",
+			map[string]string{
+				"AWS_ACCESS_KEY_ID":           "static-key",
+				"AWS_SECRET_ACCESS_KEY":       "static-secret",
+				"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile,
+				"AWS_ROLE_ARN":                "arn:aws:iam::123456789012:role/ci",
+			},
+			"static-key",
+			"static keys",
+		},
+		{
+			"web identity",
+			map[string]string{
+				"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile,
+				"AWS_ROLE_ARN":                "arn:aws:iam::123456789012:role/ci",
+				"ROLE_SESSION_NAME":           "test-session",
+				"AWS_PROFILE":                 "ci",
+			},
+			"web-key",
+			"web identity",
+		},
+		{
+			"container credentials",
+			map[string]string{
+				"AWS_CONTAINER_CREDENTIALS_FULL_URI": containerServer.URL,
+				"AWS_CONTAINER_AUTHORIZATION_TOKEN":  "container-auth",
+			},
+			"container-key",
+			"container credentials endpoint",
+		},
+		{
+			"profile",
+			map[string]string{
+				"AWS_PROFILE":                 "ci",
+				"AWS_SHARED_CREDENTIALS_FILE": credentialsFile,
+			},
+			"profile-key",
+			"shared credentials profile",
+		},
+		{
+			"profile in config file",
+			map[string]string{
+				"AWS_PROFILE":                 "config-only",
+				"AWS_CONFIG_FILE":             configFile,
+				"AWS_SHARED_CREDENTIALS_FILE": credentialsFile,
+			},
+			"config-key",
+			"shared credentials profile",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			var errorBuffer bytes.Buffer
+			h := handler.New().
+				WithErrorStream(&errorBuffer).
+				WithSTSClientFactory(func(session client.ConfigProvider) stsiface.STSAPI {
+					return sts.New(session, aws.NewConfig().WithEndpoint(stsServer.URL))
+				})
+
+			// When
+			session, err := h.GetRootAccountSession(tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := session.Config.Credentials.Get()
+
+			// Then
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value.AccessKeyID != tc.expectedKey {
+				t.Fatalf("expected %q, got %q", tc.expectedKey, value.AccessKeyID)
+			}
+			if !strings.Contains(errorBuffer.String(), "- Using AWS credentials from "+tc.expectedSource) {
+				t.Fatalf("expected source %q to be logged, got %q", tc.expectedSource, errorBuffer.String())
+			}
+		})
+	}
+
+	if !strings.Contains(stsRequestBody, "WebIdentityToken=test-jwt") || !strings.Contains(stsRequestBody, "RoleSessionName=test-session") {
+		t.Fatalf("unexpected AssumeRoleWithWebIdentity request: %q", stsRequestBody)
+	}
+	if containerAuthorization != "container-auth" {
+		t.Fatalf("expected %q, got %q", "container-auth", containerAuthorization)
+	}
+
+	t.Run("unknown profile", func(t *testing.T) {
+		// When
+		_, err := handler.New().GetRootAccountSession(map[string]string{
+			"AWS_PROFILE":                 "missing",
+			"AWS_CONFIG_FILE":             configFile,
+			"AWS_SHARED_CREDENTIALS_FILE": credentialsFile,
+		})
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), `profile "missing" not found in `+configFile+" or "+credentialsFile) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		// When
+		_, err := handler.New().GetRootAccountSession(map[string]string{"HOME": dir})
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), "no AWS credentials found in env") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
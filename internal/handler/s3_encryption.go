@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Encryption is the server-side encryption for releases, provider plugins and terraform state, from
+// config.params.s3_encryption. A nil *S3Encryption leaves encryption to the bucket defaults.
+type S3Encryption struct {
+	// Type is s3.ServerSideEncryptionAes256 (SSE-S3) or s3.ServerSideEncryptionAwsKms (SSE-KMS).
+	Type string
+	// KMSKey is the ARN of the team's key alias for SSE-KMS.
+	KMSKey string
+}
+
+// S3KMSKeyAlias returns the ARN of the alias of the team's key for SSE-KMS, in the release account. The key is shared
+// by all of the team's components, so it is named after the team rather than configured by each component.
+func S3KMSKeyAlias(profile *Profile, team string) string {
+	return fmt.Sprintf("arn:aws:kms:%s:%s:alias/%s-s3", profile.Region, profile.AccountID, team)
+}
+
+// ParseS3Encryption reads config.params.s3_encryption, returning nil if it isn't set.
+func ParseS3Encryption(config map[string]interface{}, profile *Profile, team string) (*S3Encryption, error) {
+	if _, ok := config["s3_kms_key"]; ok {
+		return nil, fmt.Errorf(
+			"cdflow.yaml error: config.params.s3_kms_key is not supported - %q uses the team's key, %s",
+			s3.ServerSideEncryptionAwsKms, S3KMSKeyAlias(profile, team),
+		)
+	}
+	value, ok := config["s3_encryption"]
+	if !ok {
+		return nil, nil
+	}
+	encryptionType, ok := value.(string)
+	if !ok || (encryptionType != s3.ServerSideEncryptionAes256 && encryptionType != s3.ServerSideEncryptionAwsKms) {
+		return nil, fmt.Errorf(
+			"cdflow.yaml error: config.params.s3_encryption must be %q or %q",
+			s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms,
+		)
+	}
+	encryption := &S3Encryption{Type: encryptionType}
+	if encryptionType == s3.ServerSideEncryptionAwsKms {
+		encryption.KMSKey = S3KMSKeyAlias(profile, team)
+	}
+	return encryption, nil
+}
+
+func (e *S3Encryption) kmsKeyID() *string {
+	if e == nil || e.KMSKey == "" {
+		return nil
+	}
+	return aws.String(e.KMSKey)
+}
+
+func (e *S3Encryption) serverSideEncryption() *string {
+	if e == nil {
+		return nil
+	}
+	return aws.String(e.Type)
+}
+
+// applyToUpload sets the encryption for an upload.
+func (e *S3Encryption) applyToUpload(input *s3manager.UploadInput) *s3manager.UploadInput {
+	input.ServerSideEncryption = e.serverSideEncryption()
+	input.SSEKMSKeyId = e.kmsKeyID()
+	return input
+}
+
+// applyToCopy sets the encryption for a copy - copies don't keep the source object's encryption.
+func (e *S3Encryption) applyToCopy(input *s3.CopyObjectInput) *s3.CopyObjectInput {
+	input.ServerSideEncryption = e.serverSideEncryption()
+	input.SSEKMSKeyId = e.kmsKeyID()
+	return input
+}
+
+// applyToMultipartUpload sets the encryption for a multipart upload.
+func (e *S3Encryption) applyToMultipartUpload(input *s3.CreateMultipartUploadInput) *s3.CreateMultipartUploadInput {
+	input.ServerSideEncryption = e.serverSideEncryption()
+	input.SSEKMSKeyId = e.kmsKeyID()
+	return input
+}
+
+// applyToBackend sets encrypt and kms_key_id in the terraform S3 backend config.
+func (e *S3Encryption) applyToBackend(backendConfig map[string]string) {
+	if e == nil {
+		return
+	}
+	backendConfig["encrypt"] = "true"
+	if e.KMSKey != "" {
+		backendConfig["kms_key_id"] = e.KMSKey
+	}
+}
+
+// isKMSAccessDenied returns whether an error is access denied by KMS. S3 also returns access denied for other reasons
+// (e.g. for a missing object when the bucket can't be listed), so only errors that mention KMS are.
+func isKMSAccessDenied(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "AccessDenied" && strings.Contains(strings.ToLower(aerr.Message()), "kms")
+}
+
+// kmsAccessDenied replaces an access denied error from KMS for a download with one saying that kms:Decrypt is needed.
+func (e *S3Encryption) kmsAccessDenied(err error, location, role string) error {
+	if !isKMSAccessDenied(err) {
+		return err
+	}
+	key := "its KMS key"
+	if e != nil && e.KMSKey != "" {
+		key = e.KMSKey
+	}
+	return fmt.Errorf(
+		"access denied downloading %s - it is encrypted with KMS, so the %q role needs kms:Decrypt on %s (in the key policy or the role's policy): %v",
+		location, role, key, err,
+	)
+}
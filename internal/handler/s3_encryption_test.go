@@ -0,0 +1,189 @@
+package handler_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// testS3KMSKey is the alias of test-team's key in the release account.
+const testS3KMSKey = "arn:aws:kms:eu-west-1:724178030834:alias/test-team-s3"
+
+var kmsEncryptionConfig = map[string]interface{}{"s3_encryption": "aws:kms"}
+
+func TestUploadReleaseEncryption(t *testing.T) {
+	// Given
+	s3Client := &MockS3Client{}
+	s3Uploader := &MockS3Uploader{}
+
+	// When
+	response, output, _ := uploadReleaseWithS3Client(t, kmsEncryptionConfig, s3Client, s3Uploader)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	upload := s3Uploader.calls[0]
+	if aws.StringValue(upload.ServerSideEncryption) != "aws:kms" || aws.StringValue(upload.SSEKMSKeyId) != testS3KMSKey {
+		t.Fatalf("unexpected encryption %v %v", upload.ServerSideEncryption, upload.SSEKMSKeyId)
+	}
+}
+
+func TestUploadReleaseDefaultEncryption(t *testing.T) {
+	// Given
+	s3Uploader := &MockS3Uploader{}
+
+	// When
+	response, output, _ := uploadReleaseWithS3Client(t, nil, &MockS3Client{}, s3Uploader)
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", output)
+	}
+	if s3Uploader.calls[0].ServerSideEncryption != nil || s3Uploader.calls[0].SSEKMSKeyId != nil {
+		t.Fatal("expected the bucket's default encryption")
+	}
+}
+
+func prepareTerraformWithEncryption(t *testing.T, config map[string]interface{}, s3Client *MockS3Client) (*common.PrepareTerraformResponse, string) {
+	request := createPrepareTerraformRequest()
+	request.Version = "1"
+	for key, value := range config {
+		request.Config[key] = value
+	}
+	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(releaseDir)
+
+	var errorBuffer bytes.Buffer
+	response := common.CreatePrepareTerraformResponse()
+	if err := createPrepareTerraformHandler(&errorBuffer, s3Client, &MockSTSClient{}, nil).PrepareTerraform(request, response, releaseDir); err != nil {
+		t.Fatal(err)
+	}
+	return response, errorBuffer.String()
+}
+
+func TestPrepareTerraformBackendEncryption(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   map[string]interface{}
+		expected map[string]string
+	}{
+		{"kms", kmsEncryptionConfig, map[string]string{"encrypt": "true", "kms_key_id": testS3KMSKey}},
+		{"s3", map[string]interface{}{"s3_encryption": "AES256"}, map[string]string{"encrypt": "true", "kms_key_id": ""}},
+		{"default", nil, map[string]string{"encrypt": "", "kms_key_id": ""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			response, output := prepareTerraformWithEncryption(t, tc.config, &MockS3Client{
+				getObjectBody: ioutil.NopCloser(strings.NewReader("release contents")),
+			})
+
+			// Then
+			if !response.Success {
+				t.Fatalf("unexpected failure: %s", output)
+			}
+			for key, value := range tc.expected {
+				if response.TerraformBackendConfig[key] != value {
+					t.Fatalf("expected %q for %s, got %q", value, key, response.TerraformBackendConfig[key])
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformKMSAccessDenied(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   map[string]interface{}
+		message  string
+		expected string
+	}{
+		{
+			"team key",
+			kmsEncryptionConfig,
+			"User is not authorized to perform: kms:Decrypt",
+			`access denied downloading s3://acuris-releases/test-team/test-component/test-component-1.zip - it is encrypted with KMS, so the "test-team-deploy" role needs kms:Decrypt on ` + testS3KMSKey,
+		},
+		{
+			"kms in the message",
+			nil,
+			"User is not authorized to perform: kms:Decrypt",
+			`the "test-team-deploy" role needs kms:Decrypt on its KMS key`,
+		},
+		{
+			"not kms",
+			kmsEncryptionConfig,
+			"Access Denied",
+			"access denied downloading s3://acuris-releases/test-team/test-component/test-component-1.zip: AccessDenied: Access Denied",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			response, output := prepareTerraformWithEncryption(t, tc.config, &MockS3Client{
+				getObjectErr: awserr.New("AccessDenied", tc.message, nil),
+			})
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			if !strings.Contains(output, tc.expected) {
+				t.Fatalf("expected %q in %q", tc.expected, output)
+			}
+		})
+	}
+}
+
+func TestParseS3EncryptionErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   map[string]interface{}
+		expected string
+	}{
+		{"bad type", map[string]interface{}{"s3_encryption": "kms"}, `config.params.s3_encryption must be "AES256" or "aws:kms"`},
+		{
+			"component key",
+			map[string]interface{}{"s3_encryption": "aws:kms", "s3_kms_key": "arn:aws:kms:eu-west-1:724178030834:key/1234abcd"},
+			`config.params.s3_kms_key is not supported - "aws:kms" uses the team's key, ` + testS3KMSKey,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			_, err := handler.ParseS3Encryption(tc.config, handler.DefaultProfile(), "test-team")
+
+			// Then
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("expected %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestParseS3EncryptionTeamKey(t *testing.T) {
+	// Given
+	profile := handler.DefaultProfile()
+	profile.AccountID = "111111111111"
+	profile.Region = "us-east-1"
+
+	// When
+	encryption, err := handler.ParseS3Encryption(map[string]interface{}{"s3_encryption": s3.ServerSideEncryptionAwsKms}, profile, "my-team")
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryption.Type != s3.ServerSideEncryptionAwsKms || encryption.KMSKey != "arn:aws:kms:us-east-1:111111111111:alias/my-team-s3" {
+		t.Fatalf("unexpected encryption %+v", encryption)
+	}
+}
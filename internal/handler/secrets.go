@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// Prefixes for the sources of config.params.secrets values.
+const (
+	secretSourceSSM            = "ssm:"
+	secretSourceSecretsManager = "secretsmanager:"
+)
+
+// secretReference is a config.params.secrets entry - an SSM parameter, or a Secrets Manager secret with an optional
+// key within a JSON secret string.
+type secretReference struct {
+	name   string
+	source string
+	id     string
+	key    string
+}
+
+func (r *secretReference) String() string {
+	if r.source == secretSourceSecretsManager && r.key != "" {
+		return r.source + r.id + "#" + r.key
+	}
+	return r.source + r.id
+}
+
+func parseSecretReferences(config map[string]interface{}) ([]*secretReference, error) {
+	value, ok := config["secrets"]
+	if !ok {
+		return nil, nil
+	}
+	secretsMap, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: config.params.secrets must be a map of environment variable names to secret references")
+	}
+	names := make([]string, 0, len(secretsMap))
+	for name := range secretsMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	references := make([]*secretReference, len(names))
+	for i, name := range names {
+		param := "config.params.secrets." + name
+		referenceString, ok := secretsMap[name].(string)
+		if !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: %s must be a string", param)
+		}
+		reference := &secretReference{name: name}
+		switch {
+		case strings.HasPrefix(referenceString, secretSourceSSM):
+			reference.source = secretSourceSSM
+			reference.id = referenceString[len(secretSourceSSM):]
+		case strings.HasPrefix(referenceString, secretSourceSecretsManager):
+			reference.source = secretSourceSecretsManager
+			reference.id = referenceString[len(secretSourceSecretsManager):]
+			if index := strings.LastIndex(reference.id, "#"); index != -1 {
+				reference.key = reference.id[index+1:]
+				reference.id = reference.id[:index]
+			}
+		default:
+			return nil, fmt.Errorf("cdflow.yaml error: %s must start with %q or %q", param, secretSourceSSM, secretSourceSecretsManager)
+		}
+		if reference.id == "" {
+			return nil, fmt.Errorf("cdflow.yaml error: %s does not name a secret", param)
+		}
+		references[i] = reference
+	}
+	return references, nil
+}
+
+// secretsSession returns the session to read secrets with, from config.params.secrets_credentials - "deploy" (the
+// default) for the deploy account credentials in responseEnv, or "release" for the release account.
+func (h *Handler) secretsSession(config map[string]interface{}, responseEnv map[string]string) (client.ConfigProvider, error) {
+	credentialsName := "deploy"
+	if value, ok := config["secrets_credentials"]; ok {
+		if credentialsName, ok = value.(string); !ok {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.secrets_credentials must be a string")
+		}
+	}
+	switch credentialsName {
+	case "deploy":
+		return deployAccountSession(responseEnv)
+	case "release":
+		return h.createReleaseAccountSession()
+	}
+	return nil, fmt.Errorf("cdflow.yaml error: unknown config.params.secrets_credentials %q (expected \"deploy\" or \"release\")", credentialsName)
+}
+
+// deployAccountSession returns a session for the deploy account credentials and region in responseEnv.
+func deployAccountSession(responseEnv map[string]string) (client.ConfigProvider, error) {
+	return session.NewSession(
+		aws.NewConfig().
+			WithCredentials(credentials.NewStaticCredentials(
+				responseEnv["AWS_ACCESS_KEY_ID"],
+				responseEnv["AWS_SECRET_ACCESS_KEY"],
+				responseEnv["AWS_SESSION_TOKEN"],
+			)).
+			WithRegion(responseEnv["AWS_DEFAULT_REGION"]),
+	)
+}
+
+func (h *Handler) readSSMSecret(session client.ConfigProvider, reference *secretReference) (string, error) {
+	output, err := h.SSMClientFactory(session).GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(reference.id),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return "", fmt.Errorf("SSM parameter %q does not exist", reference.id)
+		}
+		return "", err
+	}
+	return aws.StringValue(output.Parameter.Value), nil
+}
+
+func (h *Handler) readSecretsManagerSecret(session client.ConfigProvider, reference *secretReference) (string, error) {
+	output, err := h.SecretsManagerClientFactory(session).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(reference.id),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return "", fmt.Errorf("secret %q does not exist", reference.id)
+		}
+		return "", err
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret %q is binary, only string secrets are supported", reference.id)
+	}
+	if reference.key == "" {
+		return *output.SecretString, nil
+	}
+	// errors from here on must not include the secret string, or the JSON parser's view of it
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*output.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret %q is not a JSON object, so key %q cannot be read from it", reference.id, reference.key)
+	}
+	field, ok := fields[reference.key]
+	if !ok {
+		return "", fmt.Errorf("secret %q has no key %q", reference.id, reference.key)
+	}
+	var value string
+	if err := json.Unmarshal(field, &value); err != nil {
+		// numbers and booleans are passed through as they appear in the JSON
+		return string(field), nil
+	}
+	return value, nil
+}
+
+// ResolveSecrets reads the secrets in config.params.secrets, returning them by environment variable name. It must be
+// called after the deploy account credentials are added to responseEnv, which secrets cannot replace.
+// Secret values are never logged.
+func (h *Handler) ResolveSecrets(request *common.PrepareTerraformRequest, responseEnv map[string]string) (map[string]string, error) {
+	references, err := parseSecretReferences(request.Config)
+	if err != nil || len(references) == 0 {
+		return nil, err
+	}
+	for _, reference := range references {
+		if _, ok := responseEnv[reference.name]; ok {
+			return nil, fmt.Errorf("cdflow.yaml error: config.params.secrets cannot set %s, which is set by the config container", reference.name)
+		}
+	}
+	session, err := h.secretsSession(request.Config, responseEnv)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]string, len(references))
+	for _, reference := range references {
+		fmt.Fprintf(h.ErrorStream, "- Reading secret %s from %s...\n", reference.name, reference)
+		var value string
+		if reference.source == secretSourceSSM {
+			value, err = h.readSSMSecret(session, reference)
+		} else {
+			value, err = h.readSecretsManagerSecret(session, reference)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read secret %s from %s: %v", reference.name, reference, err)
+		}
+		secrets[reference.name] = value
+	}
+	return secrets, nil
+}
@@ -0,0 +1,200 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type MockSecretsManagerClient struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]string
+}
+
+func (m *MockSecretsManagerClient) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	value, ok := m.secrets[*input.SecretId]
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "secret not found", nil)
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+func createSecretsHandler(errorBuffer *bytes.Buffer, ssmClient *MockSSMClient, secretsManagerClient *MockSecretsManagerClient, accessKeyIDs *[]string) *handler.Handler {
+	recordAccessKeyID := func(session client.ConfigProvider, serviceName string) {
+		value, err := session.ClientConfig(serviceName).Config.Credentials.Get()
+		if err != nil {
+			panic(err)
+		}
+		*accessKeyIDs = append(*accessKeyIDs, value.AccessKeyID)
+	}
+	return createPrepareTerraformHandler(errorBuffer, &MockS3Client{}, &MockSTSClient{accessKeyID: "deploy-key", secretAccessKey: "re", sessionToken: "mi"}, nil).
+		WithSSMClientFactory(func(session client.ConfigProvider) ssmiface.SSMAPI {
+			recordAccessKeyID(session, ssm.EndpointsID)
+			return ssmClient
+		}).
+		WithSecretsManagerClientFactory(func(session client.ConfigProvider) secretsmanageriface.SecretsManagerAPI {
+			recordAccessKeyID(session, secretsmanager.EndpointsID)
+			return secretsManagerClient
+		})
+}
+
+func TestPrepareTerraformSecrets(t *testing.T) {
+	// Given
+	request := createPrepareTerraformRequest()
+	request.Env["DATADOG_API_KEY"] = "from-ci"
+	request.Config["secrets"] = map[string]interface{}{
+		"DD_API_KEY":     "ssm:/team/datadog/api-key",
+		"FASTLY_API_KEY": "secretsmanager:team/fastly#api_key",
+		"PORT":           "secretsmanager:team/fastly#port",
+		"WHOLE_SECRET":   "secretsmanager:team/plain",
+	}
+	response := common.CreatePrepareTerraformResponse()
+
+	var errorBuffer bytes.Buffer
+	var accessKeyIDs []string
+	ssmClient := &MockSSMClient{parameters: map[string]string{"/team/datadog/api-key": "dd-secret-value"}}
+	h := createSecretsHandler(&errorBuffer, ssmClient, &MockSecretsManagerClient{secrets: map[string]string{
+		"team/fastly": `{"api_key": "fastly-secret-value", "port": 8080}`,
+		"team/plain":  "plain-secret-value",
+	}}, &accessKeyIDs)
+
+	// When
+	if err := h.PrepareTerraform(request, response, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	for name, expected := range map[string]string{
+		"DD_API_KEY":     "dd-secret-value",
+		"FASTLY_API_KEY": "fastly-secret-value",
+		"PORT":           "8080",
+		"WHOLE_SECRET":   "plain-secret-value",
+	} {
+		if response.Env[name] != expected {
+			t.Fatalf("expected %q, got %q for %s", expected, response.Env[name], name)
+		}
+	}
+	if !ssmClient.decrypted {
+		t.Fatal("expected SSM parameter to be decrypted")
+	}
+	for _, accessKeyID := range accessKeyIDs {
+		if accessKeyID != "deploy-key" {
+			t.Fatalf("expected secrets to be read with deploy credentials, got %q", accessKeyID)
+		}
+	}
+	if strings.Contains(errorBuffer.String(), "secret-value") {
+		t.Fatalf("secret value logged: %q", errorBuffer.String())
+	}
+	if !strings.Contains(errorBuffer.String(), "- Reading secret FASTLY_API_KEY from secretsmanager:team/fastly#api_key...") {
+		t.Fatalf("expected secret source to be logged, got %q", errorBuffer.String())
+	}
+}
+
+func TestPrepareTerraformSecretsWithReleaseCredentials(t *testing.T) {
+	// Given
+	request := createPrepareTerraformRequest()
+	request.Config["secrets"] = map[string]interface{}{"DD_API_KEY": "ssm:/team/datadog/api-key"}
+	request.Config["secrets_credentials"] = "release"
+	response := common.CreatePrepareTerraformResponse()
+
+	var errorBuffer bytes.Buffer
+	var accessKeyIDs []string
+	ssmClient := &MockSSMClient{parameters: map[string]string{"/team/datadog/api-key": "dd-secret-value"}}
+	h := createSecretsHandler(&errorBuffer, ssmClient, &MockSecretsManagerClient{}, &accessKeyIDs)
+
+	// When
+	if err := h.PrepareTerraform(request, response, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	// the mock release account credentials from createPrepareTerraformHandler
+	if len(accessKeyIDs) != 1 || accessKeyIDs[0] != "foo" {
+		t.Fatalf("expected secrets to be read with release credentials, got %v", accessKeyIDs)
+	}
+}
+
+func TestPrepareTerraformSecretsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		secrets       map[string]interface{}
+		expectedError string
+	}{
+		{
+			"unknown source",
+			map[string]interface{}{"DD_API_KEY": "vault:/team/datadog"},
+			`config.params.secrets.DD_API_KEY must start with "ssm:" or "secretsmanager:"`,
+		},
+		{
+			"missing parameter",
+			map[string]interface{}{"DD_API_KEY": "ssm:/team/missing"},
+			`unable to read secret DD_API_KEY from ssm:/team/missing: SSM parameter "/team/missing" does not exist`,
+		},
+		{
+			"missing key",
+			map[string]interface{}{"FASTLY_API_KEY": "secretsmanager:team/fastly#token"},
+			`secret "team/fastly" has no key "token"`,
+		},
+		{
+			"key in non-JSON secret",
+			map[string]interface{}{"FASTLY_API_KEY": "secretsmanager:team/plain#token"},
+			`secret "team/plain" is not a JSON object`,
+		},
+		{
+			"config container variable",
+			map[string]interface{}{"AWS_SECRET_ACCESS_KEY": "ssm:/team/datadog/api-key"},
+			"config.params.secrets cannot set AWS_SECRET_ACCESS_KEY",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			request := createPrepareTerraformRequest()
+			request.Config["secrets"] = tc.secrets
+			response := common.CreatePrepareTerraformResponse()
+
+			var errorBuffer bytes.Buffer
+			var accessKeyIDs []string
+			h := createSecretsHandler(
+				&errorBuffer,
+				&MockSSMClient{parameters: map[string]string{"/team/datadog/api-key": "dd-secret-value"}},
+				&MockSecretsManagerClient{secrets: map[string]string{
+					"team/fastly": `{"api_key": "fastly-secret-value"}`,
+					"team/plain":  "plain-secret-value",
+				}},
+				&accessKeyIDs,
+			)
+
+			// When
+			if err := h.PrepareTerraform(request, response, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			if response.Success {
+				t.Fatal("expected failure")
+			}
+			if !strings.Contains(errorBuffer.String(), tc.expectedError) {
+				t.Fatalf("expected %q in %q", tc.expectedError, errorBuffer.String())
+			}
+			if strings.Contains(errorBuffer.String(), "secret-value") {
+				t.Fatalf("secret value logged: %q", errorBuffer.String())
+			}
+		})
+	}
+}
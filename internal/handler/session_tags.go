@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Session tag keys, for ABAC policies and CloudTrail.
+const (
+	SessionTagTeam        = "team"
+	SessionTagComponent   = "component"
+	SessionTagEnvironment = "env"
+	SessionTagVersion     = "version"
+	SessionTagBuildURL    = "build-url"
+)
+
+// AWS limits for session tags.
+const (
+	maxSessionTagValueLength = 256
+	maxRoleSessionNameLength = 64
+)
+
+var sessionTagValueStripper = regexp.MustCompile(`[^\p{L}\p{Z}\p{N}_.:/=+\-@]`)
+
+// RoleContext describes what a role is being assumed for, used for the role session name and session tags.
+type RoleContext struct {
+	Config    map[string]interface{}
+	Env       map[string]string
+	Team      string
+	Component string
+	// EnvName is the environment being deployed to, empty when releasing.
+	EnvName string
+	Version string
+}
+
+// roleSessionNameData is the data available to config.params.session_name_template.
+type roleSessionNameData struct {
+	Name        string
+	Team        string
+	Component   string
+	Environment string
+	Version     string
+}
+
+// RoleSessionName returns the role session name - config.params.session_name_template rendered with the context
+// (sanitised in the same way as GetRoleSessionName), or GetRoleSessionName if there is no template.
+func (c *RoleContext) RoleSessionName() (string, error) {
+	value, ok := c.Config["session_name_template"]
+	if !ok {
+		return GetRoleSessionName(c.Env)
+	}
+	templateString, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("cdflow.yaml error: config.params.session_name_template must be a string")
+	}
+	tmpl, err := template.New("session_name_template").Option("missingkey=error").Parse(templateString)
+	if err != nil {
+		return "", fmt.Errorf("cdflow.yaml error: config.params.session_name_template: %v", err)
+	}
+	// the template might not use it, so the default name is optional here
+	name, _ := GetRoleSessionName(c.Env)
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, &roleSessionNameData{
+		Name:        name,
+		Team:        c.Team,
+		Component:   c.Component,
+		Environment: c.EnvName,
+		Version:     c.Version,
+	}); err != nil {
+		return "", fmt.Errorf("cdflow.yaml error: config.params.session_name_template: %v", err)
+	}
+	result := sessionNameStripper.ReplaceAllLiteralString(buffer.String(), "")
+	if len(result) < 2 {
+		return "", fmt.Errorf("config.params.session_name_template rendered %q, which does not have enough valid characters (must have at least two)", buffer.String())
+	}
+	if len(result) > maxRoleSessionNameLength {
+		return result[:maxRoleSessionNameLength], nil
+	}
+	return result, nil
+}
+
+// BuildURL returns the URL of the CI build from the environment (Jenkins, GitHub Actions or GitLab CI), if any.
+func BuildURL(env map[string]string) string {
+	if env["BUILD_URL"] != "" {
+		return env["BUILD_URL"]
+	}
+	if env["GITHUB_SERVER_URL"] != "" && env["GITHUB_REPOSITORY"] != "" && env["GITHUB_RUN_ID"] != "" {
+		return fmt.Sprintf("%s/%s/actions/runs/%s", env["GITHUB_SERVER_URL"], env["GITHUB_REPOSITORY"], env["GITHUB_RUN_ID"])
+	}
+	return env["CI_JOB_URL"]
+}
+
+func sanitiseSessionTagValue(value string) string {
+	value = sessionTagValueStripper.ReplaceAllLiteralString(value, "")
+	// the limit is in characters, and cutting bytes could leave an invalid partial rune
+	if runes := []rune(value); len(runes) > maxSessionTagValueLength {
+		return string(runes[:maxSessionTagValueLength])
+	}
+	return value
+}
+
+// sessionTags returns the tags to pass when assuming a role if config.params.session_tags is true, and the keys from
+// config.params.transitive_session_tags that should be passed on to roles assumed with the session.
+func (c *RoleContext) sessionTags() ([]*sts.Tag, []*string, error) {
+	if value, ok := c.Config["session_tags"]; ok {
+		enabled, ok := value.(bool)
+		if !ok {
+			return nil, nil, fmt.Errorf("cdflow.yaml error: config.params.session_tags must be true or false")
+		}
+		if !enabled {
+			return nil, nil, nil
+		}
+	} else {
+		if _, ok := c.Config["transitive_session_tags"]; ok {
+			return nil, nil, fmt.Errorf("cdflow.yaml error: config.params.transitive_session_tags requires config.params.session_tags to be true")
+		}
+		return nil, nil, nil
+	}
+
+	values := map[string]string{
+		SessionTagTeam:        c.Team,
+		SessionTagComponent:   c.Component,
+		SessionTagEnvironment: c.EnvName,
+		SessionTagVersion:     c.Version,
+		SessionTagBuildURL:    BuildURL(c.Env),
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var tags []*sts.Tag
+	emitted := make(map[string]bool)
+	for _, key := range keys {
+		// empty values are allowed by AWS, but would make e.g. "env" on a release look like a real (blank) environment
+		if value := sanitiseSessionTagValue(values[key]); value != "" {
+			tags = append(tags, &sts.Tag{Key: aws.String(key), Value: aws.String(value)})
+			emitted[key] = true
+		}
+	}
+
+	var transitiveTagKeys []*string
+	if value, ok := c.Config["transitive_session_tags"]; ok {
+		keys, err := stringSlice(value, "config.params.transitive_session_tags")
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range keys {
+			if _, ok := values[key]; !ok {
+				return nil, nil, fmt.Errorf("cdflow.yaml error: config.params.transitive_session_tags: unknown tag %q", key)
+			}
+			// STS rejects transitive keys that aren't in the tags, e.g. "env" when releasing or "build-url" outside CI
+			if !emitted[key] {
+				continue
+			}
+			transitiveTagKeys = append(transitiveTagKeys, aws.String(key))
+		}
+	}
+	return tags, transitiveTagKeys, nil
+}
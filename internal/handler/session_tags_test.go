@@ -0,0 +1,197 @@
+package handler_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestRoleSessionName(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		template      interface{}
+		expected      string
+		expectedError string
+	}{
+		{"default", nil, "my-job", ""},
+		{"template", "{{.Name}}@{{.Component}}-{{.Version}}-{{.Environment}}", "my-job@my-component-1.2.3-live", ""},
+		{"sanitised", "{{.Team}} / {{.Component}}!", "my-teammy-component", ""},
+		{"truncated", strings.Repeat("x", 70), strings.Repeat("x", 64), ""},
+		{"unknown field", "{{.Foo}}", "", "can't evaluate field Foo"},
+		{"too short", "{{.Environment}}", "", "does not have enough valid characters"},
+		{"not a string", 1, "", "config.params.session_name_template must be a string"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			ctx := &handler.RoleContext{
+				Config:    map[string]interface{}{},
+				Env:       map[string]string{"JOB_NAME": "my-job"},
+				Team:      "my-team",
+				Component: "my-component",
+				Version:   "1.2.3",
+			}
+			if tc.template != nil {
+				ctx.Config["session_name_template"] = tc.template
+			}
+			if strings.Contains(tc.name, "template") {
+				ctx.EnvName = "live"
+			}
+
+			// When
+			name, err := ctx.RoleSessionName()
+
+			// Then
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing %q, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, name)
+			}
+		})
+	}
+}
+
+func TestBuildURL(t *testing.T) {
+	for _, tc := range []struct {
+		env      map[string]string
+		expected string
+	}{
+		{map[string]string{"BUILD_URL": "https://jenkins/job/foo/1/"}, "https://jenkins/job/foo/1/"},
+		{map[string]string{
+			"GITHUB_SERVER_URL": "https://github.com",
+			"GITHUB_REPOSITORY": "org/repo",
+			"GITHUB_RUN_ID":     "42",
+		}, "https://github.com/org/repo/actions/runs/42"},
+		{map[string]string{"CI_JOB_URL": "https://gitlab/org/repo/-/jobs/7"}, "https://gitlab/org/repo/-/jobs/7"},
+		{map[string]string{}, ""},
+	} {
+		if actual := handler.BuildURL(tc.env); actual != tc.expected {
+			t.Fatalf("expected %q, got %q", tc.expected, actual)
+		}
+	}
+}
+
+func sessionTagsMap(tags []*sts.Tag) map[string]string {
+	result := make(map[string]string)
+	for _, tag := range tags {
+		result[*tag.Key] = *tag.Value
+	}
+	return result
+}
+
+func TestPrepareTerraformSessionTags(t *testing.T) {
+	// Given
+	request := createPrepareTerraformRequest()
+	request.Version = "1.2.3"
+	request.Env["BUILD_URL"] = "https://jenkins/job/test-component/1/?param=x"
+	request.Config["session_tags"] = true
+	request.Config["transitive_session_tags"] = []interface{}{"team", "env"}
+	request.Config["session_name_template"] = "{{.Component}}-{{.Environment}}"
+	response := common.CreatePrepareTerraformResponse()
+
+	var releaseOptions *handler.AssumeRoleOptions
+	var releaseSessionName string
+	var errorBuffer bytes.Buffer
+	stsClient := &MockSTSClient{}
+	h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{getObjectBody: ioutil.NopCloser(&bytes.Buffer{})}, stsClient, nil).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			releaseOptions = options
+			releaseSessionName = roleSessionName
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		})
+
+	// When
+	if err := h.PrepareTerraform(request, response, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	if !response.Success {
+		t.Fatalf("unexpected failure: %s", errorBuffer.String())
+	}
+	expectedTags := map[string]string{
+		"team":      "test-team",
+		"component": "test-component",
+		"env":       "live",
+		"version":   "1.2.3",
+		"build-url": "https://jenkins/job/test-component/1/param=x",
+	}
+	for name, tags := range map[string][]*sts.Tag{
+		"release": releaseOptions.Tags,
+		"deploy":  stsClient.assumeRoleInput.Tags,
+	} {
+		actual := sessionTagsMap(tags)
+		if len(actual) != len(expectedTags) {
+			t.Fatalf("expected %v, got %v for %s role", expectedTags, actual, name)
+		}
+		for key, value := range expectedTags {
+			if actual[key] != value {
+				t.Fatalf("expected %q, got %q for %s tag on %s role", value, actual[key], key, name)
+			}
+		}
+	}
+	transitiveTagKeys := aws.StringValueSlice(stsClient.assumeRoleInput.TransitiveTagKeys)
+	if strings.Join(transitiveTagKeys, ",") != "team,env" {
+		t.Fatalf("expected %q, got %q", "team,env", transitiveTagKeys)
+	}
+	if releaseSessionName != "test-component-live" || *stsClient.assumeRoleInput.RoleSessionName != "test-component-live" {
+		t.Fatalf("unexpected session names %q and %q", releaseSessionName, *stsClient.assumeRoleInput.RoleSessionName)
+	}
+
+	t.Run("transitive keys are limited to the tags set", func(t *testing.T) {
+		// Given
+		request := createPrepareTerraformRequest()
+		request.Version = strings.Repeat("é", 300)
+		request.Config["session_tags"] = true
+		request.Config["transitive_session_tags"] = []interface{}{"team", "build-url"}
+		stsClient := &MockSTSClient{}
+		h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, stsClient, nil)
+
+		// When
+		if err := h.PrepareTerraform(request, common.CreatePrepareTerraformResponse(), ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		transitiveTagKeys := aws.StringValueSlice(stsClient.assumeRoleInput.TransitiveTagKeys)
+		if strings.Join(transitiveTagKeys, ",") != "team" {
+			t.Fatalf("expected %q, got %q", "team", transitiveTagKeys)
+		}
+		version := sessionTagsMap(stsClient.assumeRoleInput.Tags)["version"]
+		if !utf8.ValidString(version) || utf8.RuneCountInString(version) != 256 {
+			t.Fatalf("expected 256 whole characters, got %q", version)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		// Given
+		request := createPrepareTerraformRequest()
+		stsClient := &MockSTSClient{}
+		h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{}, stsClient, nil)
+
+		// When
+		if err := h.PrepareTerraform(request, common.CreatePrepareTerraformResponse(), ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		if stsClient.assumeRoleInput.Tags != nil {
+			t.Fatalf("unexpected tags: %v", stsClient.assumeRoleInput.Tags)
+		}
+	})
+}
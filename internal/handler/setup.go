@@ -1,8 +1,276 @@
 package handler
 
-import common "github.com/mergermarket/cdflow2-config-common"
+import (
+	"fmt"
+	"sort"
+	"strings"
 
-// Setup sets up the project.
-func (handler *Handler) Setup(request *common.SetupRequest, response *common.SetupResponse) error {
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+const setupCheckKey = ".cdflow2-setup-check"
+
+const (
+	setupStatusFound   = "found"
+	setupStatusCreated = "created"
+	setupStatusMissing = "missing"
+)
+
+type setupCheck struct {
+	description string
+	status      string
+	err         error
+}
+
+type setupChecklist struct {
+	checks []*setupCheck
+}
+
+func (c *setupChecklist) add(description, status string, err error) {
+	c.checks = append(c.checks, &setupCheck{description, status, err})
+}
+
+func (c *setupChecklist) missing() []*setupCheck {
+	var result []*setupCheck
+	for _, check := range c.checks {
+		if check.status == setupStatusMissing {
+			result = append(result, check)
+		}
+	}
+	return result
+}
+
+// Setup verifies and, where permitted, creates the platform resources the other handlers rely on.
+func (h *Handler) Setup(request *common.SetupRequest, response *common.SetupResponse) error {
+	if err := h.LoadProfile(request.Config, request.Env); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	team, err := h.getTeam(request.Config["team"])
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	if err := h.InitReleaseAccountCredentials(&RoleContext{
+		Config:    request.Config,
+		Env:       request.Env,
+		Team:      team,
+		Component: request.Component,
+	}); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	session, err := h.createReleaseAccountSession()
+	if err != nil {
+		return fmt.Errorf("unable to create AWS session in release account: %v", err)
+	}
+
+	fmt.Fprintf(h.ErrorStream, "- Checking platform prerequisites for team %q...\n", team)
+
+	checklist := &setupChecklist{}
+
+	h.checkTFLocksTable(team, h.DynamoDBClientFactory(session), checklist)
+
+	if ecrBuilds := ecrBuildIDs(request.ReleaseRequirements); len(ecrBuilds) != 0 {
+		settings, err := ParseECRRepositorySettings(request.Config, team, request.Component)
+		if err != nil {
+			response.Success = false
+			fmt.Fprintln(h.ErrorStream, err)
+			return nil
+		}
+		perBuild, err := ECRRepositoryPerBuild(request.Config)
+		if err != nil {
+			response.Success = false
+			fmt.Fprintln(h.ErrorStream, err)
+			return nil
+		}
+		ecrClient := h.ECRClientFactory(session)
+		if perBuild {
+			for _, buildID := range ecrBuilds {
+				h.checkECRRepo(ECRRepositoryName(team, request.Component, buildID, true), settings, ecrClient, checklist)
+			}
+		} else {
+			h.checkECRRepo(ECRRepositoryName(team, request.Component, "", false), settings, ecrClient, checklist)
+		}
+	}
+
+	encryption, err := ParseS3Encryption(request.Config, h.Profile, team)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+	lambdaBuckets, err := LambdaBuckets(request.Config, h.Profile)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	s3Client := h.S3ClientFactory(session)
+	// releases, plugins and state are written with the configured encryption, which the bucket policy may require
+	for _, bucket := range []string{h.Profile.ReleaseBucket, h.Profile.TFStateBucket} {
+		h.checkBucketAccess(bucket, team, encryption, s3Client, checklist)
+	}
+	// lambda artifacts are copied to the bucket for the deploy region without encryption settings
+	regions := make([]string, 0, len(lambdaBuckets))
+	for region := range lambdaBuckets {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		regionS3Client := s3Client
+		if region != h.Profile.Region {
+			regionSession, err := h.createReleaseAccountSessionInRegion(region)
+			if err != nil {
+				return fmt.Errorf("unable to create AWS session in release account: %v", err)
+			}
+			regionS3Client = h.S3ClientFactory(regionSession)
+		}
+		h.checkBucketAccess(lambdaBuckets[region], team, nil, regionS3Client, checklist)
+	}
+
+	for _, check := range checklist.checks {
+		if check.err != nil {
+			fmt.Fprintf(h.ErrorStream, "  [%s] %s: %v\n", check.status, check.description, check.err)
+		} else {
+			fmt.Fprintf(h.ErrorStream, "  [%s] %s\n", check.status, check.description)
+		}
+	}
+
+	missing := checklist.missing()
+	if len(missing) == 0 {
+		fmt.Fprintln(h.ErrorStream, "- Setup complete.")
+		return nil
+	}
+
+	descriptions := make([]string, len(missing))
+	for i, check := range missing {
+		descriptions[i] = check.description
+	}
+	fmt.Fprintf(
+		h.ErrorStream,
+		"\nsetup incomplete - %d prerequisite(s) could not be satisfied:\n\n  %s\n\n"+
+			"Check that config.params.team is correct, otherwise contact the Acuris Platform Team for access.\n",
+		len(missing), strings.Join(descriptions, "\n  "),
+	)
+	response.Success = false
 	return nil
 }
+
+func (h *Handler) checkTFLocksTable(team string, dynamoDBClient dynamodbiface.DynamoDBAPI, checklist *setupChecklist) {
+	tableName := fmt.Sprintf("%s-tflocks", team)
+	description := fmt.Sprintf("DynamoDB table %q", tableName)
+
+	_, err := dynamoDBClient.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		checklist.add(description, setupStatusFound, nil)
+		return
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		checklist.add(description, setupStatusMissing, err)
+		return
+	}
+
+	if _, err := dynamoDBClient.CreateTable(&dynamodb.CreateTableInput{
+		TableName:   aws.String(tableName),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("LockID"),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("LockID"),
+				KeyType:       aws.String(dynamodb.KeyTypeHash),
+			},
+		},
+	}); err != nil {
+		checklist.add(description, setupStatusMissing, err)
+		return
+	}
+	if err := dynamoDBClient.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}); err != nil {
+		checklist.add(description, setupStatusMissing, err)
+		return
+	}
+	checklist.add(description, setupStatusCreated, nil)
+}
+
+func (h *Handler) checkECRRepo(repoName string, settings *ECRRepositorySettings, ecrClient ecriface.ECRAPI, checklist *setupChecklist) {
+	description := fmt.Sprintf("ECR repository %q", repoName)
+
+	_, err := ecrClient.DescribeRepositories(&ecr.DescribeRepositoriesInput{
+		RepositoryNames: []*string{aws.String(repoName)},
+	})
+	if err == nil {
+		checklist.add(description, setupStatusFound, nil)
+		return
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != ecr.ErrCodeRepositoryNotFoundException {
+		checklist.add(description, setupStatusMissing, err)
+		return
+	}
+	if _, err := h.createECRRepo(repoName, settings, ecrClient); err != nil {
+		checklist.add(description, setupStatusMissing, err)
+		return
+	}
+	checklist.add(description, setupStatusCreated, nil)
+}
+
+func (h *Handler) checkBucketAccess(bucket, team string, encryption *S3Encryption, s3Client s3iface.S3API, checklist *setupChecklist) {
+	prefix := team + "/"
+
+	readDescription := fmt.Sprintf("read access to s3://%s/%s", bucket, prefix)
+	if _, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(1),
+	}); err != nil {
+		checklist.add(readDescription, setupStatusMissing, err)
+	} else {
+		checklist.add(readDescription, setupStatusFound, nil)
+	}
+
+	// Write access is checked by starting a multipart upload and aborting it, which needs
+	// s3:PutObject but leaves no object, version or delete marker behind in versioned buckets.
+	writeDescription := fmt.Sprintf("write access to s3://%s/%s", bucket, prefix)
+	key := aws.String(prefix + setupCheckKey)
+	fmt.Fprintf(h.ErrorStream, "- Checking write access with an aborted multipart upload to s3://%s/%s...\n", bucket, *key)
+	upload, err := s3Client.CreateMultipartUpload(encryption.applyToMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    key,
+	}))
+	if err != nil {
+		checklist.add(writeDescription, setupStatusMissing, err)
+		return
+	}
+	if _, err := s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      key,
+		UploadId: upload.UploadId,
+	}); err != nil {
+		checklist.add(writeDescription, setupStatusMissing, fmt.Errorf("unable to abort multipart upload %s: %v", aws.StringValue(upload.UploadId), err))
+		return
+	}
+	checklist.add(writeDescription, setupStatusFound, nil)
+}
@@ -1,13 +1,267 @@
 package handler_test
 
 import (
+	"bytes"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
 )
 
+type MockDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	tables           map[string]bool
+	createTableInput *dynamodb.CreateTableInput
+	createTableError error
+}
+
+func (m *MockDynamoDBClient) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	if !m.tables[*input.TableName] {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "table not found", nil)
+	}
+	return &dynamodb.DescribeTableOutput{
+		Table: &dynamodb.TableDescription{TableName: input.TableName},
+	}, nil
+}
+
+func (m *MockDynamoDBClient) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	if m.createTableInput != nil {
+		panic("CreateTable already called")
+	}
+	if m.createTableError != nil {
+		return nil, m.createTableError
+	}
+	m.createTableInput = input
+	m.tables[*input.TableName] = true
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+func (m *MockDynamoDBClient) WaitUntilTableExists(input *dynamodb.DescribeTableInput) error {
+	return nil
+}
+
+func createSetupRequest() *common.SetupRequest {
+	request := common.CreateSetupRequest()
+	request.Env["AWS_ACCESS_KEY_ID"] = "foo"
+	request.Env["AWS_SECRET_ACCESS_KEY"] = "bar"
+	request.Env["ROLE_SESSION_NAME"] = "baz"
+	request.Config["team"] = "test-team"
+	request.Component = "test-component"
+	return request
+}
+
+func createSetupHandler(errorBuffer *bytes.Buffer, dynamoDBClient *MockDynamoDBClient, ecrClient ecriface.ECRAPI, s3Client *MockS3Client) *handler.Handler {
+	return handler.New().
+		WithErrorStream(errorBuffer).
+		WithAssumeRoleProviderFactory(func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
+			return createMockAssumeRoleProvider("foo", "bar", "baz")
+		}).
+		WithDynamoDBClientFactory(func(client.ConfigProvider) dynamodbiface.DynamoDBAPI {
+			return dynamoDBClient
+		}).
+		WithECRClientFactory(func(client.ConfigProvider) ecriface.ECRAPI {
+			return ecrClient
+		}).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API {
+			return s3Client
+		})
+}
+
 func TestSetup(t *testing.T) {
-	// Given
+	t.Run("everything exists", func(t *testing.T) {
+		// Given
+		request := createSetupRequest()
+		request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+			"my-ecr": {Needs: []string{"ecr"}},
+		}
+		response := common.CreateSetupResponse()
+
+		var errorBuffer bytes.Buffer
+		dynamoDBClient := &MockDynamoDBClient{tables: map[string]bool{"test-team-tflocks": true}}
+		ecrClient := &MockECRClient{DefaultMutability: "IMMUTABLE", DefaultScanOnPush: true}
+		s3Client := &MockS3Client{}
+		h := createSetupHandler(&errorBuffer, dynamoDBClient, ecrClient, s3Client)
+
+		// When
+		if err := h.Setup(request, response); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		if !response.Success {
+			t.Fatalf("unexpected failure: %s", errorBuffer.String())
+		}
+		if dynamoDBClient.createTableInput != nil {
+			t.Fatal("unexpected call to CreateTable")
+		}
+		if !strings.Contains(errorBuffer.String(), "[found] ECR repository \"test-team-test-component\"") {
+			t.Fatalf("expected ECR repository to be found: %q", errorBuffer.String())
+		}
+		if len(s3Client.putObjectCalls) != 0 || len(s3Client.deleteObjectCalls) != 0 {
+			t.Fatalf("expected no objects to be written, got %d puts and %d deletes", len(s3Client.putObjectCalls), len(s3Client.deleteObjectCalls))
+		}
+		if len(s3Client.createUploadCalls) != 3 || len(s3Client.abortUploadCalls) != 3 {
+			t.Fatalf("expected an aborted upload for each bucket, got %d created and %d aborted", len(s3Client.createUploadCalls), len(s3Client.abortUploadCalls))
+		}
+		expectedKey := "test-team/.cdflow2-setup-check"
+		if *s3Client.createUploadCalls[0].Key != expectedKey {
+			t.Fatalf("expected %q, got %q", expectedKey, *s3Client.createUploadCalls[0].Key)
+		}
+		if *s3Client.abortUploadCalls[0].UploadId != "test-upload-id" {
+			t.Fatalf("expected upload to be aborted, got %q", *s3Client.abortUploadCalls[0].UploadId)
+		}
+		if !strings.Contains(errorBuffer.String(), "aborted multipart upload to s3://acuris-releases/test-team/.cdflow2-setup-check") {
+			t.Fatalf("expected the write check to be logged: %q", errorBuffer.String())
+		}
+	})
+
+	t.Run("creates missing resources", func(t *testing.T) {
+		// Given
+		request := createSetupRequest()
+		request.ReleaseRequirements = map[string]*common.ReleaseRequirements{
+			"my-ecr": {Needs: []string{"ecr"}},
+		}
+		response := common.CreateSetupResponse()
+
+		var errorBuffer bytes.Buffer
+		dynamoDBClient := &MockDynamoDBClient{tables: map[string]bool{}}
+		ecrClient := &MockECRClientNoRepo{}
+		s3Client := &MockS3Client{}
+		h := createSetupHandler(&errorBuffer, dynamoDBClient, ecrClient, s3Client)
+
+		// When
+		if err := h.Setup(request, response); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		if !response.Success {
+			t.Fatalf("unexpected failure: %s", errorBuffer.String())
+		}
+		if dynamoDBClient.createTableInput == nil {
+			t.Fatal("CreateTable not called")
+		}
+		if *dynamoDBClient.createTableInput.TableName != "test-team-tflocks" {
+			t.Fatalf("expected %q, got %q", "test-team-tflocks", *dynamoDBClient.createTableInput.TableName)
+		}
+		if *dynamoDBClient.createTableInput.KeySchema[0].AttributeName != "LockID" {
+			t.Fatalf("expected %q, got %q", "LockID", *dynamoDBClient.createTableInput.KeySchema[0].AttributeName)
+		}
+		if ecrClient.CreateRepositoryInput == nil {
+			t.Fatal("CreateRepository not called")
+		}
+		if *ecrClient.CreateRepositoryInput.RepositoryName != "test-team-test-component" {
+			t.Fatalf("expected %q, got %q", "test-team-test-component", *ecrClient.CreateRepositoryInput.RepositoryName)
+		}
+	})
+
+	t.Run("skips ECR when no build needs it", func(t *testing.T) {
+		// Given
+		request := createSetupRequest()
+		response := common.CreateSetupResponse()
+
+		var errorBuffer bytes.Buffer
+		dynamoDBClient := &MockDynamoDBClient{tables: map[string]bool{"test-team-tflocks": true}}
+		ecrClient := &MockECRClientNoRepo{}
+		h := createSetupHandler(&errorBuffer, dynamoDBClient, ecrClient, &MockS3Client{})
+
+		// When
+		if err := h.Setup(request, response); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		if !response.Success {
+			t.Fatalf("unexpected failure: %s", errorBuffer.String())
+		}
+		if ecrClient.CreateRepositoryInput != nil {
+			t.Fatal("unexpected call to CreateRepository")
+		}
+	})
+
+	t.Run("checks write access with encryption and to regional lambda buckets", func(t *testing.T) {
+		// Given
+		request := createSetupRequest()
+		request.Config["s3_encryption"] = "aws:kms"
+		request.Config["lambda_buckets"] = map[string]interface{}{"us-east-1": "acuris-lambda-us-east-1"}
+		response := common.CreateSetupResponse()
+
+		var errorBuffer bytes.Buffer
+		dynamoDBClient := &MockDynamoDBClient{tables: map[string]bool{"test-team-tflocks": true}}
+		s3Client := &MockS3Client{}
+		h := createSetupHandler(&errorBuffer, dynamoDBClient, &MockECRClient{}, s3Client)
+
+		// When
+		if err := h.Setup(request, response); err != nil {
+			t.Fatal(err)
+		}
+
+		// Then
+		if !response.Success {
+			t.Fatalf("unexpected failure: %s", errorBuffer.String())
+		}
+		encryption := map[string]string{}
+		for _, input := range s3Client.createUploadCalls {
+			encryption[*input.Bucket] = aws.StringValue(input.ServerSideEncryption) + " " + aws.StringValue(input.SSEKMSKeyId)
+		}
+		expected := map[string]string{
+			"acuris-releases":         "aws:kms " + testS3KMSKey,
+			"acuris-tfstate":          "aws:kms " + testS3KMSKey,
+			handler.LambdaBucket:      " ",
+			"acuris-lambda-us-east-1": " ",
+		}
+		if !reflect.DeepEqual(encryption, expected) {
+			t.Fatalf("expected %v, got %v", expected, encryption)
+		}
+	})
+
+	t.Run("reports what cannot be fixed", func(t *testing.T) {
+		// Given
+		request := createSetupRequest()
+		response := common.CreateSetupResponse()
+
+		var errorBuffer bytes.Buffer
+		dynamoDBClient := &MockDynamoDBClient{
+			tables:           map[string]bool{},
+			createTableError: awserr.New("AccessDeniedException", "not authorised", nil),
+		}
+		s3Client := &MockS3Client{
+			accessDeniedBuckets: map[string]bool{handler.TFStateBucket: true},
+		}
+		h := createSetupHandler(&errorBuffer, dynamoDBClient, &MockECRClient{}, s3Client)
 
-	// When
+		// When
+		if err := h.Setup(request, response); err != nil {
+			t.Fatal(err)
+		}
 
-	// Then
+		// Then
+		if response.Success {
+			t.Fatal("unexpected success")
+		}
+		output := errorBuffer.String()
+		if !strings.Contains(output, "setup incomplete - 3 prerequisite(s) could not be satisfied") {
+			t.Fatalf("expected summary of missing prerequisites: %q", output)
+		}
+		for _, expected := range []string{
+			"[missing] DynamoDB table \"test-team-tflocks\"",
+			"[missing] read access to s3://acuris-tfstate/test-team/",
+			"[missing] write access to s3://acuris-tfstate/test-team/",
+			"[found] write access to s3://acuris-releases/test-team/",
+		} {
+			if !strings.Contains(output, expected) {
+				t.Fatalf("expected %q in %q", expected, output)
+			}
+		}
+	})
 }
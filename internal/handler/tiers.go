@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultTier is the tier used for environments that don't match any other tier, unless config.params.default_tier is set.
+const DefaultTier = "dev"
+
+// Tier is a class of environments that are deployed to the same account.
+type Tier struct {
+	Name          string
+	Environments  []string
+	Patterns      []*regexp.Regexp
+	AccountSuffix string
+	AccountID     string
+	DeployRole    string
+}
+
+func (t *Tier) matches(envName string) bool {
+	if contains(envName, t.Environments) {
+		return true
+	}
+	for _, pattern := range t.Patterns {
+		if pattern.MatchString(envName) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccountName returns the name of the account for the tier.
+func (t *Tier) AccountName(accountPrefix string) string {
+	return accountPrefix + t.AccountSuffix
+}
+
+func stringSlice(value interface{}, param string) ([]string, error) {
+	switch typed := value.(type) {
+	case []string:
+		return typed, nil
+	case []interface{}:
+		result := make([]string, len(typed))
+		for i, item := range typed {
+			itemString, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("cdflow.yaml error: %s must be a list of strings", param)
+			}
+			result[i] = itemString
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("cdflow.yaml error: %s must be a list of strings", param)
+}
+
+func (h *Handler) defaultTiers(config map[string]interface{}) ([]*Tier, error) {
+	prodEnvs := []string{"live"}
+	if value, ok := config["additional_prod_envs"]; ok {
+		additionalProdEnvs, err := stringSlice(value, "config.params.additional_prod_envs")
+		if err != nil {
+			return nil, err
+		}
+		prodEnvs = append(prodEnvs, additionalProdEnvs...)
+		fmt.Fprintf(h.ErrorStream, "Found additional_prod_envs, appending them to the default resulting in: %v\n", prodEnvs)
+	}
+	return []*Tier{
+		{Name: "prod", Environments: prodEnvs, AccountSuffix: "prod"},
+		{Name: DefaultTier, AccountSuffix: "dev"},
+	}, nil
+}
+
+func parseTier(name string, value interface{}) (*Tier, error) {
+	param := "config.params.tiers." + name
+	tierMap, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cdflow.yaml error: %s must be a map", param)
+	}
+	tier := &Tier{Name: name, AccountSuffix: name}
+	for key, value := range tierMap {
+		switch key {
+		case "environments":
+			environments, err := stringSlice(value, param+".environments")
+			if err != nil {
+				return nil, err
+			}
+			tier.Environments = environments
+		case "patterns":
+			patterns, err := stringSlice(value, param+".patterns")
+			if err != nil {
+				return nil, err
+			}
+			for _, pattern := range patterns {
+				compiled, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("cdflow.yaml error: %s.patterns: %v", param, err)
+				}
+				tier.Patterns = append(tier.Patterns, compiled)
+			}
+		case "account_suffix", "account_id", "deploy_role":
+			valueString, ok := value.(string)
+			if !ok || valueString == "" {
+				return nil, fmt.Errorf("cdflow.yaml error: %s.%s must be a non-empty string", param, key)
+			}
+			switch key {
+			case "account_suffix":
+				tier.AccountSuffix = valueString
+			case "account_id":
+				if !accountIDPattern.MatchString(valueString) {
+					return nil, fmt.Errorf("cdflow.yaml error: %s.account_id must be a 12 digit account ID", param)
+				}
+				tier.AccountID = valueString
+			case "deploy_role":
+				if !roleNamePattern.MatchString(valueString) {
+					return nil, fmt.Errorf("cdflow.yaml error: %s.deploy_role must be a valid IAM role name", param)
+				}
+				tier.DeployRole = valueString
+			}
+		default:
+			return nil, fmt.Errorf("cdflow.yaml error: unknown key %s.%s", param, key)
+		}
+	}
+	return tier, nil
+}
+
+// Tiers returns the tiers from config.params.tiers, or the default "prod" (live and additional_prod_envs) and "dev" tiers.
+func (h *Handler) Tiers(config map[string]interface{}) ([]*Tier, string, error) {
+	value, ok := config["tiers"]
+	if !ok {
+		tiers, err := h.defaultTiers(config)
+		return tiers, DefaultTier, err
+	}
+	if _, ok := config["additional_prod_envs"]; ok {
+		return nil, "", fmt.Errorf("cdflow.yaml error: config.params.additional_prod_envs cannot be used with config.params.tiers, add the environments to a tier instead")
+	}
+	tiersMap, ok := value.(map[string]interface{})
+	if !ok || len(tiersMap) == 0 {
+		return nil, "", fmt.Errorf("cdflow.yaml error: config.params.tiers must be a map of tier names to tier config")
+	}
+	names := make([]string, 0, len(tiersMap))
+	for name := range tiersMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tiers := make([]*Tier, len(names))
+	envTiers := make(map[string]string)
+	for i, name := range names {
+		tier, err := parseTier(name, tiersMap[name])
+		if err != nil {
+			return nil, "", err
+		}
+		for _, envName := range tier.Environments {
+			if other, ok := envTiers[envName]; ok {
+				return nil, "", fmt.Errorf("cdflow.yaml error: environment %q is listed in more than one tier: %s, %s", envName, other, name)
+			}
+			envTiers[envName] = name
+		}
+		tiers[i] = tier
+	}
+	defaultTier := DefaultTier
+	if value, ok := config["default_tier"]; ok {
+		defaultTierString, ok := value.(string)
+		if !ok {
+			return nil, "", fmt.Errorf("cdflow.yaml error: config.params.default_tier must be a string")
+		}
+		defaultTier = defaultTierString
+	}
+	return tiers, defaultTier, nil
+}
+
+// ResolveTier returns the tier for an environment. An environment listed by name wins over a pattern match,
+// and an environment matching the patterns of more than one tier is an error.
+func (h *Handler) ResolveTier(config map[string]interface{}, envName string) (*Tier, error) {
+	tiers, defaultTier, err := h.Tiers(config)
+	if err != nil {
+		return nil, err
+	}
+	var matched []*Tier
+	for _, tier := range tiers {
+		if contains(envName, tier.Environments) {
+			return tier, nil
+		}
+		if tier.matches(envName) {
+			matched = append(matched, tier)
+		}
+	}
+	if len(matched) == 1 {
+		return matched[0], nil
+	}
+	if len(matched) > 1 {
+		names := make([]string, len(matched))
+		for i, tier := range matched {
+			names[i] = tier.Name
+		}
+		return nil, fmt.Errorf("cdflow.yaml error: environment %q matches more than one tier: %s", envName, strings.Join(names, ", "))
+	}
+	for _, tier := range tiers {
+		if tier.Name == defaultTier {
+			return tier, nil
+		}
+	}
+	return nil, fmt.Errorf("cdflow.yaml error: environment %q does not match any tier, and default tier %q is not defined in config.params.tiers", envName, defaultTier)
+}
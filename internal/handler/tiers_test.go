@@ -0,0 +1,194 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestResolveTier(t *testing.T) {
+	tiersConfig := map[string]interface{}{
+		"tiers": map[string]interface{}{
+			"prod":    map[string]interface{}{"environments": []interface{}{"live", "live-us"}},
+			"staging": map[string]interface{}{"environments": []interface{}{"staging"}, "account_id": "123456789012"},
+			"sandbox": map[string]interface{}{"patterns": []interface{}{"^sbx-"}, "account_suffix": "sbx"},
+			"dev":     map[string]interface{}{},
+		},
+	}
+
+	for _, tc := range []struct {
+		name           string
+		config         map[string]interface{}
+		envName        string
+		expectedTier   string
+		expectedSuffix string
+	}{
+		{"default live", map[string]interface{}{}, "live", "prod", "prod"},
+		{"default other", map[string]interface{}{}, "ci", "dev", "dev"},
+		{"additional prod envs", map[string]interface{}{"additional_prod_envs": []interface{}{"live-us"}}, "live-us", "prod", "prod"},
+		{"configured by name", tiersConfig, "live-us", "prod", "prod"},
+		{"configured by pattern", tiersConfig, "sbx-feature", "sandbox", "sbx"},
+		{"configured default", tiersConfig, "ci", "dev", "dev"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := handler.New().WithErrorStream(&bytes.Buffer{})
+
+			// When
+			tier, err := h.ResolveTier(tc.config, tc.envName)
+
+			// Then
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tier.Name != tc.expectedTier {
+				t.Fatalf("expected %q, got %q", tc.expectedTier, tier.Name)
+			}
+			if tier.AccountSuffix != tc.expectedSuffix {
+				t.Fatalf("expected %q, got %q", tc.expectedSuffix, tier.AccountSuffix)
+			}
+		})
+	}
+
+	t.Run("ambiguous patterns", func(t *testing.T) {
+		// Given
+		config := map[string]interface{}{
+			"tiers": map[string]interface{}{
+				"a": map[string]interface{}{"patterns": []interface{}{"^feature-"}},
+				"b": map[string]interface{}{"patterns": []interface{}{"-x$"}},
+			},
+		}
+
+		// When
+		_, err := handler.New().ResolveTier(config, "feature-x")
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), `environment "feature-x" matches more than one tier: a, b`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("environment in more than one tier", func(t *testing.T) {
+		// Given
+		config := map[string]interface{}{
+			"tiers": map[string]interface{}{
+				"prod":     map[string]interface{}{"environments": []interface{}{"live"}},
+				"unsigned": map[string]interface{}{"environments": []interface{}{"live"}},
+			},
+		}
+
+		// When
+		_, err := handler.New().ResolveTier(config, "live")
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), `environment "live" is listed in more than one tier: prod, unsigned`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("invalid account ID", func(t *testing.T) {
+		// Given
+		config := map[string]interface{}{
+			"tiers": map[string]interface{}{
+				"prod": map[string]interface{}{"environments": []interface{}{"live"}, "account_id": "123456789012:role/admin"},
+			},
+		}
+
+		// When
+		_, err := handler.New().ResolveTier(config, "live")
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), "cdflow.yaml error: config.params.tiers.prod.account_id must be a 12 digit account ID") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("no default tier", func(t *testing.T) {
+		// Given
+		config := map[string]interface{}{
+			"tiers": map[string]interface{}{
+				"prod": map[string]interface{}{"environments": []interface{}{"live"}},
+			},
+		}
+
+		// When
+		_, err := handler.New().ResolveTier(config, "ci")
+
+		// Then
+		if err == nil || !strings.Contains(err.Error(), `default tier "dev" is not defined`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestPrepareTerraformTiers(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version string
+	}{
+		{"with a release", "test-version"},
+		{"without a release", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			request := createPrepareTerraformRequest()
+			request.Version = tc.version
+			request.EnvName = "staging"
+			request.Config["tiers"] = map[string]interface{}{
+				"prod":    map[string]interface{}{"environments": []interface{}{"live"}},
+				"staging": map[string]interface{}{"environments": []interface{}{"staging"}, "account_id": "123456789012"},
+				"dev":     map[string]interface{}{},
+			}
+			response := common.CreatePrepareTerraformResponse()
+
+			releaseDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(releaseDir)
+			metadataPath := filepath.Join(releaseDir, handler.ReleaseMetadataFile)
+			if err := ioutil.WriteFile(metadataPath, []byte(`{"release": {"version": "test-version"}}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var errorBuffer bytes.Buffer
+			stsClient := &MockSTSClient{}
+			h := createPrepareTerraformHandler(&errorBuffer, &MockS3Client{getObjectBody: ioutil.NopCloser(&bytes.Buffer{})}, stsClient, nil)
+
+			// When
+			if err := h.PrepareTerraform(request, response, releaseDir); err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			if !response.Success {
+				t.Fatalf("unexpected failure: %s", errorBuffer.String())
+			}
+			if response.Env["ACURIS_ENV_TIER"] != "staging" {
+				t.Fatalf("expected %q, got %q", "staging", response.Env["ACURIS_ENV_TIER"])
+			}
+			expectedRole := "arn:aws:iam::123456789012:role/test-team-deploy"
+			if stsClient.assumedRoleArn != expectedRole {
+				t.Fatalf("expected %q, got %q", expectedRole, stsClient.assumedRoleArn)
+			}
+			contents, err := ioutil.ReadFile(metadataPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var metadata map[string]map[string]string
+			if err := json.Unmarshal(contents, &metadata); err != nil {
+				t.Fatal(err)
+			}
+			if metadata["release"]["env_tier"] != "staging" || metadata["release"]["version"] != "test-version" {
+				t.Fatalf("unexpected release metadata: %v", metadata["release"])
+			}
+		})
+	}
+}
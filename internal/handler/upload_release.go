@@ -3,6 +3,7 @@ package handler
 import (
 	"fmt"
 	"io"
+	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -15,6 +16,12 @@ import (
 
 // UploadRelease runs after release to upload the release., releaseReader io.ReadSeeker
 func (h *Handler) UploadRelease(request *common.UploadReleaseRequest, response *common.UploadReleaseResponse, configureReleaseRequest *common.ConfigureReleaseRequest, releaseDir string) error {
+	if err := h.LoadProfile(configureReleaseRequest.Config, configureReleaseRequest.Env); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
 	team, err := h.getTeam(configureReleaseRequest.Config["team"])
 	if err != nil {
 		response.Success = false
@@ -22,6 +29,29 @@ func (h *Handler) UploadRelease(request *common.UploadReleaseRequest, response *
 		return nil
 	}
 
+	allowOverwrite, err := AllowReleaseOverwrite(configureReleaseRequest.Config)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	signing := h.Profile.ReleaseSigning
+	if signing != nil {
+		if err := signing.loadSigningKey(configureReleaseRequest.Env); err != nil {
+			response.Success = false
+			fmt.Fprintln(h.ErrorStream, err)
+			return nil
+		}
+	}
+
+	encryption, err := ParseS3Encryption(configureReleaseRequest.Config, h.Profile, team)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
 	session, err := h.createReleaseAccountSession()
 	if err != nil {
 		return fmt.Errorf("Unable to create AWS session in release account: %v", err)
@@ -29,36 +59,97 @@ func (h *Handler) UploadRelease(request *common.UploadReleaseRequest, response *
 
 	s3Uploader := h.S3UploaderFactory(session)
 	s3Client := h.S3ClientFactory(session)
+
 	key := releaseS3Key(team, configureReleaseRequest.Component, configureReleaseRequest.Version)
+	if err := h.checkExistingRelease(key, allowOverwrite, s3Client); err != nil {
+		fmt.Fprintln(h.ErrorStream, err)
+		response.Success = false
+		return nil
+	}
+
+	if lambdaBuilds := buildIDsWithNeed(configureReleaseRequest.ReleaseRequirements, "lambda"); len(lambdaBuilds) != 0 {
+		if err := h.recordLambdaObjects(
+			team, configureReleaseRequest.Component, configureReleaseRequest.Version, lambdaBuilds, releaseDir, s3Client,
+		); err != nil {
+			fmt.Fprintln(h.ErrorStream, "Unable to record lambda artifacts:", err)
+			response.Success = false
+			return nil
+		}
+	}
+
+	provenance := h.releaseProvenance(configureReleaseRequest, team, request.TerraformImage)
+
 	releaseReader, err := h.ReleaseSaver.Save(
 		configureReleaseRequest.Component,
 		configureReleaseRequest.Version,
 		request.TerraformImage,
 		releaseDir,
-		h.getSubResourceUploader(team, s3Uploader, s3Client),
+		h.getSubResourceUploader(team, provenance, encryption, s3Uploader, s3Client),
 	)
 	if err != nil {
 		return err
 	}
 	defer releaseReader.Close()
-	if _, err := s3Uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(ReleaseBucket),
-		Key:    aws.String(key),
-		Body:   releaseReader,
-	}); err != nil {
+	release, checksum, err := spoolRelease(releaseReader)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(release.Name())
+	defer release.Close()
+	var uploadOptions []func(*s3manager.Uploader)
+	if !allowOverwrite {
+		uploadOptions = append(uploadOptions, s3manager.WithUploaderRequestOptions(ifNoneMatch))
+	}
+	values := map[string]string{ReleaseSHA256MetadataKey: checksum}
+	for name, value := range provenance {
+		values[name] = value
+	}
+	if _, err := s3Uploader.Upload(encryption.applyToUpload(&s3manager.UploadInput{
+		Bucket:   aws.String(h.Profile.ReleaseBucket),
+		Key:      aws.String(key),
+		Body:     release,
+		Metadata: provenanceMetadata(values),
+		Tagging:  aws.String(provenanceTagging(values)),
+	}), uploadOptions...); err != nil {
+		if isPreconditionFailed(err) {
+			fmt.Fprintf(h.ErrorStream, "Release s3://%s/%s was created by something else while releasing\n", h.Profile.ReleaseBucket, key)
+			response.Success = false
+			return nil
+		}
 		fmt.Fprintln(h.ErrorStream, "Unable to upload release to S3:", err)
 		response.Success = false
 		return nil
 	}
 
-	fmt.Fprintf(h.ErrorStream, "- Release uploaded to s3://%s/%s\n", ReleaseBucket, key)
+	fmt.Fprintf(h.ErrorStream, "- Release uploaded to s3://%s/%s (sha256 %s)\n", h.Profile.ReleaseBucket, key, checksum)
+
+	if signing != nil {
+		if err := h.signRelease(
+			signing, key, checksum, encryption, h.KMSClientFactory(session), s3Uploader, uploadOptions...,
+		); err != nil {
+			fmt.Fprintln(h.ErrorStream, err)
+			response.Success = false
+			return nil
+		}
+	}
+
+	if err := h.updateReleaseIndex(team, configureReleaseRequest.Component, &ReleaseIndexEntry{
+		Version:    configureReleaseRequest.Version,
+		UploadedAt: provenance["uploaded-at"],
+		UploadedBy: provenance["uploaded-by"],
+		GitCommit:  provenance["git-commit"],
+		SHA256:     checksum,
+	}, encryption, s3Client); err != nil {
+		// the release itself has been uploaded, so this doesn't fail the release
+		fmt.Fprintln(h.ErrorStream, "WARNING: unable to update the release index:", err)
+	}
 
 	return nil
 }
 
-func (h *Handler) getSubResourceUploader(team string, s3Uploader s3manageriface.UploaderAPI, s3Client s3iface.S3API) func(string, string, io.ReadCloser) error {
+func (h *Handler) getSubResourceUploader(team string, provenance map[string]string, encryption *S3Encryption, s3Uploader s3manageriface.UploaderAPI, s3Client s3iface.S3API) func(string, string, io.ReadCloser) error {
 	return func(path, checksum string, reader io.ReadCloser) error {
-		bucket := aws.String(ReleaseBucket)
+		bucket := aws.String(h.Profile.ReleaseBucket)
 		key := aws.String(savedPluginKey(team, path, checksum))
 		_, err := s3Client.HeadObject(&s3.HeadObjectInput{
 			Bucket: bucket,
@@ -75,11 +166,18 @@ func (h *Handler) getSubResourceUploader(team string, s3Uploader s3manageriface.
 			return err
 		}
 		fmt.Fprintf(h.ErrorStream, "- Saving provider plugin %s...\n", path)
-		if _, err := s3Uploader.Upload(&s3manager.UploadInput{
-			Bucket: bucket,
-			Key:    key,
-			Body:   reader,
-		}); err != nil {
+		// the checksum is the hex encoded SHA-256 of the plugin, so it's recorded in the same way as for releases
+		values := map[string]string{ReleaseSHA256MetadataKey: checksum}
+		for name, value := range provenance {
+			values[name] = value
+		}
+		if _, err := s3Uploader.Upload(encryption.applyToUpload(&s3manager.UploadInput{
+			Bucket:   bucket,
+			Key:      key,
+			Body:     reader,
+			Metadata: provenanceMetadata(values),
+			Tagging:  aws.String(provenanceTagging(values)),
+		})); err != nil {
 			return err
 		}
 		return nil
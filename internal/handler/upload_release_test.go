@@ -6,10 +6,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
@@ -18,11 +20,27 @@ import (
 
 type MockS3Uploader struct {
 	s3manageriface.UploaderAPI
-	calls []*s3manager.UploadInput
+	calls     []*s3manager.UploadInput
+	uploaders []*s3manager.Uploader
+	contents  []string
+	err       error
 }
 
-func (m *MockS3Uploader) Upload(input *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+func (m *MockS3Uploader) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
 	m.calls = append(m.calls, input)
+	uploader := &s3manager.Uploader{}
+	for _, option := range options {
+		option(uploader)
+	}
+	m.uploaders = append(m.uploaders, uploader)
+	contents, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.contents = append(m.contents, string(contents))
+	if m.err != nil {
+		return nil, m.err
+	}
 	return &s3manager.UploadOutput{}, nil
 }
 
@@ -33,6 +51,8 @@ type MockReleaseSaver struct {
 	terraformImage string
 	releaseDir     string
 	reader         io.ReadCloser
+	// plugins are saved with pluginSaver, by path and checksum
+	plugins map[string]string
 }
 
 func (m *MockReleaseSaver) Save(
@@ -47,6 +67,11 @@ func (m *MockReleaseSaver) Save(
 	m.version = version
 	m.terraformImage = terraformImage
 	m.releaseDir = releaseDir
+	for path, checksum := range m.plugins {
+		if err := pluginSaver(path, checksum, ioutil.NopCloser(strings.NewReader("plugin"))); err != nil {
+			return nil, err
+		}
+	}
 	return m.reader, nil
 }
 
@@ -64,7 +89,7 @@ func TestUploadRelease(t *testing.T) {
 	configureReleaseRequest.Version = version
 	request.TerraformImage = terraformImage
 
-	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string) credentials.Provider {
+	mockAssumeRoleProviderFactory := func(session client.ConfigProvider, roleARN, roleSessionName string, options *handler.AssumeRoleOptions) credentials.Provider {
 		return createMockAssumeRoleProvider("foo", "bar", "baz")
 	}
 
@@ -73,6 +98,12 @@ func TestUploadRelease(t *testing.T) {
 		log.Fatal(err)
 	}
 	defer os.Remove(file.Name())
+	if _, err := file.WriteString("release contents"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Fatal(err)
+	}
 	saver := MockReleaseSaver{reader: file}
 
 	var errorBuffer bytes.Buffer
@@ -83,10 +114,17 @@ func TestUploadRelease(t *testing.T) {
 		WithS3UploaderFactory(func(client.ConfigProvider) s3manageriface.UploaderAPI {
 			return mockS3Uploader
 		}).
+		WithS3ClientFactory(func(client.ConfigProvider) s3iface.S3API {
+			return &MockS3Client{}
+		}).
 		WithReleaseSaver(&saver)
 
 	// normally this would have happened as part of the configure release
-	h.InitReleaseAccountCredentials(map[string]string{}, "test-team")
+	h.InitReleaseAccountCredentials(&handler.RoleContext{
+		Config: configureReleaseRequest.Config,
+		Env:    map[string]string{},
+		Team:   "test-team",
+	})
 
 	releaseDir, err := ioutil.TempDir("", "cdflow2-config-acuris-test")
 	if err != nil {
@@ -123,7 +161,7 @@ func TestUploadRelease(t *testing.T) {
 	if *call.Key != expectedKey {
 		t.Fatalf("got %q, expected %q", *call.Key, expectedKey)
 	}
-	if call.Body != file {
-		t.Fatalf("expected file to be passed to PutObject")
+	if mockS3Uploader.contents[0] != "release contents" {
+		t.Fatalf("expected %q, got %q", "release contents", mockS3Uploader.contents[0])
 	}
 }
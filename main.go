@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/mergermarket/cdflow2-config-acuris/internal/handler"
 	common "github.com/mergermarket/cdflow2-config-common"
@@ -10,6 +12,16 @@ import (
 func main() {
 	if len(os.Args) == 2 && os.Args[1] == "forward" {
 		common.Forward(os.Stdin, os.Stdout, "")
+	} else if len(os.Args) >= 2 && os.Args[1] == "releases" {
+		env := make(map[string]string)
+		for _, value := range os.Environ() {
+			parts := strings.SplitN(value, "=", 2)
+			env[parts[0]] = parts[1]
+		}
+		if err := handler.New().ListReleases(os.Args[2:], env, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	} else {
 		common.Listen(handler.New(), "", "/release", nil)
 	}